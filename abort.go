@@ -0,0 +1,41 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errTransferCapped is returned to the backend's writes once a response hits
+// MaxBytesPerRequest or MaxTransferTime, and set as RequestStats.Err
+var errTransferCapped = wrapf(ErrQuotaExceeded, "bandwidthlimiter: response transfer capped")
+
+// abortTransfer ends a capped response without terminating its framing. A
+// handler that just returns would end a chunked response with the final
+// chunk, and clients and caches would take the truncated body as complete.
+// Aborting the handler makes the server drop the connection instead, so the
+// client sees an incomplete transfer it can resume from the logged offset.
+func (bl *BandwidthLimiter) abortTransfer(lrw *limitedResponseWriter, stats *RequestStats) {
+	offset := resumeOffset(lrw.Header(), stats.BytesWritten)
+	if lrw.Header().Get("Accept-Ranges") == "bytes" {
+		bl.log.warnf("Aborted response for %s at %s, resumable from byte %d", stats.Decision.Key, stats.Aborted, offset)
+	} else {
+		bl.log.warnf("Aborted response for %s at %s after %d bytes, the backend does not advertise range support", stats.Decision.Key, stats.Aborted, offset)
+	}
+	
+	// Deferred work such as releasing buckets and reporting stats still runs
+	panic(http.ErrAbortHandler)
+}
+
+// resumeOffset returns the offset in the full resource a client resumes from
+// after written bytes: past the start of the range for 206 responses
+func resumeOffset(header http.Header, written int64) int64 {
+	// Content-Range: bytes 1000-1999/5000
+	contentRange := strings.TrimPrefix(header.Get("Content-Range"), "bytes ")
+	if dash := strings.IndexByte(contentRange, '-'); dash > 0 {
+		if start, err := strconv.ParseInt(contentRange[:dash], 10, 64); err == nil {
+			return start + written
+		}
+	}
+	return written
+}
@@ -0,0 +1,167 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestMaxBytesPerRequest tests that capped responses are cut off without looking complete
+func TestMaxBytesPerRequest(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB"
+	cfg.MaxBytesPerRequest = "16KB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Accept-Ranges", "bytes")
+		for i := 0; i < 8; i++ {
+			if _, err := rw.Write(make([]byte, 8*1024)); err != nil {
+				return
+			}
+		}
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aborted string
+	var abortErr error
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		aborted = stats.Aborted
+		abortErr = stats.Err
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// The chunked response ends without its final chunk, so the client knows it is truncated
+	if err == nil {
+		t.Error("Expected the truncated response to fail to read")
+	}
+	if len(body) != 16*1024 {
+		t.Errorf("Expected exactly 16KB before the cut, got %d bytes", len(body))
+	}
+	if aborted != "maxBytesPerRequest" {
+		t.Errorf("Expected the stats to record the cap, got %q", aborted)
+	}
+	if !errors.Is(abortErr, bandwidthlimiter.ErrQuotaExceeded) {
+		t.Errorf("Expected the stats error to wrap ErrQuotaExceeded, got %v", abortErr)
+	}
+}
+
+// TestMaxTransferTime tests that slow responses are cut off at the deadline
+func TestMaxTransferTime(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "8KB"
+	cfg.BurstSize = "8KB"
+	cfg.MaxTransferTime = "1s"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 64*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	if err == nil || len(body) >= 64*1024 {
+		t.Errorf("Expected a truncated response, got %d bytes and error %v", len(body), err)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("Expected the response to be cut off after about 1s, took %v", elapsed)
+	}
+}
+
+// TestTransferCapsComplete tests that responses within the caps are sent in full
+func TestTransferCapsComplete(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.MaxBytesPerRequest = "16KB"
+	cfg.MaxTransferTime = "1m"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(strings.Repeat("x", 16*1024)))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+	if recorder.Body.Len() != 16*1024 {
+		t.Errorf("Expected the full response, got %d bytes", recorder.Body.Len())
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.MaxTransferTime = "-1s"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for a negative maxTransferTime")
+	}
+}
+
+// TestClientDisconnect tests that throttled writes stop once the client went away
+func TestClientDisconnect(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "8KB"
+	cfg.BurstSize = "8KB"
+
+	writeErr := make(chan error, 1)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, err := rw.Write(make([]byte, 1024*1024))
+		writeErr <- err
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceled := make(chan bool, 1)
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		canceled <- stats.Canceled
+	})
+
+	// The server cancels the request context when the client disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil).WithContext(ctx)
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	elapsed := time.Since(start)
+
+	// Paying for 1MB at 8KB/s would take two minutes
+	if elapsed > 2*time.Second {
+		t.Errorf("Expected the write loop to stop soon after the cancellation, took %v", elapsed)
+	}
+	if err := <-writeErr; err != context.Canceled {
+		t.Errorf("Expected the backend's write to fail with the context error, got %v", err)
+	}
+	if !<-canceled {
+		t.Error("Expected the stats to record the cancellation")
+	}
+}
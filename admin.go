@@ -0,0 +1,238 @@
+package bandwidthlimiter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// startAdmin starts the optional admin listener
+func (bl *BandwidthLimiter) startAdmin() {
+	bl.adminServer = bl.listen("Admin", bl.config.AdminAddress, bl.AdminHandler())
+}
+
+// stopAdmin stops the admin listener if it is running
+func (bl *BandwidthLimiter) stopAdmin() {
+	bl.unlisten(bl.adminServer)
+}
+
+// loopbackAddress reports whether address only accepts connections from the
+// local host
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listeners holds the admin, metrics and partition listeners of this process by address.
+// Traefik creates a new instance of the middleware on every configuration
+// reload while the previous one still holds the address, so the new instance
+// takes over the listener of the same middleware instead of binding again.
+var listeners struct {
+	mutex   sync.Mutex
+	servers map[string]*listener
+}
+
+// listener is an admin, metrics or partition listener serving the handler of whichever
+// instance owns it
+type listener struct {
+	address string
+	server  *http.Server
+	mutex   sync.RWMutex
+	owner   *BandwidthLimiter
+	handler http.Handler
+}
+
+// ServeHTTP passes the request to the handler of the current owner
+func (l *listener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	l.mutex.RLock()
+	handler := l.handler
+	l.mutex.RUnlock()
+	handler.ServeHTTP(rw, req)
+}
+
+// listen serves handler on address and returns the listener, or nil if it can't bind.
+// A listener of the previous instance of this middleware on the same address
+// is taken over. Any other failure to bind is logged rather than returned, so
+// the middleware still runs without the listener.
+func (bl *BandwidthLimiter) listen(what, address string, handler http.Handler) *listener {
+	listeners.mutex.Lock()
+	defer listeners.mutex.Unlock()
+	
+	// Ephemeral ports bind a new port every time, there is nothing to take over
+	_, port, _ := net.SplitHostPort(address)
+	if l := listeners.servers[address]; l != nil && port != "0" {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.owner.name != bl.name {
+			bl.log.warnf("Failed to start %s listener on %s: in use by middleware %s", strings.ToLower(what), address, l.owner.name)
+			return nil
+		}
+		
+		l.owner, l.handler = bl, handler
+		bl.log.infof("%s listener on %s taken over from the previous instance", what, address)
+		return l
+	}
+	
+	netListener, err := net.Listen("tcp", address)
+	if err != nil {
+		bl.log.warnf("Failed to start %s listener on %s: %v", strings.ToLower(what), address, err)
+		return nil
+	}
+	
+	if port == "0" {
+		address = netListener.Addr().String()
+	}
+	l := &listener{address: address, owner: bl, handler: handler}
+	l.server = &http.Server{Handler: l}
+	go func() {
+		if err := l.server.Serve(netListener); err != nil && err != http.ErrServerClosed {
+			bl.log.errorf("Error serving %s listener: %v", strings.ToLower(what), err)
+		}
+	}()
+	
+	if listeners.servers == nil {
+		listeners.servers = make(map[string]*listener)
+	}
+	listeners.servers[address] = l
+	
+	bl.log.infof("%s listener started on %s", what, netListener.Addr())
+	return l
+}
+
+// closeStaleListeners closes the listeners still owned by previous instances of
+// this middleware, which a reload moved to another address or disabled
+func (bl *BandwidthLimiter) closeStaleListeners() {
+	listeners.mutex.Lock()
+	defer listeners.mutex.Unlock()
+	
+	for address, l := range listeners.servers {
+		l.mutex.RLock()
+		stale := l.owner != bl && l.owner.name == bl.name
+		l.mutex.RUnlock()
+		if stale {
+			l.server.Close()
+			delete(listeners.servers, address)
+		}
+	}
+}
+
+// unlisten closes the listener, unless a newer instance has taken it over
+func (bl *BandwidthLimiter) unlisten(l *listener) {
+	if l == nil {
+		return
+	}
+	
+	listeners.mutex.Lock()
+	defer listeners.mutex.Unlock()
+	
+	l.mutex.RLock()
+	owned := l.owner == bl
+	l.mutex.RUnlock()
+	if !owned {
+		return
+	}
+	
+	l.server.Close()
+	delete(listeners.servers, l.address)
+}
+
+// AdminHandler returns the admin endpoints, so embedders can mount them on their own server
+func (bl *BandwidthLimiter) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/buckets", bl.handleBuckets)
+	mux.HandleFunc("/buckets/usage", bl.handleBucketUsage)
+	mux.HandleFunc("/buckets/limit", bl.handleKeyLimit)
+	mux.HandleFunc("/buckets/reset", bl.handleReset)
+	mux.HandleFunc("/buckets/purge", bl.handlePurge)
+	mux.HandleFunc("/buckets/openmetrics", bl.handleOpenMetrics)
+	mux.HandleFunc("/metrics", bl.handleMetrics)
+	mux.HandleFunc("/stats", bl.handleStats)
+	mux.HandleFunc("/simulate", bl.handleSimulate)
+	mux.HandleFunc("/save", bl.handleSave)
+	mux.HandleFunc("/cleanup", bl.handleCleanup)
+	mux.HandleFunc("/profile", bl.handleProfile)
+	
+	if bl.config.AdminPprof {
+		registerPprof(mux)
+	}
+	
+	return bearerAuth(bl.config.AdminToken, mux)
+}
+
+// bearerAuth requires the given bearer token, if any
+func bearerAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	
+	expected := []byte(token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), expected) != 1 {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// handleOpenMetrics serves GET /buckets/openmetrics, a dump of all bucket state
+// as OpenMetrics samples for ad-hoc analysis with Prometheus tooling
+func (bl *BandwidthLimiter) handleOpenMetrics(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	rw.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if err := limiter.WriteOpenMetrics(rw, bl.buckets.Snapshot(), time.Now()); err != nil {
+		bl.log.errorf("Error writing OpenMetrics export: %v", err)
+	}
+}
+
+// handleSave serves POST /save, which saves the buckets to PersistenceFile
+// right away, e.g. before a planned restart
+func (bl *BandwidthLimiter) handleSave(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if bl.config.PersistenceFile == "" || bl.config.PersistenceReadOnly {
+		http.Error(rw, "persistence is disabled or read-only", http.StatusConflict)
+		return
+	}
+	
+	if err := bl.saveBuckets(); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleCleanup serves POST /cleanup, which evicts idle buckets right away
+func (bl *BandwidthLimiter) handleCleanup(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	stats := bl.doCleanup()
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"removed": stats.Removed, "kept": stats.Kept})
+}
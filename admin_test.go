@@ -0,0 +1,365 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestAdminAuth tests that the admin handler requires the configured token
+func TestAdminAuth(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.AdminToken = "secret"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := handler.(*bandwidthlimiter.BandwidthLimiter).AdminHandler()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	admin.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d without token, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	admin.ServeHTTP(recorder, req)
+	if recorder.Code == http.StatusUnauthorized {
+		t.Errorf("Expected request with token to be authorized, got %d", recorder.Code)
+	}
+}
+
+// TestAdminTokenRequired tests that the admin listener is only started
+// without a token on a loopback address
+func TestAdminTokenRequired(t *testing.T) {
+	tests := []struct {
+		address string
+		token   string
+		wantErr bool
+	}{
+		{"127.0.0.1:0", "", false},
+		{"localhost:0", "", false},
+		{"[::1]:0", "", false},
+		{"0.0.0.0:0", "", true},
+		{":0", "", true},
+		{"10.0.0.1:9180", "", true},
+		{"0.0.0.0:0", "secret", false},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.AdminAddress = tt.address
+		cfg.AdminToken = tt.token
+
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter-"+tt.address)
+		if tt.wantErr {
+			if err == nil || !strings.HasPrefix(err.Error(), "adminAddress") {
+				t.Errorf("Expected an adminAddress error for %q without a token, got %v", tt.address, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q with token %q: %v", tt.address, tt.token, err)
+			continue
+		}
+		handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+	}
+}
+
+// TestAdminListenerReload tests that an instance created by a configuration
+// reload takes over the admin listener still held by the previous instance
+func TestAdminListenerReload(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := free.Addr().String()
+	free.Close()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	start := func(name, token string) *bandwidthlimiter.BandwidthLimiter {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.AdminAddress = address
+		cfg.AdminToken = token
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(*bandwidthlimiter.BandwidthLimiter)
+	}
+	status := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+address+"/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	old := start("test-limiter", "old-token")
+	if code := status("old-token"); code != http.StatusOK {
+		t.Fatalf("Expected the admin listener to serve the first instance, got %d", code)
+	}
+
+	// Traefik doesn't shut the previous instance down on a reload
+	reloaded := start("test-limiter", "new-token")
+	if code := status("old-token"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the previous instance to stop serving admin requests, got %d", code)
+	}
+	if code := status("new-token"); code != http.StatusOK {
+		t.Errorf("Expected the reloaded instance to serve admin requests, got %d", code)
+	}
+
+	// Another middleware can't take the address
+	other := start("other-limiter", "other-token")
+	other.Shutdown()
+	if code := status("new-token"); code != http.StatusOK {
+		t.Errorf("Expected another middleware to leave the listener alone, got %d", code)
+	}
+
+	old.Shutdown()
+	if code := status("new-token"); code != http.StatusOK {
+		t.Errorf("Expected the listener to survive shutting down the previous instance, got %d", code)
+	}
+
+	// A reload disabling the admin listener closes it
+	cfg := bandwidthlimiter.CreateConfig()
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+	if code := status("new-token"); code != 0 {
+		t.Errorf("Expected the stale admin listener to be closed, got %d", code)
+	}
+	reloaded.Shutdown()
+}
+
+// TestAdminOpenMetrics tests the OpenMetrics bucket state endpoint
+func TestAdminOpenMetrics(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	recorder := httptest.NewRecorder()
+	admin := handler.(*bandwidthlimiter.BandwidthLimiter).AdminHandler()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/buckets/openmetrics", nil))
+
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if !strings.Contains(recorder.Body.String(), `bwl_bucket_tokens{key="10.0.0.1:backend.local"}`) {
+		t.Errorf("Expected bucket sample in export, got:\n%s", recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), `bwl_bucket_created_seconds{key="10.0.0.1:backend.local"}`) {
+		t.Errorf("Expected the bucket creation time in export, got:\n%s", recorder.Body.String())
+	}
+}
+
+// TestAdminMetrics tests that throttling shows up in the wait histograms
+func TestAdminMetrics(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "100KB" // 100 KB/s
+	cfg.BurstSize = "4KB"      // 4 KB burst so the response is throttled
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 8*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	recorder := httptest.NewRecorder()
+	admin := handler.(*bandwidthlimiter.BandwidthLimiter).AdminHandler()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, want := range []string{
+		"bwl_chunk_wait_seconds_count 2\n",
+		"bwl_request_throttle_seconds_count 1\n",
+		`bwl_request_throttle_seconds_bucket{le="0.01"} 0` + "\n",
+	} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, recorder.Body.String())
+		}
+	}
+}
+
+// TestMetricsCounters tests the transfer, bucket and per-key metrics
+func TestMetricsCounters(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.LimitUploads = true
+	cfg.MetricsPerKey = true
+	cfg.RuleLabels["10.0.0.1"] = "partner-acme"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.ReadAll(req.Body)
+		rw.Write(make([]byte, 8*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://backend.local/", bytes.NewReader(make([]byte, 1000)))
+	req.RemoteAddr = "10.0.0.1:12345"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var metrics bytes.Buffer
+	if err := handler.(*bandwidthlimiter.BandwidthLimiter).WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`bwl_transferred_bytes_total{direction="download"} 8192` + "\n",
+		`bwl_transferred_bytes_total{direction="upload"} 1000` + "\n",
+		"bwl_active_buckets 2\n",
+		"bwl_cleanup_evictions_total 0\n",
+		`bwl_key_transferred_bytes_total{key="10.0.0.1:backend.local",label="partner-acme"} 8192` + "\n",
+		`bwl_key_transferred_bytes_total{key="10.0.0.1:backend.local|upload",label="partner-acme"} 1000` + "\n",
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, metrics.String())
+		}
+	}
+}
+
+// TestMetricsErrorBudget tests the response and delay time counters by limit class and path rule
+func TestMetricsErrorBudget(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "100KB"
+	cfg.BurstSize = "10KB"
+	cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "/downloads/", Limit: "100KB"}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 30*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	for _, path := range []string{"/", "/downloads/file"} {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local"+path, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var metrics bytes.Buffer
+	if err := bl.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	// 20KB over the burst take about 200ms at 100KB/s
+	for _, series := range []string{`{class="default",route=""}`, `{class="path",route="/downloads/"}`} {
+		response := metricValue(t, metrics.String(), "bwl_response_seconds_total"+series)
+		delay := metricValue(t, metrics.String(), "bwl_limiter_delay_seconds_total"+series)
+		if delay < 0.15 || delay > response {
+			t.Errorf("Expected %s to be delayed about 0.2s of %vs, got %vs", series, response, delay)
+		}
+	}
+}
+
+// metricValue returns the value of a series in Prometheus text output
+func metricValue(t *testing.T, metrics, series string) float64 {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+	t.Fatalf("Expected a %s series, got:\n%s", series, metrics)
+	return 0
+}
+
+// TestAdminSimulate tests that the simulate endpoint reports the rule a request would get
+func TestAdminSimulate(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.BackendLimits["api.example.com"] = "512KB"
+	cfg.ClientLimits["10.0.0.9"] = "unlimited"
+	cfg.RouteCosts["/export"] = 2
+	cfg.RuleLabels["api.example.com"] = "public-api"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{
+			"ip=1.2.3.4&host=api.example.com&path=/export/all",
+			[]string{`"key":"1.2.3.4:api.example.com"`, `"rule":"backend"`, `"label":"public-api"`, `"limit":524288`, `"cost":2`},
+		},
+		{
+			"ip=1.2.3.4",
+			[]string{`"backend":"default"`, `"rule":"default"`, `"limit":1048576`, `"cost":1`},
+		},
+		{
+			"ip=10.0.0.9&host=api.example.com",
+			[]string{`"rule":"client"`, `"unlimited":true`},
+		},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/simulate?"+tt.query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", tt.query, recorder.Code)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(recorder.Body.String(), want) {
+				t.Errorf("Expected %s to contain %s, got %s", tt.query, want, recorder.Body.String())
+			}
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/simulate?host=api.example.com", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d without ip, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	// Simulating never creates a bucket
+	if removed, _ := bl.Purge("1.2.3.4"); removed != 0 {
+		t.Errorf("Expected no buckets after simulating, got %d", removed)
+	}
+}
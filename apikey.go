@@ -0,0 +1,43 @@
+package bandwidthlimiter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// limitClassKey is reported for requests limited by the KeyLimits entry of their API key
+const limitClassKey = "key"
+
+// Fallbacks for requests without KeyHeader, see Config.KeyFallback
+const (
+	keyFallbackIP     = "ip"
+	keyFallbackReject = "reject"
+)
+
+// apiKey returns the KeyHeader value of a request, or "" if it has none
+func (bl *BandwidthLimiter) apiKey(req *http.Request) string {
+	return strings.TrimSpace(req.Header.Get(bl.config.KeyHeader))
+}
+
+// apiKeyID returns the client ID an API key is stored under in bucket keys.
+// Keys are secrets, so they are hashed instead of being written to
+// persistence, logs and metrics.
+func apiKeyID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key-" + hex.EncodeToString(sum[:8])
+}
+
+// parseKeyLimits parses KeyLimits into limits by client ID
+func parseKeyLimits(limits map[string]Size) (map[string]int64, error) {
+	parsed, err := parseLimits("keyLimits", limits)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]int64, len(parsed))
+	for apiKey, limit := range parsed {
+		byID[apiKeyID(strings.TrimSpace(apiKey))] = limit
+	}
+	return byID, nil
+}
@@ -0,0 +1,90 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestKeyHeader tests that API keys key buckets for clients sharing an address
+func TestKeyHeader(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.KeyHeader = "X-Api-Key"
+	cfg.KeyLimits["partner-secret"] = "5MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	decide := func(apiKey string) bandwidthlimiter.Decision {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = "203.0.113.1:1000" // Everyone behind the same NAT
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		return bl.Decide(req)
+	}
+
+	partner, other := decide("partner-secret"), decide("other-secret")
+	if partner.Policy.Limit != 5*1024*1024 || partner.Policy.Class != "key" {
+		t.Errorf("Expected the key limit, got %+v", partner.Policy)
+	}
+	if other.Policy.Limit != 1024*1024 || other.Policy.Class != "default" {
+		t.Errorf("Expected the default limit for an unknown key, got %+v", other.Policy)
+	}
+	if partner.Key == other.Key || !strings.HasPrefix(partner.Key, "key-") || strings.Contains(partner.Key, "partner-secret") {
+		t.Errorf("Expected separate buckets under hashed keys, got %q and %q", partner.Key, other.Key)
+	}
+	if partner.ClientIP != "203.0.113.1" {
+		t.Errorf("Expected the client IP to be kept, got %q", partner.ClientIP)
+	}
+
+	// Requests without a key fall back to their client IP
+	if decision := decide(""); decision.Key != "203.0.113.1:backend.local" {
+		t.Errorf("Expected the IP bucket without a key, got %q", decision.Key)
+	}
+}
+
+// TestKeyFallbackReject tests that requests without an API key can be refused
+func TestKeyFallbackReject(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.KeyHeader = "X-Api-Key"
+	cfg.KeyFallback = "reject"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, "http://backend.local/", nil))
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 without a key, got %d", method, recorder.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.Header.Set("X-Api-Key", "some-key")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "ok" {
+		t.Errorf("Expected the keyed request to be served, got %d", recorder.Code)
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.KeyFallback = "reject"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for keyFallback without keyHeader")
+	}
+}
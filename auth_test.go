@@ -0,0 +1,91 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+func signJWT(claims, secret string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAnonymousLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		detection     string
+		authorization string
+		wantThrottled bool
+	}{
+		{"header present", "header", "Basic dXNlcjpwYXNz", false},
+		{"header missing", "header", "", true},
+		{"valid jwt", "jwt", "Bearer " + signJWT(`{"sub":"user"}`, "secret"), false},
+		{"wrong secret", "jwt", "Bearer " + signJWT(`{"sub":"user"}`, "other"), true},
+		{"expired jwt", "jwt", "Bearer " + signJWT(`{"sub":"user","exp":1}`, "secret"), true},
+		{"not a jwt", "jwt", "Bearer garbage", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = "1MB" // 1 MB/s for logged-in users
+			cfg.AuthDetection = tt.detection
+			cfg.AuthJWTSecret = "secret"
+			cfg.AnonymousLimit = "50KB"     // 50 KB/s for anonymous clients
+			cfg.AnonymousBurstSize = "10KB" // 10 KB burst
+
+			ctx := context.Background()
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write(make([]byte, 20*1024))
+			})
+
+			handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+			req.RemoteAddr = "10.0.0.1:12345"
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			start := time.Now()
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			elapsed := time.Since(start)
+
+			// 10 KB beyond the anonymous burst at 50 KB/s takes ~200ms
+			if throttled := elapsed > 100*time.Millisecond; throttled != tt.wantThrottled {
+				t.Errorf("Expected throttled=%v, took %v", tt.wantThrottled, elapsed)
+			}
+		})
+	}
+}
+
+func TestInvalidAuthDetection(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.AuthDetection = "cookie"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for unknown authDetection")
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.AuthDetection = "jwt"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for jwt detection without a secret")
+	}
+}
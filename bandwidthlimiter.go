@@ -1,60 +1,817 @@
-// Package bandwidthlimiter implements a Traefik middleware plugin for bandwidth limiting
+// Package bandwidthlimiter implements a Traefik middleware plugin for bandwidth limiting.
+// It adapts the limiter core to Traefik's plugin configuration and handler interfaces.
 package bandwidthlimiter
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
 )
 
 // Config holds the plugin configuration
 type Config struct {
-	// Default bandwidth limit in bytes per second
-	DefaultLimit int64 `json:"defaultLimit"`
+	// Default bandwidth limit in bytes per second, e.g. 1048576 or "1MB"
+	DefaultLimit Size `json:"defaultLimit"`
 	
 	// Backend-specific limits: map[backend-address]limit
-	BackendLimits map[string]int64 `json:"backendLimits,omitempty"`
+	// A limit of -1 or "unlimited" means matching requests bypass the limiter entirely
+	BackendLimits map[string]Size `json:"backendLimits,omitempty"`
+	
+	// Client IP-specific limits: map[client-ip or CIDR]limit. Exact IPs take
+	// precedence over CIDRs, and the longest matching CIDR wins.
+	// A limit of -1 or "unlimited" means matching requests bypass the limiter entirely
+	ClientLimits map[string]Size `json:"clientLimits,omitempty"`
+	
+	// Backend-wide limits shared by all clients: map[backend-address]limit
+	// Applied on top of the per-client limits to protect small upstream links
+	BackendAggregateLimits map[string]Size `json:"backendAggregateLimits,omitempty"`
+	
+	// Limit shared by all responses through the middleware, applied on top of
+	// the client and backend aggregate limits, e.g. to stay within an uplink
+	// If 0, there is no global limit
+	GlobalLimit Size `json:"globalLimit,omitempty"`
+	
+	// Burst size of the global bucket
+	// Default: burstSize
+	GlobalBurstSize Size `json:"globalBurstSize,omitempty"`
+	
+	// Rate at which proxied responses are read from their origin, shared by
+	// all responses from the same upstream host, e.g. to protect a thin
+	// origin link even when clients are fast. Applies where the limiter
+	// wraps the proxy's transport: bwlproxy, or embedders using
+	// OriginTransport. Traefik plugins only see responses as they are written.
+	// If 0, origin reads are not limited
+	OriginReadLimit Size `json:"originReadLimit,omitempty"`
+	
+	// Burst size of the origin read buckets
+	// Default: originReadLimit
+	OriginReadBurst Size `json:"originReadBurst,omitempty"`
+	
+	// Fraction of the global burst in use, e.g. 0.8, from which chunks are
+	// delayed at random, so clients back off one at a time before the global
+	// bucket runs empty instead of all stalling together once it does. The
+	// chance rises to 1 as the bucket empties, weighted by each client's
+	// limit against an equal split of globalLimit, so the heaviest clients
+	// back off first.
+	// If 0, responses only wait once the global bucket is empty
+	GlobalEarlyThrottle float64 `json:"globalEarlyThrottle,omitempty"`
+	
+	// How long an early-throttled chunk is held, in milliseconds or e.g. "20ms"
+	// Default: tickInterval
+	GlobalEarlyDelay ShortDuration `json:"globalEarlyDelay,omitempty"`
+	
+	// How long the limits resolved for a client are reused, e.g. "30s", so
+	// repeat clients skip regular expressions and token validation. Rule
+	// changes and expiring tokens take up to this long to apply.
+	// If 0, limits are resolved for every request
+	ResolutionCacheTTL Duration `json:"resolutionCacheTTL,omitempty"`
+	
+	// Maximum number of cached resolutions
+	// Default: 10000
+	ResolutionCacheSize int64 `json:"resolutionCacheSize,omitempty"`
+	
+	// Ordered limits per URL path: prefixes, or regular expressions starting with "^".
+	// The first matching rule wins. Path rules take precedence over backend
+	// limits and defaults, client limits take precedence over path rules.
+	PathLimits []PathLimit `json:"pathLimits,omitempty"`
+	
+	// Recurring windows replacing the limit of a rule class, e.g. a lower
+	// default limit during business hours. The first open window for a
+	// request's class wins. Buckets keep their tokens when a window opens or
+	// closes and continue at the new rate.
+	LimitSchedules []LimitSchedule `json:"limitSchedules,omitempty"`
+	
+	// IANA time zone of LimitSchedules, e.g. "Europe/Berlin"
+	// Default: "UTC"
+	ScheduleTimezone string `json:"scheduleTimezone,omitempty"`
+	
+	// JSON file of limit rules reloaded while the middleware runs, with any of
+	// defaultLimit, clientLimits, backendLimits, pathLimits, tierLimits,
+	// reputationLimits, countryLimits, continentLimits, keyLimits,
+	// serviceLimits and limitSchedules. Rules in
+	// the file replace the configured ones. Buckets keep their tokens and take
+	// on new limits on their next use.
+	// If empty, limits only change with the middleware configuration
+	RulesFile string `json:"rulesFile,omitempty"`
 	
-	// Client IP-specific limits: map[client-ip]limit
-	ClientLimits map[string]int64 `json:"clientLimits,omitempty"`
+	// How often RulesFile is checked for changes, e.g. "10s"
+	// Default: 10s
+	RulesReloadInterval Duration `json:"rulesReloadInterval,omitempty"`
 	
-	// Burst size - how many bytes can be sent in a single burst
-	BurstSize int64 `json:"burstSize,omitempty"`
+	// Named sets of limit rules layered over the base rules, the configured
+	// ones and RulesFile: map[name]profile. A profile inherits the rules of
+	// the base or of another profile and overrides some of them, e.g. a
+	// "peak-hours" profile lowering the default limit and an "incident"
+	// profile building on it. One profile is in effect at a time.
+	LimitProfiles map[string]LimitProfile `json:"limitProfiles,omitempty"`
 	
-	// Maximum age of unused buckets before cleanup (in seconds)
+	// Profile in effect unless one is selected at runtime or by ProfileSchedules
+	// If empty or "base", the base rules
+	ActiveProfile string `json:"activeProfile,omitempty"`
+	
+	// Recurring windows putting a profile in effect, checked every second in
+	// ScheduleTimezone. The first open window wins.
+	ProfileSchedules []ProfileSchedule `json:"profileSchedules,omitempty"`
+	
+	// Token cost multipliers per path prefix: map[path-prefix]multiplier
+	// e.g. "/export": 2 makes every byte under /export count twice against the
+	// client's budget; the longest matching prefix wins
+	RouteCosts map[string]float64 `json:"routeCosts,omitempty"`
+	
+	// Token cost multipliers for responses served from (hit) or past (miss) an
+	// upstream cache, e.g. 0.5 and 2 to align shaping with origin cost.
+	// Combined with RouteCosts. If 0, the cache status is ignored.
+	CacheHitCost  float64 `json:"cacheHitCost,omitempty"`
+	CacheMissCost float64 `json:"cacheMissCost,omitempty"`
+	
+	// Response header carrying the cache status; a positive Age also counts as a hit
+	// Default: "X-Cache"
+	CacheStatusHeader string `json:"cacheStatusHeader,omitempty"`
+	
+	// Which traffic shares a bucket: "client-backend" gives every client/backend
+	// pair its own bucket, "client" makes a client's limit apply to the sum of its
+	// traffic across all backends (backendLimits and backendMinuteLimits are then
+	// ignored; use backendAggregateLimits to cap backends)
+	// Default: "client-backend"
+	BucketScope string `json:"bucketScope,omitempty"`
+	
+	// Default per-minute byte budget enforced on top of the per-second limit,
+	// e.g. 104857600 or "100MB"
+	// If 0, no per-minute window is applied
+	DefaultMinuteLimit Size `json:"defaultMinuteLimit,omitempty"`
+	
+	// Backend-specific per-minute budgets: map[backend-address]bytes-per-minute
+	BackendMinuteLimits map[string]Size `json:"backendMinuteLimits,omitempty"`
+	
+	// Client IP-specific per-minute budgets: map[client-ip]bytes-per-minute
+	ClientMinuteLimits map[string]Size `json:"clientMinuteLimits,omitempty"`
+	
+	// Minimum rate in bytes per second a response keeps getting when its buckets
+	// are empty, so TCP windows and intermediate proxies don't time out
+	// If 0, responses may stall until tokens are available
+	DefaultMinRate Size `json:"defaultMinRate,omitempty"`
+	
+	// Backend-specific minimum rates: map[backend-address]bytes-per-second
+	BackendMinRates map[string]Size `json:"backendMinRates,omitempty"`
+	
+	// Client IP-specific minimum rates: map[client-ip]bytes-per-second
+	ClientMinRates map[string]Size `json:"clientMinRates,omitempty"`
+	
+	// Burst size - how many bytes can be sent in a single burst, e.g. "10MB"
+	// Default: 10x DefaultLimit
+	BurstSize Size `json:"burstSize,omitempty"`
+	
+	// Maximum age of unused buckets before cleanup, in seconds or e.g. "1h"
 	// Default: 3600 (1 hour)
-	BucketMaxAge int64 `json:"bucketMaxAge,omitempty"`
+	BucketMaxAge Duration `json:"bucketMaxAge,omitempty"`
 	
-	// Cleanup interval in seconds
+	// Cleanup interval, in seconds or e.g. "5m"
 	// Default: 300 (5 minutes)
-	CleanupInterval int64 `json:"cleanupInterval,omitempty"`
+	CleanupInterval Duration `json:"cleanupInterval,omitempty"`
+	
+	// Least severe messages logged: "debug", "info", "warn", "error", or
+	// "off" to silence the middleware
+	// Default: "info"
+	LogLevel string `json:"logLevel,omitempty"`
+	
+	// Format of log lines: "text", or "json" with time, level, middleware
+	// and msg fields for log collectors
+	// Default: "text"
+	LogFormat string `json:"logFormat,omitempty"`
+	
+	// How cleanup runs are logged: "removed" logs runs that removed at least
+	// CleanupLogThreshold buckets, "debug" logs every run with its duration,
+	// "off" logs nothing. Runs are counted in the metrics and reported to
+	// OnCleanup callbacks either way.
+	// Default: "removed"
+	CleanupLog string `json:"cleanupLog,omitempty"`
+	
+	// Minimum number of removed buckets for a run to be logged with cleanupLog "removed"
+	// Default: 1
+	CleanupLogThreshold int64 `json:"cleanupLogThreshold,omitempty"`
+	
+	// How long quota records outlive the end of their period, in seconds or
+	// e.g. "2m", independent of BucketMaxAge: buckets with a per-minute budget
+	// are kept at least until their minute has passed, and cluster usage
+	// reported by instances that went away keeps counting until the quota
+	// period is over
+	// Default: 60 (1 minute)
+	QuotaGrace Duration `json:"quotaGrace,omitempty"`
 	
 	// File path for persistent bucket storage
 	// If empty, no file storage is used
 	PersistenceFile string `json:"persistenceFile,omitempty"`
 	
-	// How often to save buckets to file (in seconds)
+	// How often to save buckets to file, in seconds or e.g. "1m"
 	// Default: 60 (1 minute)
-	SaveInterval int64 `json:"saveInterval,omitempty"`
+	SaveInterval Duration `json:"saveInterval,omitempty"`
+	
+	// Load buckets from PersistenceFile at startup but never write to it,
+	// e.g. for a canary instance pointed at production state
+	PersistenceReadOnly bool `json:"persistenceReadOnly,omitempty"`
+	
+	// How to handle another live instance writing the same PersistenceFile:
+	// "warn" logs a warning and keeps saving, "exclusive" refuses to start or save,
+	// "off" disables the ownership lock file
+	// Default: "warn"
+	PersistenceLock string `json:"persistenceLock,omitempty"`
+	
+	// Drop restored buckets whose limits no longer match any configured rule,
+	// instead of only reporting them at startup
+	PersistenceDropStale bool `json:"persistenceDropStale,omitempty"`
+	
+	// Alternate file to save to when PersistenceFile's directory is not writable,
+	// e.g. a tmpfs volume in a container with a read-only root filesystem.
+	// State is still loaded from PersistenceFile until the fallback has been written.
+	// If empty, buckets are kept in memory only in that case
+	PersistenceFallbackFile string `json:"persistenceFallbackFile,omitempty"`
+	
+	// Record the applied limit, bucket key and throttle wait as request headers
+	// once the response completes, so Traefik's access log can capture them
+	AccessLogHeaders bool `json:"accessLogHeaders,omitempty"`
+	
+	// Tell clients their limit with X-Bandwidth-Limit, X-Bandwidth-Remaining-Burst
+	// and X-Bandwidth-Policy response headers, so they can pace themselves
+	SendHeaders bool `json:"sendHeaders,omitempty"`
+	
+	// Answer rejected requests (429/503) with a JSON body including the bucket
+	// key, current tokens and refill rate. Meant for internal environments,
+	// since it discloses limiter internals to clients.
+	RejectDiagnostics bool `json:"rejectDiagnostics,omitempty"`
+	
+	// Pacing algorithm: "tokens" uses shared token buckets per client/backend,
+	// "highres" uses the same buckets with larger chunks and shorter, rate-sized
+	// waits so limits above ~100MB/s can be reached, "timeslice" sends a fixed
+	// number of bytes every TickInterval per response without any bucket
+	// bookkeeping (per-minute windows and persistence don't apply)
+	// Default: "tokens"
+	Pacing string `json:"pacing,omitempty"`
+	
+	// Enforcement mode: "throttle" slows responses down to the limit, "reject"
+	// answers with 429 and Retry-After when the client's buckets can't pay for
+	// the start of the response within MaxWait
+	// Default: "throttle"
+	Mode string `json:"mode,omitempty"`
+	
+	// How long a request may have to wait for tokens before it is rejected in
+	// reject mode, e.g. "500ms". If 0, requests are rejected whenever their
+	// buckets can't pay for the start of the response right away
+	MaxWait Duration `json:"maxWait,omitempty"`
+	
+	// Only reject requests with safe or idempotent methods (GET, HEAD,
+	// OPTIONS, TRACE, PUT, DELETE) in reject mode, which clients can retry
+	// after Retry-After. Others, e.g. POST uploads, are throttled instead.
+	RejectIdempotentOnly bool `json:"rejectIdempotentOnly,omitempty"`
+	
+	// Slice length for "timeslice" pacing, in milliseconds or e.g. "100ms"
+	// Default: 100
+	TickInterval ShortDuration `json:"tickInterval,omitempty"`
+	
+	// Bytes paid for and written at a time, between 512 bytes and 1MB, e.g.
+	// "16KB", or "auto" for about 10ms of traffic at the request's limit.
+	// Chunks never exceed the burst of the buckets paying for them.
+	// If empty, 4KB, or sized by "highres" pacing
+	ChunkSize Size `json:"chunkSize,omitempty"`
+	
+	// Flush every chunk to the client once it is paid for, so streaming
+	// responses such as SSE arrive at the paced rate instead of in bursts
+	// whenever the server's write buffer fills up
+	FlushChunks bool `json:"flushChunks,omitempty"`
+	
+	// Keep limiting connections the handler takes over, e.g. for WebSockets:
+	// data sent to the client pays from the response's buckets, and data
+	// received from it from the upload buckets, or the same buckets unless
+	// LimitUploads is set. Otherwise hijacked connections bypass the limiter.
+	ThrottleHijacked bool `json:"throttleHijacked,omitempty"`
+	
+	// Also limit request bodies sent to the backend, in buckets of their own,
+	// so uploads and downloads are shaped independently
+	LimitUploads bool `json:"limitUploads,omitempty"`
+	
+	// Bandwidth limit for uploads in bytes per second
+	// If 0, uploads get the same limit as downloads from the matching rule
+	UploadLimit Size `json:"uploadLimit,omitempty"`
+	
+	// Backend-specific upload limits: map[backend-address]bytes-per-second
+	// A limit of -1 or "unlimited" means uploads to the backend are not limited
+	BackendUploadLimits map[string]Size `json:"backendUploadLimits,omitempty"`
+	
+	// Client IP-specific upload limits: map[client-ip]bytes-per-second
+	// A limit of -1 or "unlimited" means uploads from the client are not limited
+	ClientUploadLimits map[string]Size `json:"clientUploadLimits,omitempty"`
+	
+	// Requests per second per bucket key, counted in buckets of their own
+	// next to the bandwidth buckets, so "50 req/s" and "2MB/s" can apply to
+	// the same client. Requests over the rate wait, or are rejected with 429
+	// in reject mode. If 0, request rates are not limited
+	RequestLimit int64 `json:"requestLimit,omitempty"`
+	
+	// Requests that may arrive at once on top of RequestLimit
+	// Default: RequestLimit, one second of requests
+	RequestBurst int64 `json:"requestBurst,omitempty"`
+	
+	// Maximum bytes a single client may have in in-progress chunk writes across
+	// all of its concurrent responses, limiting memory held by slow streams
+	// If 0, no cap is applied
+	MaxBytesInFlight Size `json:"maxBytesInFlight,omitempty"`
+	
+	// Maximum response body bytes sent for a single request, e.g. "100MB".
+	// Longer responses are cut off so the client can resume with a Range request.
+	// If 0, no cap is applied
+	MaxBytesPerRequest Size `json:"maxBytesPerRequest,omitempty"`
+	
+	// Maximum time a single response may spend transferring its body, e.g. "10m".
+	// Slower responses are cut off so the client can resume with a Range request.
+	// If 0, no cap is applied
+	MaxTransferTime Duration `json:"maxTransferTime,omitempty"`
+	
+	// Maximum time a single chunk may wait for tokens, e.g. "30s". Responses
+	// whose buckets can't pay for the next chunk in time are cut off like
+	// capped ones, so a starved transfer can't hang on forever.
+	// Waits end right away once an embedder's Shutdown stops the middleware.
+	// If 0, chunks wait as long as their limit needs
+	MaxChunkWait Duration `json:"maxChunkWait,omitempty"`
+	
+	// Pay for responses with a Content-Length in full before their first
+	// byte instead of chunk by chunk. The body is then released at the
+	// buckets' rate, and later responses of the bucket key wait until it is
+	// paid off instead of splitting the bandwidth with it.
+	Reservation bool `json:"reservation,omitempty"`
+	
+	// Longest a reserved response may take to be sent, e.g. "30s". Responses
+	// to idempotent requests that would take longer are answered with 429 and
+	// Retry-After instead; other responses are reserved anyway.
+	// If 0, responses of any length are reserved
+	ReservationMaxWait Duration `json:"reservationMaxWait,omitempty"`
+	
+	// How long Shutdown lets in-flight responses finish before the instance
+	// stops, e.g. "30s", so embedders stopping their server don't cut off
+	// throttled transfers. Traefik doesn't call Shutdown, not even on a reload.
+	// If 0, Shutdown doesn't wait
+	DrainTimeout Duration `json:"drainTimeout,omitempty"`
+	
+	// Factor the limits of responses are raised by while draining, e.g. 4 for
+	// four times the rate. If 0, draining responses are no longer limited.
+	DrainBoost float64 `json:"drainBoost,omitempty"`
+	
+	// Maximum number of responses transferred concurrently by this middleware
+	// If 0, no cap is applied
+	MaxConcurrentTransfers int64 `json:"maxConcurrentTransfers,omitempty"`
+	
+	// Maximum number of responses a single bucket key, e.g. a client on a
+	// backend, transfers concurrently, so download managers opening many
+	// connections don't multiply their bandwidth. Requests over the cap wait
+	// for one of the key's transfers for up to QueueMaxWait, then are
+	// answered with 429.
+	// If 0, no cap is applied
+	MaxConcurrent int64 `json:"maxConcurrent,omitempty"`
+	
+	// Maximum number of requests of a key waiting under MaxConcurrent;
+	// further requests are answered with 429 right away
+	// If 0, requests over the cap are never queued
+	MaxConcurrentQueue int64 `json:"maxConcurrentQueue,omitempty"`
+	
+	// How long a request may wait for a transfer slot, in milliseconds or e.g.
+	// "2s", before it is answered with 503, or 429 under MaxConcurrent.
+	// Waiting requests are served FIFO per key, with keys taking turns for
+	// MaxConcurrentTransfers. If 0, requests over the cap fail immediately.
+	QueueMaxWait ShortDuration `json:"queueMaxWait,omitempty"`
+	
+	// Per-client and per-backend queue wait overrides, in milliseconds or e.g. "10s"
+	ClientQueueMaxWaits  map[string]ShortDuration `json:"clientQueueMaxWaits,omitempty"`
+	BackendQueueMaxWaits map[string]ShortDuration `json:"backendQueueMaxWaits,omitempty"`
+	
+	// Attach pprof labels (limit class, backend) to request goroutines, so
+	// CPU and goroutine profiles can be sliced by limiter dimension
+	// Requires a build with the bwlnative tag
+	PprofLabels bool `json:"pprofLabels,omitempty"`
+	
+	// Address of the optional admin listener, e.g. "127.0.0.1:9180"
+	// If empty, no admin listener is started
+	AdminAddress string `json:"adminAddress,omitempty"`
+	
+	// Bearer token required by the admin listener
+	// Required unless AdminAddress is a loopback address such as "127.0.0.1:9180",
+	// whose requests are then not authenticated
+	AdminToken string `json:"adminToken,omitempty"`
+	
+	// Address of an optional listener serving only the Prometheus /metrics
+	// endpoint, e.g. "0.0.0.0:9181". Requests need AdminToken if it is set.
+	// If empty, metrics are only served by the admin listener
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	
+	// Also export the bytes transferred per bucket key. Every client becomes a
+	// time series, so only enable it with few clients or with clientIDMode.
+	MetricsPerKey bool `json:"metricsPerKey,omitempty"`
+	
+	// Publish the limiter's counters, see Stats, under the expvar variable
+	// "bandwidthlimiter", keyed by middleware name, e.g. for Traefik's
+	// /debug/vars with api.debug enabled
+	Expvar bool `json:"expvar,omitempty"`
+	
+	// Expose net/http/pprof handlers under /debug/pprof/ on the admin listener
+	// Requires a build with the bwlnative tag
+	AdminPprof bool `json:"adminPprof,omitempty"`
+	
+	// Detect HLS/DASH manifests and segments and pace segments individually,
+	// so players can't buffer a whole video at line rate
+	VideoAware bool `json:"videoAware,omitempty"`
+	
+	// Pacing rate for video segments in bytes per second, on top of the client's buckets
+	// If 0, segments are only limited by the client's buckets
+	SegmentLimit Size `json:"segmentLimit,omitempty"`
+	
+	// Number of segments after a manifest fetch that are paced at StartupSegmentLimit
+	// Default: 3
+	StartupSegments int64 `json:"startupSegments,omitempty"`
+	
+	// Pacing rate for startup segments in bytes per second, to keep startup smooth
+	// If 0, startup segments are only limited by the client's buckets
+	StartupSegmentLimit Size `json:"startupSegmentLimit,omitempty"`
+	
+	// How authenticated requests are recognised: "header" (AuthHeader is present)
+	// or "jwt" (AuthHeader carries an HS256 JWT signed with AuthJWTSecret)
+	// If empty, all requests are treated alike
+	AuthDetection string `json:"authDetection,omitempty"`
+	
+	// Header inspected by AuthDetection
+	// Default: "Authorization"
+	AuthHeader string `json:"authHeader,omitempty"`
+	
+	// HMAC secret used to validate JWTs when AuthDetection is "jwt"
+	AuthJWTSecret string `json:"authJWTSecret,omitempty"`
+	
+	// JWT claim, e.g. "plan", whose value selects the limit from TierLimits.
+	// Tier limits take precedence over path, backend and default limits,
+	// client limits take precedence over tiers. If empty, tiers are disabled.
+	TierClaim string `json:"tierClaim,omitempty"`
+	
+	// Limits per TierClaim value: map[claim-value]limit, e.g. "premium": "10MB"
+	TierLimits map[string]Size `json:"tierLimits,omitempty"`
+	
+	// HMAC secret used to validate the HS256 JWTs tiers are read from
+	// Default: AuthJWTSecret
+	TierJWTSecret string `json:"tierJWTSecret,omitempty"`
+	
+	// Header carrying the JWT, with or without the "Bearer " scheme
+	// Default: "Authorization"
+	TierTokenHeader string `json:"tierTokenHeader,omitempty"`
+	
+	// Cookie carrying the JWT instead of TierTokenHeader
+	TierTokenCookie string `json:"tierTokenCookie,omitempty"`
+	
+	// Lists of client IPs and CIDRs by reputation tier: map[tier]source, where
+	// the source is a file path or an http(s) URL of a list with one entry per
+	// line, e.g. "vpn": "/etc/bwl/vpn-exits.txt". Embedders can rate IPs
+	// themselves with SetReputationProvider instead.
+	ReputationLists map[string]string `json:"reputationLists,omitempty"`
+	
+	// Limits per reputation tier, e.g. "vpn": "100KB". Reputation limits take
+	// precedence over tier, path, backend and default limits, client limits
+	// take precedence over reputations.
+	ReputationLimits map[string]Size `json:"reputationLimits,omitempty"`
+	
+	// Interval between reloads of ReputationLists, in seconds or e.g. "1h"
+	// Default: 3600 (1 hour)
+	ReputationRefresh Duration `json:"reputationRefresh,omitempty"`
+	
+	// Path of a MaxMind DB file locating client IPs for CountryLimits and
+	// ContinentLimits, e.g. "/etc/bwl/GeoLite2-Country.mmdb". Country and City
+	// databases both work. Embedders can locate IPs themselves with
+	// SetCountryProvider instead.
+	GeoIPDatabase string `json:"geoIPDatabase,omitempty"`
+	
+	// Limits per ISO 3166-1 country code of the client IP, e.g. "CN": "256KB".
+	// Country limits take precedence over backend and default limits, all
+	// other rules take precedence over countries.
+	CountryLimits map[string]Size `json:"countryLimits,omitempty"`
+	
+	// Limits per continent code, e.g. "EU": "1MB", for clients whose country
+	// has no CountryLimits entry
+	ContinentLimits map[string]Size `json:"continentLimits,omitempty"`
+	
+	// Limit and burst for anonymous requests that would otherwise get the default limit
+	// If 0, defaultLimit and burstSize are used
+	AnonymousLimit     Size `json:"anonymousLimit,omitempty"`
+	AnonymousBurstSize Size `json:"anonymousBurstSize,omitempty"`
+	
+	// Defaults per Traefik entrypoint: map[entrypoint]profile, e.g. an unlimited
+	// internal entrypoint next to a limited public one. A profile replaces
+	// defaultLimit and burstSize; client and backend rules still take precedence.
+	EntryPointProfiles map[string]EntryPointProfile `json:"entryPointProfiles,omitempty"`
+	
+	// Request header naming the entrypoint a request arrived through, e.g. set
+	// by a headers middleware on each entrypoint
+	// If empty, entrypoints are named by the port the request arrived on, e.g. "8080"
+	EntryPointHeader string `json:"entryPointHeader,omitempty"`
+	
+	// Addresses of all instances sharing the key space, including this one,
+	// e.g. ["10.0.0.1:9190", "10.0.0.2:9190"]. Each instance is authoritative for
+	// a consistent-hash slice of the bucket keys and leases tokens to its peers.
+	// If empty, every instance keeps its own buckets.
+	PartitionPeers []string `json:"partitionPeers,omitempty"`
+	
+	// This instance's address as listed in PartitionPeers
+	PartitionSelf string `json:"partitionSelf,omitempty"`
+	
+	// Address the peer RPC listener binds to
+	// Default: PartitionSelf
+	PartitionAddress string `json:"partitionAddress,omitempty"`
+	
+	// Bearer token peers must present
+	// If empty, peer requests are not authenticated, which is only allowed
+	// on a loopback PartitionAddress
+	PartitionToken string `json:"partitionToken,omitempty"`
+	
+	// Tokens leased from the owning peer at once, in bytes
+	// Default: 65536
+	PartitionLease Size `json:"partitionLease,omitempty"`
+	
+	// Timeout of a lease request in milliseconds or e.g. "1s"; on failure the
+	// key is limited locally
+	// Default: 250
+	PartitionTimeout ShortDuration `json:"partitionTimeout,omitempty"`
+	
+	// Where buckets are kept: "memory" gives every instance its own buckets,
+	// "redis" shares them between all instances through the Redis server at
+	// RedisAddress, so replicas don't each grant the full limit. While Redis is
+	// unreachable, instances fall back to their own buckets.
+	// Default: "memory"
+	Storage string `json:"storage,omitempty"`
+	
+	// Address of the Redis server for "redis" storage
+	// Default: "127.0.0.1:6379"
+	RedisAddress string `json:"redisAddress,omitempty"`
+	
+	// Password and database number for "redis" storage
+	RedisPassword string `json:"redisPassword,omitempty"`
+	RedisDB       int64  `json:"redisDB,omitempty"`
+	
+	// Prefix of all keys written to Redis
+	// Default: "bwl:"
+	RedisKeyPrefix string `json:"redisKeyPrefix,omitempty"`
+	
+	// Idle connections kept open to Redis
+	// Default: 8
+	RedisPoolSize int64 `json:"redisPoolSize,omitempty"`
+	
+	// Timeout of a Redis command in milliseconds or e.g. "200ms"; on failure
+	// buckets are kept locally
+	// Default: 100
+	RedisTimeout ShortDuration `json:"redisTimeout,omitempty"`
+	
+	// Tokens taken from a Redis bucket at once, in bytes
+	// Default: 65536
+	RedisLease Size `json:"redisLease,omitempty"`
+	
+	// Shared directory (e.g. an NFS mount) used to coordinate cluster-wide quotas.
+	// One instance is elected leader through it, periodically collects every
+	// instance's usage and redistributes the remaining quota as per-instance shares.
+	// If empty, no cluster quotas are enforced.
+	ClusterDir string `json:"clusterDir,omitempty"`
+	
+	// Bytes a client may receive across all instances per quota period; requests
+	// over the quota are answered with 429. Per-client overrides take precedence.
+	// If 0, clients have no cluster quota.
+	ClusterQuota        Size            `json:"clusterQuota,omitempty"`
+	ClientClusterQuotas map[string]Size `json:"clientClusterQuotas,omitempty"`
+	
+	// Length of a quota period in whole seconds or e.g. "24h"
+	// Default: 3600 (1 hour)
+	ClusterQuotaPeriod Duration `json:"clusterQuotaPeriod,omitempty"`
+	
+	// When quota periods start over: "daily" at midnight and "monthly" at
+	// midnight on the first of the month in ClusterQuotaTimezone, or
+	// "rolling" for a window of ClusterQuotaPeriod ending at each request.
+	// If empty, periods of ClusterQuotaPeriod follow each other from the Unix epoch
+	ClusterQuotaReset string `json:"clusterQuotaReset,omitempty"`
+	
+	// IANA time zone of daily and monthly resets, e.g. "Europe/Berlin"
+	// Default: UTC
+	ClusterQuotaTimezone string `json:"clusterQuotaTimezone,omitempty"`
+	
+	// Bytes of quota a client left unused in a period that it may use on top
+	// of its quota in the next one. Only the quota itself carries over, not
+	// what was carried into the period.
+	// If 0, unused quota is lost at the end of the period
+	ClusterQuotaCarryOver Size `json:"clusterQuotaCarryOver,omitempty"`
+	
+	// Interval between usage reports and share updates, in seconds or e.g. "30s"
+	// Default: 10
+	ClusterSyncInterval Duration `json:"clusterSyncInterval,omitempty"`
+	
+	// Human-meaningful labels for rules: map[client-IP or backend]label,
+	// e.g. "203.0.113.100": "partner-acme". Client labels take precedence.
+	// Labels show up in the access log headers, pprof labels and admin exports.
+	RuleLabels map[string]string `json:"ruleLabels,omitempty"`
+	
+	// Maximum number of new bucket keys per minute. Beyond it, requests that
+	// would create a bucket share a single "overflow" bucket at the default
+	// limit until the rate drops, and an alert is logged.
+	// If 0, key creation is not limited
+	MaxNewKeysPerMinute int64 `json:"maxNewKeysPerMinute,omitempty"`
+	
+	// How the client IP is taken from a request, matching Traefik's own IP
+	// strategies so that limits apply to the client ipWhiteList and rateLimit
+	// see: "remoteAddr" uses the connection's address, "xff:<depth>" the
+	// X-Forwarded-For entry depth places from the right, e.g. "xff:1" behind
+	// one trusted proxy, "header:<name>" a header such as CF-Connecting-IP.
+	// If empty, the first X-Forwarded-For entry, then X-Real-IP, then the
+	// remote address is used
+	ClientIPStrategy string `json:"clientIPStrategy,omitempty"`
+	
+	// How client IPs are stored in bucket keys, and therefore in persistence,
+	// logs and metrics: "hash" replaces them with a salted HMAC, "truncate"
+	// zeroes the last IPv4 octet or everything past the IPv6 /48, so the
+	// clients of a subnet share one bucket.
+	// If empty, client IPs are stored as-is
+	ClientIDMode string `json:"clientIDMode,omitempty"`
+	
+	// Secret salt for clientIDMode "hash". Changing it orphans existing buckets.
+	ClientIDSalt string `json:"clientIDSalt,omitempty"`
+	
+	// Request header, e.g. "X-Api-Key", whose value keys buckets instead of
+	// the client IP, so clients sharing an address behind NAT get their own
+	// buckets. Keys are hashed in bucket keys.
+	// If empty, buckets are keyed by client IP
+	KeyHeader string `json:"keyHeader,omitempty"`
+	
+	// Limits per API key: map[header-value]limit. By default, key limits take
+	// precedence over client, tier, path, backend and default limits.
+	KeyLimits map[string]Size `json:"keyLimits,omitempty"`
+	
+	// What happens to requests without KeyHeader: "ip" keys them by client IP,
+	// "reject" turns them away with 401 Unauthorized
+	// Default: "ip"
+	KeyFallback string `json:"keyFallback,omitempty"`
+	
+	// Request header carrying the calling service's Consul Connect identity,
+	// e.g. "X-Forwarded-Client-Cert" as set by Envoy sidecars, or a header
+	// holding a SPIFFE ID. Callers with an identity are keyed by service name
+	// instead of client IP, so all instances of a service share a bucket.
+	// The header must be set by the mesh, it is not authenticated here.
+	// If empty, callers are keyed by client IP or KeyHeader
+	ServiceIdentityHeader string `json:"serviceIdentityHeader,omitempty"`
+	
+	// Limits per calling service: map[service]limit, with services outside
+	// the default namespace written "<namespace>/<service>". By default,
+	// service limits take precedence over client, tier, path and backend limits.
+	ServiceLimits map[string]Size `json:"serviceLimits,omitempty"`
+	
+	// Consul DNS domain, e.g. "consul". Requests for Consul names such as
+	// "web.service.dc1.consul" or "web.virtual.consul" are then attributed to
+	// the service, "web", for backendLimits and bucket keys.
+	// If empty, backends are named by the request host
+	ConsulDomain string `json:"consulDomain,omitempty"`
+	
+	// How limit rules combine when several match a request: "first" applies
+	// the first matching rule in RuleOrder, "all" the lowest of their limits.
+	// Requests matching no rule get the default limit.
+	// Default: "first"
+	RuleMatching string `json:"ruleMatching,omitempty"`
+	
+	// Rule types in the order "first" matching checks them: "key", "service",
+	// "client", "reputation", "tier", "path", "country" and "backend". Types
+	// left out follow in that order.
+	// If empty, key, service, client, reputation, tier, path, country and backend rules are checked in that order
+	RuleOrder []string `json:"ruleOrder,omitempty"`
+	
+	// Marker headers, e.g. set by Traefik's rateLimit middleware or another
+	// plugin, that make requests skip bandwidth limiting. Keys are header names
+	// checked on the request and on the response; values are the required
+	// header value, or "" for any value. Request markers only count with a
+	// value, which clients must not know, and are removed from the request.
+	BypassHeaders map[string]string `json:"bypassHeaders,omitempty"`
+	
+	// What an instance does with requests another instance of the middleware
+	// already limits, e.g. when it was applied twice in one chain: "skip"
+	// passes them through, "coordinate" has the outer instance pay this one's
+	// buckets along with its own, so every byte is paid once per bucket.
+	// Such requests are counted by bwl_duplicate_requests_total.
+	// Default: "skip"
+	DuplicateMode string `json:"duplicateMode,omitempty"`
+	
+	// Requests that skip the limiter entirely, e.g. health checks, metrics
+	// scrapes and internal monitoring, so they neither wait nor create buckets
+	Exemptions Exemptions `json:"exemptions,omitempty"`
+	
+	// Internal headers, e.g. bypass secrets, injected client IDs or debug
+	// headers, removed from requests before they are proxied. The limiter
+	// still reads them first.
+	StripRequestHeaders []string `json:"stripRequestHeaders,omitempty"`
+	
+	// Internal headers removed from responses before clients see them. The
+	// limiter still reads them first, e.g. bypass markers set by the backend.
+	StripResponseHeaders []string `json:"stripResponseHeaders,omitempty"`
+	
+	// Buckets created at startup with a fixed number of initial tokens,
+	// so known heavy clients don't get a full burst right after a deploy.
+	// Buckets restored from the persistence file take precedence.
+	Preload []PreloadBucket `json:"preload,omitempty"`
+}
+
+// PreloadBucket describes a bucket created at startup
+type PreloadBucket struct {
+	// Client IP the bucket belongs to
+	ClientIP string `json:"clientIP"`
+	
+	// Backend address the bucket belongs to
+	// Default: "default"
+	Backend string `json:"backend,omitempty"`
+	
+	// Request path, so a PathLimits rule can supply the bucket
+	// Default: "/"
+	Path string `json:"path,omitempty"`
+	
+	// Request headers, e.g. KeyHeader, ServiceIdentityHeader or the TierClaim's
+	// token, so key, service and tier rules can supply the bucket
+	Headers map[string]string `json:"headers,omitempty"`
+	
+	// Entrypoint the bucket's requests arrive through, see EntryPointProfiles
+	// Default: the EntryPointHeader entry of headers
+	EntryPoint string `json:"entryPoint,omitempty"`
+	
+	// Tokens available when the bucket is created, capped at the burst size
+	InitialTokens Size `json:"initialTokens"`
 }
 
+// Request headers populated for access logging when AccessLogHeaders is enabled
+const (
+	accessLogLimitHeader = "X-Bandwidth-Limit"
+	accessLogKeyHeader   = "X-Bandwidth-Key"
+	accessLogWaitHeader  = "X-Bandwidth-Wait-Ms"
+	accessLogLabelHeader = "X-Bandwidth-Label"
+)
+
+// Unlimited is the limit value that exempts a client or backend from limiting
+const Unlimited = -1
+
+// Pacing modes
+const (
+	pacingTokens    = "tokens"
+	pacingTimeSlice = "timeslice"
+	pacingHighRes   = "highres"
+)
+
+// Enforcement modes
+const (
+	modeThrottle = "throttle"
+	modeReject   = "reject"
+)
+
 // CreateConfig creates the default plugin configuration
 func CreateConfig() *Config {
 	return &Config{
-		DefaultLimit:    1024 * 1024, // 1 MB/s default
-		BackendLimits:   make(map[string]int64),
-		ClientLimits:    make(map[string]int64),
-		BurstSize:       10 * 1024 * 1024, // 10 MB burst default
-		BucketMaxAge:    3600,  // 1 hour
-		CleanupInterval: 300,   // 5 minutes
-		SaveInterval:    60,    // 1 minute
+		DefaultLimit:           "1MB", // 1 MB/s default
+		BackendLimits:          make(map[string]Size),
+		ClientLimits:           make(map[string]Size),
+		BackendAggregateLimits: make(map[string]Size),
+		BackendMinuteLimits:    make(map[string]Size),
+		RouteCosts:             make(map[string]float64),
+		RuleLabels:             make(map[string]string),
+		ClientClusterQuotas:    make(map[string]Size),
+		ClientQueueMaxWaits:    make(map[string]ShortDuration),
+		BackendQueueMaxWaits:   make(map[string]ShortDuration),
+		ClientMinuteLimits:     make(map[string]Size),
+		BackendMinRates:        make(map[string]Size),
+		ClientMinRates:         make(map[string]Size),
+		BackendUploadLimits:    make(map[string]Size),
+		ClientUploadLimits:     make(map[string]Size),
+		BypassHeaders:          make(map[string]string),
+		EntryPointProfiles:     make(map[string]EntryPointProfile),
+		TierLimits:             make(map[string]Size),
+		ReputationLists:        make(map[string]string),
+		ReputationLimits:       make(map[string]Size),
+		CountryLimits:          make(map[string]Size),
+		ContinentLimits:        make(map[string]Size),
+		KeyLimits:              make(map[string]Size),
+		ServiceLimits:          make(map[string]Size),
+		LimitProfiles:          make(map[string]LimitProfile),
+		BurstSize:              "10MB", // 10 MB burst default
+		BucketMaxAge:           "1h",
+		CleanupInterval:        "5m",
+		CleanupLog:             cleanupLogRemoved,
+		CleanupLogThreshold:    1,
+		QuotaGrace:             "1m",
+		SaveInterval:           "1m",
+		BucketScope:            scopeClientBackend,
+		PersistenceLock:        persistenceLockWarn,
+		Pacing:                 pacingTokens,
+		Mode:                   modeThrottle,
+		Storage:                storageMemory,
+		KeyFallback:            keyFallbackIP,
+		DuplicateMode:          duplicateSkip,
+		RuleMatching:           ruleMatchFirst,
+		TickInterval:           "100ms",
 	}
 }
 
@@ -63,93 +820,89 @@ type BandwidthLimiter struct {
 	next            http.Handler
 	name            string
 	config          *Config
-	buckets         sync.Map         // map[string]*bucketWrapper
+	parsed          parsedUnits      // Config values written with units
+	rulesMutex      sync.RWMutex     // Guards the limit rules in parsed while RulesFile or LimitProfiles replace them
+	instanceID      string           // Identifies this instance in the persistence lock file
+	created         time.Time        // When New created the instance, also stamped in the lock file
+	lockTakenOver   int32            // Set once a reloaded instance took over the persistence file
+	seedFile        string           // Unwritable PersistenceFile that state is first loaded from
+	saveFailing     bool             // Suppresses repeated save errors until a save succeeds
+	saveMutex       sync.Mutex       // Serializes saves, which share a temporary file
+	buckets         *limiter.MemoryStore
+	routeCosts      []routeCost      // Compiled RouteCosts, longest prefix first
+	exemptions      *exemptions      // Compiled Exemptions, nil if nothing is exempt
+	clientIPs       clientIPStrategy // Compiled ClientIPStrategy
+	ruleOrder       []string         // Rule types in matching order, completed from RuleOrder
+	resolutions     *resolutionCache // Nil unless ResolutionCacheTTL is set
+	videoSessions   sync.Map         // Per-key *videoSession when VideoAware is enabled
+	transfers       *limiter.TransferQueue // Nil unless MaxConcurrentTransfers is set
+	keySlots        *limiter.KeySlots      // Nil unless MaxConcurrent is set
+	inFlight        limiter.InFlightGauges // Per-client bytes in flight
 	cleanupTicker   *time.Ticker
 	saveTicker      *time.Ticker
+	adminServer     *listener
+	metricsServer   *listener
+	ring            *limiter.HashRing // Nil unless PartitionPeers is set
+	remoteBuckets   sync.Map          // Per-key *remoteBucket for keys owned by peers
+	partitionClient *http.Client
+	redis           *redisStore // Nil unless Storage is "redis"
+	partitionServer *listener
+	cluster         *clusterState // Nil unless ClusterDir is set
+	reputation      reputationState // Rates client IPs for ReputationLimits
+	country         countryState    // Locates client IPs for CountryLimits and ContinentLimits
+	metrics         *metrics
+	statsCallbacks  statsCallbacks // Functions registered with OnRequestDone
+	spanSource      spanSource     // Function registered with TraceSpans
+	origins         originBuckets  // Read buckets of upstream hosts, see OriginTransport
+	onCleanup       cleanupCallbacks // Functions registered with OnCleanup
+	keyGuard        keyGuard
+	overrides       keyOverrides // Limits set at runtime, see SetKeyLimit
+	log             *logger      // Filters by LogLevel, see SetLogger
+	layers          ruleLayers   // What the limit rules are built from, see LimitProfiles
+	drainer         drainState // In-flight responses, see Config.DrainTimeout
+	early           earlyThrottle // See Config.GlobalEarlyThrottle
+	clusterTicker   *time.Ticker
+	rulesTicker     *time.Ticker
+	profileTicker   *time.Ticker
 	shutdownChan    chan struct{}
 	wg              sync.WaitGroup
 }
 
-// bucketWrapper wraps a TokenBucket with metadata for cleanup and persistence
-type bucketWrapper struct {
-	bucket   *TokenBucket
-	lastUsed time.Time
-	key      string // For easier identification
-}
-
 // TokenBucket implements the token bucket algorithm for rate limiting
-type TokenBucket struct {
-	tokens     int64
-	limit      int64
-	burstSize  int64
-	lastRefill time.Time
-	mutex      sync.Mutex
-}
-
-// bucketState represents the serializable state of a bucket
-type bucketState struct {
-	Key        string    `json:"key"`
-	Tokens     int64     `json:"tokens"`
-	Limit      int64     `json:"limit"`
-	BurstSize  int64     `json:"burstSize"`
-	LastRefill time.Time `json:"lastRefill"`
-	LastUsed   time.Time `json:"lastUsed"`
-}
+type TokenBucket = limiter.TokenBucket
 
 // NewTokenBucket creates a new token bucket
 func NewTokenBucket(limit, burstSize int64) *TokenBucket {
-	return &TokenBucket{
-		tokens:     burstSize,
-		limit:      limit,
-		burstSize:  burstSize,
-		lastRefill: time.Now(),
-	}
+	return limiter.NewTokenBucket(limit, burstSize)
 }
 
-// Consume attempts to consume tokens from the bucket
-func (tb *TokenBucket) Consume(tokens int64) bool {
-	tb.mutex.Lock()
-	defer tb.mutex.Unlock()
-	
-	// Refill tokens based on time elapsed
-	now := time.Now()
-	elapsed := now.Sub(tb.lastRefill)
-	tokensToAdd := int64(elapsed.Seconds() * float64(tb.limit))
-	tb.tokens = min(tb.tokens+tokensToAdd, tb.burstSize)
-	tb.lastRefill = now
-	
-	// Check if we have enough tokens
-	if tb.tokens >= tokens {
-		tb.tokens -= tokens
-		return true
-	}
-	
-	// Not enough tokens, return false
-	return false
-}
+// direction identifies which side of the exchange a bucket limits.
+// Each direction gets its own buckets so upload and download budgets stay independent.
+type direction string
 
-// getState returns the serializable state of the bucket
-func (tb *TokenBucket) getState() bucketState {
-	tb.mutex.Lock()
-	defer tb.mutex.Unlock()
-	
-	return bucketState{
-		Tokens:     tb.tokens,
-		Limit:      tb.limit,
-		BurstSize:  tb.burstSize,
-		LastRefill: tb.lastRefill,
-	}
+const (
+	directionDownload direction = "download" // Response bodies sent to the client
+	directionUpload   direction = "upload"   // Request bodies sent to the backend
+	directionRequests direction = "requests" // Requests admitted, see Config.RequestLimit
+)
+
+// Bucket scopes
+const (
+	scopeClientBackend = "client-backend" // One bucket per client/backend pair
+	scopeClient        = "client"         // One bucket per client across all backends
+)
+
+// bucketKey builds the bucket key for a client/backend pair in the given direction.
+// Download buckets keep the plain "client:backend" form used by existing persistence files.
+func (bl *BandwidthLimiter) bucketKey(clientIP, backend string, dir direction) string {
+	var key keyBuilder
+	bl.buildBucketKey(&key, clientIP, backend, dir)
+	return key.String()
 }
 
-// restoreFromState restores the bucket from a saved state
-func (tb *TokenBucket) restoreFromState(state bucketState) {
-	tb.mutex.Lock()
-	defer tb.mutex.Unlock()
-	
-	tb.tokens = state.Tokens
-	tb.limit = state.Limit
-	tb.burstSize = state.BurstSize
-	tb.lastRefill = state.LastRefill
+// aggregateKey builds the key of the bucket shared by all clients of a backend
+func aggregateKey(backend string) string {
+	return "*:" + backend
 }
 
 // min helper function
@@ -162,293 +915,930 @@ func min(a, b int64) int64 {
 
 // New creates a new BandwidthLimiter plugin
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if config.DefaultLimit <= 0 {
-		return nil, fmt.Errorf("defaultLimit must be greater than 0")
+	parsed, err := parseUnits(config)
+	if err != nil {
+		return nil, err
+	}
+	
+	log, err := newLogger(config, name)
+	if err != nil {
+		return nil, err
+	}
+	
+	if config.MaxNewKeysPerMinute < 0 {
+		return nil, wrapf(ErrInvalidLimit, "maxNewKeysPerMinute must not be negative")
+	}
+	
+	if config.ResolutionCacheSize < 0 {
+		return nil, wrapf(ErrInvalidLimit, "resolutionCacheSize must not be negative")
+	}
+	if config.ResolutionCacheSize == 0 {
+		config.ResolutionCacheSize = 10000
+	}
+	
+	if config.RequestLimit < 0 || config.RequestBurst < 0 {
+		return nil, wrapf(ErrInvalidLimit, "requestLimit and requestBurst must not be negative")
+	}
+	if config.RequestLimit == 0 && config.RequestBurst > 0 {
+		return nil, wrapf(ErrInvalidLimit, "requestBurst requires requestLimit")
+	}
+	if config.RequestBurst == 0 {
+		config.RequestBurst = config.RequestLimit
+	}
+	
+	if config.DrainBoost != 0 && config.DrainBoost < 1 {
+		return nil, wrapf(ErrInvalidLimit, "drainBoost must be 0 or at least 1")
+	}
+	if config.DrainBoost != 0 && parsed.drainTimeout == 0 {
+		return nil, wrapf(ErrInvalidLimit, "drainBoost requires drainTimeout")
+	}
+	if config.GlobalEarlyThrottle < 0 || config.GlobalEarlyThrottle >= 1 {
+		return nil, wrapf(ErrInvalidLimit, "globalEarlyThrottle must be at least 0 and below 1")
+	}
+	if config.GlobalEarlyThrottle > 0 && parsed.globalLimit == 0 {
+		return nil, wrapf(ErrInvalidLimit, "globalEarlyThrottle requires globalLimit")
+	}
+	if parsed.reservationMaxWait > 0 && !config.Reservation {
+		return nil, wrapf(ErrInvalidLimit, "reservationMaxWait requires reservation")
+	}
+	
+	if config.CacheHitCost < 0 || config.CacheMissCost < 0 {
+		return nil, wrapf(ErrInvalidLimit, "cacheHitCost and cacheMissCost must not be negative")
+	}
+	
+	if config.CacheStatusHeader == "" {
+		config.CacheStatusHeader = "X-Cache"
+	}
+	
+	if config.MaxConcurrentTransfers < 0 {
+		return nil, wrapf(ErrInvalidLimit, "maxConcurrentTransfers must not be negative")
+	}
+	if config.MaxConcurrent < 0 || config.MaxConcurrentQueue < 0 {
+		return nil, wrapf(ErrInvalidLimit, "maxConcurrent and maxConcurrentQueue must not be negative")
+	}
+	if config.MaxConcurrent == 0 && config.MaxConcurrentQueue > 0 {
+		return nil, wrapf(ErrInvalidLimit, "maxConcurrentQueue requires maxConcurrent")
+	}
+	
+	if config.StartupSegments < 0 {
+		return nil, wrapf(ErrInvalidLimit, "startupSegments must not be negative")
+	}
+	
+	if config.VideoAware && config.StartupSegments == 0 {
+		config.StartupSegments = 3
+	}
+	
+	for i, preload := range config.Preload {
+		if preload.ClientIP == "" {
+			return nil, wrapf(ErrInvalidLimit, "preload[%d]: clientIP must be set", i)
+		}
+	}
+	
+	switch config.CleanupLog {
+	case "":
+		config.CleanupLog = cleanupLogRemoved
+	case cleanupLogRemoved, cleanupLogDebug, cleanupLogOff:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "cleanupLog must be one of %q, %q or %q", cleanupLogRemoved, cleanupLogDebug, cleanupLogOff)
+	}
+	if config.CleanupLogThreshold < 0 {
+		return nil, wrapf(ErrInvalidLimit, "cleanupLogThreshold must not be negative")
+	}
+	if config.CleanupLogThreshold == 0 {
+		config.CleanupLogThreshold = 1
+	}
+	
+	switch config.Pacing {
+	case "":
+		config.Pacing = pacingTokens
+	case pacingTokens, pacingTimeSlice, pacingHighRes:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "pacing must be one of %q, %q or %q", pacingTokens, pacingHighRes, pacingTimeSlice)
+	}
+	
+	switch config.Mode {
+	case "":
+		config.Mode = modeThrottle
+	case modeThrottle:
+	case modeReject:
+		if config.Pacing == pacingTimeSlice {
+			return nil, wrapf(ErrInvalidLimit, "mode %q needs token buckets and can't be combined with pacing %q", modeReject, pacingTimeSlice)
+		}
+	default:
+		return nil, wrapf(ErrInvalidLimit, "mode must be one of %q or %q", modeThrottle, modeReject)
+	}
+	if config.RejectIdempotentOnly && config.Mode != modeReject {
+		return nil, wrapf(ErrInvalidLimit, "rejectIdempotentOnly needs mode %q", modeReject)
+	}
+	
+	if parsed.globalEarlyDelay == 0 {
+		parsed.globalEarlyDelay = parsed.tickInterval
+	}
+	
+	switch config.BucketScope {
+	case "":
+		config.BucketScope = scopeClientBackend
+	case scopeClientBackend:
+	case scopeClient:
+		if len(config.BackendLimits) > 0 || len(config.BackendMinuteLimits) > 0 {
+			log.warnf("backendLimits and backendMinuteLimits are ignored with bucketScope %q", scopeClient)
+		}
+	default:
+		return nil, wrapf(ErrInvalidLimit, "bucketScope must be one of %q or %q", scopeClientBackend, scopeClient)
+	}
+	
+	switch config.PersistenceLock {
+	case "":
+		config.PersistenceLock = persistenceLockWarn
+	case persistenceLockWarn, persistenceLockExclusive, persistenceLockOff:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "persistenceLock must be one of %q, %q or %q", persistenceLockWarn, persistenceLockExclusive, persistenceLockOff)
+	}
+	
+	switch config.AuthDetection {
+	case "":
+	case authDetectionHeader:
+	case authDetectionJWT:
+		if config.AuthJWTSecret == "" {
+			return nil, wrapf(ErrInvalidLimit, "authJWTSecret must be set when authDetection is %q", authDetectionJWT)
+		}
+	default:
+		return nil, wrapf(ErrInvalidLimit, "authDetection must be one of %q or %q", authDetectionHeader, authDetectionJWT)
+	}
+	
+	if config.AuthHeader == "" {
+		config.AuthHeader = "Authorization"
+	}
+	
+	if config.TierClaim != "" {
+		if config.TierJWTSecret == "" {
+			config.TierJWTSecret = config.AuthJWTSecret
+		}
+		if config.TierJWTSecret == "" {
+			return nil, wrapf(ErrInvalidLimit, "tierJWTSecret or authJWTSecret must be set when tierClaim is set")
+		}
+		if config.TierTokenHeader == "" {
+			config.TierTokenHeader = "Authorization"
+		}
+	}
+	
+	clientIPs, err := parseClientIPStrategy(config.ClientIPStrategy)
+	if err != nil {
+		return nil, err
+	}
+	
+	switch config.ClientIDMode {
+	case "":
+	case clientIDHash:
+		if config.ClientIDSalt == "" {
+			return nil, wrapf(ErrInvalidLimit, "clientIDSalt must be set when clientIDMode is %q", clientIDHash)
+		}
+	case clientIDTruncate:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "clientIDMode must be one of %q or %q", clientIDHash, clientIDTruncate)
+	}
+	
+	switch config.DuplicateMode {
+	case "":
+		config.DuplicateMode = duplicateSkip
+	case duplicateSkip, duplicateCoordinate:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "duplicateMode must be one of %q or %q", duplicateSkip, duplicateCoordinate)
+	}
+	
+	switch config.KeyFallback {
+	case "":
+		config.KeyFallback = keyFallbackIP
+	case keyFallbackIP, keyFallbackReject:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "keyFallback must be one of %q or %q", keyFallbackIP, keyFallbackReject)
+	}
+	if config.KeyHeader == "" && (len(config.KeyLimits) > 0 || config.KeyFallback == keyFallbackReject) {
+		return nil, wrapf(ErrInvalidLimit, "keyHeader must be set when keyLimits or keyFallback %q are set", keyFallbackReject)
+	}
+	if config.ServiceIdentityHeader == "" && len(config.ServiceLimits) > 0 {
+		return nil, wrapf(ErrInvalidLimit, "serviceIdentityHeader must be set when serviceLimits are set")
+	}
+	
+	switch config.RuleMatching {
+	case "":
+		config.RuleMatching = ruleMatchFirst
+	case ruleMatchFirst, ruleMatchAll:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "ruleMatching must be one of %q or %q", ruleMatchFirst, ruleMatchAll)
+	}
+	ruleOrder, err := parseRuleOrder(config.RuleOrder)
+	if err != nil {
+		return nil, err
+	}
+	
+	if len(config.PartitionPeers) > 0 {
+		found := false
+		for _, peer := range config.PartitionPeers {
+			found = found || peer == config.PartitionSelf
+		}
+		if !found {
+			return nil, wrapf(ErrInvalidLimit, "partitionSelf must be one of partitionPeers")
+		}
+		if config.PartitionAddress == "" {
+			config.PartitionAddress = config.PartitionSelf
+		}
+	}
+	
+	switch config.Storage {
+	case "":
+		config.Storage = storageMemory
+	case storageMemory:
+	case storageRedis:
+		if len(config.PartitionPeers) > 0 {
+			return nil, wrapf(ErrInvalidLimit, "storage %q can't be combined with partitionPeers", storageRedis)
+		}
+		if config.RedisPoolSize < 0 {
+			return nil, wrapf(ErrInvalidLimit, "redisPoolSize must not be negative")
+		}
+		if config.RedisAddress == "" {
+			config.RedisAddress = "127.0.0.1:6379"
+		}
+		if config.RedisKeyPrefix == "" {
+			config.RedisKeyPrefix = "bwl:"
+		}
+		if config.RedisPoolSize == 0 {
+			config.RedisPoolSize = 8
+		}
+	default:
+		return nil, wrapf(ErrInvalidLimit, "storage must be one of %q or %q", storageMemory, storageRedis)
+	}
+	
+	switch config.ClusterQuotaReset {
+	case "", quotaResetDaily, quotaResetMonthly, quotaResetRolling:
+	default:
+		return nil, wrapf(ErrInvalidLimit, "clusterQuotaReset must be empty or one of %q, %q or %q", quotaResetDaily, quotaResetMonthly, quotaResetRolling)
+	}
+	if config.ClusterQuotaTimezone != "" && config.ClusterQuotaReset != quotaResetDaily && config.ClusterQuotaReset != quotaResetMonthly {
+		return nil, wrapf(ErrInvalidLimit, "clusterQuotaTimezone requires a %q or %q clusterQuotaReset", quotaResetDaily, quotaResetMonthly)
+	}
+	if parsed.clusterQuotaCarryOver > 0 && config.ClusterQuotaReset == quotaResetRolling {
+		return nil, wrapf(ErrInvalidLimit, "clusterQuotaCarryOver can't be combined with a %q clusterQuotaReset", quotaResetRolling)
+	}
+	
+	// Without a token anyone who can reach the admin listener could change limits
+	if config.AdminAddress != "" && config.AdminToken == "" && !loopbackAddress(config.AdminAddress) {
+		return nil, wrapf(ErrInvalidLimit, "adminAddress must be a loopback address unless adminToken is set")
 	}
 	
-	if config.BurstSize == 0 {
-		config.BurstSize = config.DefaultLimit * 10 // Default burst is 10x the rate
+	// Likewise anyone reaching the partition listener could lease any key's tokens
+	if config.PartitionAddress != "" && config.PartitionToken == "" && !loopbackAddress(config.PartitionAddress) {
+		return nil, wrapf(ErrInvalidLimit, "partitionAddress must be a loopback address unless partitionToken is set")
 	}
 	
-	if config.BucketMaxAge == 0 {
-		config.BucketMaxAge = 3600 // 1 hour default
+	// Degrade gracefully when running under Yaegi
+	if !nativeBuild && (config.PprofLabels || config.AdminPprof) {
+		log.warnf("pprofLabels and adminPprof require building with -tags bwlnative, disabling them")
+		config.PprofLabels = false
+		config.AdminPprof = false
 	}
 	
-	if config.CleanupInterval == 0 {
-		config.CleanupInterval = 300 // 5 minutes default
+	routeCosts, err := compileRouteCosts(config.RouteCosts)
+	if err != nil {
+		return nil, err
 	}
 	
-	if config.SaveInterval == 0 {
-		config.SaveInterval = 60 // 1 minute default
+	if err := validateStripHeaders("stripRequestHeaders", config.StripRequestHeaders); err != nil {
+		return nil, err
+	}
+	if err := validateStripHeaders("stripResponseHeaders", config.StripResponseHeaders); err != nil {
+		return nil, err
+	}
+	exempt, err := compileExemptions(config.Exemptions, clientIPs)
+	if err != nil {
+		return nil, err
+	}
+	
+	if len(config.StripRequestHeaders) > 0 {
+		next = stripRequestHeaders(next, config.StripRequestHeaders)
 	}
 	
 	bl := &BandwidthLimiter{
 		next:         next,
 		name:         name,
 		config:       config,
+		parsed:       parsed,
+		instanceID:   newInstanceID(),
+		created:      time.Now(),
+		buckets:      limiter.NewMemoryStore(),
+		routeCosts:   routeCosts,
+		exemptions:   exempt,
+		clientIPs:    clientIPs,
+		ruleOrder:    ruleOrder,
+		metrics:      newMetrics(),
+		log:          log,
+		drainer:      drainState{boost: config.DrainBoost},
 		shutdownChan: make(chan struct{}),
 	}
 	
+	if parsed.resolutionCacheTTL > 0 {
+		bl.resolutions = newResolutionCache(parsed.resolutionCacheTTL, int(config.ResolutionCacheSize))
+	}
+	
+	if config.MaxConcurrentTransfers > 0 {
+		bl.transfers = limiter.NewTransferQueue(config.MaxConcurrentTransfers)
+	}
+	
+	if config.MaxConcurrent > 0 {
+		bl.keySlots = limiter.NewKeySlots(config.MaxConcurrent, int(config.MaxConcurrentQueue))
+	}
+	
+	if len(config.PartitionPeers) > 0 {
+		bl.ring = limiter.NewHashRing(config.PartitionPeers, 64)
+		bl.partitionClient = &http.Client{Timeout: parsed.partitionTimeout}
+	}
+	
+	if config.Storage == storageRedis {
+		bl.redis = newRedisStore(config, parsed.redisTimeout, log)
+	}
+	
+	if err := bl.validateProfiles(); err != nil {
+		return nil, err
+	}
+	
+	// Degrade gracefully when the persistence file can't be written
+	bl.checkPersistenceWritable()
+	
+	// Claim ownership of the persistence file before anything is written to it
+	if bl.usesPersistenceLock() {
+		if err := bl.acquirePersistenceLock(); err != nil {
+			return nil, err
+		}
+	}
+	
+	// Rules from ActiveProfile, ProfileSchedules and RulesFile apply from the
+	// start, so restored buckets are checked against them
+	if err := bl.updateProfile(); err != nil {
+		return nil, err
+	}
+	var rulesInfo os.FileInfo
+	if config.RulesFile != "" {
+		rulesInfo = bl.initialRules()
+	}
+	
 	// Load persisted buckets if persistence is enabled
 	if config.PersistenceFile != "" {
 		if err := bl.loadBuckets(); err != nil {
 			// Log the error but don't fail startup
-			fmt.Printf("Warning: Failed to load persisted buckets: %v\n", err)
+			atomic.AddInt64(&bl.metrics.persistenceErrors, 1)
+			bl.log.warnf("Failed to load persisted buckets: %v", err)
 		}
 	}
 	
+	// Create preloaded buckets that weren't restored from persistence
+	for i, preload := range config.Preload {
+		bl.preloadBucket(preload, parsed.preloadTokens[i])
+	}
+	
 	// Start cleanup routine
-	bl.cleanupTicker = time.NewTicker(time.Duration(config.CleanupInterval) * time.Second)
+	bl.cleanupTicker = time.NewTicker(parsed.cleanupInterval)
 	bl.wg.Add(1)
 	go bl.cleanupRoutine()
 	
-	// Start save routine if persistence is enabled
-	if config.PersistenceFile != "" {
-		bl.saveTicker = time.NewTicker(time.Duration(config.SaveInterval) * time.Second)
+	// Start save routine if persistence is enabled and writable
+	if config.PersistenceFile != "" && !config.PersistenceReadOnly {
+		bl.saveTicker = time.NewTicker(parsed.saveInterval)
 		bl.wg.Add(1)
 		go bl.saveRoutine()
 	}
 	
+	// Start admin listener if configured
+	if config.AdminAddress != "" {
+		bl.startAdmin()
+	}
+	if config.MetricsAddress != "" {
+		bl.startMetrics()
+	}
+	
+	// Start answering lease requests from peers
+	if bl.ring != nil {
+		bl.startPartition()
+	}
+	bl.closeStaleListeners()
+	if config.Expvar {
+		bl.publishExpvar()
+	}
+	
+	// Start coordinating cluster quotas through the shared directory
+	if config.ClusterDir != "" {
+		bl.cluster = &clusterState{used: make(map[string]int64)}
+		bl.restoreCluster()
+		bl.clusterTicker = time.NewTicker(parsed.clusterSyncInterval)
+		bl.wg.Add(1)
+		go bl.clusterRoutine()
+	}
+	
+	// Load the reputation lists and keep refreshing them
+	if len(config.ReputationLists) > 0 {
+		bl.startReputation()
+	}
+	
+	// Open the database locating clients for country limits
+	if config.GeoIPDatabase != "" {
+		bl.startCountries()
+	}
+	
+	// Reload the rules whenever RulesFile changes
+	if config.RulesFile != "" {
+		bl.startRules(rulesInfo)
+	}
+	
+	// Switch profiles as their windows open and close
+	if len(config.ProfileSchedules) > 0 {
+		bl.startProfiles()
+	}
+	
+	bl.logStartup()
 	return bl, nil
 }
 
-// cleanupRoutine periodically removes unused buckets
-func (bl *BandwidthLimiter) cleanupRoutine() {
-	defer bl.wg.Done()
+// Shutdown gracefully shuts down the bandwidth limiter, first draining
+// in-flight responses for up to DrainTimeout
+func (bl *BandwidthLimiter) Shutdown() {
+	// Let in-flight responses finish before the final save
+	bl.drain()
+	close(bl.shutdownChan)
 	
-	for {
-		select {
-		case <-bl.cleanupTicker.C:
-			bl.doCleanup()
-		case <-bl.shutdownChan:
-			return
-		}
+	bl.stopAdmin()
+	bl.stopMetrics()
+	bl.unpublishExpvar()
+	bl.stopPartition()
+	
+	if bl.cleanupTicker != nil {
+		bl.cleanupTicker.Stop()
 	}
-}
-
-// doCleanup removes buckets that haven't been used recently
-func (bl *BandwidthLimiter) doCleanup() {
-	now := time.Now()
-	maxAge := time.Duration(bl.config.BucketMaxAge) * time.Second
-	
-	// Count buckets before cleanup
-	beforeCount := 0
-	bl.buckets.Range(func(key, value interface{}) bool {
-		beforeCount++
-		return true
-	})
-	
-	// Remove old buckets
-	bl.buckets.Range(func(key, value interface{}) bool {
-		wrapper := value.(*bucketWrapper)
-		if now.Sub(wrapper.lastUsed) > maxAge {
-			bl.buckets.Delete(key)
-		}
-		return true
-	})
-	
-	// Count buckets after cleanup
-	afterCount := 0
-	bl.buckets.Range(func(key, value interface{}) bool {
-		afterCount++
-		return true
-	})
-	
-	removed := beforeCount - afterCount
-	if removed > 0 {
-		fmt.Printf("Cleanup removed %d unused buckets (kept %d active buckets)\n", removed, afterCount)
+	
+	if bl.saveTicker != nil {
+		bl.saveTicker.Stop()
 	}
-}
-
-// saveRoutine periodically saves buckets to file
-func (bl *BandwidthLimiter) saveRoutine() {
-	defer bl.wg.Done()
 	
-	for {
-		select {
-		case <-bl.saveTicker.C:
-			if err := bl.saveBuckets(); err != nil {
-				fmt.Printf("Error saving buckets: %v\n", err)
-			}
-		case <-bl.shutdownChan:
-			// Save one final time on shutdown
-			if err := bl.saveBuckets(); err != nil {
-				fmt.Printf("Error saving buckets on shutdown: %v\n", err)
-			}
-			return
-		}
+	if bl.clusterTicker != nil {
+		bl.clusterTicker.Stop()
+	}
+	
+	if bl.reputation.ticker != nil {
+		bl.reputation.ticker.Stop()
+	}
+	
+	if bl.rulesTicker != nil {
+		bl.rulesTicker.Stop()
+	}
+	
+	if bl.profileTicker != nil {
+		bl.profileTicker.Stop()
+	}
+	
+	bl.wg.Wait()
+	
+	if bl.redis != nil {
+		bl.redis.client.Close()
+	}
+	
+	// Release ownership of the persistence file after the final save
+	if bl.usesPersistenceLock() {
+		bl.releasePersistenceLock()
 	}
 }
 
-// saveBuckets saves all current buckets to the configured file
-func (bl *BandwidthLimiter) saveBuckets() error {
-	if bl.config.PersistenceFile == "" {
-		return nil // Persistence disabled
+// ServeHTTP implements the http.Handler interface
+func (bl *BandwidthLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Internal response headers are removed last, after the limiter has seen them
+	if len(bl.config.StripResponseHeaders) > 0 {
+		rw = &strippingResponseWriter{ResponseWriter: rw, names: bl.config.StripResponseHeaders}
 	}
 	
-	var states []bucketState
+	// Requests another limiter already dealt with are not accounted twice.
+	// Markers are removed from every request, so none reaches the backend
+	// whether or not it matched.
+	if bl.bypassedRequest(req) {
+		bl.next.ServeHTTP(rw, req)
+		return
+	}
 	
-	// Collect all bucket states
-	bl.buckets.Range(func(key, value interface{}) bool {
-		wrapper := value.(*bucketWrapper)
-		state := wrapper.bucket.getState()
-		state.Key = key.(string)
-		state.LastUsed = wrapper.lastUsed
-		states = append(states, state)
-		return true
-	})
+	// Exempt traffic goes straight to the backend
+	if bl.exemptions != nil && bl.exemptions.match(req) {
+		bl.next.ServeHTTP(rw, req)
+		return
+	}
 	
-	// Create directory if it doesn't exist
-	dir := filepath.Dir(bl.config.PersistenceFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	// Requests another instance of the middleware is already limiting
+	if marker, ok := req.Context().Value(chainContextKey{}).(*chainMarker); ok {
+		bl.serveDuplicate(rw, req, marker)
+		return
 	}
 	
-	// Write to temporary file first (atomic save)
-	tempFile := bl.config.PersistenceFile + ".tmp"
-	file, err := os.Create(tempFile)
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+	// Resolve which bucket and limits apply to this request
+	decision := bl.Decide(req)
+	clientIP, backend, key, policy := decision.ClientIP, decision.Backend, decision.Key, decision.Policy
+	
+	if bl.config.SendHeaders {
+		bl.setLimitHeaders(rw, decision)
 	}
-	defer file.Close()
 	
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ") // Pretty print for debugging
-	if err := encoder.Encode(states); err != nil {
-		return fmt.Errorf("failed to encode buckets: %w", err)
+	// Unlimited rules skip all limiter work
+	if policy.Limit == Unlimited {
+		bl.next.ServeHTTP(rw, req)
+		return
 	}
 	
-	file.Close()
+	// Everything the limiter does for the request is accumulated in its stats
+	stats := &RequestStats{Decision: decision, Start: time.Now()}
+	marker := &chainMarker{name: bl.name}
+	ctx := context.WithValue(req.Context(), statsContextKey{}, stats)
+	req = req.WithContext(context.WithValue(ctx, chainContextKey{}, marker))
+	defer bl.finishRequest(req, stats)
 	
-	// Atomic rename
-	if err := os.Rename(tempFile, bl.config.PersistenceFile); err != nil {
-		return fmt.Errorf("failed to rename file: %w", err)
+	// Requests without an API key are refused when keys are required
+	if bl.config.KeyFallback == keyFallbackReject && bl.apiKey(req) == "" {
+		bl.reject(rw, http.StatusUnauthorized, "API key required", decision)
+		stats.Rejected = http.StatusUnauthorized
+		return
 	}
 	
-	fmt.Printf("Saved %d buckets to %s\n", len(states), bl.config.PersistenceFile)
-	return nil
-}
-
-// loadBuckets loads saved buckets from the configured file
-func (bl *BandwidthLimiter) loadBuckets() error {
-	if bl.config.PersistenceFile == "" {
-		return nil // Persistence disabled
+	// Clients over their share of the cluster quota are turned away until the period ends
+	clusterQuota := int64(0)
+	if bl.cluster != nil {
+		clusterQuota = bl.clusterQuota(clientIP)
+	}
+	if clusterQuota > 0 {
+		if ok, retryAt := bl.admitCluster(decision.ClientID, clusterQuota); !ok {
+			retryAfter := time.Until(retryAt)
+			rw.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter.Seconds())+1, 10))
+			bl.reject(rw, http.StatusTooManyRequests, "cluster quota exceeded", decision)
+			stats.Rejected = http.StatusTooManyRequests
+			stats.Err = errClusterQuota
+			return
+		}
 	}
 	
-	file, err := os.Open(bl.config.PersistenceFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // File doesn't exist yet, that's OK
+	// Buckets the request pays from are kept from cleanup until it completes
+	refs := &entryRefs{}
+	defer refs.release()
+	
+	// Every request pays a token from its request-rate bucket before any bytes
+	if bl.config.RequestLimit > 0 && !bl.admitRequest(rw, req, stats, refs) {
+		return
+	}
+	
+	// HEAD responses never carry a body, so once admitted there is nothing
+	// left to limit
+	if req.Method == http.MethodHead {
+		bl.next.ServeHTTP(rw, req)
+		return
+	}
+	
+	// Fail fast instead of slow-dripping when the buckets are drained
+	if bl.config.Mode == modeReject && (!bl.config.RejectIdempotentOnly || idempotent(req.Method)) {
+		if wait := bl.tokenWait(decision); wait > bl.parsed.maxWait {
+			rw.Header().Set("Retry-After", strconv.FormatInt(int64(wait.Seconds())+1, 10))
+			bl.reject(rw, http.StatusTooManyRequests, "bandwidth limit exceeded", decision)
+			stats.Rejected = http.StatusTooManyRequests
+			return
 		}
-		return fmt.Errorf("failed to open file: %w", err)
 	}
-	defer file.Close()
 	
-	var states []bucketState
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&states); err != nil {
-		return fmt.Errorf("failed to decode buckets: %w", err)
+	// Wait for one of the key's own transfers to finish when it has too many
+	if bl.keySlots != nil {
+		queueStart := time.Now()
+		acquired := bl.keySlots.Acquire(req.Context(), key, policy.QueueMaxWait)
+		stats.QueueWait += time.Since(queueStart)
+		if !acquired {
+			bl.reject(rw, http.StatusTooManyRequests, "too many concurrent transfers for this client", decision)
+			stats.Rejected = http.StatusTooManyRequests
+			return
+		}
+		defer bl.keySlots.Release(key)
+	}
+	
+	// Wait for a transfer slot when concurrent transfers are capped
+	if bl.transfers != nil {
+		queueStart := time.Now()
+		acquired := bl.transfers.Acquire(req.Context(), key, policy.QueueMaxWait)
+		stats.QueueWait += time.Since(queueStart)
+		if !acquired {
+			bl.reject(rw, http.StatusServiceUnavailable, "too many concurrent transfers", decision)
+			stats.Rejected = http.StatusServiceUnavailable
+			return
+		}
+		defer bl.transfers.Release()
 	}
 	
-	// Restore buckets
-	loaded := 0
-	for _, state := range states {
-		bucket := NewTokenBucket(state.Limit, state.BurstSize)
-		bucket.restoreFromState(state)
+	// Chunks stop waiting for tokens once the request ends or Shutdown stops the middleware
+	waits := bl.newTokenWaits(req)
+	defer waits.release()
+	
+	// Uploads are paid for as the backend reads the request body
+	if bl.config.LimitUploads {
+		bl.limitUpload(req, stats, refs, waits)
+	}
+	
+	// Wrap the response writer to monitor bandwidth
+	lrw := &limitedResponseWriter{
+		ResponseWriter: rw,
+		ctx:            req.Context(),
+		waits:          waits,
+		cost:           decision.Cost,
+		minRate:        policy.MinRate,
+		stats:          stats,
+		chunkSize:      bl.parsed.chunkSize,
+		maxBytes:       bl.parsed.maxBytesPerRequest,
+		chunkWaits:     bl.metrics.chunkWait,
+		flushChunks:    bl.config.FlushChunks,
+	}
+	if bl.parsed.drainTimeout > 0 {
+		bl.drainer.begin()
+		defer bl.drainer.end()
+		lrw.drain = &bl.drainer
+	}
+	if bl.config.Reservation {
+		lrw.reserve = true
+		defer lrw.releaseReservation()
+	}
+	if bl.config.GlobalEarlyThrottle > 0 {
+		defer lrw.leaveEarly()
+	}
+	
+	// Buckets are only bound on the first non-empty write, so 204/304 and
+	// other empty responses never create a bucket or do any token work
+	lrw.bind = func() {
+		// Responses marked by a limiter further down the chain, e.g.
+		// rejections, and exempt content types
+		if bl.bypassed(lrw.Header()) || (bl.exemptions != nil && bl.exemptions.matchResponse(lrw.Header())) {
+			stats.Bypassed = true
+			return
+		}
+		stats.Limited = true
+		
+		if bl.parsed.maxTransferTime > 0 {
+			lrw.deadline = time.Now().Add(bl.parsed.maxTransferTime)
+		}
 		
-		wrapper := &bucketWrapper{
-			bucket:   bucket,
-			lastUsed: state.LastUsed,
-			key:      state.Key,
+		if bl.config.Pacing == pacingTimeSlice {
+			// Time-slice pacing is per response and needs no shared bucket
+			lrw.pacer = limiter.NewTimeSlicePacer(policy.Limit, bl.parsed.tickInterval)
+		} else {
+			// Cheap cache hits and expensive misses, known once headers are written
+			if bl.config.CacheHitCost > 0 || bl.config.CacheMissCost > 0 {
+				lrw.cost *= bl.cacheCost(lrw.Header())
+			}
+			
+			// Local buckets, or a lease on them if a peer owns the key
+			bucketKey, bucketPolicy := bl.guardKey(key, policy)
+			lrw.buckets = append(lrw.buckets, bl.consumers(bucketKey, bucketPolicy, refs)...)
+			
+			// All clients of the backend share its aggregate bucket, and all
+			// traffic shares the global bucket
+			levels := bl.parentLevels(backend)
+			for _, level := range levels {
+				lrw.buckets = append(lrw.buckets, bl.consumers(level.key, level.policy, refs)...)
+			}
+			lrw.early = bl.joinEarlyThrottle(bucketPolicy.Limit)
+			
+			// Instances further down the chain coordinating with this one
+			coordinated, coordinatedLimit, coordinatedBurst := marker.contributed()
+			lrw.buckets = append(lrw.buckets, coordinated...)
+			
+			// Chunks are sized for the slowest bucket and small enough for
+			// every burst to cover one. High-resolution pacing pays for
+			// bigger chunks unless ChunkSize fixes them.
+			limit, burst := bucketPolicy.Limit, bucketPolicy.Burst
+			if bucketPolicy.MinuteLimit > 0 {
+				burst = min(burst, bucketPolicy.MinuteLimit)
+			}
+			for _, level := range levels {
+				limit = min(limit, level.policy.Limit)
+				burst = min(burst, level.policy.Burst)
+			}
+			if len(coordinated) > 0 {
+				limit, burst = min(limit, coordinatedLimit), min(burst, coordinatedBurst)
+			}
+			burst = int64(float64(burst) / lrw.cost)
+			switch {
+			case bl.config.Pacing == pacingHighRes && (bl.config.ChunkSize == "" || bl.parsed.autoChunkSize):
+				lrw.chunkSize = limiter.HighResChunkSize(limit, burst)
+			case bl.parsed.autoChunkSize:
+				lrw.chunkSize = limiter.AutoChunkSize(limit, burst)
+			default:
+				lrw.chunkSize = limiter.ChunkForBurst(lrw.chunkSize, burst)
+			}
+			if bl.config.Pacing == pacingHighRes {
+				lrw.refillRate = int64(float64(limit) / lrw.cost)
+			}
+			
+			// Segments are additionally paced per response
+			if bl.config.VideoAware {
+				if kind := classifyMedia(req.URL.Path, lrw.Header().Get("Content-Type")); kind != mediaOther {
+					if limit := bl.segmentLimit(key, kind); limit > 0 {
+						lrw.pacer = limiter.NewTimeSlicePacer(limit, bl.parsed.tickInterval)
+					}
+				}
+			}
+			
+			// Paid for in full once the headers tell the body's length
+			if bl.config.Reservation && lrw.pacer == nil {
+				bl.reserveBody(lrw, req)
+			}
 		}
 		
-		bl.buckets.Store(state.Key, wrapper)
-		loaded++
+		// Share the client's in-flight byte budget across its concurrent responses
+		if bl.parsed.maxBytesInFlight > 0 {
+			lrw.inFlight = bl.inFlight.Retain(clientIP)
+			lrw.maxInFlight = bl.parsed.maxBytesInFlight
+		}
 	}
+	defer func() {
+		if lrw.inFlight != nil {
+			bl.inFlight.Release(clientIP, lrw.inFlight)
+		}
+	}()
 	
-	fmt.Printf("Loaded %d buckets from %s\n", loaded, bl.config.PersistenceFile)
-	return nil
-}
-
-// Shutdown gracefully shuts down the bandwidth limiter
-func (bl *BandwidthLimiter) Shutdown() {
-	close(bl.shutdownChan)
+	// Connections taken over by the handler, e.g. WebSockets, keep paying
+	if bl.config.ThrottleHijacked {
+		lrw.throttleConn = func(conn net.Conn, buffered io.Reader) net.Conn {
+			return bl.throttleHijacked(lrw, conn, buffered, refs)
+		}
+	}
 	
-	if bl.cleanupTicker != nil {
-		bl.cleanupTicker.Stop()
+	// Call the next handler, labelled for profiling if enabled
+	if bl.config.PprofLabels {
+		withPprofLabels(req.Context(), func(ctx context.Context) {
+			bl.next.ServeHTTP(lrw, req.WithContext(ctx))
+		}, "bwl_limit_class", policy.Class, "bwl_backend", backend, "bwl_label", policy.Label)
+	} else {
+		bl.next.ServeHTTP(lrw, req)
 	}
 	
-	if bl.saveTicker != nil {
-		bl.saveTicker.Stop()
+	if clusterQuota > 0 && !stats.Bypassed {
+		bl.recordCluster(decision.ClientID, stats.BytesWritten)
 	}
 	
-	bl.wg.Wait()
+	// Capped responses must not look complete. Hijacked connections are
+	// the handler's to close.
+	if stats.Aborted != "" && !stats.Hijacked {
+		bl.abortTransfer(lrw, stats)
+	}
 }
 
-// ServeHTTP implements the http.Handler interface
-func (bl *BandwidthLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// Extract client IP
-	clientIP := getClientIP(req)
+// preloadBucket creates a bucket with the given initial tokens, for the key and
+// limits a request described by the preload entry would get.
+// Existing buckets, e.g. restored from persistence, are left untouched.
+func (bl *BandwidthLimiter) preloadBucket(preload PreloadBucket, tokens int64) {
+	req := syntheticRequest(preload.ClientIP, preload.Backend, preload.Path)
+	for name, value := range preload.Headers {
+		req.Header.Set(name, value)
+	}
+	entryPoint := preload.EntryPoint
+	if entryPoint == "" {
+		entryPoint = bl.entryPoint(req)
+	}
 	
-	// Get backend address from request
-	backend := req.URL.Host
-	if backend == "" {
-		backend = "default"
+	bl.rulesMutex.RLock()
+	decision := bl.override(bl.schedule(bl.decide(req, entryPoint), time.Now()))
+	bl.rulesMutex.RUnlock()
+	if decision.Policy.Limit == Unlimited {
+		return // Unlimited clients never use a bucket
 	}
 	
-	// Determine the bandwidth limit to apply
-	limit := bl.getLimit(clientIP, backend)
+	if _, exists := bl.buckets.Load(decision.Key); exists {
+		return
+	}
+	entry := bl.buckets.LoadOrCreate(decision.Key, decision.Policy)
+	entry.Bucket.SetTokens(tokens)
+}
+
+// resolvePolicy determines all limits that apply to a given client IP and backend
+func (bl *BandwidthLimiter) resolvePolicy(clientIP, backend string) limiter.Policy {
+	limit, class := bl.resolveLimit(clientIP, backend)
+	return limiter.Policy{
+		Limit:        limit,
+		Burst:        bl.parsed.burstSize,
+		MinuteLimit:  bl.getMinuteLimit(clientIP, backend),
+		MinRate:      bl.getMinRate(clientIP, backend),
+		QueueMaxWait: bl.getQueueMaxWait(clientIP, backend),
+		Class:        class,
+		Label:        bl.resolveLabel(clientIP, backend),
+	}
+}
+
+// Limit classes reported by resolveLimit
+const (
+	limitClassClient  = "client"
+	limitClassBackend = "backend"
+	limitClassDefault = "default"
+)
+
+// resolveLimit determines the bandwidth limit for a given client IP and backend,
+// and which class of rule supplied it
+func (bl *BandwidthLimiter) resolveLimit(clientIP, backend string) (int64, string) {
+	// Check for client-specific limit
+	if limit, exists := bl.clientLimit(clientIP); exists {
+		return limit, limitClassClient
+	}
 	
-	// Create or get the token bucket for this client/backend combination
-	key := fmt.Sprintf("%s:%s", clientIP, backend)
+	// Check for backend-specific limit
+	if limit, exists := bl.backendLimit(backend); exists {
+		return limit, limitClassBackend
+	}
 	
-	// Get or create bucket with automatic update of last used time
-	wrapper := bl.getOrCreateBucket(key, limit)
-	wrapper.lastUsed = time.Now() // Update last used time
+	// Return default limit
+	return bl.parsed.defaultLimit, limitClassDefault
+}
+
+// clientLimit returns the limit of the client rule for an IP, exact entries
+// before the narrowest matching CIDR
+func (bl *BandwidthLimiter) clientLimit(clientIP string) (int64, bool) {
+	if limit, exists := bl.parsed.clientLimits[clientIP]; exists {
+		return limit, true
+	}
+	if bl.parsed.clientNetworks != nil {
+		return bl.parsed.clientNetworks.lookup(net.ParseIP(clientIP))
+	}
+	return 0, false
+}
+
+// backendLimit returns the limit of the backend rule for a backend. Backend
+// limits only make sense for per-pair buckets.
+func (bl *BandwidthLimiter) backendLimit(backend string) (int64, bool) {
+	if bl.config.BucketScope == scopeClient {
+		return 0, false
+	}
+	limit, exists := bl.parsed.backendLimits[backend]
+	return limit, exists
+}
+
+// getMinuteLimit determines the per-minute byte budget for a given client IP and backend.
+// It follows the same precedence as resolveLimit; 0 means no per-minute window.
+func (bl *BandwidthLimiter) getMinuteLimit(clientIP, backend string) int64 {
+	if limit, exists := bl.parsed.clientMinuteLimits[clientIP]; exists {
+		return limit
+	}
 	
-	// Wrap the response writer to monitor bandwidth
-	lrw := &limitedResponseWriter{
-		ResponseWriter: rw,
-		bucket:         wrapper.bucket,
+	if bl.config.BucketScope != scopeClient {
+		if limit, exists := bl.parsed.backendMinuteLimits[backend]; exists {
+			return limit
+		}
 	}
 	
-	// Call the next handler
-	bl.next.ServeHTTP(lrw, req)
+	return bl.parsed.defaultMinuteLimit
 }
 
-// getOrCreateBucket gets an existing bucket or creates a new one
-func (bl *BandwidthLimiter) getOrCreateBucket(key string, limit int64) *bucketWrapper {
-	if value, ok := bl.buckets.Load(key); ok {
-		return value.(*bucketWrapper)
+// getMinRate determines the minimum rate for a given client IP and backend.
+// It follows the same precedence as resolveLimit; 0 means no floor.
+func (bl *BandwidthLimiter) getMinRate(clientIP, backend string) int64 {
+	if rate, exists := bl.parsed.clientMinRates[clientIP]; exists {
+		return rate
 	}
 	
-	// Create new bucket
-	bucket := NewTokenBucket(limit, bl.config.BurstSize)
-	wrapper := &bucketWrapper{
-		bucket:   bucket,
-		lastUsed: time.Now(),
-		key:      key,
+	if bl.config.BucketScope != scopeClient {
+		if rate, exists := bl.parsed.backendMinRates[backend]; exists {
+			return rate
+		}
 	}
 	
-	// Store it (may overwrite if another goroutine created it first)
-	actual, _ := bl.buckets.LoadOrStore(key, wrapper)
-	return actual.(*bucketWrapper)
+	return bl.parsed.defaultMinRate
 }
 
-// getLimit determines the bandwidth limit for a given client IP and backend
-func (bl *BandwidthLimiter) getLimit(clientIP, backend string) int64 {
-	// Check for client-specific limit
-	if limit, exists := bl.config.ClientLimits[clientIP]; exists {
+// getUploadLimit determines the upload limit for a given client IP and backend.
+// It follows the same precedence as resolveLimit; 0 means the download limit.
+func (bl *BandwidthLimiter) getUploadLimit(clientIP, backend string) int64 {
+	if limit, exists := bl.parsed.clientUploadLimits[clientIP]; exists {
 		return limit
 	}
 	
-	// Check for backend-specific limit
-	if limit, exists := bl.config.BackendLimits[backend]; exists {
-		return limit
+	if bl.config.BucketScope != scopeClient {
+		if limit, exists := bl.parsed.backendUploadLimits[backend]; exists {
+			return limit
+		}
 	}
 	
-	// Return default limit
-	return bl.config.DefaultLimit
+	return bl.parsed.uploadLimit
+}
+
+// getQueueMaxWait determines how long a request may queue for a transfer slot.
+// It follows the same precedence as resolveLimit.
+func (bl *BandwidthLimiter) getQueueMaxWait(clientIP, backend string) time.Duration {
+	if wait, exists := bl.parsed.clientQueueMaxWaits[clientIP]; exists {
+		return wait
+	}
+	
+	if wait, exists := bl.parsed.backendQueueMaxWaits[backend]; exists {
+		return wait
+	}
+	
+	return bl.parsed.queueMaxWait
+}
+
+// resolveLabel returns the label configured for the client IP or, failing that, the backend
+func (bl *BandwidthLimiter) resolveLabel(clientIP, backend string) string {
+	if label, exists := bl.config.RuleLabels[clientIP]; exists {
+		return label
+	}
+	return bl.config.RuleLabels[backend]
 }
 
 // getClientIP extracts the client IP from the request
@@ -461,17 +1851,14 @@ func getClientIP(req *http.Request) string {
 		}
 	}
 	
-	// Try to get IP from X-Real-IP header
-	if xri := req.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	// Try to get IP from X-Real-IP header. The canonical name is looked up
+	// directly, since Header.Get would allocate to canonicalize "X-Real-IP".
+	if xri := req.Header["X-Real-Ip"]; len(xri) > 0 && xri[0] != "" {
+		return xri[0]
 	}
 	
 	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return req.RemoteAddr
-	}
-	return host
+	return remoteIP(req)
 }
 
 // parseForwardedFor parses the X-Forwarded-For header
@@ -485,44 +1872,3 @@ func parseForwardedFor(xff string) []string {
 	}
 	return ips
 }
-
-// limitedResponseWriter wraps http.ResponseWriter to apply bandwidth limiting
-type limitedResponseWriter struct {
-	http.ResponseWriter
-	bucket *TokenBucket
-}
-
-// Write applies bandwidth limiting when writing response data
-func (lrw *limitedResponseWriter) Write(p []byte) (int, error) {
-	// Track the total bytes written
-	totalWritten := 0
-	remaining := p
-	
-	for len(remaining) > 0 {
-		// Determine how many bytes to write in this iteration
-		chunkSize := min(int64(len(remaining)), 4096) // 4KB chunks
-		
-		// Wait until we have tokens available
-		for !lrw.bucket.Consume(chunkSize) {
-			// No tokens available, wait a bit
-			time.Sleep(10 * time.Millisecond)
-		}
-		
-		// Write the chunk
-		written, err := lrw.ResponseWriter.Write(remaining[:chunkSize])
-		totalWritten += written
-		
-		if err != nil {
-			return totalWritten, err
-		}
-		
-		remaining = remaining[written:]
-	}
-	
-	return totalWritten, nil
-}
-
-// Required for interface compliance, but we don't apply limiting here
-func (lrw *limitedResponseWriter) WriteHeader(statusCode int) {
-	lrw.ResponseWriter.WriteHeader(statusCode)
-}
\ No newline at end of file
@@ -2,26 +2,28 @@ package bandwidthlimiter_test
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/hhftechnology/bandwidthlimiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
 )
 
 // TestBandwidthLimiter tests the basic bandwidth limiting functionality
 func TestBandwidthLimiter(t *testing.T) {
 	// Create plugin configuration with more aggressive limits for testing
 	cfg := bandwidthlimiter.CreateConfig()
-	cfg.DefaultLimit = 1024 * 50  // 50 KB/s (reduced for faster testing)
-	cfg.BurstSize = 1024 * 10     // 10 KB burst (smaller burst for clearer testing)
-	
+	cfg.DefaultLimit = "50KB" // 50 KB/s (reduced for faster testing)
+	cfg.BurstSize = "10KB"    // 10 KB burst (smaller burst for clearer testing)
+
 	// Create context
 	ctx := context.Background()
-	
+
 	// Create a test handler that sends a large response
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		// Send 100 KB of data (should take ~2 seconds at 50 KB/s)
@@ -44,37 +46,37 @@ func TestBandwidthLimiter(t *testing.T) {
 			}
 		}
 	})
-	
+
 	// Create the bandwidth limiter middleware
 	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
 	if err != nil {
 		t.Fatal(err)
 	}
-	
+
 	// Create a recorder to capture the response
 	recorder := httptest.NewRecorder()
-	
+
 	// Create a test request
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	
+
 	// Measure the time it takes to get the response
 	start := time.Now()
-	
+
 	// Execute the request
 	handler.ServeHTTP(recorder, req)
-	
+
 	elapsed := time.Since(start)
-	
+
 	// Verify that the response was throttled
 	// With 50 KB/s limit and 100 KB data, it should take at least 1.5-2 seconds
 	minExpectedTime := time.Second
 	if elapsed < minExpectedTime {
 		t.Errorf("Response was not properly throttled. Expected >%v, got %v", minExpectedTime, elapsed)
 	}
-	
+
 	// Verify the response size
 	body := recorder.Body.Bytes()
 	if len(body) != 100*1024 {
@@ -85,14 +87,14 @@ func TestBandwidthLimiter(t *testing.T) {
 // TestPerBackendLimits tests that different backends get different limits
 func TestPerBackendLimits(t *testing.T) {
 	cfg := bandwidthlimiter.CreateConfig()
-	cfg.DefaultLimit = 1024 * 25  // 25 KB/s default (slower for testing)
-	cfg.BackendLimits = map[string]int64{
-		"fast-api.local": 1024 * 100, // 100 KB/s for fast API
+	cfg.DefaultLimit = "25KB" // 25 KB/s default (slower for testing)
+	cfg.BackendLimits = map[string]bandwidthlimiter.Size{
+		"fast-api.local": "100KB", // 100 KB/s for fast API
 	}
-	cfg.BurstSize = 1024 * 5 // 5 KB burst (smaller for clearer testing)
-	
+	cfg.BurstSize = "5KB" // 5 KB burst (smaller for clearer testing)
+
 	ctx := context.Background()
-	
+
 	// Create handler that sends 50 KB
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		data := make([]byte, 50*1024)
@@ -111,37 +113,37 @@ func TestPerBackendLimits(t *testing.T) {
 			}
 		}
 	})
-	
+
 	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
 	if err != nil {
 		t.Fatal(err)
 	}
-	
+
 	// Test default backend (should be slower)
 	t.Run("DefaultBackend", func(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://default-api.local", nil)
-		
+
 		start := time.Now()
 		handler.ServeHTTP(recorder, req)
 		elapsed := time.Since(start)
-		
+
 		// With 25 KB/s, 50 KB should take ~2 seconds (accounting for burst)
 		minExpectedTime := time.Duration(1.5 * float64(time.Second))
 		if elapsed < minExpectedTime {
 			t.Errorf("Default backend was too fast. Expected >%v, got %v", minExpectedTime, elapsed)
 		}
 	})
-	
+
 	// Test fast backend (should be faster)
 	t.Run("FastBackend", func(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://fast-api.local", nil)
-		
+
 		start := time.Now()
 		handler.ServeHTTP(recorder, req)
 		elapsed := time.Since(start)
-		
+
 		// With 100 KB/s, 50 KB should take ~0.5 seconds (with burst)
 		maxExpectedTime := time.Second
 		if elapsed > maxExpectedTime {
@@ -153,14 +155,14 @@ func TestPerBackendLimits(t *testing.T) {
 // TestPerClientLimits tests that different client IPs get different limits
 func TestPerClientLimits(t *testing.T) {
 	cfg := bandwidthlimiter.CreateConfig()
-	cfg.DefaultLimit = 1024 * 25  // 25 KB/s default (slower for testing)
-	cfg.ClientLimits = map[string]int64{
-		"10.0.0.100": 1024 * 75, // 75 KB/s for premium client
+	cfg.DefaultLimit = "25KB" // 25 KB/s default (slower for testing)
+	cfg.ClientLimits = map[string]bandwidthlimiter.Size{
+		"10.0.0.100": "75KB", // 75 KB/s for premium client
 	}
-	cfg.BurstSize = 1024 * 5 // 5 KB burst (smaller for clearer testing)
-	
+	cfg.BurstSize = "5KB" // 5 KB burst (smaller for clearer testing)
+
 	ctx := context.Background()
-	
+
 	// Create handler that sends 50 KB
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		data := make([]byte, 50*1024)
@@ -179,39 +181,39 @@ func TestPerClientLimits(t *testing.T) {
 			}
 		}
 	})
-	
+
 	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
 	if err != nil {
 		t.Fatal(err)
 	}
-	
+
 	// Test regular client
 	t.Run("RegularClient", func(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
 		req.RemoteAddr = "192.168.1.100:12345" // Regular client IP
-		
+
 		start := time.Now()
 		handler.ServeHTTP(recorder, req)
 		elapsed := time.Since(start)
-		
+
 		// With 25 KB/s, 50 KB should take ~2 seconds (accounting for burst)
 		minExpectedTime := time.Duration(1.5 * float64(time.Second))
 		if elapsed < minExpectedTime {
 			t.Errorf("Regular client was too fast. Expected >%v, got %v", minExpectedTime, elapsed)
 		}
 	})
-	
+
 	// Test premium client
 	t.Run("PremiumClient", func(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
 		req.RemoteAddr = "10.0.0.100:12345" // Premium client IP
-		
+
 		start := time.Now()
 		handler.ServeHTTP(recorder, req)
 		elapsed := time.Since(start)
-		
+
 		// With 75 KB/s, 50 KB should take ~0.7 seconds (with burst)
 		maxExpectedTime := time.Second
 		if elapsed > maxExpectedTime {
@@ -223,20 +225,20 @@ func TestPerClientLimits(t *testing.T) {
 // TestTokenBucket tests the token bucket implementation directly
 func TestTokenBucket(t *testing.T) {
 	bucket := bandwidthlimiter.NewTokenBucket(1000, 2000) // 1000 tokens/second, 2000 burst
-	
+
 	// Should be able to consume burst amount initially
 	if !bucket.Consume(2000) {
 		t.Error("Should be able to consume burst amount initially")
 	}
-	
+
 	// Should not be able to consume more than burst
 	if bucket.Consume(100) {
 		t.Error("Should not be able to consume more than burst")
 	}
-	
+
 	// Wait for refill
 	time.Sleep(100 * time.Millisecond)
-	
+
 	// Should be able to consume some tokens after waiting
 	if !bucket.Consume(50) {
 		t.Error("Should be able to consume tokens after waiting")
@@ -247,24 +249,24 @@ func TestTokenBucket(t *testing.T) {
 func TestPersistence(t *testing.T) {
 	// Create temporary file for testing
 	tempFile := t.TempDir() + "/test-buckets.json"
-	
+
 	cfg := bandwidthlimiter.CreateConfig()
-	cfg.DefaultLimit = 1048576
+	cfg.DefaultLimit = "1MB"
 	cfg.PersistenceFile = tempFile
-	cfg.SaveInterval = 1 // Save every second for testing
-	
+	cfg.SaveInterval = "1s" // Save every second for testing
+
 	ctx := context.Background()
-	
+
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rw.Write([]byte("test"))
 	})
-	
+
 	// Create first instance and make some requests
 	handler1, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter-1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	
+
 	// Create some traffic to generate buckets
 	for i := 0; i < 3; i++ {
 		recorder := httptest.NewRecorder()
@@ -272,10 +274,10 @@ func TestPersistence(t *testing.T) {
 		req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
 		handler1.ServeHTTP(recorder, req)
 	}
-	
+
 	// Wait for the save interval to ensure buckets are saved
 	time.Sleep(2 * time.Second)
-	
+
 	// We need to access the private Shutdown method, so let's cast the handler
 	// This is a bit of a hack, but necessary since we can't access private fields
 	if handler1, ok := handler1.(*bandwidthlimiter.BandwidthLimiter); ok {
@@ -283,12 +285,12 @@ func TestPersistence(t *testing.T) {
 	} else {
 		t.Fatal("Handler is not of type *BandwidthLimiter")
 	}
-	
+
 	// Check that the file exists and has content
 	if _, err := os.Stat(tempFile); os.IsNotExist(err) {
 		t.Errorf("Persistence file was not created: %s", tempFile)
 	}
-	
+
 	// Create second instance and verify it loads the saved buckets
 	// We can't directly verify the bucket count since buckets is private
 	// But we can verify that the instance loads successfully
@@ -296,20 +298,777 @@ func TestPersistence(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	
+
 	// Make a request with one of the previous IPs to verify the bucket was loaded
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
 	req.RemoteAddr = "192.168.1.0:12345" // Use the first IP from the previous test
 	handler2.ServeHTTP(recorder, req)
-	
+
 	// If no error occurred, the bucket was likely loaded successfully
 	if recorder.Code != http.StatusOK {
 		t.Errorf("Second instance failed to handle request, possibly due to persistence issues")
 	}
-	
+
 	// Cleanup
 	if handler2, ok := handler2.(*bandwidthlimiter.BandwidthLimiter); ok {
 		handler2.Shutdown()
 	}
-}
\ No newline at end of file
+}
+
+// TestMinuteWindowLimit tests that the per-minute budget throttles even when the per-second limit is generous
+func TestMinuteWindowLimit(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB"       // 10 MB/s, never the bottleneck here
+	cfg.DefaultMinuteLimit = "6000" // 6000 bytes per minute (100 B/s refill)
+
+	ctx := context.Background()
+
+	// Send slightly more than the minute budget
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 6100))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+
+	start := time.Now()
+	handler.ServeHTTP(recorder, req)
+	elapsed := time.Since(start)
+
+	// The second chunk needs ~100 bytes more than the window holds, i.e. ~1 second of refill
+	minExpectedTime := 500 * time.Millisecond
+	if elapsed < minExpectedTime {
+		t.Errorf("Minute window was not enforced. Expected >%v, got %v", minExpectedTime, elapsed)
+	}
+
+	if recorder.Body.Len() != 6100 {
+		t.Errorf("Unexpected response size. Expected %d, got %d", 6100, recorder.Body.Len())
+	}
+}
+
+// TestAccessLogHeaders tests that limiter data is recorded on the request for the access log
+func TestAccessLogHeaders(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "100KB" // 100 KB/s
+	cfg.BurstSize = "4KB"      // 4 KB burst so the response is throttled
+	cfg.AccessLogHeaders = true
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The headers must not leak to the backend
+		if req.Header.Get("X-Bandwidth-Key") != "" {
+			t.Error("Access log headers were set before the backend was called")
+		}
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "192.168.1.50:12345"
+	handler.ServeHTTP(recorder, req)
+
+	if got := req.Header.Get("X-Bandwidth-Limit"); got != "102400" {
+		t.Errorf("Unexpected X-Bandwidth-Limit. Expected %q, got %q", "102400", got)
+	}
+
+	if got := req.Header.Get("X-Bandwidth-Key"); got != "192.168.1.50:localhost" {
+		t.Errorf("Unexpected X-Bandwidth-Key. Expected %q, got %q", "192.168.1.50:localhost", got)
+	}
+
+	if got := req.Header.Get("X-Bandwidth-Wait-Ms"); got == "" || got == "0" {
+		t.Errorf("Expected a non-zero X-Bandwidth-Wait-Ms, got %q", got)
+	}
+}
+
+// TestPreload tests that preloaded buckets start with the configured tokens instead of a full burst
+func TestPreload(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "50KB" // 50 KB/s
+	cfg.BurstSize = "10KB"    // 10 KB burst
+	cfg.Preload = []bandwidthlimiter.PreloadBucket{
+		{ClientIP: "10.0.0.200", InitialTokens: "0"},
+	}
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(remoteAddr string) time.Duration {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		start := time.Now()
+		handler.ServeHTTP(recorder, req)
+		return time.Since(start)
+	}
+
+	// A regular client fits in its fresh burst
+	if elapsed := serve("10.0.0.201:12345"); elapsed > 100*time.Millisecond {
+		t.Errorf("Regular client should be served from its burst. Got %v", elapsed)
+	}
+
+	// The preloaded client has to wait for ~200ms of refill
+	if elapsed := serve("10.0.0.200:12345"); elapsed < 100*time.Millisecond {
+		t.Errorf("Preloaded client was not throttled. Got %v", elapsed)
+	}
+}
+
+// TestPreloadRules tests that preloaded buckets are the ones path and key
+// rules pay from, not the client's default bucket
+func TestPreloadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(cfg *bandwidthlimiter.Config)
+		preload bandwidthlimiter.PreloadBucket
+		target  string
+		header  http.Header
+	}{
+		{
+			"path rule",
+			func(cfg *bandwidthlimiter.Config) {
+				cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "/downloads/", Limit: "50KB"}}
+			},
+			bandwidthlimiter.PreloadBucket{ClientIP: "10.0.0.200", Path: "/downloads/big", InitialTokens: "0"},
+			"/downloads/big",
+			http.Header{},
+		},
+		{
+			"key rule",
+			func(cfg *bandwidthlimiter.Config) {
+				cfg.KeyHeader = "X-Api-Key"
+				cfg.KeyLimits["partner-secret"] = "50KB"
+			},
+			bandwidthlimiter.PreloadBucket{ClientIP: "10.0.0.200", Headers: map[string]string{"X-Api-Key": "partner-secret"}, InitialTokens: "0"},
+			"/",
+			http.Header{"X-Api-Key": {"partner-secret"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = "50KB"
+			cfg.BurstSize = "10KB"
+			tt.config(cfg)
+			cfg.Preload = []bandwidthlimiter.PreloadBucket{tt.preload}
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write(make([]byte, 10*1024))
+			})
+			handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+			serve := func(target string, header http.Header) time.Duration {
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				req.RemoteAddr = "10.0.0.200:12345"
+				for name, values := range header {
+					req.Header[name] = values
+				}
+				start := time.Now()
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				return time.Since(start)
+			}
+
+			// The client's default bucket wasn't preloaded
+			if elapsed := serve("/other", nil); elapsed > 100*time.Millisecond {
+				t.Errorf("Expected the default bucket to serve from its burst, took %v", elapsed)
+			}
+
+			// The rule's bucket has to wait for ~200ms of refill
+			if elapsed := serve(tt.target, tt.header); elapsed < 100*time.Millisecond {
+				t.Errorf("Expected the preloaded rule bucket to throttle, took %v", elapsed)
+			}
+		})
+	}
+}
+
+// TestPersistenceReadOnly tests that a read-only instance never writes the persistence file
+func TestPersistenceReadOnly(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+	original := []byte("[]\n")
+	if err := os.WriteFile(tempFile, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = tempFile
+	cfg.PersistenceReadOnly = true
+	cfg.SaveInterval = "1s"
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("test"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a bucket that would normally be saved
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	handler.ServeHTTP(recorder, req)
+
+	handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	content, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(original) {
+		t.Errorf("Read-only persistence file was modified: %q", content)
+	}
+}
+
+// TestPersistenceDropStale tests that restored buckets no longer matching the configuration are dropped
+func TestPersistenceDropStale(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+	now := time.Now()
+	states := []limiter.State{
+		{Key: "192.168.1.1:default", Tokens: 4096, Limit: 1048576, BurstSize: 4096, LastRefill: now, LastUsed: now},
+		{Key: "192.168.1.2:default", Tokens: 4096, Limit: 2048, BurstSize: 4096, LastRefill: now, LastUsed: now},
+		{Key: "*:removed-backend", Tokens: 4096, Limit: 1048576, BurstSize: 4096, LastRefill: now, LastUsed: now},
+	}
+	if err := limiter.WriteSnapshot(tempFile, states); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.BurstSize = "4KB"
+	cfg.PersistenceFile = tempFile
+	cfg.PersistenceDropStale = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("test"))
+	})
+
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	saved, err := limiter.ReadSnapshot(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Key != "192.168.1.1:default" {
+		t.Errorf("Expected only the matching bucket to survive, got %+v", saved)
+	}
+}
+
+// TestPersistenceFallback tests that an unwritable persistence file falls back to the alternate path or memory
+func TestPersistenceFallback(t *testing.T) {
+	dir := t.TempDir()
+
+	// A regular file where the persistence directory should be makes it unwritable, even for root
+	if err := os.WriteFile(dir+"/readonly", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("test"))
+	})
+
+	tests := []struct {
+		name     string
+		fallback string
+	}{
+		{"fallback file", dir + "/fallback/buckets.json"},
+		{"memory only", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.PersistenceFile = dir + "/readonly/buckets.json"
+			cfg.PersistenceFallbackFile = tt.fallback
+
+			handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", recorder.Code)
+			}
+
+			handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+			if tt.fallback != "" {
+				saved, err := limiter.ReadSnapshot(tt.fallback)
+				if err != nil || len(saved) != 1 {
+					t.Errorf("Expected 1 bucket saved to the fallback file, got %d (%v)", len(saved), err)
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentRequestsAndCleanup exercises requests racing with cleanup and saves, run it with -race
+func TestConcurrentRequestsAndCleanup(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.BucketMaxAge = "1s"
+	cfg.CleanupInterval = "1s"
+	cfg.SaveInterval = "1s"
+	cfg.PersistenceFile = t.TempDir() + "/test-buckets.json"
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("test"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	// Keep a few clients busy across several cleanup and save runs
+	deadline := time.Now().Add(2500 * time.Millisecond)
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			for time.Now().Before(deadline) {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+				req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+// TestEmptyResponsesSkipBuckets tests that bodiless responses never create buckets
+func TestEmptyResponsesSkipBuckets(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = tempFile
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/not-modified":
+			rw.WriteHeader(http.StatusNotModified)
+		case "/no-content":
+			rw.WriteHeader(http.StatusNoContent)
+		case "/empty":
+			rw.Write(nil)
+		default:
+			rw.Write([]byte("body"))
+		}
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, path, remoteAddr string) {
+		req, _ := http.NewRequestWithContext(ctx, method, path, nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(http.MethodGet, "/not-modified", "10.0.0.1:12345")
+	serve(http.MethodGet, "/no-content", "10.0.0.2:12345")
+	serve(http.MethodGet, "/empty", "10.0.0.3:12345")
+	serve(http.MethodHead, "/", "10.0.0.4:12345")
+	serve(http.MethodGet, "/", "10.0.0.5:12345")
+
+	// The final save on shutdown shows which buckets were created
+	handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	content, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if strings.Contains(string(content), ip) {
+			t.Errorf("Bodiless response for %s should not have created a bucket", ip)
+		}
+	}
+	if !strings.Contains(string(content), "10.0.0.5") {
+		t.Error("Response with a body should have created a bucket")
+	}
+}
+
+// TestBackendAggregateLimits tests that all clients of a backend share its aggregate bucket
+func TestBackendAggregateLimits(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB" // Per-client limits are never the bottleneck here
+	cfg.BurstSize = "10KB"    // 10 KB burst
+	cfg.BackendAggregateLimits = map[string]bandwidthlimiter.Size{
+		"small.local": "50KB", // 50 KB/s for all clients together
+	}
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 20*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		go func(ip string) {
+			defer func() { done <- struct{}{} }()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://small.local/", nil)
+			req.RemoteAddr = ip + ":12345"
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}(ip)
+	}
+	<-done
+	<-done
+	elapsed := time.Since(start)
+
+	// 40 KB in total minus the 10 KB burst takes ~600ms at 50 KB/s
+	minExpectedTime := 400 * time.Millisecond
+	if elapsed < minExpectedTime {
+		t.Errorf("Backend aggregate limit was not enforced. Expected >%v, got %v", minExpectedTime, elapsed)
+	}
+}
+
+// TestClientBucketScope tests that a client-scoped bucket is shared across backends
+func TestClientBucketScope(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "50KB" // 50 KB/s
+	cfg.BurstSize = "10KB"    // 10 KB burst
+	cfg.BucketScope = "client"
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(url string) time.Duration {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return time.Since(start)
+	}
+
+	// The first backend uses up the client's burst
+	serve("http://first.local/")
+
+	// A different backend must not get a fresh burst
+	if elapsed := serve("http://second.local/"); elapsed < 100*time.Millisecond {
+		t.Errorf("Client bucket was not shared across backends. Got %v", elapsed)
+	}
+}
+
+func TestRouteCosts(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "50KB" // 50 KB/s
+	cfg.BurstSize = "20KB"    // 20 KB burst
+	cfg.RouteCosts = map[string]float64{
+		"/export": 2,
+	}
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(url string) time.Duration {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return time.Since(start)
+	}
+
+	// 10 KB from /export costs the whole 20 KB burst
+	serve("http://backend.local/export/report.csv")
+
+	// So a regular request right after has to wait for tokens
+	if elapsed := serve("http://backend.local/index.html"); elapsed < 100*time.Millisecond {
+		t.Errorf("Route cost multiplier was not applied. Got %v", elapsed)
+	}
+
+	cfg.RouteCosts = map[string]float64{"/export": 0}
+	if _, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for non-positive route cost")
+	}
+}
+
+func TestMaxConcurrentTransfers(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.MaxConcurrentTransfers = 1
+	cfg.QueueMaxWait = bandwidthlimiter.Milliseconds(20)
+	cfg.ClientQueueMaxWaits = map[string]bandwidthlimiter.ShortDuration{
+		"10.0.0.2": "1s",
+	}
+
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			close(started)
+			<-finish
+		}
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(remote, path string) int {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local"+path, nil)
+		req.RemoteAddr = remote
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	go serve("10.0.0.1:1000", "/slow")
+	<-started
+
+	// The default queue wait expires while the slot is busy
+	if code := serve("10.0.0.3:1000", "/"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d after queue wait, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	// A client with a longer queue wait gets the slot once it is freed
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(finish)
+	}()
+	if code := serve("10.0.0.2:1000", "/"); code != http.StatusOK {
+		t.Errorf("Expected queued request to succeed, got %d", code)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.MaxConcurrent = 2
+	cfg.MaxConcurrentQueue = 1
+	cfg.QueueMaxWait = "1s"
+
+	ctx := context.Background()
+
+	started := make(chan struct{}, 2)
+	finish := make(chan struct{})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-finish
+		}
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(remote string) int {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/slow", nil)
+		req.RemoteAddr = remote
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Two transfers fill the client's slots, a third one queues
+	for i := 0; i < 2; i++ {
+		go serve("10.0.0.1:1000")
+		<-started
+	}
+	queued := make(chan int, 1)
+	go func() {
+		queued <- serve("10.0.0.1:1000")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The queue is full, so a fourth one is turned away
+	if code := serve("10.0.0.1:1000"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d with a full queue, got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Other clients have slots of their own
+	go func() {
+		<-started
+		close(finish)
+	}()
+	if code := serve("10.0.0.2:1000"); code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", code)
+	}
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("Expected the queued request to be served, got %d", code)
+	}
+}
+
+func TestRuleLabels(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.AccessLogHeaders = true
+	cfg.RuleLabels = map[string]string{
+		"10.0.0.1":  "partner-acme",
+		"api.local": "public-api",
+	}
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"10.0.0.1:1000", "partner-acme"}, // Client label wins over the backend label
+		{"10.0.0.2:1000", "public-api"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://api.local/", nil)
+		req.RemoteAddr = tt.remote
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got := req.Header.Get("X-Bandwidth-Label"); got != tt.want {
+			t.Errorf("Unexpected X-Bandwidth-Label for %s. Expected %q, got %q", tt.remote, tt.want, got)
+		}
+	}
+}
+
+func TestMinRate(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1"     // Practically no refill
+	cfg.BurstSize = "4KB"      // Used up by the first chunk
+	cfg.DefaultMinRate = "1KB" // But keep 1 KB/s flowing
+
+	ctx := context.Background()
+
+	written := make(chan int, 1)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n, _ := rw.Write(make([]byte, 4096+1024))
+		written <- n
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	go handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Without the floor the last 1 KB would wait over an hour for tokens
+	select {
+	case n := <-written:
+		if n != 4096+1024 {
+			t.Errorf("Expected %d bytes written, got %d", 4096+1024, n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Minimum rate did not keep the response going")
+	}
+
+	cfg.DefaultMinRate = "-1"
+	if _, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for negative defaultMinRate")
+	}
+}
+
+func TestUnlimitedSentinel(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10KB" // 10 KB/s
+	cfg.BurstSize = "4KB"     // 4 KB burst
+	cfg.ClientLimits = map[string]bandwidthlimiter.Size{
+		"10.0.0.1": "-1",
+	}
+	cfg.AccessLogHeaders = true
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 100*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Unlimited client was throttled, took %v", elapsed)
+	}
+
+	// The request never went through the limiter
+	if got := req.Header.Get("X-Bandwidth-Key"); got != "" {
+		t.Errorf("Expected no limiter headers for unlimited client, got key %q", got)
+	}
+
+	cfg.ClientLimits = map[string]bandwidthlimiter.Size{"10.0.0.1": "-2"}
+	if _, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for negative client limit other than -1")
+	}
+}
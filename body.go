@@ -0,0 +1,128 @@
+package bandwidthlimiter
+
+import (
+	"io"
+	"net/http"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// limitedRequestBody wraps a request body to apply bandwidth limiting to uploads
+type limitedRequestBody struct {
+	io.ReadCloser
+	buckets []limiter.Consumer // All buckets a chunk must be paid from
+	stats   *RequestStats      // Bytes read and upload waits of the request
+	waits   *tokenWaits        // What chunks wait for tokens with
+	
+	// Most bytes read and paid for at a time, never above the upload burst
+	chunkSize int64
+	
+	bind func() // Binds buckets on the first read that returns data, nil once bound
+}
+
+// Read reads at most one chunk and waits until its bytes are paid for, so the
+// backend, and through TCP backpressure the client, only see the limited rate
+func (lrb *limitedRequestBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > lrb.chunkSize {
+		p = p[:lrb.chunkSize]
+	}
+	
+	n, err := lrb.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	
+	if lrb.bind != nil {
+		lrb.bind()
+		lrb.bind = nil
+	}
+	
+	// Wait until we have tokens available, failing the read if the wait is
+	// cut short so the backend stops reading
+	if !limiter.ConsumeAll(lrb.buckets, int64(n)) {
+		waitStart := time.Now()
+		ctx, cancel := lrb.waits.chunk()
+		waitErr := limiter.ConsumeAllWait(ctx, lrb.buckets, int64(n), leaseRetryInterval)
+		cancel()
+		lrb.stats.UploadWait += time.Since(waitStart)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	lrb.stats.BytesRead += int64(n)
+	return n, err
+}
+
+// limitUpload wraps the request body in upload buckets, which are independent of
+// the download buckets. Requests without a body are left untouched.
+func (bl *BandwidthLimiter) limitUpload(req *http.Request, stats *RequestStats, refs *entryRefs, waits *tokenWaits) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	
+	decision := stats.Decision
+	key := bl.uploadKey(decision)
+	policy := bl.uploadPolicy(decision)
+	if policy.Limit == Unlimited {
+		return
+	}
+	
+	// Chunks are sized like those of responses, and small enough for the
+	// upload burst to cover one
+	chunkSize := limiter.ChunkForBurst(bl.parsed.chunkSize, policy.Burst)
+	if bl.parsed.autoChunkSize {
+		chunkSize = limiter.AutoChunkSize(policy.Limit, policy.Burst)
+	}
+	
+	lrb := &limitedRequestBody{ReadCloser: req.Body, stats: stats, waits: waits, chunkSize: chunkSize}
+	lrb.bind = func() {
+		lrb.buckets = bl.consumers(key, policy, refs)
+	}
+	req.Body = lrb
+}
+
+// uploadKey returns the key of the upload bucket a request's body is paid from
+func (bl *BandwidthLimiter) uploadKey(decision Decision) string {
+	return bl.sideKey(decision, directionUpload)
+}
+
+// sideKey returns the key of a request's bucket in a direction other than
+// downloads, with the same rule suffixes as its download bucket
+func (bl *BandwidthLimiter) sideKey(decision Decision, dir direction) string {
+	var key keyBuilder
+	bl.buildBucketKey(&key, decision.ClientID, decision.Backend, dir)
+	if decision.Policy.Class == limitClassPath {
+		pathKey(&key, decision.pathRule)
+	}
+	if decision.EntryPoint != "" {
+		entryPointKey(&key, decision.EntryPoint)
+	}
+	if decision.Policy.Class == limitClassAnonymous {
+		anonymousKey(&key)
+	}
+	if decision.Reputation != "" {
+		reputationKey(&key, decision.Reputation)
+	}
+	if decision.Tier != "" {
+		tierKey(&key, decision.Tier)
+	}
+	return key.String()
+}
+
+// uploadPolicy derives the upload limits of a request from its download
+// policy, which supplies the limit unless an upload limit is configured. Per-minute
+// budgets only apply to downloads.
+func (bl *BandwidthLimiter) uploadPolicy(decision Decision) limiter.Policy {
+	return bl.uploadPolicyFor(decision.ClientIP, decision.Backend, decision.Policy)
+}
+
+// uploadPolicyFor derives the upload limits of a client and backend from their
+// download policy, see uploadPolicy
+func (bl *BandwidthLimiter) uploadPolicyFor(clientIP, backend string, policy limiter.Policy) limiter.Policy {
+	if limit := bl.getUploadLimit(clientIP, backend); limit != 0 {
+		policy.Limit = limit
+	}
+	policy.MinuteLimit = 0
+	return policy
+}
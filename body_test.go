@@ -0,0 +1,209 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestLimitUploads tests that request bodies are throttled by their own upload limit
+func TestLimitUploads(t *testing.T) {
+	tests := []struct {
+		name         string
+		limitUploads bool
+		minDuration  time.Duration
+		maxDuration  time.Duration
+	}{
+		{"uploads limited", true, 800 * time.Millisecond, 2 * time.Second},
+		{"uploads unlimited", false, 0, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = "1MB" // Downloads are fast
+			cfg.BurstSize = "4KB"
+			cfg.LimitUploads = tt.limitUploads
+			cfg.UploadLimit = "8KB" // 8 KB/s uploads
+
+			var received int
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				received = len(body)
+				rw.Write([]byte("ok"))
+			})
+
+			handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 4 KB burst plus 8 KB at 8 KB/s is about one second
+			upload := make([]byte, 12*1024)
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/upload", bytes.NewReader(upload))
+
+			start := time.Now()
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			elapsed := time.Since(start)
+
+			if received != len(upload) || recorder.Body.String() != "ok" {
+				t.Errorf("Expected %d bytes uploaded and an ok response, got %d and %q", len(upload), received, recorder.Body.String())
+			}
+			if elapsed < tt.minDuration || elapsed > tt.maxDuration {
+				t.Errorf("Expected upload to take between %v and %v, took %v", tt.minDuration, tt.maxDuration, elapsed)
+			}
+		})
+	}
+}
+
+// TestLimitUploadsSmallBurst tests that upload reads shrink to a burst below
+// the chunk size instead of waiting for tokens the bucket can never hold
+func TestLimitUploadsSmallBurst(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.BurstSize = "1KB"
+	cfg.LimitUploads = true
+	cfg.UploadLimit = "8KB"
+	cfg.MaxChunkWait = "2s"
+
+	var received int
+	var readErr error
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		received, readErr = len(body), err
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	// 1 KB burst plus 7 KB at 8 KB/s is under a second
+	upload := make([]byte, 8*1024)
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/upload", bytes.NewReader(upload))
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if received != len(upload) || readErr != nil {
+		t.Errorf("Expected %d bytes uploaded, got %d and %v", len(upload), received, readErr)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the upload to take about a second, took %v", elapsed)
+	}
+}
+
+// TestUploadLimitRules tests that client and backend upload limits take
+// precedence over UploadLimit, the way client and backend limits do
+func TestUploadLimitRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucketScope string
+		query       string
+		want        string
+	}{
+		{"default upload limit", "", "ip=1.2.3.4", `"uploadLimit":8192`},
+		{"client upload limit", "", "ip=10.0.0.1&host=api.example.com", `"uploadLimit":16384`},
+		{"unlimited client uploads", "", "ip=10.0.0.2", `"uploadLimit":-1`},
+		{"backend upload limit", "", "ip=1.2.3.4&host=api.example.com", `"uploadLimit":4096`},
+		{"backend ignored per client", "client", "ip=1.2.3.4&host=api.example.com", `"uploadLimit":8192`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.LimitUploads = true
+			cfg.UploadLimit = "8KB"
+			cfg.ClientUploadLimits["10.0.0.1"] = "16KB"
+			cfg.ClientUploadLimits["10.0.0.2"] = "unlimited"
+			cfg.BackendUploadLimits["api.example.com"] = "4KB"
+			if tt.bucketScope != "" {
+				cfg.BucketScope = tt.bucketScope
+			}
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+			handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+			defer bl.Shutdown()
+
+			recorder := httptest.NewRecorder()
+			bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/simulate?"+tt.query, nil))
+			if !strings.Contains(recorder.Body.String(), tt.want) {
+				t.Errorf("Expected %s, got %s", tt.want, recorder.Body.String())
+			}
+		})
+	}
+}
+
+// TestClientUploadLimits tests that request bodies are paid at the client's
+// own upload limit, and that the waits show up in the metrics
+func TestClientUploadLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientLimit bandwidthlimiter.Size
+		uploadLimit bandwidthlimiter.Size
+		minDuration time.Duration
+		maxDuration time.Duration
+		waits       int
+	}{
+		{"client limit below uploadLimit", "8KB", "1MB", 800 * time.Millisecond, 2 * time.Second, 1},
+		{"unlimited client", "unlimited", "1KB", 0, 500 * time.Millisecond, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = "1MB"
+			cfg.BurstSize = "4KB"
+			cfg.LimitUploads = true
+			cfg.UploadLimit = tt.uploadLimit
+			cfg.ClientUploadLimits["192.0.2.1"] = tt.clientLimit // httptest's client
+
+			var received int
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				received = len(body)
+			})
+			handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+			defer bl.Shutdown()
+
+			// 4 KB burst plus 8 KB at 8 KB/s is about one second
+			upload := make([]byte, 12*1024)
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/upload", bytes.NewReader(upload))
+			start := time.Now()
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			elapsed := time.Since(start)
+
+			if received != len(upload) {
+				t.Errorf("Expected %d bytes uploaded, got %d", len(upload), received)
+			}
+			if elapsed < tt.minDuration || elapsed > tt.maxDuration {
+				t.Errorf("Expected upload to take between %v and %v, took %v", tt.minDuration, tt.maxDuration, elapsed)
+			}
+
+			var metrics bytes.Buffer
+			if err := bl.WriteMetrics(&metrics); err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("bwl_upload_throttle_seconds_count %d\n", tt.waits)
+			if !strings.Contains(metrics.String(), want) {
+				t.Errorf("Expected %q in metrics, got:\n%s", want, metrics.String())
+			}
+		})
+	}
+}
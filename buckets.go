@@ -0,0 +1,249 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// BucketInfo is a snapshot of a local bucket, as returned by Buckets and
+// Lookup and served by the admin listener
+type BucketInfo struct {
+	Key         string         `json:"key"`
+	Label       string         `json:"label,omitempty"`
+	Tokens      int64          `json:"tokens"` // Available right now
+	Limit       int64          `json:"limit"`
+	Burst       int64          `json:"burst"`
+	Minute      *WindowInfo    `json:"minute,omitempty"`
+	Transferred int64          `json:"transferred"` // Body bytes paid since the bucket was created
+	Created     time.Time      `json:"created"`
+	LastUsed    time.Time      `json:"lastUsed"`
+	InUse       bool           `json:"inUse"`
+	Override    *LimitOverride `json:"override,omitempty"` // Limit set with SetKeyLimit
+}
+
+// WindowInfo describes the per-minute bucket of a BucketInfo
+type WindowInfo struct {
+	Tokens int64 `json:"tokens"`
+	Limit  int64 `json:"limit"`
+}
+
+// BucketUsage sums up the local buckets of a target, as returned by Usage
+type BucketUsage struct {
+	Buckets     int       `json:"buckets"`
+	InUse       int       `json:"inUse"`       // Buckets with a request in flight
+	Transferred int64     `json:"transferred"` // Body bytes paid through all of them
+	LastUsed    time.Time `json:"lastUsed"`    // Zero without buckets
+}
+
+// newBucketInfo describes a stored entry
+func (bl *BandwidthLimiter) newBucketInfo(entry *limiter.Entry) BucketInfo {
+	state := entry.Bucket.State()
+	info := BucketInfo{
+		Key:         entry.Key,
+		Label:       entry.Label,
+		Tokens:      entry.Bucket.Available(),
+		Limit:       state.Limit,
+		Burst:       state.BurstSize,
+		Transferred: entry.Transferred(),
+		Created:     entry.Created(),
+		LastUsed:    entry.LastUsed(),
+		InUse:       entry.InUse(),
+	}
+	if entry.Window != nil {
+		info.Minute = &WindowInfo{Tokens: entry.Window.Available(), Limit: entry.Window.State().BurstSize}
+	}
+	if override, ok := bl.keyLimit(entry.Key); ok {
+		info.Override = &override
+	}
+	return info
+}
+
+// bucketInfos describes the local buckets match selects, ordered by key
+func (bl *BandwidthLimiter) bucketInfos(match func(key string) bool) []BucketInfo {
+	infos := []BucketInfo{}
+	bl.buckets.Range(func(entry *limiter.Entry) bool {
+		if match == nil || match(entry.Key) {
+			infos = append(infos, bl.newBucketInfo(entry))
+		}
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// Buckets returns a snapshot of all local buckets, ordered by key. With a
+// shared store, buckets of other instances aren't included.
+func (bl *BandwidthLimiter) Buckets() []BucketInfo {
+	return bl.bucketInfos(nil)
+}
+
+// SelectBuckets returns a snapshot of the local buckets selected by target,
+// which is either an exact bucket key, a client IP or a CIDR, ordered by key
+func (bl *BandwidthLimiter) SelectBuckets(target string) ([]BucketInfo, error) {
+	match, err := bl.bucketMatcher(target)
+	if err != nil {
+		return nil, err
+	}
+	return bl.bucketInfos(match), nil
+}
+
+// RangeBuckets calls fn with a snapshot of every local bucket, in no
+// particular order, until fn returns false. Unlike Buckets, it doesn't hold
+// all of them at once, which suits limiters with many clients.
+func (bl *BandwidthLimiter) RangeBuckets(fn func(info BucketInfo) bool) {
+	bl.buckets.Range(func(entry *limiter.Entry) bool {
+		return fn(bl.newBucketInfo(entry))
+	})
+}
+
+// Lookup returns a snapshot of the local bucket with key, e.g.
+// "10.0.0.1:backend.local", and whether it exists
+func (bl *BandwidthLimiter) Lookup(key string) (BucketInfo, bool) {
+	entry, ok := bl.buckets.Load(key)
+	if !ok {
+		return BucketInfo{}, false
+	}
+	return bl.newBucketInfo(entry), true
+}
+
+// Usage sums up the local buckets selected by target, which is either an
+// exact bucket key, a client IP or a CIDR, e.g. the bytes a client
+// transferred through all backends
+func (bl *BandwidthLimiter) Usage(target string) (BucketUsage, error) {
+	usage := BucketUsage{}
+	if target == "" {
+		return usage, wrapf(ErrInvalidLimit, "usage target must not be empty")
+	}
+	match, err := bl.bucketMatcher(target)
+	if err != nil {
+		return usage, err
+	}
+	
+	bl.buckets.Range(func(entry *limiter.Entry) bool {
+		if !match(entry.Key) {
+			return true
+		}
+		usage.Buckets++
+		if entry.InUse() {
+			usage.InUse++
+		}
+		usage.Transferred += entry.Transferred()
+		if lastUsed := entry.LastUsed(); lastUsed.After(usage.LastUsed) {
+			usage.LastUsed = lastUsed
+		}
+		return true
+	})
+	return usage, nil
+}
+
+// ResetBucket refills the buckets selected by target, which is either an exact
+// bucket key, a client IP or a CIDR, to their full burst. Unlike Purge, the
+// buckets keep their history. It returns the number of reset buckets.
+func (bl *BandwidthLimiter) ResetBucket(target string) (int, error) {
+	if target == "" {
+		return 0, wrapf(ErrInvalidLimit, "reset target must not be empty")
+	}
+	match, err := bl.bucketMatcher(target)
+	if err != nil {
+		return 0, err
+	}
+	
+	reset := 0
+	bl.buckets.Range(func(entry *limiter.Entry) bool {
+		if match(entry.Key) {
+			entry.Refill()
+			reset++
+		}
+		return true
+	})
+	
+	bl.log.infof("Reset %d buckets matching %s", reset, target)
+	return reset, nil
+}
+
+// handleBuckets serves GET /buckets?target=<key|ip|cidr>, the local buckets
+// of target or all of them
+func (bl *BandwidthLimiter) handleBuckets(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	infos := bl.Buckets()
+	if target := req.URL.Query().Get("target"); target != "" {
+		var err error
+		if infos, err = bl.SelectBuckets(target); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(infos)
+}
+
+// handleBucketUsage serves GET /buckets/usage?key=<key>, the usage of one bucket
+func (bl *BandwidthLimiter) handleBucketUsage(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	info, ok := bl.Lookup(req.URL.Query().Get("key"))
+	if !ok {
+		http.Error(rw, "no such bucket", http.StatusNotFound)
+		return
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(info)
+}
+
+// handleKeyLimit serves PUT /buckets/limit?key=<key>&limit=<size>[&burst=<size>],
+// which sets the limit of a bucket key, and DELETE /buckets/limit?key=<key>,
+// which returns it to its rule
+func (bl *BandwidthLimiter) handleKeyLimit(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	key := query.Get("key")
+	
+	switch req.Method {
+	case http.MethodPut:
+		if err := bl.SetKeyLimit(key, Size(query.Get("limit")), Size(query.Get("burst"))); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		override, _ := bl.keyLimit(key)
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(override)
+	case http.MethodDelete:
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]bool{"cleared": bl.ClearKeyLimit(key)})
+	default:
+		rw.Header().Set("Allow", http.MethodPut+", "+http.MethodDelete)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReset serves POST /buckets/reset?target=<key|ip|cidr>
+func (bl *BandwidthLimiter) handleReset(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	reset, err := bl.ResetBucket(req.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"reset": reset})
+}
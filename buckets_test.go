@@ -0,0 +1,240 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// bucketInfo is the JSON the admin listener describes buckets with
+type bucketInfo struct {
+	Key         string `json:"key"`
+	Tokens      int64  `json:"tokens"`
+	Limit       int64  `json:"limit"`
+	Burst       int64  `json:"burst"`
+	Transferred int64  `json:"transferred"`
+	Override    *struct {
+		Limit int64 `json:"limit"`
+		Burst int64 `json:"burst"`
+	} `json:"override"`
+}
+
+// newAdminLimiter returns a limiter at 1KB/s with a 4KB burst whose backend
+// sends 1KB, with two clients' buckets created
+func newAdminLimiter(t *testing.T, cfg *bandwidthlimiter.Config) (*bandwidthlimiter.BandwidthLimiter, http.Handler) {
+	cfg.DefaultLimit = "1KB"
+	cfg.BurstSize = "4KB"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	t.Cleanup(bl.Shutdown)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.1.1"} {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = ip + ":1000"
+		bl.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	return bl, bl.AdminHandler()
+}
+
+// adminRequest sends a request to the admin handler and decodes its JSON
+// response into v, if given
+func adminRequest(t *testing.T, admin http.Handler, method, target string, status int, v interface{}) {
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	if recorder.Code != status {
+		t.Fatalf("%s %s: expected %d, got %d: %s", method, target, status, recorder.Code, recorder.Body.String())
+	}
+	if v != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+}
+
+// TestAdminBuckets tests listing buckets and viewing one bucket's usage
+func TestAdminBuckets(t *testing.T) {
+	_, admin := newAdminLimiter(t, bandwidthlimiter.CreateConfig())
+
+	var buckets []bucketInfo
+	adminRequest(t, admin, http.MethodGet, "/buckets", http.StatusOK, &buckets)
+	if len(buckets) != 2 || buckets[0].Key != "10.0.0.1:backend.local" || buckets[1].Key != "10.0.1.1:backend.local" {
+		t.Fatalf("Expected both buckets ordered by key, got %+v", buckets)
+	}
+
+	adminRequest(t, admin, http.MethodGet, "/buckets?target=10.0.1.0/24", http.StatusOK, &buckets)
+	if len(buckets) != 1 || buckets[0].Key != "10.0.1.1:backend.local" {
+		t.Errorf("Expected the bucket in the CIDR, got %+v", buckets)
+	}
+
+	var usage bucketInfo
+	adminRequest(t, admin, http.MethodGet, "/buckets/usage?key=10.0.0.1:backend.local", http.StatusOK, &usage)
+	if usage.Transferred != 1024 || usage.Limit != 1024 || usage.Burst != 4*1024 || usage.Tokens >= usage.Burst {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	adminRequest(t, admin, http.MethodGet, "/buckets/usage?key=10.0.0.9:backend.local", http.StatusNotFound, nil)
+	adminRequest(t, admin, http.MethodGet, "/buckets?target=not/a/cidr", http.StatusBadRequest, nil)
+}
+
+// TestBucketQueries tests the Go API for querying buckets without the admin
+// listener
+func TestBucketQueries(t *testing.T) {
+	bl, _ := newAdminLimiter(t, bandwidthlimiter.CreateConfig())
+
+	buckets := bl.Buckets()
+	if len(buckets) != 2 || buckets[0].Key != "10.0.0.1:backend.local" || buckets[1].Key != "10.0.1.1:backend.local" {
+		t.Fatalf("Expected both buckets ordered by key, got %+v", buckets)
+	}
+	buckets, err := bl.SelectBuckets("10.0.1.0/24")
+	if err != nil || len(buckets) != 1 || buckets[0].Key != "10.0.1.1:backend.local" {
+		t.Errorf("Expected the bucket in the CIDR, got %+v: %v", buckets, err)
+	}
+	if _, err := bl.SelectBuckets("not/a/cidr"); err == nil {
+		t.Error("Expected an error for an invalid CIDR")
+	}
+
+	seen := 0
+	bl.RangeBuckets(func(info bandwidthlimiter.BucketInfo) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Errorf("Expected ranging to stop after the first bucket, saw %d", seen)
+	}
+
+	info, ok := bl.Lookup("10.0.0.1:backend.local")
+	if !ok || info.Transferred != 1024 || info.Limit != 1024 || info.Burst != 4*1024 || info.Override != nil {
+		t.Errorf("Unexpected bucket %+v", info)
+	}
+	if _, ok := bl.Lookup("10.0.0.9:backend.local"); ok {
+		t.Error("Expected no bucket for an unknown key")
+	}
+
+	// Snapshots don't change with the bucket
+	if err := bl.SetKeyLimit("10.0.0.1:backend.local", "2KB", ""); err != nil {
+		t.Fatal(err)
+	}
+	if info.Override != nil {
+		t.Error("Expected the snapshot to be left alone")
+	}
+	if info, _ := bl.Lookup("10.0.0.1:backend.local"); info.Override == nil || info.Override.Limit != 2048 {
+		t.Errorf("Expected the override in a new snapshot, got %+v", info.Override)
+	}
+
+	usage, err := bl.Usage("10.0.0.0/16")
+	if err != nil || usage.Buckets != 2 || usage.Transferred != 2*1024 || usage.InUse != 0 || usage.LastUsed.IsZero() {
+		t.Errorf("Unexpected usage %+v: %v", usage, err)
+	}
+	if usage, err := bl.Usage("10.0.0.9"); err != nil || usage.Buckets != 0 || !usage.LastUsed.IsZero() {
+		t.Errorf("Expected no usage for an unknown client, got %+v: %v", usage, err)
+	}
+	if _, err := bl.Usage(""); err == nil {
+		t.Error("Expected an error for an empty target")
+	}
+}
+
+// TestAdminKeyLimit tests that limits set at runtime replace the rule of a key
+// and its existing bucket until they are cleared
+func TestAdminKeyLimit(t *testing.T) {
+	bl, admin := newAdminLimiter(t, bandwidthlimiter.CreateConfig())
+	key := "10.0.0.1:backend.local"
+
+	adminRequest(t, admin, http.MethodPut, "/buckets/limit?key="+key+"&limit=fast", http.StatusBadRequest, nil)
+	adminRequest(t, admin, http.MethodPut, "/buckets/limit?limit=100KB", http.StatusBadRequest, nil)
+	adminRequest(t, admin, http.MethodPost, "/buckets/limit?key="+key+"&limit=100KB", http.StatusMethodNotAllowed, nil)
+
+	adminRequest(t, admin, http.MethodPut, "/buckets/limit?key="+key+"&limit=100KB", http.StatusOK, nil)
+	if decision := decideFor(bl, "10.0.0.1"); decision.Policy.Limit != 100*1024 || decision.Policy.Burst != 100*1024 || !decision.Overridden {
+		t.Errorf("Expected the runtime limit with a one second burst, got %+v", decision)
+	}
+	if decision := decideFor(bl, "10.0.1.1"); decision.Policy.Limit != 1024 || decision.Overridden {
+		t.Errorf("Expected other keys to keep their rule, got %+v", decision)
+	}
+
+	// The existing bucket takes on the limit on its next use
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	bl.ServeHTTP(httptest.NewRecorder(), req)
+	var usage bucketInfo
+	adminRequest(t, admin, http.MethodGet, "/buckets/usage?key="+key, http.StatusOK, &usage)
+	if usage.Limit != 100*1024 || usage.Burst != 100*1024 || usage.Transferred != 2048 || usage.Override == nil {
+		t.Errorf("Expected the bucket to follow the runtime limit, got %+v", usage)
+	}
+
+	var cleared map[string]bool
+	adminRequest(t, admin, http.MethodDelete, "/buckets/limit?key="+key, http.StatusOK, &cleared)
+	if !cleared["cleared"] {
+		t.Error("Expected the runtime limit to be cleared")
+	}
+	if decision := decideFor(bl, "10.0.0.1"); decision.Policy.Limit != 1024 || decision.Overridden {
+		t.Errorf("Expected the rule's limit again, got %+v", decision)
+	}
+	if bl.ClearKeyLimit(key) {
+		t.Error("Expected nothing left to clear")
+	}
+
+	if err := bl.SetKeyLimit(key, "unlimited", ""); err != nil {
+		t.Fatal(err)
+	}
+	if limit := decideFor(bl, "10.0.0.1").Policy.Limit; limit != bandwidthlimiter.Unlimited {
+		t.Errorf("Expected the key to be unlimited, got %d", limit)
+	}
+}
+
+// TestAdminReset tests that resetting refills buckets without removing them
+func TestAdminReset(t *testing.T) {
+	_, admin := newAdminLimiter(t, bandwidthlimiter.CreateConfig())
+
+	var reset map[string]int
+	adminRequest(t, admin, http.MethodPost, "/buckets/reset?target=10.0.0.1", http.StatusOK, &reset)
+	if reset["reset"] != 1 {
+		t.Errorf("Expected one bucket to be reset, got %v", reset)
+	}
+
+	var usage bucketInfo
+	adminRequest(t, admin, http.MethodGet, "/buckets/usage?key=10.0.0.1:backend.local", http.StatusOK, &usage)
+	if usage.Tokens != usage.Burst || usage.Transferred != 1024 {
+		t.Errorf("Expected a full bucket keeping its history, got %+v", usage)
+	}
+	adminRequest(t, admin, http.MethodGet, "/buckets/usage?key=10.0.1.1:backend.local", http.StatusOK, &usage)
+	if usage.Tokens == usage.Burst {
+		t.Error("Expected other buckets to be left alone")
+	}
+	adminRequest(t, admin, http.MethodPost, "/buckets/reset", http.StatusBadRequest, nil)
+}
+
+// TestAdminSaveCleanup tests triggering a save and a cleanup
+func TestAdminSaveCleanup(t *testing.T) {
+	_, admin := newAdminLimiter(t, bandwidthlimiter.CreateConfig())
+	adminRequest(t, admin, http.MethodPost, "/save", http.StatusConflict, nil)
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = filepath.Join(t.TempDir(), "buckets.json")
+	cfg.BucketMaxAge = "1ms"
+	_, admin = newAdminLimiter(t, cfg)
+
+	adminRequest(t, admin, http.MethodGet, "/save", http.StatusMethodNotAllowed, nil)
+	adminRequest(t, admin, http.MethodPost, "/save", http.StatusNoContent, nil)
+	if states, err := limiter.ReadSnapshot(cfg.PersistenceFile); err != nil || len(states) != 2 {
+		t.Errorf("Expected both buckets to be saved, got %+v, %v", states, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	var cleanup map[string]int
+	adminRequest(t, admin, http.MethodPost, "/cleanup", http.StatusOK, &cleanup)
+	if cleanup["removed"] != 2 || cleanup["kept"] != 0 {
+		t.Errorf("Expected both idle buckets to be removed, got %v", cleanup)
+	}
+}
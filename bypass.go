@@ -0,0 +1,36 @@
+package bandwidthlimiter
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// bypassed reports whether response headers carry one of the configured
+// bypass markers
+func (bl *BandwidthLimiter) bypassed(header http.Header) bool {
+	for name, want := range bl.config.BypassHeaders {
+		if value := header.Get(name); value != "" && (want == "" || value == want) {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassedRequest reports whether the request carries one of the configured
+// bypass markers, and removes them all before the request is passed on.
+// Clients can send any header, so on requests only markers with a configured
+// value count, which should be a secret only the middleware setting it knows.
+func (bl *BandwidthLimiter) bypassedRequest(req *http.Request) bool {
+	bypass := false
+	for name, want := range bl.config.BypassHeaders {
+		value := req.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if want != "" && subtle.ConstantTimeCompare([]byte(value), []byte(want)) == 1 {
+			bypass = true
+		}
+		req.Header.Del(name)
+	}
+	return bypass
+}
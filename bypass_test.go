@@ -0,0 +1,112 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestBypassHeaders tests that requests marked by another limiter skip bandwidth limiting
+func TestBypassHeaders(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "4KB"
+	cfg.BurstSize = "4KB"
+	cfg.BypassHeaders["X-RateLimit-Rejected"] = "true"
+	cfg.BypassHeaders["X-Upstream-Limited"] = ""
+
+	ctx := context.Background()
+	body := make([]byte, 16384)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/rejected":
+			rw.Header().Set("X-Upstream-Limited", "1")
+		case "/small":
+			rw.Write([]byte("ok"))
+			return
+		}
+		rw.Write(body)
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+	}{
+		{"request marker", "/", "true"},
+		{"response marker", "/rejected", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+tt.path, nil)
+			req.RemoteAddr = "10.0.0.1:12345"
+			if tt.header != "" {
+				req.Header.Set("X-RateLimit-Rejected", tt.header)
+			}
+
+			start := time.Now()
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected bypassed response to be unthrottled, took %v", elapsed)
+			}
+			if recorder.Body.Len() != len(body) {
+				t.Errorf("Expected %d bytes, got %d", len(body), recorder.Body.Len())
+			}
+			if removed, _ := bl.Purge("10.0.0.1"); removed != 0 {
+				t.Errorf("Expected no bucket for a bypassed request, got %d", removed)
+			}
+		})
+	}
+
+	// Clients can't bypass with a marker without a configured value, and
+	// the backend never sees request markers
+	var forwarded []string
+	spoofable, err := bandwidthlimiter.New(ctx, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = append(forwarded, req.Header.Get("X-Upstream-Limited"), req.Header.Get("X-RateLimit-Rejected"))
+		rw.Write([]byte("ok"))
+	}), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoofed := spoofable.(*bandwidthlimiter.BandwidthLimiter)
+	defer spoofed.Shutdown()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = "10.0.0.2:12345"
+	req.Header.Set("X-Upstream-Limited", "1")
+	spoofed.ServeHTTP(httptest.NewRecorder(), req)
+	if removed, _ := spoofed.Purge("10.0.0.2"); removed != 1 {
+		t.Errorf("Expected a bucket for a request with a client-sent marker, got %d", removed)
+	}
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = "10.0.0.2:12345"
+	req.Header.Set("X-RateLimit-Rejected", "true")
+	spoofed.ServeHTTP(httptest.NewRecorder(), req)
+	for _, value := range forwarded {
+		if value != "" {
+			t.Errorf("Expected request markers to be removed, the backend saw %q", forwarded)
+			break
+		}
+	}
+
+	// A marker with the wrong value doesn't bypass
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/small", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-RateLimit-Rejected", "false")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if removed, _ := bl.Purge("10.0.0.1"); removed != 1 {
+		t.Errorf("Expected a bucket for a request with a non-matching marker, got %d", removed)
+	}
+}
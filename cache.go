@@ -0,0 +1,47 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Cache statuses detected from response headers
+const (
+	cacheUnknown = iota
+	cacheHit
+	cacheMiss
+)
+
+// cacheStatus detects whether an upstream cache served the response, from the
+// configured status header (e.g. "X-Cache: HIT from edge") or a positive Age
+func (bl *BandwidthLimiter) cacheStatus(header http.Header) int {
+	if status := strings.ToUpper(header.Get(bl.config.CacheStatusHeader)); status != "" {
+		switch {
+		case strings.Contains(status, "HIT"):
+			return cacheHit
+		case strings.Contains(status, "MISS"):
+			return cacheMiss
+		}
+	}
+	
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		return cacheHit
+	}
+	return cacheUnknown
+}
+
+// cacheCost returns the token multiplier for a response's cache status, 1 if unknown
+func (bl *BandwidthLimiter) cacheCost(header http.Header) float64 {
+	switch bl.cacheStatus(header) {
+	case cacheHit:
+		if bl.config.CacheHitCost > 0 {
+			return bl.config.CacheHitCost
+		}
+	case cacheMiss:
+		if bl.config.CacheMissCost > 0 {
+			return bl.config.CacheMissCost
+		}
+	}
+	return 1
+}
@@ -0,0 +1,60 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestCacheStatusCosts tests that cache hits and misses are charged differently
+func TestCacheStatusCosts(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		value         string
+		wantThrottled bool
+	}{
+		{"hit", "X-Cache", "HIT from edge", false},
+		{"age", "Age", "120", false},
+		{"miss", "X-Cache", "MISS", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = "50KB" // 50 KB/s
+			cfg.BurstSize = "20KB"    // 20 KB burst
+			cfg.CacheHitCost = 0.5
+			cfg.CacheMissCost = 2
+
+			ctx := context.Background()
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set(tt.header, tt.value)
+				rw.Write(make([]byte, 10*1024))
+			})
+
+			handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Three 10 KB responses fit the burst as hits, but not as misses
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+				req.RemoteAddr = "10.0.0.1:12345"
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			elapsed := time.Since(start)
+
+			if throttled := elapsed > 100*time.Millisecond; throttled != tt.wantThrottled {
+				t.Errorf("Expected throttled=%v, took %v", tt.wantThrottled, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// What an instance does with requests another instance already limits, see Config.DuplicateMode
+const (
+	duplicateSkip       = "skip"
+	duplicateCoordinate = "coordinate"
+)
+
+// chainContextKey is the context key of the *chainMarker of a limited request
+type chainContextKey struct{}
+
+// chainMarker tells instances further down the chain that a request is
+// already limited, and collects the buckets of those coordinating with the
+// instance that set it
+type chainMarker struct {
+	name string // Of the instance limiting the request
+	
+	mutex   sync.Mutex
+	buckets []limiter.Consumer
+	limit   int64 // Slowest limit and smallest burst among the buckets
+	burst   int64
+}
+
+// add contributes buckets paying at up to limit with the given burst
+func (m *chainMarker) add(buckets []limiter.Consumer, limit, burst int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	if len(m.buckets) == 0 {
+		m.limit, m.burst = limit, burst
+	} else {
+		m.limit, m.burst = min(m.limit, limit), min(m.burst, burst)
+	}
+	m.buckets = append(m.buckets, buckets...)
+}
+
+// contributed returns the buckets added by coordinating instances with their
+// slowest limit and smallest burst
+func (m *chainMarker) contributed() ([]limiter.Consumer, int64, int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	return m.buckets, m.limit, m.burst
+}
+
+// serveDuplicate serves a request another instance of the middleware is
+// already limiting, most likely because the middleware was applied twice in
+// one chain. Paying for its body again would throttle it twice.
+func (bl *BandwidthLimiter) serveDuplicate(rw http.ResponseWriter, req *http.Request, marker *chainMarker) {
+	if atomic.AddInt64(&bl.metrics.duplicates, 1) == 1 {
+		bl.log.warnf("Requests are already limited by %s, is the middleware applied twice in a chain? Handling them in duplicateMode %q",
+			marker.name, bl.config.DuplicateMode)
+	}
+	if bl.config.DuplicateMode != duplicateCoordinate {
+		bl.next.ServeHTTP(rw, req)
+		return
+	}
+	
+	// The outer instance pays this one's buckets along with its own for every chunk
+	decision := bl.Decide(req)
+	if decision.Policy.Limit != Unlimited {
+		refs := &entryRefs{}
+		defer refs.release()
+		
+		key, policy := bl.guardKey(decision.Key, decision.Policy)
+		buckets := bl.consumers(key, policy, refs)
+		limit, burst := policy.Limit, policy.Burst
+		if policy.MinuteLimit > 0 {
+			burst = min(burst, policy.MinuteLimit)
+		}
+		for _, level := range bl.parentLevels(decision.Backend) {
+			buckets = append(buckets, bl.consumers(level.key, level.policy, refs)...)
+			limit, burst = min(limit, level.policy.Limit), min(burst, level.policy.Burst)
+		}
+		marker.add(buckets, limit, burst)
+	}
+	bl.next.ServeHTTP(rw, req)
+}
@@ -0,0 +1,116 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// newChain returns an outer limiter at 1MB/s in front of an inner one at
+// 100KB/s with a 10KB burst, in front of a backend sending 50KB responses
+func newChain(t *testing.T, duplicateMode string) (outer, inner *bandwidthlimiter.BandwidthLimiter) {
+	backend := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 50*1024))
+	})
+
+	innerCfg := bandwidthlimiter.CreateConfig()
+	innerCfg.DefaultLimit = "100KB"
+	innerCfg.BurstSize = "10KB"
+	innerCfg.DuplicateMode = duplicateMode
+	handler, err := bandwidthlimiter.New(context.Background(), backend, innerCfg, "inner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner = handler.(*bandwidthlimiter.BandwidthLimiter)
+	t.Cleanup(inner.Shutdown)
+
+	outerCfg := bandwidthlimiter.CreateConfig()
+	outerCfg.DefaultLimit = "1MB"
+	handler, err = bandwidthlimiter.New(context.Background(), inner, outerCfg, "outer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer = handler.(*bandwidthlimiter.BandwidthLimiter)
+	t.Cleanup(outer.Shutdown)
+	return outer, inner
+}
+
+// serveChain sends a request through the chain and returns how long it took
+func serveChain(t *testing.T, outer *bandwidthlimiter.BandwidthLimiter) time.Duration {
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/file", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	outer.ServeHTTP(rr, req)
+	if rr.Body.Len() != 50*1024 {
+		t.Errorf("Expected the full response, got %d bytes", rr.Body.Len())
+	}
+	return time.Since(start)
+}
+
+// duplicates returns the duplicate request counter of a limiter
+func duplicates(t *testing.T, bl *bandwidthlimiter.BandwidthLimiter) string {
+	var buf bytes.Buffer
+	if err := bl.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "bwl_duplicate_requests_total ") {
+			return strings.TrimPrefix(line, "bwl_duplicate_requests_total ")
+		}
+	}
+	t.Fatal("Expected a bwl_duplicate_requests_total metric")
+	return ""
+}
+
+// TestDuplicateSkip tests that an instance further down the chain leaves
+// requests to the instance already limiting them
+func TestDuplicateSkip(t *testing.T) {
+	outer, inner := newChain(t, "")
+	innerDone := 0
+	inner.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		innerDone++
+	})
+
+	if elapsed := serveChain(t, outer); elapsed > 150*time.Millisecond {
+		t.Errorf("Expected the response to be limited by the outer instance only, took %v", elapsed)
+	}
+	if innerDone != 0 {
+		t.Error("Expected the inner instance to skip the request")
+	}
+	if count := duplicates(t, inner); count != "1" {
+		t.Errorf("Expected 1 duplicate request, got %s", count)
+	}
+	if count := duplicates(t, outer); count != "0" {
+		t.Errorf("Expected no duplicate requests on the outer instance, got %s", count)
+	}
+}
+
+// TestDuplicateCoordinate tests that the outer instance pays the buckets of a
+// coordinating instance further down the chain
+func TestDuplicateCoordinate(t *testing.T) {
+	outer, inner := newChain(t, "coordinate")
+
+	// 10KB from the inner burst and 40KB at 100KB/s
+	if elapsed := serveChain(t, outer); elapsed < 300*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("Expected the response to go at the inner instance's limit, took %v", elapsed)
+	}
+	if count := duplicates(t, inner); count != "1" {
+		t.Errorf("Expected 1 duplicate request, got %s", count)
+	}
+}
+
+// TestDuplicateModeConfig tests that duplicateMode is validated
+func TestDuplicateModeConfig(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DuplicateMode = "twice"
+	if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an unknown duplicateMode")
+	}
+}
@@ -0,0 +1,70 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// chunksFor returns the chunks a response of size bytes was paid in
+func chunksFor(t *testing.T, cfg *bandwidthlimiter.Config, size int) int64 {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, size))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks int64
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		chunks = stats.Chunks
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+	return chunks
+}
+
+// TestChunkSize tests fixed and automatic chunk sizes
+func TestChunkSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     bandwidthlimiter.Size
+		burst     bandwidthlimiter.Size
+		chunkSize bandwidthlimiter.Size
+		size      int
+		chunks    int64
+	}{
+		{"default", "1MB", "10MB", "", 64 * 1024, 16},
+		{"fixed", "1MB", "10MB", "16KB", 64 * 1024, 4},
+		{"auto fast", "100MB", "100MB", "auto", 4 << 20, 4},
+		{"auto slow", "8KB", "8KB", "auto", 4096, 8},
+		{"capped at the burst", "64KB", "1KB", "", 4096, 4},
+		{"burst below the smallest chunk", "64KB", "256", "", 4096, 16},
+		{"auto burst below the smallest chunk", "64KB", "256", "auto", 1024, 4},
+	}
+
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DefaultLimit = tt.limit
+		cfg.BurstSize = tt.burst
+		cfg.ChunkSize = tt.chunkSize
+		if chunks := chunksFor(t, cfg, tt.size); chunks != tt.chunks {
+			t.Errorf("%s: expected %d chunks, got %d", tt.name, tt.chunks, chunks)
+		}
+	}
+}
+
+// TestChunkSizeConfig tests that chunk sizes outside the bounds are rejected
+func TestChunkSizeConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, chunkSize := range []bandwidthlimiter.Size{"100", "2MB", "unlimited", "fast"} {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.ChunkSize = chunkSize
+		if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for chunkSize %q", chunkSize)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package bandwidthlimiter
+
+import (
+	"math/bits"
+	"net"
+)
+
+// cidrTrie maps IP prefixes to values and finds the longest prefix holding an
+// address. It is a path-compressed binary radix tree, so a lookup visits at
+// most one node per distinct prefix length on the address's path instead of
+// checking every rule.
+type cidrTrie struct {
+	v4, v6 *cidrNode
+	size   int
+}
+
+// cidrNode is a prefix in a cidrTrie. Nodes without a value only fork the
+// paths of longer prefixes.
+type cidrNode struct {
+	key      net.IP // Masked to bits, 4 or 16 bytes
+	bits     int
+	value    int64
+	set      bool
+	children [2]*cidrNode
+}
+
+// newCIDRTrie creates an empty trie
+func newCIDRTrie() *cidrTrie {
+	return &cidrTrie{}
+}
+
+// root returns the tree an address belongs to, and the address in its family's length
+func (t *cidrTrie) root(ip net.IP) (**cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &t.v4, ip4
+	}
+	return &t.v6, ip.To16()
+}
+
+// insert stores value for network, replacing the value of an equal prefix
+func (t *cidrTrie) insert(network *net.IPNet, value int64) {
+	link, ip := t.root(network.IP)
+	ones, size := network.Mask.Size()
+	if size != len(ip)*8 {
+		ones += len(ip)*8 - size // IPv4 networks with a 128-bit mask
+	}
+	node := &cidrNode{key: ip.Mask(net.CIDRMask(ones, len(ip)*8)), bits: ones, value: value, set: true}
+	
+	for {
+		current := *link
+		if current == nil {
+			*link = node
+			t.size++
+			return
+		}
+		
+		common := commonPrefix(current.key, node.key, current.bits, ones)
+		switch {
+		case common == current.bits && common == ones:
+			if !current.set {
+				t.size++
+			}
+			current.value, current.set = value, true
+			return
+		case common == current.bits:
+			link = &current.children[bitAt(node.key, common)]
+			continue
+		case common == ones:
+			node.children[bitAt(current.key, common)] = current
+		default:
+			fork := &cidrNode{key: node.key.Mask(net.CIDRMask(common, len(ip)*8)), bits: common}
+			fork.children[bitAt(node.key, common)] = node
+			fork.children[bitAt(current.key, common)] = current
+			node = fork
+		}
+		*link = node
+		t.size++
+		return
+	}
+}
+
+// lookup returns the value of the longest prefix containing ip
+func (t *cidrTrie) lookup(ip net.IP) (int64, bool) {
+	link, ip := t.root(ip)
+	if ip == nil {
+		return 0, false
+	}
+	
+	value, found := int64(0), false
+	for node := *link; node != nil; node = node.children[bitAt(ip, node.bits)] {
+		if commonPrefix(node.key, ip, node.bits, node.bits) < node.bits {
+			break
+		}
+		if node.set {
+			value, found = node.value, true
+		}
+		if node.bits == len(ip)*8 {
+			break
+		}
+	}
+	return value, found
+}
+
+// len returns the number of stored prefixes
+func (t *cidrTrie) len() int {
+	return t.size
+}
+
+// commonPrefix returns how many leading bits a and b share, looking at no
+// more than the shorter of aBits and bBits
+func commonPrefix(a, b net.IP, aBits, bBits int) int {
+	limit := aBits
+	if bBits < limit {
+		limit = bBits
+	}
+	
+	common := 0
+	for i := 0; common < limit; i++ {
+		if diff := a[i] ^ b[i]; diff != 0 {
+			common += bits.LeadingZeros8(diff)
+			break
+		}
+		common += 8
+	}
+	if common > limit {
+		return limit
+	}
+	return common
+}
+
+// bitAt returns bit i of ip, counting from the most significant bit
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,135 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// newCIDRLimiter creates a limiter with the given client limits
+func newCIDRLimiter(t testing.TB, clientLimits map[string]bandwidthlimiter.Size) *bandwidthlimiter.BandwidthLimiter {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClientLimits = clientLimits
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler.(*bandwidthlimiter.BandwidthLimiter)
+}
+
+// decideFor resolves the decision for a request from ip
+func decideFor(bl *bandwidthlimiter.BandwidthLimiter, ip string) bandwidthlimiter.Decision {
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = net.JoinHostPort(ip, "1000")
+	return bl.Decide(req)
+}
+
+// TestClientCIDRLimits tests that the most specific client rule applies
+func TestClientCIDRLimits(t *testing.T) {
+	bl := newCIDRLimiter(t, map[string]bandwidthlimiter.Size{
+		"10.0.0.0/8":      "1KB",
+		"10.1.0.0/16":     "2KB",
+		"10.1.2.0/24":     "3KB",
+		"10.1.2.3":        "4KB",
+		"0.0.0.0/1":       "5KB",
+		"2001:db8::/32":   "6KB",
+		"2001:db8:1::/48": "unlimited",
+	})
+
+	tests := []struct {
+		ip    string
+		limit int64
+		class string
+	}{
+		{"10.200.0.1", 1024, "client"},
+		{"10.1.200.1", 2048, "client"},
+		{"10.1.2.200", 3072, "client"},
+		{"10.1.2.3", 4096, "client"},
+		{"11.0.0.1", 5120, "client"},
+		{"192.168.0.1", 1024 * 1024, "default"},
+		{"2001:db8:2::1", 6144, "client"},
+		{"2001:db8:1::1", bandwidthlimiter.Unlimited, "client"},
+		{"2001:db9::1", 1024 * 1024, "default"},
+	}
+	for _, tt := range tests {
+		if decision := decideFor(bl, tt.ip); decision.Policy.Limit != tt.limit || decision.Policy.Class != tt.class {
+			t.Errorf("%s: expected %d from %s rules, got %+v", tt.ip, tt.limit, tt.class, decision.Policy)
+		}
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClientLimits["10.0.0.0/33"] = "1KB"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an invalid CIDR")
+	}
+}
+
+// randomNetworks returns n random IPv4 networks with prefix lengths 8 to 32,
+// and their limits
+func randomNetworks(random *rand.Rand, n int) map[string]bandwidthlimiter.Size {
+	rules := make(map[string]bandwidthlimiter.Size, n)
+	for len(rules) < n {
+		ip := net.IPv4(byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)))
+		mask := net.CIDRMask(8+random.Intn(25), 32)
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		rules[network.String()] = bandwidthlimiter.Size(fmt.Sprint(1 + len(rules)))
+	}
+	return rules
+}
+
+// TestClientCIDRLimitsMatchScan tests the trie against a scan of every rule
+func TestClientCIDRLimitsMatchScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	rules := randomNetworks(random, 2000)
+	bl := newCIDRLimiter(t, rules)
+
+	networks := make(map[*net.IPNet]bandwidthlimiter.Size, len(rules))
+	for rule, limit := range rules {
+		_, network, _ := net.ParseCIDR(rule)
+		networks[network] = limit
+	}
+
+	for i := 0; i < 5000; i++ {
+		ip := net.IPv4(byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)))
+		best, expected := -1, int64(1024*1024)
+		for network, limit := range networks {
+			if ones, _ := network.Mask.Size(); network.Contains(ip) && ones > best {
+				best = ones
+				fmt.Sscan(string(limit), &expected)
+			}
+		}
+		if decision := decideFor(bl, ip.String()); decision.Policy.Limit != expected {
+			t.Fatalf("%s: expected %d, got %d", ip, expected, decision.Policy.Limit)
+		}
+	}
+}
+
+// BenchmarkClientCIDRLimits measures decisions against large CIDR rule sets
+func BenchmarkClientCIDRLimits(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			random := rand.New(rand.NewSource(1))
+			bl := newCIDRLimiter(b, randomNetworks(random, n))
+			reqs := make([]*http.Request, 1024)
+			for i := range reqs {
+				reqs[i] = httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+				reqs[i].RemoteAddr = fmt.Sprintf("%d.%d.%d.%d:1000", random.Intn(256), random.Intn(256), random.Intn(256), random.Intn(256))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bl.Decide(reqs[i%len(reqs)])
+			}
+		})
+	}
+}
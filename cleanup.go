@@ -0,0 +1,61 @@
+package bandwidthlimiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Cleanup log modes, see Config.CleanupLog
+const (
+	cleanupLogRemoved = "removed"
+	cleanupLogDebug   = "debug"
+	cleanupLogOff     = "off"
+)
+
+// CleanupStats describes one run of the idle bucket cleanup
+type CleanupStats struct {
+	// When the run started and how long it took
+	Start    time.Time
+	Duration time.Duration
+	
+	// Buckets evicted for being idle longer than BucketMaxAge, and buckets kept
+	Removed int
+	Kept    int
+}
+
+// cleanupCallbacks holds the functions run after every cleanup
+type cleanupCallbacks struct {
+	mutex     sync.RWMutex
+	callbacks []func(CleanupStats)
+}
+
+// OnCleanup registers a function called with the results of every cleanup
+// run. Callbacks run on the cleanup goroutine and should return quickly.
+func (bl *BandwidthLimiter) OnCleanup(callback func(CleanupStats)) {
+	bl.onCleanup.mutex.Lock()
+	defer bl.onCleanup.mutex.Unlock()
+	
+	bl.onCleanup.callbacks = append(bl.onCleanup.callbacks, callback)
+}
+
+// reportCleanup logs a cleanup run as configured, counts it in the metrics and
+// passes it to the OnCleanup callbacks
+func (bl *BandwidthLimiter) reportCleanup(stats CleanupStats) {
+	bl.metrics.observeCleanup(stats)
+	
+	switch bl.config.CleanupLog {
+	case cleanupLogRemoved:
+		if int64(stats.Removed) >= bl.config.CleanupLogThreshold {
+			bl.log.infof("Cleanup removed %d unused buckets (kept %d active buckets)", stats.Removed, stats.Kept)
+		}
+	case cleanupLogDebug:
+		bl.log.infof("Cleanup removed %d unused buckets (kept %d active buckets) in %v", stats.Removed, stats.Kept, stats.Duration)
+	}
+	
+	bl.onCleanup.mutex.RLock()
+	defer bl.onCleanup.mutex.RUnlock()
+	
+	for _, callback := range bl.onCleanup.callbacks {
+		callback(stats)
+	}
+}
@@ -0,0 +1,83 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestOnCleanup tests that cleanup runs are reported to callbacks and metrics
+func TestOnCleanup(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.BucketMaxAge = "100ms"
+	cfg.CleanupInterval = "200ms"
+	cfg.QuotaGrace = bandwidthlimiter.Seconds(1)
+	cfg.CleanupLog = "off"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	var mutex sync.Mutex
+	var runs []bandwidthlimiter.CleanupStats
+	bl.OnCleanup(func(stats bandwidthlimiter.CleanupStats) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		runs = append(runs, stats)
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+	time.Sleep(700 * time.Millisecond)
+
+	mutex.Lock()
+	removed := 0
+	for _, run := range runs {
+		removed += run.Removed
+		if run.Start.IsZero() || run.Duration < 0 {
+			t.Errorf("Unexpected cleanup stats %+v", run)
+		}
+	}
+	count := len(runs)
+	mutex.Unlock()
+	if count < 2 || removed != 1 {
+		t.Errorf("Expected the idle bucket to be removed once over several runs, got %d runs removing %d", count, removed)
+	}
+
+	var metrics bytes.Buffer
+	if err := bl.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(metrics.String(), "bwl_cleanup_evictions_total 1") || !strings.Contains(metrics.String(), "bwl_cleanup_duration_seconds_count") {
+		t.Errorf("Expected the cleanup runs in the metrics, got:\n%s", metrics.String())
+	}
+}
+
+// TestCleanupLogConfig tests that invalid cleanup logging settings are rejected
+func TestCleanupLogConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.CleanupLog = "verbose"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an unknown cleanupLog")
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.CleanupLogThreshold = -1
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for a negative cleanupLogThreshold")
+	}
+}
@@ -0,0 +1,77 @@
+package bandwidthlimiter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// Client ID modes, see Config.ClientIDMode
+const (
+	clientIDHash     = "hash"
+	clientIDTruncate = "truncate"
+)
+
+// clientID returns the identifier a client is stored under in bucket keys, and
+// therefore in persistence, logs and metrics. Limits are still resolved from the raw IP.
+func (bl *BandwidthLimiter) clientID(clientIP string) string {
+	switch bl.config.ClientIDMode {
+	case clientIDHash:
+		mac := hmac.New(sha256.New, []byte(bl.config.ClientIDSalt))
+		mac.Write([]byte(clientIP))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	case clientIDTruncate:
+		return truncateIP(clientIP)
+	}
+	return clientIP
+}
+
+// truncateIP zeroes the host part of an IP: the last octet of IPv4 addresses
+// and everything past the /48 of IPv6 addresses. Values that aren't IPs are kept.
+func truncateIP(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return clientIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// clientForID maps a stored client ID back to a client with its own rule, so
+// restored buckets and reported cluster usage can be checked against it.
+// Other IDs resolve like unknown clients.
+func (bl *BandwidthLimiter) clientForID(id string) string {
+	if bl.config.ClientIDMode == "" {
+		return id
+	}
+	
+	bl.rulesMutex.RLock()
+	clientLimits := bl.parsed.clientLimits
+	bl.rulesMutex.RUnlock()
+	for _, rules := range []map[string]int64{
+		clientLimits,
+		bl.parsed.clientMinuteLimits,
+		bl.parsed.clientUploadLimits,
+		bl.parsed.clientClusterQuotas,
+	} {
+		for client := range rules {
+			if bl.clientID(client) == id {
+				return client
+			}
+		}
+	}
+	return id
+}
+
+// keyHasClientID reports whether a bucket key belongs to the given client ID
+func keyHasClientID(key, id string) bool {
+	if !strings.HasPrefix(key, id) {
+		return false
+	}
+	rest := key[len(id):]
+	return rest == "" || strings.IndexAny(rest[:1], ":|@#~$") == 0
+}
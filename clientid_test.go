@@ -0,0 +1,109 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestClientIDHash tests that hashed client IDs keep IPs out of keys and state while limits still apply
+func TestClientIDHash(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClientIDMode = "hash"
+	cfg.ClientIDSalt = "test-salt"
+	cfg.ClientLimits["10.0.0.1"] = "2MB"
+	cfg.PersistenceFile = tempFile
+	cfg.AccessLogHeaders = true
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+
+	decision := bl.Decide(req)
+	if decision.Policy.Class != "client" || decision.Policy.Limit != 2097152 {
+		t.Errorf("Expected the client rule to apply, got %+v", decision.Policy)
+	}
+	if strings.Contains(decision.Key, "10.0.0.1") || !strings.HasPrefix(decision.Key, decision.ClientID+":") {
+		t.Errorf("Expected the key to hold the hashed client ID, got %q", decision.Key)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if key := req.Header.Get("X-Bandwidth-Key"); key != decision.Key {
+		t.Errorf("Expected access log key %q, got %q", decision.Key, key)
+	}
+
+	bl.Shutdown()
+
+	content, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "10.0.0.1") {
+		t.Errorf("Persistence file contains the raw client IP: %s", content)
+	}
+
+	if removed, _ := bl.Purge("10.0.0.1"); removed != 1 {
+		t.Errorf("Expected 1 bucket purged by IP, got %d", removed)
+	}
+	if _, err := bl.Purge("10.0.0.0/24"); err == nil {
+		t.Error("Expected error purging by CIDR with hashed client IDs")
+	}
+}
+
+// TestClientIDTruncate tests that truncated client IDs share a bucket per subnet
+func TestClientIDTruncate(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClientIDMode = "truncate"
+
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	for remote, key := range map[string]string{
+		"192.168.1.77:1000":      "192.168.1.0:default",
+		"[2001:db8:1:2::5]:1000": "2001:db8:1:::default",
+		"not-an-ip":              "not-an-ip:default",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Host = ""
+		req.URL.Host = ""
+		req.RemoteAddr = remote
+		if got := bl.Decide(req).Key; got != key {
+			t.Errorf("Expected key %q for %s, got %q", key, remote, got)
+		}
+	}
+}
+
+// TestClientIDConfig tests validation of the client ID options
+func TestClientIDConfig(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClientIDMode = "hash"
+	if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for hash mode without a salt")
+	}
+
+	cfg.ClientIDMode = "encrypt"
+	if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+		t.Error("Expected error for unknown client ID mode")
+	}
+}
@@ -0,0 +1,84 @@
+package bandwidthlimiter
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Client IP strategies, see Config.ClientIPStrategy
+const (
+	clientIPRemoteAddr = "remoteAddr"
+	clientIPDepth      = "xff"
+	clientIPHeader     = "header"
+)
+
+// clientIPStrategy is the compiled form of Config.ClientIPStrategy. The zero
+// value takes the first X-Forwarded-For entry, then X-Real-IP, then the
+// remote address.
+type clientIPStrategy struct {
+	mode   string
+	depth  int    // X-Forwarded-For entry counted from the right, for "xff"
+	header string // Header holding the client IP, for "header"
+}
+
+// parseClientIPStrategy validates a ClientIPStrategy value: "remoteAddr",
+// "xff:<depth>" or "header:<name>"
+func parseClientIPStrategy(value string) (clientIPStrategy, error) {
+	mode, arg := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		mode, arg = value[:i], value[i+1:]
+	}
+	
+	switch mode {
+	case "":
+		return clientIPStrategy{}, nil
+	case clientIPRemoteAddr:
+		if arg == "" {
+			return clientIPStrategy{mode: mode}, nil
+		}
+	case clientIPDepth:
+		if depth, err := strconv.Atoi(arg); err == nil && depth > 0 {
+			return clientIPStrategy{mode: mode, depth: depth}, nil
+		}
+		return clientIPStrategy{}, wrapf(ErrInvalidLimit, "clientIPStrategy %q must have a positive depth, e.g. \"xff:1\"", value)
+	case clientIPHeader:
+		if arg != "" {
+			return clientIPStrategy{mode: mode, header: http.CanonicalHeaderKey(arg)}, nil
+		}
+		return clientIPStrategy{}, wrapf(ErrInvalidLimit, "clientIPStrategy %q must name a header, e.g. \"header:X-Real-IP\"", value)
+	}
+	return clientIPStrategy{}, wrapf(ErrInvalidLimit, "clientIPStrategy must be %q, \"xff:<depth>\" or \"header:<name>\", got %q", clientIPRemoteAddr, value)
+}
+
+// clientIP extracts the client IP from the request. Like Traefik's depth
+// strategy, "xff" counts entries from the right, the ones appended by trusted
+// proxies. Requests carrying fewer entries, or lacking the header, came in
+// past those proxies and are identified by their remote address.
+func (s clientIPStrategy) clientIP(req *http.Request) string {
+	switch s.mode {
+	case "":
+		return getClientIP(req)
+	case clientIPDepth:
+		if ips := parseForwardedFor(strings.Join(req.Header.Values("X-Forwarded-For"), ",")); len(ips) >= s.depth {
+			return ips[len(ips)-s.depth]
+		}
+	case clientIPHeader:
+		if values := req.Header[s.header]; len(values) > 0 {
+			if ip := strings.TrimSpace(values[0]); ip != "" {
+				return ip
+			}
+		}
+	}
+	return remoteIP(req)
+}
+
+// remoteIP returns the host part of the request's remote address
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
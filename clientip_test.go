@@ -0,0 +1,93 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestClientIPStrategy tests that the client IP strategy selects the address requests are keyed by
+func TestClientIPStrategy(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	newLimiter := func(strategy string) *bandwidthlimiter.BandwidthLimiter {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.ClientIPStrategy = strategy
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(*bandwidthlimiter.BandwidthLimiter)
+	}
+
+	request := func(header string, values ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		for _, value := range values {
+			req.Header.Add(header, value)
+		}
+		return req
+	}
+
+	tests := []struct {
+		strategy string
+		req      *http.Request
+		expected string
+	}{
+		{"", request("X-Forwarded-For", "203.0.113.7, 172.16.0.1"), "203.0.113.7"},
+		{"", request("X-Real-IP", "203.0.113.8"), "203.0.113.8"},
+		{"remoteAddr", request("X-Forwarded-For", "203.0.113.7"), "10.0.0.1"},
+		{"xff:1", request("X-Forwarded-For", "198.51.100.1, 203.0.113.7"), "203.0.113.7"},
+		{"xff:2", request("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 172.16.0.1"), "203.0.113.7"},
+		{"xff:2", request("X-Forwarded-For", "198.51.100.1", "203.0.113.7, 172.16.0.1"), "203.0.113.7"},
+		{"xff:3", request("X-Forwarded-For", "203.0.113.7, 172.16.0.1"), "10.0.0.1"},
+		{"header:CF-Connecting-IP", request("Cf-Connecting-Ip", " 203.0.113.9 "), "203.0.113.9"},
+		{"header:CF-Connecting-IP", request("X-Forwarded-For", "203.0.113.7"), "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if decision := newLimiter(tt.strategy).Decide(tt.req); decision.ClientIP != tt.expected {
+			t.Errorf("Expected %q for strategy %q and %v, got %q", tt.expected, tt.strategy, tt.req.Header, decision.ClientIP)
+		}
+	}
+
+	for _, strategy := range []string{"xff", "xff:0", "xff:two", "header:", "remoteAddr:1", "depth:1"} {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.ClientIPStrategy = strategy
+		if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for clientIPStrategy %q", strategy)
+		}
+	}
+}
+
+// TestClientIPStrategyExemptions tests that exempt client CIDRs match the address chosen by the strategy
+func TestClientIPStrategyExemptions(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClientIPStrategy = "xff:1"
+	cfg.Exemptions.ClientCIDRs = []string{"10.0.0.0/8"}
+
+	var limited bool
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		limited = bandwidthlimiter.StatsFromContext(req.Context()) != nil
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients can't forge their way into the exemption by prepending to the header
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "172.16.0.1:1000"
+	req.Header.Set("X-Forwarded-For", "10.0.0.5, 203.0.113.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !limited {
+		t.Error("Expected the forged client to be limited")
+	}
+
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.5")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if limited {
+		t.Error("Expected the internal client added by the proxy to be exempt")
+	}
+}
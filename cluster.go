@@ -0,0 +1,441 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Files kept in Config.ClusterDir
+const (
+	clusterLeaderFile  = "leader.json"
+	clusterSharesFile  = "shares.json"
+	clusterUsagePrefix = "usage-"
+)
+
+// clusterLeader is the leadership stamp of the aggregating instance
+type clusterLeader struct {
+	InstanceID string    `json:"instanceId"`
+	Heartbeat  time.Time `json:"heartbeat"`
+}
+
+// clusterUsage is the usage one instance reports for the current quota period
+type clusterUsage struct {
+	InstanceID string           `json:"instanceId"`
+	Period     int64            `json:"period"`
+	Heartbeat  time.Time        `json:"heartbeat"`
+	Used       map[string]int64 `json:"used"`
+	Previous   map[string]int64 `json:"previous,omitempty"` // Usage in the period before, see tracksPreviousPeriod
+	
+	// Middleware name, process and creation time of the instance, so the
+	// leader can tell the instances a reload superseded, see retireReloaded
+	Name     string    `json:"name,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	PID      int       `json:"pid,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// clusterShares is the quota split published by the leader, along with the
+// period's boundaries and the cluster's usage it was computed from
+type clusterShares struct {
+	Period    int64                       `json:"period"`
+	Start     time.Time                   `json:"start"`
+	End       time.Time                   `json:"end"`
+	Instances int64                       `json:"instances"`
+	Shares    map[string]map[string]int64 `json:"shares"` // map[instanceID]map[clientID]bytes
+	Totals    map[string]int64            `json:"totals,omitempty"`
+	Previous  map[string]int64            `json:"previous,omitempty"` // Totals of the period before, see tracksPreviousPeriod
+}
+
+// clusterState tracks local usage and the share of the cluster quota granted to this instance
+type clusterState struct {
+	mutex  sync.Mutex
+	period int64
+	used   map[string]int64
+	shares *clusterShares // Nil until the leader published shares for this period
+	
+	// Usage and shares of the previous period, nil unless tracksPreviousPeriod
+	previous map[string]int64
+	last     *clusterShares
+}
+
+// errClusterQuota is RequestStats.Err of requests rejected by ClusterQuota
+var errClusterQuota = wrapf(ErrQuotaExceeded, "bandwidthlimiter: cluster quota exceeded")
+
+// clusterQuota returns the cluster-wide byte quota for a client, 0 for none
+func (bl *BandwidthLimiter) clusterQuota(clientIP string) int64 {
+	if quota, exists := bl.parsed.clientClusterQuotas[clientIP]; exists {
+		return quota
+	}
+	return bl.parsed.clusterQuota
+}
+
+// admitCluster reports whether a client may start another transfer within its
+// share of the cluster quota, and if not, when it may retry. Until the leader
+// published shares, the instance assumes it is alone and allows the whole quota.
+func (bl *BandwidthLimiter) admitCluster(key string, quota int64) (bool, time.Time) {
+	cs := bl.cluster
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	
+	now := time.Now()
+	bl.rollPeriod(bl.currentPeriod(now))
+	
+	previous := cs.previousUsage(key)
+	weight := bl.rollingWeight(cs.period, now)
+	allowance := bl.quotaAllowance(quota, previous)
+	limit, used := allowance, cs.used[key]+int64(weight*float64(previous))
+	if cs.shares != nil {
+		if share, exists := cs.shares.Shares[bl.instanceID][key]; exists {
+			limit, used = share, cs.used[key]
+		} else if cs.shares.Instances > 0 {
+			// Instances the leader doesn't know yet, e.g. restarted ones, get
+			// a share of what the cluster left
+			remaining := allowance - cs.shares.Totals[key] - int64(weight*float64(previous))
+			limit, used = remaining/cs.shares.Instances, cs.used[key]
+		}
+	}
+	if used < limit {
+		return true, time.Time{}
+	}
+	return false, bl.quotaRetryAt(cs.period, cs.used[key], previous, allowance)
+}
+
+// recordCluster adds bytes sent to a client to the local usage
+func (bl *BandwidthLimiter) recordCluster(key string, bytes int64) {
+	cs := bl.cluster
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	
+	bl.rollPeriod(bl.currentPeriod(time.Now()))
+	cs.used[key] += bytes
+}
+
+// clusterRoutine periodically reports usage, aggregates it when leading and picks up new shares
+func (bl *BandwidthLimiter) clusterRoutine() {
+	defer bl.wg.Done()
+	
+	for {
+		select {
+		case <-bl.clusterTicker.C:
+			if err := bl.syncCluster(); err != nil {
+				bl.log.errorf("Error syncing cluster quota: %v", err)
+			}
+		case <-bl.shutdownChan:
+			bl.releaseClusterLeader()
+			return
+		}
+	}
+}
+
+// syncCluster runs one report/aggregate/read cycle
+func (bl *BandwidthLimiter) syncCluster() error {
+	now := time.Now()
+	period := bl.currentPeriod(now)
+	
+	hostname, _ := os.Hostname()
+	bl.cluster.mutex.Lock()
+	bl.rollPeriod(period)
+	usage := clusterUsage{
+		InstanceID: bl.instanceID,
+		Period:     period,
+		Heartbeat:  now,
+		Used:       copyUsage(bl.cluster.used),
+		Name:       bl.name,
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+		Created:    bl.created,
+	}
+	if len(bl.cluster.previous) > 0 {
+		usage.Previous = copyUsage(bl.cluster.previous)
+	}
+	bl.cluster.mutex.Unlock()
+	
+	if err := writeJSONFile(bl.clusterPath(clusterUsagePrefix+bl.instanceID+".json"), usage); err != nil {
+		return err
+	}
+	
+	if bl.electClusterLeader(now) {
+		if err := bl.aggregateCluster(now, period); err != nil {
+			return err
+		}
+	}
+	
+	var shares clusterShares
+	found, err := readJSONFile(bl.clusterPath(clusterSharesFile), &shares)
+	if err != nil || !found || shares.Period != period {
+		return err
+	}
+	
+	bl.cluster.mutex.Lock()
+	if bl.cluster.period == period {
+		bl.cluster.shares = &shares
+	}
+	bl.cluster.mutex.Unlock()
+	return nil
+}
+
+// electClusterLeader claims or refreshes leadership; it returns whether this instance leads
+func (bl *BandwidthLimiter) electClusterLeader(now time.Time) bool {
+	var leader clusterLeader
+	found, err := readJSONFile(bl.clusterPath(clusterLeaderFile), &leader)
+	if err != nil {
+		bl.log.warnf("Ignoring unreadable cluster leader file: %v", err)
+	}
+	
+	// Another live leader keeps its role
+	if found && leader.InstanceID != bl.instanceID && now.Sub(leader.Heartbeat) <= bl.clusterStaleAfter() {
+		return false
+	}
+	
+	if err := writeJSONFile(bl.clusterPath(clusterLeaderFile), clusterLeader{InstanceID: bl.instanceID, Heartbeat: now}); err != nil {
+		bl.log.warnf("Failed to claim cluster leadership: %v", err)
+		return false
+	}
+	
+	// Two instances may have claimed at once; the file content decides
+	found, err = readJSONFile(bl.clusterPath(clusterLeaderFile), &leader)
+	return err == nil && found && leader.InstanceID == bl.instanceID
+}
+
+// aggregateCluster sums the usage of all live instances and gives every
+// instance what it already used plus an equal split of the remaining quota
+func (bl *BandwidthLimiter) aggregateCluster(now time.Time, period int64) error {
+	paths, err := filepath.Glob(bl.clusterPath(clusterUsagePrefix + "*.json"))
+	if err != nil {
+		return err
+	}
+	
+	var reports []clusterUsage
+	totals := make(map[string]int64)
+	previous := make(map[string]int64)
+	previousPeriod := bl.previousPeriod(period)
+	for _, path := range paths {
+		var usage clusterUsage
+		if found, err := readJSONFile(path, &usage); err != nil || !found {
+			continue
+		}
+		
+		// Usage of the current period counts even if its instance went away,
+		// e.g. restarted under a new instance ID
+		if usage.Period == period {
+			for key, used := range usage.Used {
+				totals[key] += used
+			}
+			for key, used := range usage.Previous {
+				previous[key] += used
+			}
+		} else if usage.Period == previousPeriod {
+			for key, used := range usage.Used {
+				previous[key] += used
+			}
+		}
+		
+		// Instances that stopped reporting are gone and get no share. Their
+		// report is kept until its period is over plus the grace, or the
+		// period after it if that depends on it.
+		if now.Sub(usage.Heartbeat) > bl.clusterStaleAfter() {
+			end := bl.periodEnd(usage.Period)
+			if bl.tracksPreviousPeriod() {
+				end = bl.periodEnd(bl.currentPeriod(end))
+			}
+			if now.After(end.Add(bl.parsed.quotaGrace)) {
+				os.Remove(path)
+			}
+			continue
+		}
+		reports = append(reports, usage)
+	}
+	reports = retireReloaded(reports)
+	
+	// Usage of the previous period is also kept in the published shares,
+	// which outlive the reports of instances that went away
+	if bl.tracksPreviousPeriod() {
+		bl.mergePublishedUsage(period, previousPeriod, previous)
+		for key := range previous {
+			if _, exists := totals[key]; !exists {
+				totals[key] = 0
+			}
+		}
+	} else {
+		previous = nil
+	}
+	
+	shares := clusterShares{
+		Period:    period,
+		Start:     bl.periodStart(period),
+		End:       bl.periodEnd(period),
+		Instances: int64(len(reports)),
+		Shares:    make(map[string]map[string]int64, len(reports)),
+		Totals:    totals,
+		Previous:  previous,
+	}
+	weight := bl.rollingWeight(period, now)
+	for _, usage := range reports {
+		instanceShares := make(map[string]int64, len(totals))
+		for key, total := range totals {
+			used := int64(0)
+			if usage.Period == period {
+				used = usage.Used[key]
+			}
+			quota := bl.clusterQuota(bl.clientForID(key))
+			remaining := bl.quotaAllowance(quota, previous[key]) - total - int64(weight*float64(previous[key]))
+			if remaining < 0 {
+				remaining = 0
+			}
+			instanceShares[key] = used + remaining/shares.Instances
+		}
+		shares.Shares[usage.InstanceID] = instanceShares
+	}
+	
+	return writeJSONFile(bl.clusterPath(clusterSharesFile), shares)
+}
+
+// retireReloaded drops the reports of instances superseded by a newer instance
+// of the same middleware in the same process. Traefik keeps the previous
+// instance running after a configuration reload, so it keeps reporting while
+// serving no traffic, and would take an ever growing part of the quota. Its
+// usage still counts towards the totals.
+func retireReloaded(reports []clusterUsage) []clusterUsage {
+	process := func(usage clusterUsage) string {
+		return usage.Name + "\x00" + usage.Hostname + "\x00" + strconv.Itoa(usage.PID)
+	}
+	
+	// Reports of versions that didn't tell their process are all kept
+	newest := make(map[string]time.Time)
+	for _, usage := range reports {
+		if usage.PID != 0 && usage.Created.After(newest[process(usage)]) {
+			newest[process(usage)] = usage.Created
+		}
+	}
+	
+	current := reports[:0]
+	for _, usage := range reports {
+		if usage.PID == 0 || !usage.Created.Before(newest[process(usage)]) {
+			current = append(current, usage)
+		}
+	}
+	return current
+}
+
+// mergePublishedUsage adds the previous period's usage published in the last
+// shares to previous, where the reports it came from may be gone by now
+func (bl *BandwidthLimiter) mergePublishedUsage(period, previousPeriod int64, previous map[string]int64) {
+	var published clusterShares
+	if found, err := readJSONFile(bl.clusterPath(clusterSharesFile), &published); err != nil || !found {
+		return
+	}
+	usage := published.Previous
+	if published.Period == previousPeriod {
+		usage = published.Totals
+	} else if published.Period != period {
+		return
+	}
+	for key, used := range usage {
+		if used > previous[key] {
+			previous[key] = used
+		}
+	}
+}
+
+// restoreCluster picks up the shares last published, so a restarted instance
+// counts the cluster's usage from its first request instead of its first sync
+func (bl *BandwidthLimiter) restoreCluster() {
+	var shares clusterShares
+	found, err := readJSONFile(bl.clusterPath(clusterSharesFile), &shares)
+	if err != nil {
+		bl.log.warnf("Ignoring unreadable cluster shares: %v", err)
+	}
+	if !found {
+		return
+	}
+	
+	cs := bl.cluster
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.period, cs.shares = shares.Period, &shares
+	bl.rollPeriod(bl.currentPeriod(time.Now()))
+}
+
+// copyUsage returns a copy of usage by client ID
+func copyUsage(usage map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(usage))
+	for key, used := range usage {
+		copied[key] = used
+	}
+	return copied
+}
+
+// releaseClusterLeader gives up leadership on shutdown so another instance takes over quickly
+func (bl *BandwidthLimiter) releaseClusterLeader() {
+	var leader clusterLeader
+	found, err := readJSONFile(bl.clusterPath(clusterLeaderFile), &leader)
+	if err == nil && found && leader.InstanceID == bl.instanceID {
+		os.Remove(bl.clusterPath(clusterLeaderFile))
+	}
+}
+
+// clusterPath returns the path of a file in the cluster directory
+func (bl *BandwidthLimiter) clusterPath(name string) string {
+	return filepath.Join(bl.config.ClusterDir, name)
+}
+
+// clusterStaleAfter returns how long an instance counts as live without reporting
+func (bl *BandwidthLimiter) clusterStaleAfter() time.Duration {
+	return 3 * bl.parsed.clusterSyncInterval
+}
+
+// writeJSONFile atomically writes v as JSON to path
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filepath.Base(path), err)
+	}
+	
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	
+	// Write to temporary file first (atomic save). Every writer gets its own,
+	// so instances writing the same file never rename each other's half-written one.
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary %s: %w", filepath.Base(path), err)
+	}
+	defer os.Remove(tempFile.Name())
+	
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Chmod(0644)
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// readJSONFile decodes the JSON file at path into v. It reports false for a missing file.
+func readJSONFile(path string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+	
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", filepath.Base(path), err)
+	}
+	return true, nil
+}
@@ -0,0 +1,374 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestClusterQuota tests that usage on one instance reduces the quota share of another
+func TestClusterQuota(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	instances := make([]*bandwidthlimiter.BandwidthLimiter, 2)
+	for i := range instances {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.ClusterDir = dir
+		cfg.ClusterQuota = "20KB"
+		cfg.ClusterSyncInterval = bandwidthlimiter.Seconds(1)
+
+		handler, err := bandwidthlimiter.New(ctx, next, cfg, fmt.Sprintf("test-limiter-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i] = handler.(*bandwidthlimiter.BandwidthLimiter)
+		defer instances[i].Shutdown()
+	}
+
+	serve := func(instance *bandwidthlimiter.BandwidthLimiter) int {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		recorder := httptest.NewRecorder()
+		instance.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// The first instance uses up the whole quota
+	for i := 0; i < 2; i++ {
+		if code := serve(instances[0]); code != http.StatusOK {
+			t.Fatalf("Expected request within quota to succeed, got %d", code)
+		}
+	}
+	if code := serve(instances[0]); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d over quota, got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Once the leader redistributed the quota, the second instance has nothing left.
+	// Usage is reported on the first sync and redistributed by the next ones.
+	time.Sleep(3500 * time.Millisecond)
+	if code := serve(instances[1]); code != http.StatusTooManyRequests {
+		t.Errorf("Expected second instance to enforce the cluster-wide usage, got %d", code)
+	}
+}
+
+// TestClusterQuotaDeadInstance tests that usage reported by an instance that went away
+// keeps counting until its period is over, and old reports are removed after the grace
+func TestClusterQuotaDeadInstance(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	period := now.Unix() / 3600
+
+	writeUsage := func(name string, period int64, heartbeat time.Time) {
+		data, _ := json.Marshal(map[string]interface{}{
+			"instanceId": name,
+			"period":     period,
+			"heartbeat":  heartbeat,
+			"used":       map[string]int64{"10.0.0.1": 20 * 1024},
+		})
+		if err := os.WriteFile(dir+"/usage-"+name+".json", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeUsage("restarted", period, now.Add(-time.Minute))
+	writeUsage("ancient", period-2, now.Add(-2*time.Hour))
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClusterDir = dir
+	cfg.ClusterQuota = "20KB"
+	cfg.ClusterSyncInterval = bandwidthlimiter.Seconds(1)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	time.Sleep(1500 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the dead instance's usage to exhaust the quota, got %d", recorder.Code)
+	}
+
+	if _, err := os.Stat(dir + "/usage-restarted.json"); err != nil {
+		t.Errorf("Expected the current period's report to be kept: %v", err)
+	}
+	if _, err := os.Stat(dir + "/usage-ancient.json"); !os.IsNotExist(err) {
+		t.Errorf("Expected the old report to be removed, got %v", err)
+	}
+}
+
+// writeClusterFile writes v as JSON to a file in a cluster directory
+func writeClusterFile(t *testing.T, dir, name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"/"+name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newClusterInstance returns an instance enforcing a 20KB cluster quota in
+// dir, in front of a backend sending 10KB responses
+func newClusterInstance(t *testing.T, dir string, modify func(cfg *bandwidthlimiter.Config)) *bandwidthlimiter.BandwidthLimiter {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ClusterDir = dir
+	cfg.ClusterQuota = "20KB"
+	cfg.ClusterSyncInterval = bandwidthlimiter.Seconds(1)
+	if modify != nil {
+		modify(cfg)
+	}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	t.Cleanup(bl.Shutdown)
+	return bl
+}
+
+// serveCluster sends a request of 10.0.0.1 and returns the response
+func serveCluster(bl *bandwidthlimiter.BandwidthLimiter) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	bl.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestClusterQuotaCarryOver tests that quota left unused in the previous
+// period is added to the next one, up to ClusterQuotaCarryOver
+func TestClusterQuotaCarryOver(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeClusterFile(t, dir, "usage-gone.json", map[string]interface{}{
+		"instanceId": "gone",
+		"period":     now.Unix()/3600 - 1,
+		"heartbeat":  now.Add(-time.Hour),
+		"used":       map[string]int64{"10.0.0.1": 15 * 1024},
+	})
+
+	// 5KB were left of the previous period, within the 10KB carry-over
+	bl := newClusterInstance(t, dir, func(cfg *bandwidthlimiter.Config) {
+		cfg.ClusterQuotaCarryOver = "10KB"
+	})
+	time.Sleep(1500 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if code := serveCluster(bl).Code; code != http.StatusOK {
+			t.Fatalf("Expected request %d within quota and carry-over to succeed, got %d", i, code)
+		}
+	}
+	if code := serveCluster(bl).Code; code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d over quota and carry-over, got %d", http.StatusTooManyRequests, code)
+	}
+	if _, err := os.Stat(dir + "/usage-gone.json"); err != nil {
+		t.Errorf("Expected the previous period's report to be kept: %v", err)
+	}
+}
+
+// TestClusterQuotaRolling tests that a rolling window still counts the part
+// of the previous period's usage within it
+func TestClusterQuotaRolling(t *testing.T) {
+	now := time.Now()
+	if time.Until(now.Truncate(time.Hour).Add(time.Hour)) < 2*time.Minute {
+		t.Skip("Too close to the end of the hour, when the previous period's usage has slid out")
+	}
+	dir := t.TempDir()
+	writeClusterFile(t, dir, "usage-gone.json", map[string]interface{}{
+		"instanceId": "gone",
+		"period":     now.Unix()/3600 - 1,
+		"heartbeat":  now.Add(-time.Hour),
+		"used":       map[string]int64{"10.0.0.1": 1000 * 1024},
+	})
+
+	bl := newClusterInstance(t, dir, func(cfg *bandwidthlimiter.Config) {
+		cfg.ClusterQuotaReset = "rolling"
+	})
+	time.Sleep(1500 * time.Millisecond)
+
+	recorder := serveCluster(bl)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the previous period's usage to exhaust the quota, got %d", recorder.Code)
+	}
+
+	// Usage slides out before the end of the period, once under the quota
+	retryAfter, _ := strconv.Atoi(recorder.Header().Get("Retry-After"))
+	end := time.Until(now.Truncate(time.Hour).Add(time.Hour))
+	if retryAfter <= 0 || time.Duration(retryAfter)*time.Second > end {
+		t.Errorf("Expected a retry before the end of the period in %v, got %q", end, recorder.Header().Get("Retry-After"))
+	}
+}
+
+// TestClusterQuotaDaily tests that daily periods end at midnight in the configured time zone
+func TestClusterQuotaDaily(t *testing.T) {
+	bl := newClusterInstance(t, t.TempDir(), func(cfg *bandwidthlimiter.Config) {
+		cfg.ClusterQuota = "10KB"
+		cfg.ClusterQuotaReset = "daily"
+		cfg.ClusterQuotaTimezone = "America/New_York"
+	})
+	if code := serveCluster(bl).Code; code != http.StatusOK {
+		t.Fatalf("Expected the first request to succeed, got %d", code)
+	}
+	recorder := serveCluster(bl)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d over quota, got %d", http.StatusTooManyRequests, recorder.Code)
+	}
+
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	local := time.Now().In(location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, location)
+	retryAfter, _ := strconv.Atoi(recorder.Header().Get("Retry-After"))
+	if wait := time.Until(midnight); time.Duration(retryAfter)*time.Second < wait || time.Duration(retryAfter)*time.Second > wait+5*time.Second {
+		t.Errorf("Expected a retry at midnight in New York in %v, got %ds", wait, retryAfter)
+	}
+}
+
+// TestClusterQuotaRestore tests that a restarted instance enforces the
+// published usage before its first sync
+func TestClusterQuotaRestore(t *testing.T) {
+	dir := t.TempDir()
+	writeClusterFile(t, dir, "shares.json", map[string]interface{}{
+		"period":    time.Now().Unix() / 3600,
+		"instances": 1,
+		"shares":    map[string]map[string]int64{"gone": {"10.0.0.1": 20 * 1024}},
+		"totals":    map[string]int64{"10.0.0.1": 20 * 1024},
+	})
+
+	bl := newClusterInstance(t, dir, func(cfg *bandwidthlimiter.Config) {
+		cfg.ClusterSyncInterval = "1m"
+	})
+	if code := serveCluster(bl).Code; code != http.StatusTooManyRequests {
+		t.Errorf("Expected the published usage to exhaust the quota, got %d", code)
+	}
+
+	// Other clients still get their share
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.2:12345"
+	recorder := httptest.NewRecorder()
+	bl.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", recorder.Code)
+	}
+}
+
+// TestClusterQuotaResetConfig tests that reset settings are validated
+func TestClusterQuotaResetConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	tests := []struct {
+		name   string
+		modify func(cfg *bandwidthlimiter.Config)
+	}{
+		{"unknown reset", func(cfg *bandwidthlimiter.Config) { cfg.ClusterQuotaReset = "weekly" }},
+		{"timezone without calendar reset", func(cfg *bandwidthlimiter.Config) { cfg.ClusterQuotaTimezone = "Europe/Berlin" }},
+		{"unknown timezone", func(cfg *bandwidthlimiter.Config) {
+			cfg.ClusterQuotaReset = "daily"
+			cfg.ClusterQuotaTimezone = "Mars/Olympus_Mons"
+		}},
+		{"negative carry-over", func(cfg *bandwidthlimiter.Config) { cfg.ClusterQuotaCarryOver = "-1" }},
+		{"carry-over with rolling window", func(cfg *bandwidthlimiter.Config) {
+			cfg.ClusterQuotaReset = "rolling"
+			cfg.ClusterQuotaCarryOver = "1KB"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			tt.modify(cfg)
+			if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+// TestClusterQuotaReload tests that an instance superseded by a configuration
+// reload, which Traefik leaves running, gets no share of the cluster quota
+func TestClusterQuotaReload(t *testing.T) {
+	dir := t.TempDir()
+	newClusterInstance(t, dir, nil)
+	reloaded := newClusterInstance(t, dir, nil)
+
+	if code := serveCluster(reloaded).Code; code != http.StatusOK {
+		t.Fatalf("Expected request within quota to succeed, got %d", code)
+	}
+
+	// Usage is reported on the first sync and split by the next ones
+	time.Sleep(2500 * time.Millisecond)
+
+	data, err := os.ReadFile(dir + "/shares.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shares struct {
+		Instances int64                       `json:"instances"`
+		Shares    map[string]map[string]int64 `json:"shares"`
+	}
+	if err := json.Unmarshal(data, &shares); err != nil {
+		t.Fatal(err)
+	}
+	if shares.Instances != 1 || len(shares.Shares) != 1 {
+		t.Fatalf("Expected only the reloaded instance to get a share, got %s", data)
+	}
+
+	// The reloaded instance keeps all of the 10KB left
+	for _, instanceShares := range shares.Shares {
+		if share := instanceShares["10.0.0.1"]; share != 20*1024 {
+			t.Errorf("Expected a share of the whole quota, got %d", share)
+		}
+	}
+}
+
+// TestClusterFilesConcurrentWrites tests that instances writing the cluster
+// files at once each leave a complete file and no temporary files behind
+func TestClusterFilesConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 8; i++ {
+		newClusterInstance(t, dir, nil)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("Expected no temporary files left, found %s", entry.Name())
+			continue
+		}
+		var v interface{}
+		data, err := os.ReadFile(dir + "/" + entry.Name())
+		if err != nil || json.Unmarshal(data, &v) != nil {
+			t.Errorf("Expected %s to hold complete JSON, got %q (%v)", entry.Name(), data, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// traceRequest is the request metadata recovered from one access log line
+type traceRequest struct {
+	ClientAddr string
+	Host       string
+	Method     string
+	Path       string
+	Header     http.Header
+}
+
+// networkHit reports whether a CIDR client rule covers any client decided by a
+// client rule. Hits of exact IP rules inside the network count too.
+func networkHit(client string, clientHits map[string]int) bool {
+	_, network, err := net.ParseCIDR(client)
+	if err != nil {
+		return false
+	}
+	for ip := range clientHits {
+		if parsed := net.ParseIP(ip); parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// runCheck implements "bwl check"
+func runCheck(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON middleware configuration (defaults are used if empty)")
+	tracePath := flags.String("trace", "", "Traefik access log to replay, in JSON or common log format")
+	verbose := flags.Bool("v", false, "print the decision for every request")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tracePath == "" {
+		return fmt.Errorf("-trace is required")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	// Only resolve decisions: no persistence and no admin listener
+	config.PersistenceFile = ""
+	config.AdminAddress = ""
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, config, "bwl-check")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	limiter := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer limiter.Shutdown()
+
+	file, err := os.Open(*tracePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	classes := make(map[string]int)
+	clientHits := make(map[string]int)
+	backendHits := make(map[string]int)
+	shadowed := make(map[string]int)
+	skipped := 0
+	total := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		trace, ok := parseTraceLine(scanner.Text())
+		if !ok {
+			skipped++
+			continue
+		}
+
+		req, err := http.NewRequest(trace.Method, "http://"+trace.Host+trace.Path, nil)
+		if err != nil {
+			skipped++
+			continue
+		}
+		req.RemoteAddr = trace.ClientAddr
+		for name, values := range trace.Header {
+			req.Header[name] = values
+		}
+
+		decision := limiter.Decide(req)
+		total++
+		classes[decision.Policy.Class]++
+
+		switch decision.Policy.Class {
+		case "client":
+			clientHits[decision.ClientIP]++
+			if _, exists := config.BackendLimits[decision.Backend]; exists {
+				shadowed[fmt.Sprintf("backendLimits[%s] by clientLimits[%s]", decision.Backend, decision.ClientIP)]++
+			}
+		case "backend":
+			backendHits[decision.Backend]++
+		}
+
+		if *verbose {
+			fmt.Fprintf(out, "line %d: %s %s%s -> key=%s class=%s label=%q limit=%d burst=%d minute=%d cost=%g\n",
+				line, decision.ClientIP, decision.Backend, trace.Path, decision.Key, decision.Policy.Class, decision.Policy.Label,
+				decision.Policy.Limit, decision.Policy.Burst, decision.Policy.MinuteLimit, decision.Cost)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	fmt.Fprintf(out, "%d requests replayed, %d lines skipped\n", total, skipped)
+	for _, class := range sortedKeys(classes) {
+		fmt.Fprintf(out, "  %-10s %d\n", class, classes[class])
+	}
+
+	// Rules that never matched are often typos or precedence mistakes
+	var warnings []string
+	for client := range config.ClientLimits {
+		if clientHits[client] == 0 && !networkHit(client, clientHits) {
+			warnings = append(warnings, fmt.Sprintf("clientLimits[%s] never matched", client))
+		}
+	}
+	for backend := range config.BackendLimits {
+		if backendHits[backend] == 0 {
+			warnings = append(warnings, fmt.Sprintf("backendLimits[%s] never matched as the deciding rule", backend))
+		}
+	}
+	for rule, count := range shadowed {
+		warnings = append(warnings, fmt.Sprintf("%s shadowed for %d requests", rule, count))
+	}
+	sort.Strings(warnings)
+	for _, warning := range warnings {
+		fmt.Fprintf(out, "warning: %s\n", warning)
+	}
+	return nil
+}
+
+// parseTraceLine parses a Traefik access log line in JSON or common log format
+func parseTraceLine(line string) (traceRequest, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return traceRequest{}, false
+	}
+	if strings.HasPrefix(line, "{") {
+		return parseJSONTraceLine(line)
+	}
+	return parseCLFTraceLine(line)
+}
+
+// parseJSONTraceLine parses a line of Traefik's JSON access log. Request
+// headers are only available when the access log is configured to keep them.
+func parseJSONTraceLine(line string) (traceRequest, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return traceRequest{}, false
+	}
+
+	str := func(name string) string {
+		value, _ := fields[name].(string)
+		return value
+	}
+
+	trace := traceRequest{
+		ClientAddr: str("ClientAddr"),
+		Host:       str("RequestHost"),
+		Method:     str("RequestMethod"),
+		Path:       str("RequestPath"),
+		Header:     make(http.Header),
+	}
+	if trace.ClientAddr == "" && str("ClientHost") != "" {
+		trace.ClientAddr = net.JoinHostPort(str("ClientHost"), "0")
+	}
+	if trace.Method == "" {
+		trace.Method = http.MethodGet
+	}
+	if trace.ClientAddr == "" || trace.Path == "" {
+		return traceRequest{}, false
+	}
+
+	for name, value := range fields {
+		if header := strings.TrimPrefix(name, "request_"); header != name {
+			if s, ok := value.(string); ok {
+				trace.Header.Set(header, s)
+			}
+		}
+	}
+	return trace, true
+}
+
+// parseCLFTraceLine parses a line of Traefik's common log format:
+// <client> - <user> [<time>] "<method> <path> <proto>" ...
+func parseCLFTraceLine(line string) (traceRequest, bool) {
+	client, rest, found := strings.Cut(line, " ")
+	if !found {
+		return traceRequest{}, false
+	}
+
+	start := strings.IndexByte(rest, '"')
+	if start < 0 {
+		return traceRequest{}, false
+	}
+	end := strings.IndexByte(rest[start+1:], '"')
+	if end < 0 {
+		return traceRequest{}, false
+	}
+
+	parts := strings.Fields(rest[start+1 : start+1+end])
+	if len(parts) < 2 {
+		return traceRequest{}, false
+	}
+
+	return traceRequest{
+		ClientAddr: net.JoinHostPort(client, "0"),
+		Method:     parts[0],
+		Path:       parts[1],
+		Header:     make(http.Header),
+	}, true
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
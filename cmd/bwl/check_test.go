@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		ok     bool
+		client string
+		host   string
+		path   string
+	}{
+		{`{"ClientAddr":"10.0.0.1:5555","RequestHost":"api.local","RequestMethod":"GET","RequestPath":"/a"}`, true, "10.0.0.1:5555", "api.local", "/a"},
+		{`{"ClientHost":"2001:db8::1","RequestPath":"/b"}`, true, "[2001:db8::1]:0", "", "/b"},
+		{`10.0.0.2 - - [10/Oct/2026:13:55:36 +0000] "GET /c HTTP/1.1" 200 10 "-" "curl" 1 "router" "http://x" 3ms`, true, "10.0.0.2:0", "", "/c"},
+		{`{"RequestPath":"/no-client"}`, false, "", "", ""},
+		{`garbage`, false, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		trace, ok := parseTraceLine(tt.line)
+		if ok != tt.ok {
+			t.Errorf("parseTraceLine(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && (trace.ClientAddr != tt.client || trace.Host != tt.host || trace.Path != tt.path) {
+			t.Errorf("parseTraceLine(%q) = %+v", tt.line, trace)
+		}
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "cfg.json")
+	tracePath := filepath.Join(dir, "access.log")
+
+	os.WriteFile(configPath, []byte(`{"defaultLimit": 1000, "clientLimits": {"10.0.0.1": 5000, "10.9.9.9": 1}, "backendLimits": {"api.local": 2000}}`), 0644)
+	os.WriteFile(tracePath, []byte(`{"ClientAddr":"10.0.0.1:5555","RequestHost":"api.local","RequestPath":"/a"}
+{"ClientAddr":"10.0.0.2:5555","RequestHost":"api.local","RequestPath":"/b"}
+`), 0644)
+
+	var out bytes.Buffer
+	if err := runCheck([]string{"-config", configPath, "-trace", tracePath}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"2 requests replayed",
+		"warning: clientLimits[10.9.9.9] never matched",
+		"warning: backendLimits[api.local] by clientLimits[10.0.0.1] shadowed for 1 requests",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
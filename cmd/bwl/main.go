@@ -0,0 +1,69 @@
+// Command bwl is the operator tool for the bandwidthlimiter middleware.
+//
+// Usage:
+//
+//	bwl check -config cfg.json -trace access.log
+//	bwl migrate -middleware ratelimit.json -response-size 64KB
+//
+// The configuration file uses the same field names as the Traefik plugin
+// configuration, in JSON.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+const usage = `usage: bwl <command> [flags]
+
+Commands:
+  check    replay request metadata from an access log and report which rules match
+  migrate  convert a Traefik rateLimit middleware into a bandwidth limit
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "check":
+		err = runCheck(os.Args[2:], os.Stdout)
+	case "migrate":
+		err = runMigrate(os.Args[2:], os.Stdout, os.Stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "bwl: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bwl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads a JSON configuration on top of the plugin defaults
+func loadConfig(path string) (*bandwidthlimiter.Config, error) {
+	config := bandwidthlimiter.CreateConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// runMigrate implements "bwl migrate". The configuration goes to out, notes on
+// settings that don't convert exactly to notes.
+func runMigrate(args []string, out, notes io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	middlewarePath := flags.String("middleware", "", "JSON rateLimit middleware definition, as in Traefik's dynamic configuration")
+	average := flags.Int64("average", 0, "requests per period, overrides the middleware definition")
+	period := flags.String("period", "", "rate period, e.g. \"1s\" or \"1m\", overrides the middleware definition")
+	burst := flags.Int64("burst", 0, "burst in requests, overrides the middleware definition")
+	responseSize := flags.String("response-size", "", "average response size, e.g. \"64KB\"")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *responseSize == "" {
+		return fmt.Errorf("-response-size is required")
+	}
+
+	var options bandwidthlimiter.RateLimitOptions
+	if *middlewarePath != "" {
+		var err error
+		if options, err = loadRateLimit(*middlewarePath); err != nil {
+			return err
+		}
+	}
+	if *average != 0 {
+		options.Average = *average
+	}
+	if *period != "" {
+		options.Period = bandwidthlimiter.Duration(*period)
+	}
+	if *burst != 0 {
+		options.Burst = *burst
+	}
+
+	config, converted, err := bandwidthlimiter.ConvertRateLimit(options, bandwidthlimiter.Size(*responseSize))
+	if err != nil {
+		return err
+	}
+
+	// New fills in defaults, so take the fields before checking the result is accepted
+	changed, err := changedFields(config)
+	if err != nil {
+		return err
+	}
+	config.PersistenceFile = ""
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, config, "bwl-migrate")
+	if err != nil {
+		return fmt.Errorf("converted configuration is invalid: %w", err)
+	}
+	handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	data, err := json.MarshalIndent(changed, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s\n", data)
+
+	for _, note := range converted {
+		fmt.Fprintf(notes, "note: %s\n", note)
+	}
+	return nil
+}
+
+// loadRateLimit reads a rateLimit middleware definition, either the options
+// alone or wrapped in a "rateLimit" object
+func loadRateLimit(path string) (bandwidthlimiter.RateLimitOptions, error) {
+	var options bandwidthlimiter.RateLimitOptions
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return options, fmt.Errorf("failed to read middleware: %w", err)
+	}
+
+	var wrapped struct {
+		RateLimit *bandwidthlimiter.RateLimitOptions `json:"rateLimit"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return options, fmt.Errorf("failed to parse middleware %s: %w", path, err)
+	}
+	if wrapped.RateLimit != nil {
+		return *wrapped.RateLimit, nil
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return options, fmt.Errorf("failed to parse middleware %s: %w", path, err)
+	}
+	return options, nil
+}
+
+// changedFields returns the configuration fields that differ from the plugin
+// defaults, so the output only holds what the migration decided
+func changedFields(config *bandwidthlimiter.Config) (map[string]json.RawMessage, error) {
+	fields, err := configFields(config)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := configFields(bandwidthlimiter.CreateConfig())
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range fields {
+		if bytes.Equal(value, defaults[name]) {
+			delete(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+// configFields returns the JSON encoding of each configuration field
+func configFields(config *bandwidthlimiter.Config) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunMigrate(t *testing.T) {
+	middlewarePath := filepath.Join(t.TempDir(), "ratelimit.json")
+	os.WriteFile(middlewarePath, []byte(`{"rateLimit": {"average": 100, "burst": 50, "sourceCriterion": {"requestHeaderName": "X-User"}}}`), 0644)
+
+	var out, notes bytes.Buffer
+	if err := runMigrate([]string{"-middleware", middlewarePath, "-period", "1m", "-response-size", "64KB"}, &out, &notes); err != nil {
+		t.Fatal(err)
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &config); err != nil {
+		t.Fatalf("Expected a JSON configuration, got %v:\n%s", err, out.String())
+	}
+	expected := map[string]interface{}{
+		"defaultLimit":     "109227",
+		"burstSize":        "3276800",
+		"bucketScope":      "client",
+		"clientIPStrategy": "remoteAddr",
+		"keyHeader":        "X-User",
+	}
+	if len(config) != len(expected) {
+		t.Errorf("Expected only the converted fields, got:\n%s", out.String())
+	}
+	for name, value := range expected {
+		if config[name] != value {
+			t.Errorf("Expected %s %v, got %v", name, value, config[name])
+		}
+	}
+	if !strings.Contains(notes.String(), "note: Requests without the X-User header") {
+		t.Errorf("Expected a note on the key header, got:\n%s", notes.String())
+	}
+
+	if err := runMigrate([]string{"-average", "10"}, &out, &notes); err == nil {
+		t.Error("Expected an error without -response-size")
+	}
+}
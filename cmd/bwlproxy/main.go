@@ -0,0 +1,107 @@
+// Command bwlproxy runs a minimal reverse proxy in front of a single service,
+// applying the bandwidthlimiter middleware with its full configuration.
+//
+// Usage:
+//
+//	bwlproxy -listen :8080 -upstream http://127.0.0.1:3000 -config limits.json
+//
+// The configuration file uses the same field names as the Traefik plugin
+// configuration, in JSON.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to listen on")
+	upstream := flag.String("upstream", "", "URL of the service to proxy to")
+	configPath := flag.String("config", "", "path to a JSON middleware configuration (defaults are used if empty)")
+	name := flag.String("name", "bwlproxy", "middleware instance name used in logs")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+	flag.Parse()
+
+	if *upstream == "" {
+		fmt.Fprintln(os.Stderr, "bwlproxy: -upstream is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	target, err := url.Parse(*upstream)
+	if err != nil {
+		log.Fatalf("bwlproxy: invalid upstream URL: %v", err)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("bwlproxy: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	handler, err := bandwidthlimiter.New(ctx, proxy, config, *name)
+	if err != nil {
+		log.Fatalf("bwlproxy: invalid configuration: %v", err)
+	}
+	limiter := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	// Reads from the upstream are limited too if originReadLimit is set
+	proxy.Transport = limiter.OriginTransport(http.DefaultTransport)
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("bwlproxy: shutdown: %v", err)
+		}
+	}()
+
+	log.Printf("bwlproxy: listening on %s, proxying to %s", *listen, target)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("bwlproxy: %v", err)
+	}
+
+	// Stop background routines and save state once no more requests are served
+	limiter.Shutdown()
+}
+
+// loadConfig reads a JSON configuration on top of the plugin defaults
+func loadConfig(path string) (*bandwidthlimiter.Config, error) {
+	config := bandwidthlimiter.CreateConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return config, nil
+}
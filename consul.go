@@ -0,0 +1,127 @@
+package bandwidthlimiter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// limitClassService is reported for requests limited by the ServiceLimits entry of their calling service
+const limitClassService = "service"
+
+// Labels of Consul DNS names that follow the service name, e.g. in
+// "web.service.dc1.consul" or "web.virtual.consul"
+var consulServiceLabels = map[string]bool{
+	"service": true,
+	"connect": true,
+	"virtual": true,
+	"ingress": true,
+}
+
+// serviceIdentity returns the calling service named by the request's
+// ServiceIdentityHeader, or "" if it names none. Services outside the default
+// namespace are named "<namespace>/<service>".
+func (bl *BandwidthLimiter) serviceIdentity(req *http.Request) string {
+	value := strings.TrimSpace(req.Header.Get(bl.config.ServiceIdentityHeader))
+	if value == "" {
+		return ""
+	}
+	if !strings.HasPrefix(value, "spiffe://") {
+		value = xfccURI(value)
+	}
+	return spiffeService(value)
+}
+
+// xfccURI returns the URI of the nearest hop in an X-Forwarded-Client-Cert
+// value: the last element, as every proxy appends its client's certificate
+func xfccURI(value string) string {
+	elements := strings.Split(value, ",")
+	for _, field := range strings.Split(elements[len(elements)-1], ";") {
+		field = strings.TrimSpace(field)
+		if i := strings.Index(field, "="); i >= 0 && strings.EqualFold(field[:i], "URI") {
+			return strings.Trim(field[i+1:], `"`)
+		}
+	}
+	return ""
+}
+
+// spiffeService returns the service of a Consul SPIFFE ID such as
+// "spiffe://<trust-domain>/ns/default/dc/dc1/svc/web", or "" if id isn't one
+func spiffeService(id string) string {
+	path := strings.TrimPrefix(id, "spiffe://")
+	if path == id {
+		return ""
+	}
+	segments := strings.Split(path, "/")[1:] // After the trust domain
+	
+	namespace, service := "", ""
+	for i := 0; i+1 < len(segments); i += 2 {
+		switch segments[i] {
+		case "ns":
+			namespace = segments[i+1]
+		case "svc":
+			service = segments[i+1]
+		}
+	}
+	if !validServiceName(service) || (namespace != "" && !validServiceName(namespace)) {
+		return ""
+	}
+	if namespace != "" && namespace != "default" {
+		return namespace + "/" + service
+	}
+	return service
+}
+
+// validServiceName reports whether a name is safe to use in bucket keys,
+// which use ":", "|", "~", "@", "#" and "$" as separators
+func validServiceName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceID returns the client ID a calling service is stored under in bucket keys
+func serviceID(service string) string {
+	return "svc-" + service
+}
+
+// consulBackend returns the service a Consul DNS host name such as
+// "v2.web.service.dc1.consul" resolves to, or host itself if it isn't one
+func (bl *BandwidthLimiter) consulBackend(host string) string {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	suffix := "." + strings.ToLower(bl.config.ConsulDomain)
+	if !strings.HasSuffix(name, suffix) {
+		return host
+	}
+	
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	for i := 1; i < len(labels); i++ {
+		if consulServiceLabels[labels[i]] {
+			return labels[i-1]
+		}
+	}
+	return host
+}
+
+// parseServiceLimits parses ServiceLimits into limits by client ID
+func parseServiceLimits(limits map[string]Size) (map[string]int64, error) {
+	parsed, err := parseLimits("serviceLimits", limits)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]int64, len(parsed))
+	for service, limit := range parsed {
+		byID[serviceID(service)] = limit
+	}
+	return byID, nil
+}
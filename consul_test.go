@@ -0,0 +1,104 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestServiceIdentity tests that mesh callers are keyed and limited by their Consul service
+func TestServiceIdentity(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ServiceIdentityHeader = "X-Forwarded-Client-Cert"
+	cfg.ServiceLimits["web"] = "2MB"
+	cfg.ServiceLimits["payments/api"] = "512KB"
+	cfg.ClientLimits["10.0.0.1"] = "5MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	decide := func(ip, identity string) bandwidthlimiter.Decision {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = ip + ":1000"
+		if identity != "" {
+			req.Header.Set("X-Forwarded-Client-Cert", identity)
+		}
+		return bl.Decide(req)
+	}
+
+	// Instances of a service share its bucket, and its limit beats client rules
+	web := `By=spiffe://dc1.consul/ns/default/dc/dc1/svc/api;Hash=abc;URI=spiffe://dc1.consul/ns/default/dc/dc1/svc/web`
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		decision := decide(ip, web)
+		if decision.Key != "svc-web:backend.local" || decision.Policy.Class != "service" || decision.Policy.Limit != 2*1024*1024 {
+			t.Errorf("%s: expected the web service's bucket and limit, got key %q and %+v", ip, decision.Key, decision.Policy)
+		}
+	}
+
+	// The last element of a forwarded chain is the nearest caller
+	chain := `URI=spiffe://dc1.consul/ns/default/dc/dc1/svc/gateway,By=spiffe://dc1.consul/ns/default/dc/dc1/svc/web;URI="spiffe://dc1.consul/ns/payments/dc/dc1/svc/api"`
+	if decision := decide("10.0.0.3", chain); decision.Key != "svc-payments/api:backend.local" || decision.Policy.Limit != 512*1024 {
+		t.Errorf("Expected the namespaced caller, got key %q and %+v", decision.Key, decision.Policy)
+	}
+
+	// Bare SPIFFE IDs work too, and services without a rule get the default limit
+	if decision := decide("10.0.0.3", "spiffe://dc1.consul/ns/default/dc/dc1/svc/billing"); decision.Key != "svc-billing:backend.local" || decision.Policy.Class != "default" {
+		t.Errorf("Expected the billing service's bucket, got key %q and %+v", decision.Key, decision.Policy)
+	}
+
+	// Callers without a usable identity are keyed by client IP
+	for _, identity := range []string{"", "URI=spiffe://dc1.consul/ns/default/dc/dc1/svc/we:b", "Hash=abc", "spiffe://dc1.consul/ns/default"} {
+		if decision := decide("10.0.0.1", identity); decision.Key != "10.0.0.1:backend.local" || decision.Policy.Class != "client" {
+			t.Errorf("%q: expected the client's bucket, got key %q and %+v", identity, decision.Key, decision.Policy)
+		}
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.ServiceLimits["web"] = "2MB"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for serviceLimits without serviceIdentityHeader")
+	}
+}
+
+// TestConsulBackends tests that Consul DNS names are attributed to their service
+func TestConsulBackends(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ConsulDomain = "consul"
+	cfg.BackendLimits["web"] = "3MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	tests := []struct {
+		host    string
+		backend string
+	}{
+		{"web.service.consul", "web"},
+		{"v2.web.service.dc1.consul:8080", "web"},
+		{"WEB.virtual.consul.", "web"},
+		{"web.connect.consul", "web"},
+		{"node1.node.consul", "node1.node.consul"},
+		{"web.example.com", "web.example.com"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		decision := bl.Decide(req)
+		if decision.Backend != tt.backend {
+			t.Errorf("%s: expected backend %q, got %q", tt.host, tt.backend, decision.Backend)
+		}
+		if tt.backend == "web" && decision.Policy.Limit != 3*1024*1024 {
+			t.Errorf("%s: expected the web backend limit, got %+v", tt.host, decision.Policy)
+		}
+	}
+}
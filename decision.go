@@ -0,0 +1,189 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// Decision describes how a request is limited: which bucket it is paid from
+// and which limits apply
+type Decision struct {
+	ClientIP string
+	Backend  string
+	Key      string
+	Policy   limiter.Policy
+	
+	// ClientIP as stored in bucket keys, see Config.ClientIDMode
+	ClientID string
+	
+	// Tokens consumed per byte written, see Config.RouteCosts
+	Cost float64
+	
+	// Entrypoint whose profile supplied the default limit, see Config.EntryPointProfiles
+	EntryPoint string
+	
+	// TierClaim value whose TierLimits entry supplied the limit, if any
+	Tier string
+	
+	// Reputation tier whose ReputationLimits entry supplied the limit, if any
+	Reputation string
+	
+	// Country or continent code whose CountryLimits or ContinentLimits entry
+	// supplied the limit, if any
+	Country string
+	
+	// Whether a LimitSchedules entry replaced the limit of the rule
+	Scheduled bool
+	
+	// Whether a limit set with SetKeyLimit replaced the limit of the rule
+	Overridden bool
+	
+	// Config.LimitProfiles entry whose rules were in effect, if any
+	Profile string
+	
+	// Path of the Config.PathLimits rule that supplied the limit, if any
+	PathLimit string
+	pathRule  int // Index of that rule
+}
+
+// Decide resolves the bucket and limits for a request without consuming any
+// tokens, e.g. to check a configuration against recorded traffic
+func (bl *BandwidthLimiter) Decide(req *http.Request) Decision {
+	// RulesFile reloads wait until the decision is made and cached
+	bl.rulesMutex.RLock()
+	defer bl.rulesMutex.RUnlock()
+	
+	entryPoint := bl.entryPoint(req)
+	now := time.Now()
+	if bl.resolutions == nil {
+		return bl.override(bl.schedule(bl.decide(req, entryPoint), now))
+	}
+	
+	// Repeat clients reuse their decision while it is cached. Route costs
+	// are cheap prefix matches and keep the path out of most cache keys.
+	// Schedules and runtime limits are applied afterwards, so cached
+	// decisions follow them.
+	key := bl.resolutionKey(req, entryPoint)
+	if decision, ok := bl.resolutions.get(key, now); ok {
+		decision.Cost = bl.resolveCost(req.URL.Path)
+		return bl.override(bl.schedule(decision, now))
+	}
+	decision := bl.decide(req, entryPoint)
+	bl.resolutions.put(key, decision, now)
+	return bl.override(bl.schedule(decision, now))
+}
+
+// decide resolves the bucket and limits for a request arriving through entryPoint
+func (bl *BandwidthLimiter) decide(req *http.Request, entryPoint string) Decision {
+	// Extract client IP
+	clientIP := bl.clientIPs.clientIP(req)
+	
+	// Get backend address from request
+	backend := req.URL.Host
+	if bl.config.ConsulDomain != "" {
+		backend = bl.consulBackend(backend)
+	}
+	if backend == "" {
+		backend = "default"
+	}
+	
+	// Determine the bandwidth limit and per-minute budget to apply
+	policy := bl.resolvePolicy(clientIP, backend)
+	
+	// Create or get the token bucket for this client/backend combination
+	clientID := bl.clientID(clientIP)
+	
+	// API keys identify the caller better than an address shared behind NAT
+	keyID := ""
+	if bl.config.KeyHeader != "" {
+		if apiKey := bl.apiKey(req); apiKey != "" {
+			keyID = apiKeyID(apiKey)
+			clientID = keyID
+		}
+	}
+	
+	// Mesh callers are identified by their service wherever they run
+	if keyID == "" && bl.config.ServiceIdentityHeader != "" {
+		if service := bl.serviceIdentity(req); service != "" {
+			keyID = serviceID(service)
+			clientID = keyID
+		}
+	}
+	var key keyBuilder
+	bl.buildBucketKey(&key, clientID, backend, directionDownload)
+	
+	// The matching key, client, tier, path or backend rule supplies the limit,
+	// see Config.RuleMatching. Tier and path rules get buckets of their own.
+	tier, reputation, country, pathRule := "", "", "", -1
+	rule, matched := bl.pickRule(func(class string) (ruleMatch, bool) {
+		return bl.matchRule(class, req, clientIP, keyID, backend)
+	})
+	if matched {
+		policy.Limit = rule.limit
+		policy.Class = rule.class
+		switch rule.class {
+		case limitClassTier:
+			tier = rule.tier
+		case limitClassReputation:
+			reputation = rule.reputation
+			reputationKey(&key, reputation)
+		case limitClassCountry:
+			country = rule.country
+		case limitClassPath:
+			pathRule = rule.pathRule
+			pathKey(&key, pathRule)
+		}
+	} else {
+		policy.Limit = bl.parsed.defaultLimit
+		policy.Class = limitClassDefault
+	}
+	
+	// The entrypoint's profile replaces the default limit
+	profile, profiled := bl.parsed.entryPointProfiles[entryPoint]
+	if profiled && policy.Class == limitClassDefault {
+		policy.Limit = profile.limit
+		policy.Burst = profile.burst
+		policy.Class = limitClassEntryPoint
+		entryPointKey(&key, entryPoint)
+	} else {
+		entryPoint = ""
+	}
+	
+	// Anonymous clients without a more specific rule get the anonymous allowance
+	if bl.config.AuthDetection != "" && policy.Class == limitClassDefault && !bl.isAuthenticated(req) {
+		if bl.parsed.anonymousLimit > 0 {
+			policy.Limit = bl.parsed.anonymousLimit
+		}
+		if bl.parsed.anonymousBurstSize > 0 {
+			policy.Burst = bl.parsed.anonymousBurstSize
+		}
+		policy.Class = limitClassAnonymous
+		anonymousKey(&key)
+	}
+	
+	if tier != "" {
+		tierKey(&key, tier)
+	}
+	
+	decision := Decision{
+		ClientIP: clientIP,
+		ClientID: clientID,
+		Backend:  backend,
+		Key:      key.String(),
+		Policy:   policy,
+		Cost:     bl.resolveCost(req.URL.Path),
+		
+		EntryPoint: entryPoint,
+		Tier:       tier,
+		Reputation: reputation,
+		Country:    country,
+		Profile:    bl.parsed.profile,
+	}
+	if pathRule >= 0 {
+		decision.PathLimit = bl.parsed.pathLimits[pathRule].path
+		decision.pathRule = pathRule
+	}
+	return decision
+}
@@ -0,0 +1,68 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// newKeyedLimiter creates a limiter whose keys carry path and anonymous suffixes
+func newKeyedLimiter(tb testing.TB) *bandwidthlimiter.BandwidthLimiter {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "/api/", Limit: "5MB"}}
+	cfg.AuthDetection = "header"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return handler.(*bandwidthlimiter.BandwidthLimiter)
+}
+
+// TestDecideAllocs tests that resolving a request's bucket key allocates only the key
+func TestDecideAllocs(t *testing.T) {
+	bl := newKeyedLimiter(t)
+
+	for _, path := range []string{"/", "/api/users"} {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local"+path, nil)
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+
+		var key string
+		allocs := testing.AllocsPerRun(100, func() {
+			key = bl.Decide(req).Key
+		})
+		if allocs > 1 {
+			t.Errorf("%s: expected 1 allocation for key %q, got %v", path, key, allocs)
+		}
+	}
+}
+
+// BenchmarkDecide measures resolving the bucket and limits of a request
+func BenchmarkDecide(b *testing.B) {
+	bl := newKeyedLimiter(b)
+
+	for _, path := range []string{"/", "/api/users"} {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local"+path, nil)
+		b.Run(path, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bl.Decide(req)
+			}
+		})
+	}
+}
+
+// BenchmarkServeHTTP measures the per-request overhead of an empty limited response
+func BenchmarkServeHTTP(b *testing.B) {
+	bl := newKeyedLimiter(b)
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bl.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
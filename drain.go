@@ -0,0 +1,62 @@
+package bandwidthlimiter
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// How often Shutdown checks whether draining responses have finished
+const drainPollInterval = 10 * time.Millisecond
+
+// drainState counts the limited responses in flight, so Shutdown can give
+// them DrainTimeout to finish at DrainBoost times their limit
+type drainState struct {
+	active   int64   // Responses in flight, updated atomically
+	draining int32   // Set once Shutdown started draining, updated atomically
+	boost    float64 // See Config.DrainBoost
+}
+
+// begin counts a response as in flight until end is called
+func (d *drainState) begin() {
+	atomic.AddInt64(&d.active, 1)
+}
+
+// end counts a response as finished
+func (d *drainState) end() {
+	atomic.AddInt64(&d.active, -1)
+}
+
+// started reports whether Shutdown is draining responses
+func (d *drainState) started() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// boostTokens returns the tokens paid for a draining chunk that costs tokens
+// outside of a drain
+func (d *drainState) boostTokens(tokens int64) int64 {
+	return int64(math.Ceil(float64(tokens) / d.boost))
+}
+
+// drain lets in-flight responses finish for up to DrainTimeout, sped up by
+// DrainBoost. Responses still transferring afterwards are cut off at their
+// next wait for tokens, once Shutdown closes shutdownChan.
+func (bl *BandwidthLimiter) drain() {
+	if bl.parsed.drainTimeout == 0 {
+		return
+	}
+	atomic.StoreInt32(&bl.drainer.draining, 1)
+	
+	deadline := time.Now().Add(bl.parsed.drainTimeout)
+	for {
+		active := atomic.LoadInt64(&bl.drainer.active)
+		if active == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			bl.log.warnf("%d responses still transferring after a drain of %v", active, bl.parsed.drainTimeout)
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
@@ -0,0 +1,127 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// startDrainTransfer starts a 200KB response limited to 20KB/s and returns
+// the limiter and a channel receiving the response's stats once it is done
+func startDrainTransfer(t *testing.T, cfg *bandwidthlimiter.Config, ctx context.Context) (*bandwidthlimiter.BandwidthLimiter, chan bandwidthlimiter.RequestStats) {
+	cfg.DefaultLimit = "20KB"
+	cfg.BurstSize = "20KB"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 200*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	done := make(chan bandwidthlimiter.RequestStats, 1)
+	bl.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		done <- *stats
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/file", nil).WithContext(ctx)
+	req.RemoteAddr = "10.0.0.1:1000"
+	go func() {
+		// Cut off responses abort their handler, which the server recovers from
+		defer func() {
+			if r := recover(); r != nil && r != http.ErrAbortHandler {
+				panic(r)
+			}
+		}()
+		bl.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(100 * time.Millisecond) // Through the burst and into throttling
+	return bl, done
+}
+
+// TestDrainUnlimited tests that Shutdown lets in-flight responses finish unlimited
+func TestDrainUnlimited(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DrainTimeout = "5s"
+	bl, done := startDrainTransfer(t, cfg, context.Background())
+
+	start := time.Now()
+	bl.Shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the drain to end with the response, took %v", elapsed)
+	}
+	select {
+	case stats := <-done:
+		if !stats.Drained || stats.BytesWritten != 200*1024 {
+			t.Errorf("Expected the drained response to be sent in full, got %+v", stats)
+		}
+	default:
+		t.Error("Expected the response to be done once Shutdown returned")
+	}
+}
+
+// TestDrainBoost tests that draining responses continue at DrainBoost times their limit
+func TestDrainBoost(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DrainTimeout = "10s"
+	cfg.DrainBoost = 10
+	bl, done := startDrainTransfer(t, cfg, context.Background())
+
+	// About 180KB are left, which takes 9s at 20KB/s and 0.9s at 200KB/s
+	start := time.Now()
+	bl.Shutdown()
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the rest of the response to take about 0.9s, took %v", elapsed)
+	}
+	if stats := <-done; !stats.Drained || stats.BytesWritten != 200*1024 {
+		t.Errorf("Expected the drained response to be sent in full, got %+v", stats)
+	}
+}
+
+// TestDrainTimeout tests that Shutdown stops waiting for responses after
+// DrainTimeout and cuts off those still waiting for tokens
+func TestDrainTimeout(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DrainTimeout = "200ms"
+	cfg.DrainBoost = 1
+	bl, done := startDrainTransfer(t, cfg, context.Background())
+
+	start := time.Now()
+	bl.Shutdown()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected Shutdown to give up after 200ms, took %v", elapsed)
+	}
+	select {
+	case stats := <-done:
+		if stats.Aborted != "shutdown" || stats.BytesWritten == 200*1024 {
+			t.Errorf("Expected the response to be cut off, got %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the response to end with the shutdown")
+	}
+}
+
+// TestDrainConfig tests the validation of the drain settings
+func TestDrainConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	tests := []struct {
+		timeout bandwidthlimiter.Duration
+		boost   float64
+	}{
+		{"-1s", 0},
+		{"30s", 0.5},
+		{"30s", -2},
+		{"", 4},
+	}
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DrainTimeout, cfg.DrainBoost = tt.timeout, tt.boost
+		if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for drainTimeout %q and drainBoost %v", tt.timeout, tt.boost)
+		}
+	}
+}
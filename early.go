@@ -0,0 +1,103 @@
+package bandwidthlimiter
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// earlyThrottle counts the responses taking part in early throttling, see
+// Config.GlobalEarlyThrottle
+type earlyThrottle struct {
+	active  int64 // Responses paying from the global bucket, updated atomically
+	delayed int64 // Chunks delayed so far, updated atomically
+}
+
+// earlyShare is a response's part in early throttling. Like random early
+// detection in routers, chunks are delayed at random before the global
+// bucket runs empty, so clients back off one at a time instead of all
+// stalling together once it is.
+type earlyShare struct {
+	bl     *BandwidthLimiter
+	bucket *limiter.TokenBucket // Local global bucket
+	limit  int64                // Limit of the response's own bucket
+}
+
+// joinEarlyThrottle returns the early throttling share of a response limited
+// to limit, nil if early throttling is disabled or the global bucket is
+// not local
+func (bl *BandwidthLimiter) joinEarlyThrottle(limit int64) *earlyShare {
+	if bl.config.GlobalEarlyThrottle == 0 || bl.parsed.globalLimit == 0 {
+		return nil
+	}
+	entry, ok := bl.buckets.Load(globalKey)
+	if !ok {
+		return nil
+	}
+	atomic.AddInt64(&bl.early.active, 1)
+	return &earlyShare{bl: bl, bucket: entry.Bucket, limit: limit}
+}
+
+// leaveEarly stops counting the response towards the responses in flight
+func (lrw *limitedResponseWriter) leaveEarly() {
+	if lrw.early != nil {
+		atomic.AddInt64(&lrw.early.bl.early.active, -1)
+		lrw.early = nil
+	}
+}
+
+// delay returns how long to hold the next chunk, usually 0. Once more than
+// GlobalEarlyThrottle of the global burst is used, the chance of a delay
+// rises linearly to 1 as the bucket empties. It is weighted by the
+// response's limit against an equal split of the global limit between the
+// responses in flight, so clients allowed more than their split back off at
+// the full chance and smaller ones less often.
+func (s *earlyShare) delay() time.Duration {
+	threshold := s.bl.config.GlobalEarlyThrottle
+	state := s.bucket.State()
+	if state.BurstSize <= 0 {
+		return 0
+	}
+	used := 1 - float64(s.bucket.Available())/float64(state.BurstSize)
+	if used <= threshold {
+		return 0
+	}
+	pressure := (used - threshold) / (1 - threshold)
+	
+	share := 1.0
+	if s.limit != Unlimited {
+		fair := float64(state.Limit) / float64(atomic.LoadInt64(&s.bl.early.active))
+		if weight := float64(s.limit) / fair; weight < share {
+			share = weight
+		}
+	}
+	if rand.Float64() >= pressure*share {
+		return 0
+	}
+	atomic.AddInt64(&s.bl.early.delayed, 1)
+	return s.bl.parsed.globalEarlyDelay
+}
+
+// holdEarly holds the next chunk if early throttling picks it, returning
+// how long it was held
+func (lrw *limitedResponseWriter) holdEarly() (time.Duration, error) {
+	delay := lrw.early.delay()
+	if delay == 0 {
+		return 0, nil
+	}
+	lrw.stats.EarlyThrottled++
+	
+	ctx, cancel := lrw.waits.chunk()
+	defer cancel()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	
+	select {
+	case <-ctx.Done():
+		return 0, lrw.waitError()
+	case <-timer.C:
+		return delay, nil
+	}
+}
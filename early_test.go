@@ -0,0 +1,86 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// earlyThrottled sends a 256KB response through a 256KB/s global limit with
+// a 64KB burst and returns its stats and the limiter's metrics
+func earlyThrottled(t *testing.T, threshold float64) (*bandwidthlimiter.RequestStats, string) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB"
+	cfg.BurstSize = "10MB"
+	cfg.GlobalLimit = "256KB"
+	cfg.GlobalBurstSize = "64KB"
+	cfg.GlobalEarlyThrottle = threshold
+	cfg.GlobalEarlyDelay = "5ms"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 256*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	done := make(chan *bandwidthlimiter.RequestStats, 1)
+	bl.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		done <- stats
+	})
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	bl.ServeHTTP(httptest.NewRecorder(), req)
+
+	var metrics bytes.Buffer
+	if err := bl.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	return <-done, metrics.String()
+}
+
+// TestGlobalEarlyThrottle tests that chunks are delayed at random once the
+// global bucket runs low
+func TestGlobalEarlyThrottle(t *testing.T) {
+	stats, metrics := earlyThrottled(t, 0.25)
+	if stats.EarlyThrottled == 0 || stats.BytesWritten != 256*1024 {
+		t.Errorf("Expected some chunks to be delayed early, got %+v", stats)
+	}
+	if delayed := metricValue(t, metrics, "bwl_early_throttle_delays_total"); delayed != float64(stats.EarlyThrottled) {
+		t.Errorf("Expected %d delays in the metrics, got %v", stats.EarlyThrottled, delayed)
+	}
+
+	if stats, _ := earlyThrottled(t, 0); stats.EarlyThrottled != 0 {
+		t.Errorf("Expected no early delays when disabled, got %d", stats.EarlyThrottled)
+	}
+}
+
+// TestGlobalEarlyThrottleConfig tests that globalEarlyThrottle is validated
+func TestGlobalEarlyThrottleConfig(t *testing.T) {
+	tests := []struct {
+		threshold float64
+		global    bandwidthlimiter.Size
+		delay     bandwidthlimiter.ShortDuration
+	}{
+		{-0.1, "1MB", ""},
+		{1, "1MB", ""},
+		{0.8, "", ""},
+		{0.8, "1MB", "-5ms"},
+	}
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.GlobalEarlyThrottle = tt.threshold
+		cfg.GlobalLimit = tt.global
+		cfg.GlobalEarlyDelay = tt.delay
+		if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for %+v", tt)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package bandwidthlimiter
+
+import (
+	"net"
+	"net/http"
+)
+
+// EntryPointProfile holds the defaults for requests arriving through one entrypoint
+type EntryPointProfile struct {
+	// Default bandwidth limit for the entrypoint, or "unlimited"
+	DefaultLimit Size `json:"defaultLimit"`
+	
+	// Burst size for the entrypoint
+	// Default: 10x defaultLimit
+	BurstSize Size `json:"burstSize,omitempty"`
+}
+
+// entryPointProfile is an EntryPointProfile with its sizes parsed
+type entryPointProfile struct {
+	limit int64
+	burst int64
+}
+
+// limitClassEntryPoint is reported for requests that got their entrypoint's default limit
+const limitClassEntryPoint = "entrypoint"
+
+// entryPointKey marks a bucket key as belonging to traffic of an entrypoint,
+// so the same client gets separate buckets on differently limited entrypoints
+func entryPointKey(key *keyBuilder, entryPoint string) {
+	key.add("@", entryPoint)
+}
+
+// entryPoint returns the entrypoint a request arrived through: the value of
+// EntryPointHeader if configured, else the port of the local address
+func (bl *BandwidthLimiter) entryPoint(req *http.Request) string {
+	if bl.config.EntryPointHeader != "" {
+		return req.Header.Get(bl.config.EntryPointHeader)
+	}
+	
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// parseEntryPointProfiles parses the sizes of all entrypoint profiles
+func parseEntryPointProfiles(profiles map[string]EntryPointProfile) (map[string]entryPointProfile, error) {
+	parsed := make(map[string]entryPointProfile, len(profiles))
+	for name, profile := range profiles {
+		limit, err := parseSize(profile.DefaultLimit)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "entryPointProfiles[%s].defaultLimit: %v", name, err)
+		}
+		if limit == 0 || (limit < 0 && limit != Unlimited) {
+			return nil, wrapf(ErrInvalidLimit, "entryPointProfiles[%s].defaultLimit must be greater than 0, or -1 or \"unlimited\"", name)
+		}
+		
+		burst, err := parseSize(profile.BurstSize)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "entryPointProfiles[%s].burstSize: %v", name, err)
+		}
+		if burst < 0 {
+			return nil, wrapf(ErrInvalidLimit, "entryPointProfiles[%s].burstSize must not be negative", name)
+		}
+		if burst == 0 && limit != Unlimited {
+			burst = limit * 10 // Default burst is 10x the rate
+		}
+		
+		parsed[name] = entryPointProfile{limit: limit, burst: burst}
+	}
+	return parsed, nil
+}
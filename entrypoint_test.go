@@ -0,0 +1,85 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestEntryPointProfiles tests that the entrypoint a request arrives through selects its defaults
+func TestEntryPointProfiles(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.EntryPointProfiles["8080"] = bandwidthlimiter.EntryPointProfile{DefaultLimit: "unlimited"}
+	cfg.EntryPointProfiles["443"] = bandwidthlimiter.EntryPointProfile{DefaultLimit: "512KB", BurstSize: "1MB"}
+	cfg.ClientLimits["10.0.0.9"] = "2MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	decide := func(ip string, port int) bandwidthlimiter.Decision {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = ip + ":1000"
+		local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+		return bl.Decide(req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local)))
+	}
+
+	if decision := decide("10.0.0.1", 8080); decision.Policy.Limit != bandwidthlimiter.Unlimited {
+		t.Errorf("Expected the internal entrypoint to be unlimited, got %+v", decision.Policy)
+	}
+
+	decision := decide("10.0.0.1", 443)
+	if decision.Policy.Limit != 512*1024 || decision.Policy.Burst != 1024*1024 || decision.Policy.Class != "entrypoint" {
+		t.Errorf("Expected the public profile, got %+v", decision.Policy)
+	}
+	if decision.Key != "10.0.0.1:backend.local@443" || decision.EntryPoint != "443" {
+		t.Errorf("Expected a separate bucket for the entrypoint, got key %q", decision.Key)
+	}
+
+	// Client rules take precedence over the profile
+	if decision := decide("10.0.0.9", 443); decision.Policy.Limit != 2*1024*1024 || decision.Key != "10.0.0.9:backend.local" {
+		t.Errorf("Expected the client rule, got %+v with key %q", decision.Policy, decision.Key)
+	}
+
+	// Entrypoints without a profile get the global default
+	if decision := decide("10.0.0.1", 9000); decision.Policy.Limit != 1024*1024 || decision.EntryPoint != "" {
+		t.Errorf("Expected the default limit, got %+v", decision.Policy)
+	}
+}
+
+// TestEntryPointHeader tests that entrypoints can be named by a request header
+func TestEntryPointHeader(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.EntryPointHeader = "X-Entrypoint"
+	cfg.EntryPointProfiles["internal"] = bandwidthlimiter.EntryPointProfile{DefaultLimit: "unlimited"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	if decision := bl.Decide(req); decision.Policy.Limit == bandwidthlimiter.Unlimited {
+		t.Error("Expected requests without the header to be limited")
+	}
+
+	req.Header.Set("X-Entrypoint", "internal")
+	if decision := bl.Decide(req); decision.Policy.Limit != bandwidthlimiter.Unlimited {
+		t.Errorf("Expected the internal profile, got %+v", decision.Policy)
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.EntryPointProfiles["public"] = bandwidthlimiter.EntryPointProfile{DefaultLimit: "0"}
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for a profile without a limit")
+	}
+}
@@ -0,0 +1,33 @@
+package bandwidthlimiter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors callers can test for with errors.Is. The errors returned still
+// describe the failure, e.g. "burstSize must not be negative"; these only
+// tell what kind of failure it is.
+var (
+	// ErrInvalidLimit is wrapped by errors about an invalid configuration
+	// from New, e.g. a limit, duration or mode, about invalid limits and keys
+	// from SetKeyLimit and ConvertRateLimit, and about invalid targets from
+	// Usage, ResetBucket and Purge
+	ErrInvalidLimit = errors.New("invalid limit")
+	
+	// ErrStoreUnavailable is wrapped by errors about buckets that couldn't be
+	// saved to PersistenceFile, from Save
+	ErrStoreUnavailable = errors.New("bucket store unavailable")
+	
+	// ErrQuotaExceeded is wrapped by RequestStats.Err when a request was
+	// rejected by ClusterQuota or cut short by MaxBytesPerRequest or
+	// MaxTransferTime
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// wrapf formats an error like fmt.Errorf that also wraps sentinel, without
+// adding its text to the message. Plain %w wrapping is used rather than an
+// error type with an Is method, which Yaegi doesn't see through.
+func wrapf(sentinel error, format string, args ...interface{}) error {
+	return fmt.Errorf(format+"%.0w", append(args, sentinel)...)
+}
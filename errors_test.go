@@ -0,0 +1,167 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestErrInvalidLimit tests that every configuration error New reports can be
+// told apart from runtime failures, without changing the messages
+func TestErrInvalidLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *bandwidthlimiter.Config)
+	}{
+		// Sizes and limits
+		{"bad unit", func(cfg *bandwidthlimiter.Config) { cfg.DefaultLimit = "10XB" }},
+		{"negative burst", func(cfg *bandwidthlimiter.Config) { cfg.BurstSize = "-1" }},
+		{"negative client limit", func(cfg *bandwidthlimiter.Config) { cfg.ClientLimits["10.0.0.1"] = "-2" }},
+		{"negative quota", func(cfg *bandwidthlimiter.Config) { cfg.ClusterQuota = "-1" }},
+		{"bad minute limit", func(cfg *bandwidthlimiter.Config) { cfg.ClientMinuteLimits["10.0.0.1"] = "lots" }},
+		{"bad initial tokens", func(cfg *bandwidthlimiter.Config) {
+			cfg.Preload = []bandwidthlimiter.PreloadBucket{{ClientIP: "10.0.0.1", InitialTokens: "half"}}
+		}},
+
+		// Durations
+		{"bad duration", func(cfg *bandwidthlimiter.Config) { cfg.CleanupInterval = "5 minutes" }},
+		{"negative duration", func(cfg *bandwidthlimiter.Config) { cfg.BucketMaxAge = "-1h" }},
+		{"bad wait", func(cfg *bandwidthlimiter.Config) { cfg.MaxWait = "soon" }},
+		{"fractional quota period", func(cfg *bandwidthlimiter.Config) { cfg.ClusterQuotaPeriod = "1.5s" }},
+		{"bad queue override", func(cfg *bandwidthlimiter.Config) { cfg.ClientQueueMaxWaits["10.0.0.1"] = "-1s" }},
+		{"unknown timezone", func(cfg *bandwidthlimiter.Config) { cfg.ScheduleTimezone = "Mars/Olympus" }},
+
+		// Enums
+		{"unknown pacing", func(cfg *bandwidthlimiter.Config) { cfg.Pacing = "warp" }},
+		{"unknown mode", func(cfg *bandwidthlimiter.Config) { cfg.Mode = "drop" }},
+		{"unknown storage", func(cfg *bandwidthlimiter.Config) { cfg.Storage = "etcd" }},
+		{"unknown log level", func(cfg *bandwidthlimiter.Config) { cfg.LogLevel = "loud" }},
+		{"unknown client IP strategy", func(cfg *bandwidthlimiter.Config) { cfg.ClientIPStrategy = "cookie" }},
+		{"unknown rule type", func(cfg *bandwidthlimiter.Config) { cfg.RuleOrder = []string{"planet"} }},
+
+		// Settings requiring others
+		{"request burst without limit", func(cfg *bandwidthlimiter.Config) { cfg.RequestBurst = 10 }},
+		{"negative count", func(cfg *bandwidthlimiter.Config) { cfg.MaxConcurrent = -1 }},
+		{"admin without token", func(cfg *bandwidthlimiter.Config) { cfg.AdminAddress = "0.0.0.0:9180" }},
+		{"partition without token", func(cfg *bandwidthlimiter.Config) {
+			cfg.PartitionPeers = []string{"10.0.0.1:9190"}
+			cfg.PartitionSelf = "10.0.0.1:9190"
+		}},
+		{"preload without client", func(cfg *bandwidthlimiter.Config) {
+			cfg.Preload = []bandwidthlimiter.PreloadBucket{{InitialTokens: "1KB"}}
+		}},
+
+		// Rule lists
+		{"client CIDR", func(cfg *bandwidthlimiter.Config) { cfg.ClientLimits["10.0.0.0/33"] = "1MB" }},
+		{"path limit", func(cfg *bandwidthlimiter.Config) {
+			cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "/downloads", Limit: "0"}}
+		}},
+		{"schedule", func(cfg *bandwidthlimiter.Config) {
+			cfg.LimitSchedules = []bandwidthlimiter.LimitSchedule{{Hours: "9-5", Limit: "1MB"}}
+		}},
+		{"profile limit", func(cfg *bandwidthlimiter.Config) {
+			cfg.LimitProfiles["peak"] = bandwidthlimiter.LimitProfile{DefaultLimit: "fast"}
+		}},
+		{"unknown profile", func(cfg *bandwidthlimiter.Config) { cfg.ActiveProfile = "night" }},
+		{"country code", func(cfg *bandwidthlimiter.Config) { cfg.CountryLimits["Germany"] = "1MB" }},
+		{"route cost", func(cfg *bandwidthlimiter.Config) { cfg.RouteCosts["/export"] = 0 }},
+		{"exemption", func(cfg *bandwidthlimiter.Config) { cfg.Exemptions.Paths = []string{""} }},
+		{"strip header", func(cfg *bandwidthlimiter.Config) { cfg.StripRequestHeaders = []string{""} }},
+	}
+
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		tt.modify(cfg)
+		_, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !errors.Is(err, bandwidthlimiter.ErrInvalidLimit) {
+			t.Errorf("%s: expected the error to wrap ErrInvalidLimit, got %v", tt.name, err)
+		}
+		if strings.Contains(err.Error(), bandwidthlimiter.ErrInvalidLimit.Error()) {
+			t.Errorf("%s: expected the message to be unchanged, got %v", tt.name, err)
+		}
+	}
+
+	// A persistence file owned by another instance isn't a configuration error
+	persistenceFile := filepath.Join(t.TempDir(), "buckets.json")
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = persistenceFile
+	newAdminLimiter(t, cfg)
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = persistenceFile
+	cfg.PersistenceLock = "exclusive"
+	if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "other-limiter"); err == nil || errors.Is(err, bandwidthlimiter.ErrInvalidLimit) {
+		t.Errorf("Expected an owned persistence file not to wrap ErrInvalidLimit, got %v", err)
+	}
+
+	// Invalid input to the exported entry points
+	bl, _ := newAdminLimiter(t, bandwidthlimiter.CreateConfig())
+	hashedCfg := bandwidthlimiter.CreateConfig()
+	hashedCfg.ClientIDMode = "hash"
+	hashedCfg.ClientIDSalt = "salt"
+	hashed, _ := newAdminLimiter(t, hashedCfg)
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{"SetKeyLimit limit", func() error { return bl.SetKeyLimit("key", "-5", "") }},
+		{"SetKeyLimit key", func() error { return bl.SetKeyLimit("", "1MB", "") }},
+		{"ConvertRateLimit", func() error {
+			_, _, err := bandwidthlimiter.ConvertRateLimit(bandwidthlimiter.RateLimitOptions{Average: 10}, "0")
+			return err
+		}},
+		{"Usage target", func() error { _, err := bl.Usage(""); return err }},
+		{"Usage CIDR", func() error { _, err := bl.Usage("10.0.0.0/33"); return err }},
+		{"ResetBucket target", func() error { _, err := bl.ResetBucket(""); return err }},
+		{"ResetBucket CIDR", func() error { _, err := bl.ResetBucket("10.0.0.0/8x"); return err }},
+		{"Purge target", func() error { _, err := bl.Purge(""); return err }},
+		{"Purge CIDR", func() error { _, err := bl.Purge("300.0.0.0/8"); return err }},
+		{"Purge hashed CIDR", func() error { _, err := hashed.Purge("10.0.0.0/8"); return err }},
+	}
+	for _, tt := range calls {
+		err := tt.call()
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !errors.Is(err, bandwidthlimiter.ErrInvalidLimit) {
+			t.Errorf("%s: expected the error to wrap ErrInvalidLimit, got %v", tt.name, err)
+		}
+	}
+}
+
+// TestErrStoreUnavailable tests that failed saves wrap ErrStoreUnavailable
+func TestErrStoreUnavailable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = filepath.Join(dir, "buckets.json")
+	bl, admin := newAdminLimiter(t, cfg)
+
+	// The directory is replaced by a regular file once the limiter runs
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Save(); !errors.Is(err, bandwidthlimiter.ErrStoreUnavailable) {
+		t.Errorf("Expected Save to wrap ErrStoreUnavailable, got %v", err)
+	}
+	adminRequest(t, admin, http.MethodPost, "/save", http.StatusInternalServerError, nil)
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = filepath.Join(t.TempDir(), "buckets.json")
+	bl, _ = newAdminLimiter(t, cfg)
+	if err := bl.Save(); err != nil {
+		t.Errorf("Expected the buckets to be saved, got %v", err)
+	}
+}
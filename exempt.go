@@ -0,0 +1,130 @@
+package bandwidthlimiter
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Exemptions selects requests that skip the limiter entirely. A request
+// matching any of the lists but ContentTypes is passed straight to the next
+// handler; ContentTypes only exempts the response once its headers are written.
+type Exemptions struct {
+	// Client IPs or CIDRs, e.g. "10.0.0.0/8" for internal monitoring
+	ClientCIDRs []string `json:"clientCIDRs,omitempty"`
+	
+	// Request path prefixes, e.g. "/health" or "/metrics"
+	Paths []string `json:"paths,omitempty"`
+	
+	// Media types of the response, e.g. "application/grpc" or "video/*". The
+	// request Content-Type is set by the client and never exempts anything.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	
+	// HTTP methods, e.g. "OPTIONS"
+	Methods []string `json:"methods,omitempty"`
+}
+
+// exemptions is the compiled form of Config.Exemptions
+type exemptions struct {
+	networks     *cidrTrie
+	paths        []string
+	contentTypes []string
+	methods      map[string]bool
+	clientIPs    clientIPStrategy
+}
+
+// compileExemptions validates Exemptions, returning nil if nothing is exempt
+func compileExemptions(config Exemptions, clientIPs clientIPStrategy) (*exemptions, error) {
+	if len(config.ClientCIDRs) == 0 && len(config.Paths) == 0 && len(config.ContentTypes) == 0 && len(config.Methods) == 0 {
+		return nil, nil
+	}
+	
+	compiled := &exemptions{paths: config.Paths, networks: newCIDRTrie(), methods: make(map[string]bool, len(config.Methods)), clientIPs: clientIPs}
+	for _, value := range config.ClientCIDRs {
+		network, err := parseCIDROrIP(value)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "exemptions.clientCIDRs: %v", err)
+		}
+		compiled.networks.insert(network, 0)
+	}
+	for _, path := range config.Paths {
+		if path == "" {
+			return nil, wrapf(ErrInvalidLimit, "exemptions.paths must not contain empty prefixes")
+		}
+	}
+	for _, contentType := range config.ContentTypes {
+		mediaType := strings.ToLower(strings.TrimSpace(contentType))
+		if !strings.Contains(mediaType, "/") {
+			return nil, wrapf(ErrInvalidLimit, "exemptions.contentTypes: invalid media type %q", contentType)
+		}
+		compiled.contentTypes = append(compiled.contentTypes, mediaType)
+	}
+	for _, method := range config.Methods {
+		if method == "" {
+			return nil, wrapf(ErrInvalidLimit, "exemptions.methods must not contain empty methods")
+		}
+		compiled.methods[strings.ToUpper(method)] = true
+	}
+	return compiled, nil
+}
+
+// parseCIDROrIP parses a CIDR, or a single IP as a network of one address
+func parseCIDROrIP(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// match reports whether a request is exempt from limiting, before it is
+// passed on
+func (e *exemptions) match(req *http.Request) bool {
+	if e.methods[req.Method] {
+		return true
+	}
+	
+	for _, path := range e.paths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			return true
+		}
+	}
+	
+	if e.networks.len() > 0 {
+		if _, exempt := e.networks.lookup(net.ParseIP(e.clientIPs.clientIP(req))); exempt {
+			return true
+		}
+	}
+	return false
+}
+
+// matchResponse reports whether a response is exempt from limiting by its
+// Content-Type, once the backend has written its headers
+func (e *exemptions) matchResponse(header http.Header) bool {
+	if len(e.contentTypes) == 0 {
+		return false
+	}
+	
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range e.contentTypes {
+		if contentType == mediaType || (strings.HasSuffix(contentType, "/*") && strings.HasPrefix(mediaType, contentType[:len(contentType)-1])) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestExemptions tests that exempt requests skip the limiter and create no buckets
+func TestExemptions(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.Exemptions = bandwidthlimiter.Exemptions{
+		ClientCIDRs:  []string{"10.10.0.0/16", "192.0.2.7"},
+		Paths:        []string{"/health", "/metrics"},
+		ContentTypes: []string{"application/grpc"},
+		Methods:      []string{"options"},
+	}
+
+	var limited bool
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		limited = bandwidthlimiter.StatsFromContext(req.Context()) != nil
+		rw.Write([]byte("ok"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		exempt bool
+	}{
+		{"plain request", func(req *http.Request) {}, false},
+		{"monitoring CIDR", func(req *http.Request) { req.RemoteAddr = "10.10.3.4:1000" }, true},
+		{"single IP", func(req *http.Request) { req.RemoteAddr = "192.0.2.7:1000" }, true},
+		{"health path", func(req *http.Request) { req.URL.Path = "/healthz" }, true},
+		{"gRPC request body", func(req *http.Request) { req.Header.Set("Content-Type", "application/grpc") }, false},
+		{"preflight", func(req *http.Request) { req.Method = http.MethodOptions }, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/files", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		tt.modify(req)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if limited == tt.exempt {
+			t.Errorf("%s: expected exempt %v", tt.name, tt.exempt)
+		}
+	}
+}
+
+// TestExemptContentTypes tests that content types exempt responses by their own
+// Content-Type, which a client can't spoof through the request's
+func TestExemptContentTypes(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.Exemptions.ContentTypes = []string{"application/grpc", "video/*"}
+
+	var stats *bandwidthlimiter.RequestStats
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		stats = bandwidthlimiter.StatsFromContext(req.Context())
+		rw.Header().Set("Content-Type", req.URL.Query().Get("type"))
+		rw.Write([]byte("ok"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		request     string
+		response    string
+		wantLimited bool
+	}{
+		{"gRPC response", "application/grpc", "application/grpc", false},
+		{"any video subtype", "", "video/mp4", false},
+		{"parameters are ignored", "", "application/grpc; charset=utf-8", false},
+		{"JSON response", "", "application/json", true},
+		{"spoofed request Content-Type", "application/grpc", "application/octet-stream", true},
+		{"spoofed wildcard", "video/mp4", "application/zip", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://backend.local/files?type="+url.QueryEscape(tt.response), nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		if tt.request != "" {
+			req.Header.Set("Content-Type", tt.request)
+		}
+		stats = nil
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if stats == nil {
+			t.Fatalf("%s: expected the request to reach the limiter", tt.name)
+		}
+		if stats.Limited != tt.wantLimited || stats.Bypassed == tt.wantLimited {
+			t.Errorf("%s: expected limited %v, got limited %v bypassed %v", tt.name, tt.wantLimited, stats.Limited, stats.Bypassed)
+		}
+	}
+}
+
+// TestExemptionsErrors tests that invalid exemptions are rejected at startup
+func TestExemptionsErrors(t *testing.T) {
+	tests := []struct {
+		exemptions bandwidthlimiter.Exemptions
+		field      string
+	}{
+		{bandwidthlimiter.Exemptions{ClientCIDRs: []string{"10.0.0.0/33"}}, "exemptions.clientCIDRs"},
+		{bandwidthlimiter.Exemptions{ClientCIDRs: []string{"monitoring"}}, "exemptions.clientCIDRs"},
+		{bandwidthlimiter.Exemptions{ContentTypes: []string{"grpc"}}, "exemptions.contentTypes"},
+		{bandwidthlimiter.Exemptions{Paths: []string{""}}, "exemptions.paths"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.Exemptions = tt.exemptions
+		_, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err == nil || !strings.HasPrefix(err.Error(), tt.field) {
+			t.Errorf("%+v: expected an error naming %s, got %v", tt.exemptions, tt.field, err)
+		}
+	}
+}
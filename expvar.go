@@ -0,0 +1,107 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Name of the expvar variable published with Config.Expvar
+const expvarName = "bandwidthlimiter"
+
+// LimiterStats is a snapshot of the limiter's counters, as returned by Stats.
+// Counters start at zero when the middleware is created.
+type LimiterStats struct {
+	Buckets           int           `json:"buckets"`           // Buckets currently held in memory
+	Evictions         int64         `json:"evictions"`         // Buckets removed by cleanup
+	BytesDownloaded   int64         `json:"bytesDownloaded"`   // Response body bytes that went through the limiter
+	BytesUploaded     int64         `json:"bytesUploaded"`     // Request body bytes that went through the limiter
+	Delay             time.Duration `json:"delay"`             // Time the limiter held requests up, in nanoseconds
+	Rejected          int64         `json:"rejected"`          // Requests turned away by the limiter
+	Duplicates        int64         `json:"duplicates"`        // Requests already limited by another instance
+	Overflowed        int64         `json:"overflowed"`        // Requests collapsed into the overflow bucket
+	EarlyThrottled    int64         `json:"earlyThrottled"`    // Chunks delayed as the global bucket ran low
+	PersistenceErrors int64         `json:"persistenceErrors"` // Failed loads and saves of the persistence file
+}
+
+// Stats returns a snapshot of the limiter's counters, for lightweight
+// monitoring without scraping the Prometheus metrics
+func (bl *BandwidthLimiter) Stats() LimiterStats {
+	_, overflowed := bl.overflowStats()
+	return LimiterStats{
+		Buckets:           bl.buckets.Len(),
+		Evictions:         atomic.LoadInt64(&bl.metrics.evictions),
+		BytesDownloaded:   bl.metrics.transferred.Get(string(directionDownload)),
+		BytesUploaded:     bl.metrics.transferred.Get(string(directionUpload)),
+		Delay:             bl.metrics.delayTime.Total(),
+		Rejected:          bl.metrics.rejected.Total(),
+		Duplicates:        atomic.LoadInt64(&bl.metrics.duplicates),
+		Overflowed:        overflowed,
+		EarlyThrottled:    atomic.LoadInt64(&bl.early.delayed),
+		PersistenceErrors: atomic.LoadInt64(&bl.metrics.persistenceErrors),
+	}
+}
+
+// expvarLimiters holds the middlewares published with Config.Expvar by name.
+// expvar variables can't be removed or replaced, so a single variable is
+// published once and reads whichever middlewares are current, which keeps
+// configuration reloads from publishing a name twice.
+var expvarLimiters struct {
+	once     sync.Once
+	mutex    sync.Mutex
+	limiters map[string]*BandwidthLimiter
+}
+
+// publishExpvar adds the middleware to the expvar variable, replacing an
+// earlier middleware of the same name
+func (bl *BandwidthLimiter) publishExpvar() {
+	expvarLimiters.once.Do(func() {
+		expvar.Publish(expvarName, expvar.Func(expvarStats))
+	})
+	
+	expvarLimiters.mutex.Lock()
+	defer expvarLimiters.mutex.Unlock()
+	
+	if expvarLimiters.limiters == nil {
+		expvarLimiters.limiters = make(map[string]*BandwidthLimiter)
+	}
+	expvarLimiters.limiters[bl.name] = bl
+}
+
+// unpublishExpvar removes the middleware from the expvar variable, unless a
+// newer middleware of the same name has taken its place
+func (bl *BandwidthLimiter) unpublishExpvar() {
+	expvarLimiters.mutex.Lock()
+	defer expvarLimiters.mutex.Unlock()
+	
+	if expvarLimiters.limiters[bl.name] == bl {
+		delete(expvarLimiters.limiters, bl.name)
+	}
+}
+
+// expvarStats returns the stats of every published middleware by name
+func expvarStats() interface{} {
+	expvarLimiters.mutex.Lock()
+	defer expvarLimiters.mutex.Unlock()
+	
+	stats := make(map[string]LimiterStats, len(expvarLimiters.limiters))
+	for name, bl := range expvarLimiters.limiters {
+		stats[name] = bl.Stats()
+	}
+	return stats
+}
+
+// handleStats serves GET /stats, the limiter's counters as JSON
+func (bl *BandwidthLimiter) handleStats(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(bl.Stats())
+}
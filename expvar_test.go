@@ -0,0 +1,84 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestStats tests the snapshot of the limiter's counters
+func TestStats(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(cfg.PersistenceFile, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bl, admin := newAdminLimiter(t, cfg)
+
+	stats := bl.Stats()
+	if stats.Buckets != 2 || stats.BytesDownloaded != 2*1024 || stats.BytesUploaded != 0 || stats.Rejected != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.PersistenceErrors != 1 {
+		t.Errorf("Expected the unreadable persistence file to be counted, got %d", stats.PersistenceErrors)
+	}
+
+	var served bandwidthlimiter.LimiterStats
+	adminRequest(t, admin, http.MethodGet, "/stats", http.StatusOK, &served)
+	if served != stats {
+		t.Errorf("Expected /stats to serve %+v, got %+v", stats, served)
+	}
+	adminRequest(t, admin, http.MethodPost, "/stats", http.StatusMethodNotAllowed, nil)
+}
+
+// TestExpvar tests that stats are published by middleware name and that a
+// middleware replaced through a reload keeps the name published
+func TestExpvar(t *testing.T) {
+	newLimiter := func() *bandwidthlimiter.BandwidthLimiter {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.Expvar = true
+		handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "expvar-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(*bandwidthlimiter.BandwidthLimiter)
+	}
+	published := func() map[string]bandwidthlimiter.LimiterStats {
+		v := expvar.Get("bandwidthlimiter")
+		if v == nil {
+			t.Fatal("Expected the bandwidthlimiter variable to be published")
+		}
+		stats := map[string]bandwidthlimiter.LimiterStats{}
+		if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	old := newLimiter()
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	old.ServeHTTP(httptest.NewRecorder(), req)
+	if stats, ok := published()["expvar-limiter"]; !ok || stats.Buckets != old.Stats().Buckets {
+		t.Errorf("Expected the middleware's stats, got %+v", published())
+	}
+
+	// The new instance starts before the old one is shut down
+	current := newLimiter()
+	old.Shutdown()
+	if _, ok := published()["expvar-limiter"]; !ok {
+		t.Error("Expected the replacing middleware to stay published")
+	}
+
+	current.Shutdown()
+	if _, ok := published()["expvar-limiter"]; ok {
+		t.Error("Expected the middleware to be removed once shut down")
+	}
+}
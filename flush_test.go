@@ -0,0 +1,80 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// flushCounter is a ResponseWriter that counts flushes
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (fc *flushCounter) Flush() {
+	fc.flushes++
+	fc.ResponseRecorder.Flush()
+}
+
+// TestFlush tests that handlers can flush through the limiter and the header stripping writer
+func TestFlush(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.StripResponseHeaders = []string{"X-Internal"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Internal", "secret")
+		rw.Header().Set("Content-Type", "text/event-stream")
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			t.Fatal("Expected the response writer to be a Flusher")
+		}
+		flusher.Flush()
+		rw.Write([]byte("data: hello\n\n"))
+		flusher.Flush()
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/events", nil))
+	if recorder.flushes != 2 {
+		t.Errorf("Expected 2 flushes to reach the client's writer, got %d", recorder.flushes)
+	}
+	if recorder.Header().Get("X-Internal") != "" {
+		t.Error("Expected the header to be stripped before the first flush sent it")
+	}
+}
+
+// TestFlushChunks tests that throttled chunks are flushed one by one when configured
+func TestFlushChunks(t *testing.T) {
+	for _, flushChunks := range []bool{false, true} {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.FlushChunks = flushChunks
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write(make([]byte, 10000))
+		})
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+
+		// 10000 bytes are written in 3 chunks of at most 4KB
+		expected := 0
+		if flushChunks {
+			expected = 3
+		}
+		if recorder.flushes != expected {
+			t.Errorf("flushChunks %v: expected %d flushes, got %d", flushChunks, expected, recorder.flushes)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package bandwidthlimiter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// limitClassCountry is reported for requests limited by the CountryLimits or ContinentLimits entry of their client's location
+const limitClassCountry = "country"
+
+// CountryProvider locates client IPs for CountryLimits and ContinentLimits,
+// by default the database of GeoIPDatabase. Country is called for every
+// request that isn't limited by a more specific rule and must be safe for
+// concurrent use.
+type CountryProvider interface {
+	// Country returns the ISO 3166-1 country code and the continent code of
+	// an IP, e.g. "DE" and "EU", each "" if it is unknown
+	Country(ip net.IP) (country, continent string)
+}
+
+// countryState holds the provider locating client IPs
+type countryState struct {
+	mutex    sync.RWMutex
+	provider CountryProvider
+}
+
+// SetCountryProvider replaces the provider locating client IPs for
+// CountryLimits and ContinentLimits, by default the database of
+// GeoIPDatabase. A nil provider locates no IP.
+func (bl *BandwidthLimiter) SetCountryProvider(provider CountryProvider) {
+	bl.country.mutex.Lock()
+	bl.country.provider = provider
+	bl.country.mutex.Unlock()
+	
+	// Cached decisions were made with the previous provider
+	if bl.resolutions != nil {
+		bl.resolutions.clear()
+	}
+}
+
+// countryLimit returns the code and limit of the CountryLimits entry of a
+// client IP's country or, failing that, of the ContinentLimits entry of its
+// continent
+func (bl *BandwidthLimiter) countryLimit(clientIP string) (string, int64, bool) {
+	if len(bl.parsed.countryLimits) == 0 && len(bl.parsed.continentLimits) == 0 {
+		return "", 0, false
+	}
+	bl.country.mutex.RLock()
+	provider := bl.country.provider
+	bl.country.mutex.RUnlock()
+	if provider == nil {
+		return "", 0, false
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return "", 0, false
+	}
+	
+	country, continent := provider.Country(ip)
+	country, continent = strings.ToUpper(country), strings.ToUpper(continent)
+	if limit, exists := bl.parsed.countryLimits[country]; exists && country != "" {
+		return country, limit, true
+	}
+	if limit, exists := bl.parsed.continentLimits[continent]; exists && continent != "" {
+		return continent, limit, true
+	}
+	return "", 0, false
+}
+
+// parseCountryLimits parses CountryLimits or ContinentLimits, whose keys are
+// two-letter codes in any case
+func parseCountryLimits(name string, limits map[string]Size) (map[string]int64, error) {
+	codes := make(map[string]Size, len(limits))
+	for code, limit := range limits {
+		if len(code) != 2 || !isLetter(code[0]) || !isLetter(code[1]) {
+			return nil, wrapf(ErrInvalidLimit, "%s: invalid code %q, must be two letters, e.g. \"DE\"", name, code)
+		}
+		if _, exists := codes[strings.ToUpper(code)]; exists {
+			return nil, wrapf(ErrInvalidLimit, "%s: code %q is listed twice", name, strings.ToUpper(code))
+		}
+		codes[strings.ToUpper(code)] = limit
+	}
+	return parseLimits(name, codes)
+}
+
+// isLetter reports whether c is an ASCII letter
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// startCountries opens GeoIPDatabase. A database that can't be read only
+// logs a warning, and country limits then don't apply.
+func (bl *BandwidthLimiter) startCountries() {
+	db, err := OpenGeoIPDatabase(bl.config.GeoIPDatabase)
+	if err != nil {
+		bl.log.warnf("Failed to open GeoIP database: %v", err)
+		return
+	}
+	bl.country.provider = db
+	bl.log.infof("Loaded GeoIP database %s (%s)", bl.config.GeoIPDatabase, db.Type())
+}
+
+// Marker preceding the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data section types of the MaxMind DB format
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbDouble   = 3
+	mmdbBytes    = 4
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbUint128  = 10
+	mmdbArray    = 11
+	mmdbBool     = 14
+	mmdbFloat    = 15
+)
+
+// mmdbMaxDepth bounds the nesting of decoded values, so corrupt files with
+// pointer cycles fail instead of recursing forever
+const mmdbMaxDepth = 32
+
+// GeoIPDatabase is a CountryProvider reading a MaxMind DB file, such as
+// GeoLite2-Country.mmdb or GeoIP2-City.mmdb. The file is read into memory
+// once; replace the database by opening the new file and passing it to
+// SetCountryProvider.
+type GeoIPDatabase struct {
+	tree       []byte // Search tree
+	data       mmdbDecoder
+	dbType     string
+	nodeCount  uint32
+	recordSize int    // Bits per record: 24, 28 or 32
+	ipVersion  int    // 4 for IPv4-only databases, 6 otherwise
+	ipv4Start  uint32 // Node of ::/96, where IPv4 addresses start in IPv6 trees
+	
+	// Locations by data section offset. Networks share few distinct
+	// records, so there are only about as many as countries.
+	mutex     sync.RWMutex
+	locations map[uint32]geoLocation
+}
+
+// geoLocation is the part of a database record country limits look at
+type geoLocation struct {
+	country   string
+	continent string
+}
+
+// OpenGeoIPDatabase reads a MaxMind DB file
+func OpenGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	
+	marker := bytes.LastIndex(file, mmdbMetadataMarker)
+	if marker < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	value, _, err := mmdbDecoder(file[marker+len(mmdbMetadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %v", path, err)
+	}
+	metadata, _ := value.(map[string]interface{})
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	dbType, _ := metadata["database_type"].(string)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported IP version %d", path, ipVersion)
+	}
+	
+	// The search tree is followed by 16 zero bytes and the data section
+	if nodeCount == 0 || nodeCount > math.MaxUint32 || nodeCount*recordSize/4+16 > uint64(marker) {
+		return nil, fmt.Errorf("%s: invalid search tree of %d nodes", path, nodeCount)
+	}
+	treeSize := nodeCount * recordSize / 4
+	db := &GeoIPDatabase{
+		tree:       file[:treeSize],
+		data:       mmdbDecoder(file[treeSize+16 : marker]),
+		dbType:     dbType,
+		nodeCount:  uint32(nodeCount),
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+		locations:  make(map[uint32]geoLocation),
+	}
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, false)
+		}
+	}
+	return db, nil
+}
+
+// Type returns the database type of the file, e.g. "GeoLite2-Country"
+func (db *GeoIPDatabase) Type() string {
+	return db.dbType
+}
+
+// Country returns the country and continent codes of the record holding ip.
+// Networks without a country, e.g. anycast ranges, report the country they
+// are registered in.
+func (db *GeoIPDatabase) Country(ip net.IP) (string, string) {
+	offset, found := db.lookup(ip)
+	if !found {
+		return "", ""
+	}
+	
+	db.mutex.RLock()
+	location, exists := db.locations[offset]
+	db.mutex.RUnlock()
+	if exists {
+		return location.country, location.continent
+	}
+	
+	value, _, err := db.data.decode(int(offset), 0)
+	if err != nil {
+		return "", ""
+	}
+	record, _ := value.(map[string]interface{})
+	location = geoLocation{
+		country:   recordString(record, "country", "iso_code"),
+		continent: recordString(record, "continent", "code"),
+	}
+	if location.country == "" {
+		location.country = recordString(record, "registered_country", "iso_code")
+	}
+	
+	db.mutex.Lock()
+	db.locations[offset] = location
+	db.mutex.Unlock()
+	return location.country, location.continent
+}
+
+// lookup walks the search tree and returns the data section offset of the
+// record holding ip
+func (db *GeoIPDatabase) lookup(ip net.IP) (uint32, bool) {
+	node := uint32(0)
+	address := ip.To4()
+	if address != nil {
+		node = db.ipv4Start
+	} else if db.ipVersion == 6 {
+		address = ip.To16()
+	}
+	if address == nil {
+		return 0, false
+	}
+	
+	for i := 0; i < len(address)*8 && node < db.nodeCount; i++ {
+		bit := address[i/8] >> (7 - uint(i%8)) & 1
+		node = db.record(node, bit == 1)
+	}
+	
+	// Records past the node count point into the data section, after the
+	// 16 byte separator; the node count itself means no data
+	if node <= db.nodeCount {
+		return 0, false
+	}
+	return node - db.nodeCount - 16, true
+}
+
+// record returns the left or right record of a search tree node
+func (db *GeoIPDatabase) record(node uint32, right bool) uint32 {
+	b := db.tree[int(node)*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		if right {
+			b = b[3:]
+		}
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if right {
+			return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+		}
+		return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	default:
+		if right {
+			b = b[4:]
+		}
+		return binary.BigEndian.Uint32(b)
+	}
+}
+
+// recordString returns the string at a path of map keys in a decoded record,
+// "" if there is none
+func recordString(record map[string]interface{}, path ...string) string {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section. Pointers are
+// offsets into the section it holds.
+type mmdbDecoder []byte
+
+// decode decodes the value at offset and returns it with the offset of the
+// value following it. Maps decode to map[string]interface{}, arrays to
+// []interface{}, unsigned integers to uint64 and signed ones to int64.
+func (d mmdbDecoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("values nested too deep")
+	}
+	if offset >= len(d) {
+		return nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+	control := d[offset]
+	offset++
+	
+	kind := int(control >> 5)
+	if kind == mmdbPointer {
+		n := int(control>>3&3) + 1
+		if offset+n > len(d) {
+			return nil, 0, fmt.Errorf("pointer at %d out of range", offset)
+		}
+		b := d[offset : offset+n]
+		target := 0
+		switch n {
+		case 1:
+			target = int(control&7)<<8 | int(b[0])
+		case 2:
+			target = (int(control&7)<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 3:
+			target = (int(control&7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			target = int(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, offset + n, err
+	}
+	if kind == mmdbExtended {
+		if offset >= len(d) {
+			return nil, 0, fmt.Errorf("type at %d out of range", offset)
+		}
+		kind = 7 + int(d[offset])
+		offset++
+	}
+	
+	size := int(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d) {
+			return nil, 0, fmt.Errorf("size at %d out of range", offset)
+		}
+		b := d[offset : offset+n]
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+		offset += n
+	}
+	
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at %d is not a string", offset)
+			}
+			if m[name], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		values := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	
+	if offset+size > len(d) {
+		return nil, 0, fmt.Errorf("value at %d out of range", offset)
+	}
+	b := d[offset : offset+size]
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			return b, offset, nil // Only IPv6 network bounds use 128 bits
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type %d at %d", kind, offset-size)
+}
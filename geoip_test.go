@@ -0,0 +1,260 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// mmdbWriter builds a MaxMind DB file with an IPv6 search tree of 24-bit
+// records, IPv4 networks living under ::/96
+type mmdbWriter struct {
+	nodes [][2]int // Records: node index, or -offset-1 for data
+	data  []byte
+}
+
+// mmdbControl encodes the control byte of a value with less than 29 bytes
+// or entries
+func mmdbControl(kind, size int) []byte {
+	return []byte{byte(kind<<5 | size)}
+}
+
+// mmdbValue encodes a string, uint32, pointer or map with ordered keys
+func mmdbValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(2, len(v)), v...)
+	case uint32:
+		return append(mmdbControl(6, 4), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case mmdbPointer:
+		return []byte{1<<5 | byte(v>>8), byte(v)}
+	case []interface{}: // Alternating keys and values
+		b := mmdbControl(7, len(v)/2)
+		for _, item := range v {
+			b = append(b, mmdbValue(item)...)
+		}
+		return b
+	}
+	panic("unsupported value")
+}
+
+// mmdbPointer is an offset into the data section, encoded as a pointer
+type mmdbPointer uint16
+
+// addData appends a value to the data section and returns its offset
+func (w *mmdbWriter) addData(v interface{}) int {
+	offset := len(w.data)
+	w.data = append(w.data, mmdbValue(v)...)
+	return offset
+}
+
+// insert points a network at the data at offset
+func (w *mmdbWriter) insert(cidr string, offset int) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, bits := network.Mask.Size()
+	address := network.IP.To16()
+	if bits == 32 {
+		address = append(make([]byte, 12), network.IP.To4()...)
+		ones += 96
+	}
+	if len(w.nodes) == 0 {
+		w.nodes = append(w.nodes, [2]int{0, 0})
+	}
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := address[i/8] >> (7 - uint(i%8)) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = -offset - 1
+			return
+		}
+		if w.nodes[node][bit] == 0 {
+			w.nodes = append(w.nodes, [2]int{0, 0})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+// write writes the database to path
+func (w *mmdbWriter) write(t *testing.T, path string) {
+	count := len(w.nodes)
+	var file []byte
+	for _, node := range w.nodes {
+		for _, record := range node {
+			value := count // Empty
+			if record > 0 {
+				value = record
+			} else if record < 0 {
+				value = count + 16 - record - 1
+			}
+			file = append(file, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, w.data...)
+	file = append(file, "\xab\xcd\xefMaxMind.com"...)
+	file = append(file, mmdbValue([]interface{}{
+		"database_type", "Test-Country",
+		"ip_version", uint32(6),
+		"node_count", uint32(count),
+		"record_size", uint32(24),
+	})...)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeGeoIPDatabase writes a database locating 10.1.0.0/16 in Germany,
+// 10.2.0.0/16 in France, 10.3.0.0/16 in the US and 2001:db8::/32, without a
+// country of its own, in China
+func writeGeoIPDatabase(t *testing.T) string {
+	var w mmdbWriter
+	europe := w.addData([]interface{}{"code", "EU"})
+	w.insert("10.1.0.0/16", w.addData([]interface{}{
+		"continent", mmdbPointer(europe),
+		"country", []interface{}{"iso_code", "DE"},
+	}))
+	w.insert("10.2.0.0/16", w.addData([]interface{}{
+		"continent", mmdbPointer(europe),
+		"country", []interface{}{"iso_code", "FR"},
+	}))
+	w.insert("10.3.0.0/16", w.addData([]interface{}{
+		"continent", []interface{}{"code", "NA"},
+		"country", []interface{}{"iso_code", "US"},
+	}))
+	w.insert("2001:db8::/32", w.addData([]interface{}{
+		"continent", []interface{}{"code", "AS"},
+		"registered_country", []interface{}{"iso_code", "CN"},
+	}))
+
+	path := filepath.Join(t.TempDir(), "test-country.mmdb")
+	w.write(t, path)
+	return path
+}
+
+// TestGeoIPDatabase tests locating IPs with a MaxMind DB file
+func TestGeoIPDatabase(t *testing.T) {
+	db, err := bandwidthlimiter.OpenGeoIPDatabase(writeGeoIPDatabase(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Type() != "Test-Country" {
+		t.Errorf("Expected the database type, got %q", db.Type())
+	}
+
+	tests := []struct {
+		ip        string
+		country   string
+		continent string
+	}{
+		{"10.1.2.3", "DE", "EU"},
+		{"10.2.255.255", "FR", "EU"},
+		{"10.3.0.1", "US", "NA"},
+		{"10.4.0.1", "", ""},
+		{"192.0.2.1", "", ""},
+		{"2001:db8:1::1", "CN", "AS"},
+		{"2001:db9::1", "", ""},
+	}
+	for _, tt := range tests {
+		// Twice, the second time from the cached locations
+		for i := 0; i < 2; i++ {
+			country, continent := db.Country(net.ParseIP(tt.ip))
+			if country != tt.country || continent != tt.continent {
+				t.Errorf("%s: expected %q/%q, got %q/%q", tt.ip, tt.country, tt.continent, country, continent)
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "broken.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bandwidthlimiter.OpenGeoIPDatabase(path); err == nil {
+		t.Error("Expected an error for a file without metadata")
+	}
+}
+
+// TestCountryLimits tests that clients get the limit of their country or,
+// failing that, their continent
+func TestCountryLimits(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.GeoIPDatabase = writeGeoIPDatabase(t)
+	cfg.CountryLimits["de"] = "50KB"
+	cfg.CountryLimits["CN"] = "20KB"
+	cfg.ContinentLimits["EU"] = "100KB"
+	cfg.ClientLimits["10.1.9.9"] = "1MB"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	tests := []struct {
+		ip      string
+		class   string
+		limit   int64
+		country string
+	}{
+		{"10.1.0.1", "country", 50 * 1024, "DE"},
+		{"10.2.0.1", "country", 100 * 1024, "EU"},
+		{"2001:db8::1", "country", 20 * 1024, "CN"},
+		{"10.3.0.1", "default", 1024 * 1024, ""},
+		{"10.9.0.1", "default", 1024 * 1024, ""},
+		{"10.1.9.9", "client", 1024 * 1024, ""},
+	}
+	for _, tt := range tests {
+		decision := decideFor(bl, tt.ip)
+		if decision.Policy.Class != tt.class || decision.Policy.Limit != tt.limit || decision.Country != tt.country {
+			t.Errorf("%s: expected %s limit %d from %q, got %s limit %d from %q", tt.ip, tt.class, tt.limit, tt.country,
+				decision.Policy.Class, decision.Policy.Limit, decision.Country)
+		}
+	}
+
+	// Embedders can locate clients themselves
+	bl.SetCountryProvider(staticCountry{"CN", "AS"})
+	if decision := decideFor(bl, "10.1.0.1"); decision.Country != "CN" || decision.Policy.Limit != 20*1024 {
+		t.Errorf("Expected the provider's country, got %+v", decision)
+	}
+	bl.SetCountryProvider(nil)
+	if decision := decideFor(bl, "10.1.0.1"); decision.Policy.Class != "default" {
+		t.Errorf("Expected no country rules without a provider, got %+v", decision)
+	}
+}
+
+// staticCountry locates every IP in the same country
+type staticCountry [2]string
+
+func (c staticCountry) Country(ip net.IP) (string, string) {
+	return c[0], c[1]
+}
+
+// TestCountryLimitsConfig tests that country and continent codes are validated
+func TestCountryLimitsConfig(t *testing.T) {
+	tests := []struct {
+		countries  map[string]bandwidthlimiter.Size
+		continents map[string]bandwidthlimiter.Size
+	}{
+		{map[string]bandwidthlimiter.Size{"DEU": "1MB"}, nil},
+		{map[string]bandwidthlimiter.Size{"D1": "1MB"}, nil},
+		{map[string]bandwidthlimiter.Size{"de": "1MB", "DE": "2MB"}, nil},
+		{nil, map[string]bandwidthlimiter.Size{"EU": "fast"}},
+	}
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.CountryLimits = tt.countries
+		cfg.ContinentLimits = tt.continents
+		if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for %+v", tt)
+		}
+	}
+}
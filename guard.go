@@ -0,0 +1,80 @@
+package bandwidthlimiter
+
+import (
+	"sync"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// overflowKey is the bucket shared by all new keys while the cardinality guard is tripped
+const overflowKey = "overflow"
+
+// limitClassOverflow is reported for requests collapsed into the overflow bucket
+const limitClassOverflow = "overflow"
+
+// keyGuard counts bucket key creations per minute to detect cardinality
+// explosions, e.g. from spoofed X-Forwarded-For headers or scanners
+type keyGuard struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	created     int64
+	tripped     bool
+	overflowed  int64 // Requests collapsed into the overflow bucket, for metrics
+}
+
+// guardKey returns the key a request's buckets are created under: its own key
+// if that already exists or the creation rate allows a new one, the shared
+// overflow key otherwise. Clients with explicit rules are never collapsed.
+func (bl *BandwidthLimiter) guardKey(key string, policy limiter.Policy) (string, limiter.Policy) {
+	if bl.config.MaxNewKeysPerMinute == 0 || policy.Class == limitClassClient || policy.Class == limitClassKey {
+		return key, policy
+	}
+	if _, exists := bl.buckets.Load(key); exists {
+		return key, policy
+	}
+	
+	guard := &bl.keyGuard
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	
+	now := time.Now()
+	if now.Sub(guard.windowStart) >= time.Minute {
+		if guard.tripped {
+			bl.log.infof("Bucket key creation back to normal (%d new keys last minute)", guard.created)
+		}
+		guard.windowStart = now
+		guard.created = 0
+		guard.tripped = false
+	}
+	
+	if guard.created < bl.config.MaxNewKeysPerMinute {
+		guard.created++
+		return key, policy
+	}
+	
+	if !guard.tripped {
+		guard.tripped = true
+		bl.log.warnf("More than %d new bucket keys per minute, likely spoofed X-Forwarded-For or scanning; collapsing new keys into the %q bucket",
+			bl.config.MaxNewKeysPerMinute, overflowKey)
+	}
+	guard.overflowed++
+	
+	bl.rulesMutex.RLock()
+	defer bl.rulesMutex.RUnlock()
+	return overflowKey, limiter.Policy{
+		Limit: bl.parsed.defaultLimit,
+		Burst: bl.parsed.burstSize,
+		Class: limitClassOverflow,
+	}
+}
+
+// overflowStats returns whether the guard is tripped and how many requests it collapsed
+func (bl *BandwidthLimiter) overflowStats() (bool, int64) {
+	guard := &bl.keyGuard
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	
+	tripped := guard.tripped && time.Since(guard.windowStart) < time.Minute
+	return tripped, guard.overflowed
+}
@@ -0,0 +1,64 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestKeyCardinalityGuard tests that keys beyond the creation rate share the overflow bucket
+func TestKeyCardinalityGuard(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "50KB" // 50 KB/s
+	cfg.BurstSize = "20KB"    // 20 KB burst
+	cfg.MaxNewKeysPerMinute = 2
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(client int) time.Duration {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:12345", client)
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return time.Since(start)
+	}
+
+	// Two new keys are allowed, the next ones share one 20 KB burst
+	for client := 1; client <= 4; client++ {
+		if elapsed := serve(client); elapsed > 100*time.Millisecond {
+			t.Errorf("Client %d should not be throttled yet, took %v", client, elapsed)
+		}
+	}
+	if elapsed := serve(5); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected overflow bucket to be used up, took %v", elapsed)
+	}
+
+	// Existing keys keep their own buckets
+	if elapsed := serve(1); elapsed > 100*time.Millisecond {
+		t.Errorf("Existing key should keep its own bucket, took %v", elapsed)
+	}
+
+	recorder := httptest.NewRecorder()
+	admin := handler.(*bandwidthlimiter.BandwidthLimiter).AdminHandler()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"bwl_overflow_active 1\n", "bwl_overflow_requests_total 3\n"} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Response headers telling clients about their limit when SendHeaders is enabled
+const (
+	limitHeader          = "X-Bandwidth-Limit"
+	remainingBurstHeader = "X-Bandwidth-Remaining-Burst"
+	policyHeader         = "X-Bandwidth-Policy"
+)
+
+// setLimitHeaders advertises the limit applied to a request on its response.
+// The remaining burst is the bucket's tokens when the request arrived, and is
+// left out when the bucket is kept by a peer or in Redis.
+func (bl *BandwidthLimiter) setLimitHeaders(rw http.ResponseWriter, decision Decision) {
+	header := rw.Header()
+	policy := decision.Policy
+	
+	header.Set(policyHeader, policy.Class)
+	if policy.Limit == Unlimited {
+		header.Set(limitHeader, "unlimited")
+		return
+	}
+	header.Set(limitHeader, strconv.FormatInt(policy.Limit, 10))
+	
+	if entry, ok := bl.buckets.Load(decision.Key); ok {
+		header.Set(remainingBurstHeader, strconv.FormatInt(entry.Bucket.Available(), 10))
+		return
+	}
+	
+	// Local keys without a bucket yet get a full one
+	owner := bl.PartitionOwner(decision.Key)
+	if bl.redis == nil && (owner == "" || owner == bl.config.PartitionSelf) {
+		header.Set(remainingBurstHeader, strconv.FormatInt(policy.Burst, 10))
+	}
+}
@@ -0,0 +1,70 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestSendHeaders tests that responses advertise the applied limit
+func TestSendHeaders(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.BurstSize = "64KB"
+	cfg.SendHeaders = true
+	cfg.ClientLimits["10.0.0.9"] = "unlimited"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 16*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(ip string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = ip + ":1000"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Header()
+	}
+
+	header := serve("10.0.0.1")
+	if header.Get("X-Bandwidth-Limit") != "1048576" || header.Get("X-Bandwidth-Policy") != "default" {
+		t.Errorf("Expected the default limit, got %v", header)
+	}
+	if header.Get("X-Bandwidth-Remaining-Burst") != "65536" {
+		t.Errorf("Expected a full burst for a new client, got %q", header.Get("X-Bandwidth-Remaining-Burst"))
+	}
+
+	// The second response sees what the first one used
+	if remaining := serve("10.0.0.1").Get("X-Bandwidth-Remaining-Burst"); remaining == "" || remaining == "65536" {
+		t.Errorf("Expected the remaining burst to drop, got %q", remaining)
+	}
+
+	header = serve("10.0.0.9")
+	if header.Get("X-Bandwidth-Limit") != "unlimited" || header.Get("X-Bandwidth-Policy") != "client" {
+		t.Errorf("Expected the unlimited client rule, got %v", header)
+	}
+}
+
+// TestSendHeadersDisabled tests that no headers are sent by default
+func TestSendHeadersDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, bandwidthlimiter.CreateConfig(), "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+	if recorder.Header().Get("X-Bandwidth-Limit") != "" {
+		t.Errorf("Expected no limit headers, got %v", recorder.Header())
+	}
+}
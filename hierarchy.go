@@ -0,0 +1,48 @@
+package bandwidthlimiter
+
+import "github.com/hhftechnology/bandwidthlimiter/limiter"
+
+// limitClassGlobal is reported for the bucket shared by all traffic, see Config.GlobalLimit
+const limitClassGlobal = "global"
+
+// globalKey is the key of the bucket shared by all traffic through the middleware
+const globalKey = "*"
+
+// bucketLevel is a shared bucket above the client's bucket
+type bucketLevel struct {
+	key    string
+	policy limiter.Policy
+}
+
+// parentLevels returns the shared buckets a response pays from on top of its
+// client's bucket, innermost first: the backend's aggregate bucket and the
+// global bucket, each only if configured. Every chunk waits for all of them,
+// so no client can take more than its backend or the middleware allows.
+func (bl *BandwidthLimiter) parentLevels(backend string) []bucketLevel {
+	var levels []bucketLevel
+	if limit, exists := bl.parsed.backendAggregateLimits[backend]; exists {
+		levels = append(levels, bucketLevel{key: aggregateKey(backend), policy: bl.aggregatePolicy(limit)})
+	}
+	if bl.parsed.globalLimit > 0 {
+		levels = append(levels, bucketLevel{key: globalKey, policy: bl.globalPolicy()})
+	}
+	return levels
+}
+
+// aggregatePolicy returns the policy of a backend's aggregate bucket
+func (bl *BandwidthLimiter) aggregatePolicy(limit int64) limiter.Policy {
+	return limiter.Policy{
+		Limit: limit,
+		Burst: bl.parsed.burstSize,
+		Class: limitClassBackend,
+	}
+}
+
+// globalPolicy returns the policy of the global bucket
+func (bl *BandwidthLimiter) globalPolicy() limiter.Policy {
+	return limiter.Policy{
+		Limit: bl.parsed.globalLimit,
+		Burst: bl.parsed.globalBurstSize,
+		Class: limitClassGlobal,
+	}
+}
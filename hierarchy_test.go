@@ -0,0 +1,55 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestGlobalLimit tests that every response pays from the global bucket on
+// top of its client and backend buckets
+func TestGlobalLimit(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB" // Per-client limits are never the bottleneck here
+	cfg.BurstSize = "10KB"
+	cfg.ClientLimits["10.0.0.9"] = "100MB" // A premium client is still bound by the global limit
+	cfg.GlobalLimit = "50KB"
+	cfg.GlobalBurstSize = "10KB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 20*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, target := range []struct{ ip, host string }{{"10.0.0.1", "a.local"}, {"10.0.0.9", "b.local"}} {
+		wg.Add(1)
+		go func(ip, host string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+			req.RemoteAddr = ip + ":12345"
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}(target.ip, target.host)
+	}
+	wg.Wait()
+
+	// 40 KB in total minus the 10 KB global burst takes ~600ms at 50 KB/s
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the global limit to apply across clients and backends, took %v", elapsed)
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.GlobalLimit = "unlimited"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for a negative globalLimit")
+	}
+}
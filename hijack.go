@@ -0,0 +1,79 @@
+package bandwidthlimiter
+
+import (
+	"io"
+	"net"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// throttledConn is a connection taken over by the handler whose traffic keeps
+// paying from the request's buckets, see Config.ThrottleHijacked. Writes and
+// reads may run concurrently, as WebSocket handlers do.
+type throttledConn struct {
+	net.Conn
+	reader      io.Reader              // The hijacked connection's buffered reader
+	lrw         *limitedResponseWriter // Paces data sent to the client
+	readBuckets []limiter.Consumer     // Pay for data received from the client
+}
+
+// Write sends p to the client in paid-for chunks, like response bodies
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written, err := c.lrw.writeChunks(int64(len(p)), func(n int64) (int64, error) {
+		written, err := c.Conn.Write(p[:n])
+		p = p[written:]
+		return int64(written), err
+	})
+	return int(written), err
+}
+
+// Read reads at most one chunk from the client and waits until it is paid for
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.lrw.chunkSize {
+		p = p[:c.lrw.chunkSize]
+	}
+	
+	n, err := c.reader.Read(p)
+	if n == 0 || len(c.readBuckets) == 0 {
+		return n, err
+	}
+	
+	stats := c.lrw.stats
+	if !limiter.ConsumeAll(c.readBuckets, int64(n)) {
+		waitStart := time.Now()
+		ctx, cancel := c.lrw.waits.chunk()
+		err := limiter.ConsumeAllWait(ctx, c.readBuckets, int64(n), leaseRetryInterval)
+		cancel()
+		if err != nil {
+			return n, err
+		}
+		stats.UploadWait += time.Since(waitStart)
+	}
+	stats.BytesRead += int64(n)
+	return n, err
+}
+
+// throttleHijacked wraps a connection hijacked from lrw, so data sent on it is
+// paid from the response's buckets and data received from the upload buckets,
+// or from the response's buckets as well unless LimitUploads is set
+func (bl *BandwidthLimiter) throttleHijacked(lrw *limitedResponseWriter, conn net.Conn, buffered io.Reader, refs *entryRefs) net.Conn {
+	if lrw.bind != nil {
+		lrw.bind()
+		lrw.bind = nil
+		lrw.lastWrite = time.Now()
+	}
+	if lrw.stats.Bypassed {
+		return conn
+	}
+	
+	readBuckets := lrw.buckets
+	if bl.config.LimitUploads {
+		decision := lrw.stats.Decision
+		readBuckets = nil
+		if policy := bl.uploadPolicy(decision); policy.Limit != Unlimited {
+			readBuckets = bl.consumers(bl.uploadKey(decision), policy, refs)
+		}
+	}
+	return &throttledConn{Conn: conn, reader: buffered, lrw: lrw, readBuckets: readBuckets}
+}
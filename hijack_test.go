@@ -0,0 +1,144 @@
+package bandwidthlimiter_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// echoUpgrade switches the connection to a line echo protocol, the way
+// WebSocket handlers take over connections
+var echoUpgrade = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	conn, brw, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	brw.Flush()
+	line, err := brw.ReadString('\n')
+	if err != nil {
+		return
+	}
+	brw.WriteString(line)
+	brw.Flush()
+})
+
+// dialUpgrade upgrades a connection to the echo protocol and returns it with its reader
+func dialUpgrade(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: backend.local\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %d", resp.StatusCode)
+	}
+	return conn, reader
+}
+
+// TestHijack tests that handlers can take over the connection through the limiter's writers
+func TestHijack(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.StripResponseHeaders = []string{"X-Internal"}
+
+	handler, err := bandwidthlimiter.New(context.Background(), echoUpgrade, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hijacked := make(chan bool, 1)
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		hijacked <- stats.Hijacked
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, reader := dialUpgrade(t, server.Listener.Addr().String())
+	conn.Write([]byte("ping\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("Expected the echo over the hijacked connection, got %q (%v)", line, err)
+	}
+	if !<-hijacked {
+		t.Error("Expected the stats to record the hijack")
+	}
+
+	// Writers that can't be hijacked report it
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/socket", nil))
+	<-hijacked
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the handler to see the hijack fail, got %d", recorder.Code)
+	}
+}
+
+// TestThrottleHijacked tests that traffic in both directions of a hijacked connection pays from the client's buckets
+func TestThrottleHijacked(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "16KB"
+	cfg.BurstSize = "4KB"
+	cfg.ThrottleHijacked = true
+
+	var writeTime, readTime time.Duration
+	socket := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+
+		start := time.Now()
+		conn.Write(make([]byte, 12*1024))
+		writeTime = time.Since(start)
+
+		start = time.Now()
+		io.ReadFull(brw, make([]byte, 8*1024))
+		readTime = time.Since(start)
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), socket, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bandwidthlimiter.RequestStats, 1)
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		done <- *stats
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, reader := dialUpgrade(t, server.Listener.Addr().String())
+	if _, err := io.ReadFull(reader, make([]byte, 12*1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(make([]byte, 8*1024))
+	stats := <-done
+
+	// The burst covers the upgrade response and part of the data, the rest is paced at 16KB/s
+	if writeTime < 400*time.Millisecond || readTime < 400*time.Millisecond {
+		t.Errorf("Expected both directions to be throttled, writing took %v and reading %v", writeTime, readTime)
+	}
+	if stats.BytesWritten < 12*1024 || stats.BytesRead != 8*1024 {
+		t.Errorf("Expected the socket traffic in the stats, got %d bytes written and %d read", stats.BytesWritten, stats.BytesRead)
+	}
+}
@@ -0,0 +1,69 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// slowWriter is a ResponseWriter whose writes take a while and that records write concurrency
+type slowWriter struct {
+	http.ResponseWriter
+	active    *int32
+	maxActive *int32
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	active := atomic.AddInt32(sw.active, 1)
+	for {
+		current := atomic.LoadInt32(sw.maxActive)
+		if active <= current || atomic.CompareAndSwapInt32(sw.maxActive, current, active) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt32(sw.active, -1)
+	return len(p), nil
+}
+
+// TestMaxBytesInFlight tests that a client's concurrent responses share one in-flight byte budget
+func TestMaxBytesInFlight(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB"    // Tokens are never the bottleneck here
+	cfg.MaxBytesInFlight = "4KB" // One chunk at a time per client
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 2*4096))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var active, maxActive int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := &slowWriter{ResponseWriter: httptest.NewRecorder(), active: &active, maxActive: &maxActive}
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.168.1.10:12345"
+			handler.ServeHTTP(rw, req)
+		}()
+	}
+	wg.Wait()
+
+	if maxActive != 1 {
+		t.Errorf("Expected at most 1 concurrent chunk write for the client, got %d", maxActive)
+	}
+}
@@ -0,0 +1,246 @@
+// Package integration_test runs the middleware end to end, in front of an
+// httputil.ReverseProxy forwarding to a real backend server, the way Traefik
+// chains it. Unlike the handler tests of the root package, requests go over
+// real connections, so flushing, hijacking and disconnects behave as in
+// production.
+package integration_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// stack is a backend served through a reverse proxy wrapped in the middleware
+type stack struct {
+	limiter *bandwidthlimiter.BandwidthLimiter
+	server  *httptest.Server
+	done    chan *bandwidthlimiter.RequestStats
+}
+
+// newStack starts a backend and a frontend proxying to it through the middleware
+func newStack(t *testing.T, cfg *bandwidthlimiter.Config, backend http.Handler) *stack {
+	backendServer := httptest.NewServer(backend)
+	t.Cleanup(backendServer.Close)
+	target, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := bandwidthlimiter.New(context.Background(), httputil.NewSingleHostReverseProxy(target), cfg, "integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stack{
+		limiter: handler.(*bandwidthlimiter.BandwidthLimiter),
+		server:  httptest.NewServer(handler),
+		done:    make(chan *bandwidthlimiter.RequestStats, 16),
+	}
+	t.Cleanup(s.server.Close)
+	s.limiter.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		copied := *stats
+		s.done <- &copied
+	})
+	return s
+}
+
+// stats waits for the statistics of the next completed request
+func (s *stack) stats(t *testing.T) *bandwidthlimiter.RequestStats {
+	select {
+	case stats := <-s.done:
+		return stats
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the request to complete")
+		return nil
+	}
+}
+
+// get fetches a path from the frontend and returns the body and how long it took
+func (s *stack) get(t *testing.T, path string) ([]byte, time.Duration) {
+	start := time.Now()
+	resp, err := http.Get(s.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, time.Since(start)
+}
+
+// payload writes n bytes
+func payload(n int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, n))
+	})
+}
+
+// TestPacing tests that proxied responses are paced to the limit after the burst
+func TestPacing(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "64KB"
+	cfg.BurstSize = "16KB"
+	s := newStack(t, cfg, payload(80*1024))
+
+	// 16KB come from the burst, the other 64KB take a second
+	body, elapsed := s.get(t, "/")
+	if len(body) != 80*1024 {
+		t.Errorf("Expected the full body, got %d bytes", len(body))
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the response to take about 1s, took %v", elapsed)
+	}
+	if stats := s.stats(t); !stats.Limited || stats.BytesWritten != 80*1024 || stats.Wait < 500*time.Millisecond {
+		t.Errorf("Expected a limited response with token waits, got %+v", stats)
+	}
+}
+
+// TestFlush tests that events the backend flushes reach the client right away
+func TestFlush(t *testing.T) {
+	release := make(chan struct{})
+	events := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		rw.Write([]byte("data: second\n\n"))
+	})
+	s := newStack(t, bandwidthlimiter.CreateConfig(), events)
+	defer close(release)
+
+	resp, err := http.Get(s.server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first event arrives while the backend still holds the response open
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		received <- line
+	}()
+	select {
+	case line := <-received:
+		if line != "data: first\n" {
+			t.Errorf("Expected the first event, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the flushed event before the response completed")
+	}
+}
+
+// TestHijack tests that the proxy can upgrade connections through the middleware
+func TestHijack(t *testing.T) {
+	echo := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		if line, err := brw.ReadString('\n'); err == nil {
+			brw.WriteString(line)
+			brw.Flush()
+		}
+	})
+	s := newStack(t, bandwidthlimiter.CreateConfig(), echo)
+
+	conn, err := net.Dial("tcp", s.server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: backend.local\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %d", resp.StatusCode)
+	}
+
+	conn.Write([]byte("ping\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("Expected the echo through the proxy, got %q (%v)", line, err)
+	}
+	conn.Close()
+	if stats := s.stats(t); !stats.Hijacked {
+		t.Errorf("Expected the stats to record the hijack, got %+v", stats)
+	}
+}
+
+// TestClientDisconnect tests that a client hanging up stops the throttled transfer
+func TestClientDisconnect(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "8KB"
+	cfg.BurstSize = "8KB"
+	s := newStack(t, cfg, payload(1024*1024))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.server.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// Sending 1MB at 8KB/s would take two minutes
+	stats := s.stats(t)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the transfer to stop soon after the disconnect, took %v", elapsed)
+	}
+	if !stats.Canceled || stats.BytesWritten >= 1024*1024 {
+		t.Errorf("Expected a canceled, incomplete transfer, got %+v", stats)
+	}
+}
+
+// TestPersistenceRestart tests that a drained bucket stays drained across a restart
+func TestPersistenceRestart(t *testing.T) {
+	newConfig := func(file string) *bandwidthlimiter.Config {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DefaultLimit = "16KB"
+		cfg.BurstSize = "16KB"
+		cfg.PersistenceFile = file
+		return cfg
+	}
+	file := t.TempDir() + "/buckets.json"
+
+	first := newStack(t, newConfig(file), payload(16*1024))
+	if _, elapsed := first.get(t, "/"); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the burst to cover the first response, took %v", elapsed)
+	}
+	first.stats(t)
+	first.limiter.Shutdown()
+
+	second := newStack(t, newConfig(file), payload(16*1024))
+	defer second.limiter.Shutdown()
+	body, elapsed := second.get(t, "/")
+	if len(body) != 16*1024 || elapsed < 700*time.Millisecond {
+		t.Errorf("Expected the restored bucket to throttle the response, got %d bytes in %v", len(body), elapsed)
+	}
+	if stats := second.stats(t); !strings.HasPrefix(stats.Decision.Key, "127.0.0.1:") {
+		t.Errorf("Expected the client's own bucket, got %q", stats.Decision.Key)
+	}
+}
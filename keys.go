@@ -0,0 +1,48 @@
+package bandwidthlimiter
+
+import "strings"
+
+// keyBuilder assembles a bucket key from its parts, so a key with any number
+// of suffixes costs a single allocation on the request path
+type keyBuilder struct {
+	parts [8]string
+	n     int
+}
+
+// add appends parts to the key
+func (kb *keyBuilder) add(parts ...string) {
+	for _, part := range parts {
+		kb.parts[kb.n] = part
+		kb.n++
+	}
+}
+
+// String returns the assembled key
+func (kb *keyBuilder) String() string {
+	if kb.n == 1 {
+		return kb.parts[0] // Plain client keys need no copy
+	}
+	
+	size := 0
+	for _, part := range kb.parts[:kb.n] {
+		size += len(part)
+	}
+	var key strings.Builder
+	key.Grow(size)
+	for _, part := range kb.parts[:kb.n] {
+		key.WriteString(part)
+	}
+	return key.String()
+}
+
+// buildBucketKey starts key with the base key of a client/backend pair in the
+// given direction, see bucketKey
+func (bl *BandwidthLimiter) buildBucketKey(key *keyBuilder, clientIP, backend string, dir direction) {
+	key.add(clientIP)
+	if bl.config.BucketScope != scopeClient {
+		key.add(":", backend)
+	}
+	if dir != directionDownload {
+		key.add("|", string(dir))
+	}
+}
@@ -0,0 +1,310 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrExceedsBurst is returned by waits for more tokens than a bucket's burst
+// size, which it can never hold at once
+var ErrExceedsBurst = errors.New("limiter: tokens exceed the burst size")
+
+// Consumer is anything tokens can be taken from and given back to, such as a
+// TokenBucket or a lease on a bucket owned by another instance
+type Consumer interface {
+	Consume(tokens int64) bool
+	Refund(tokens int64)
+}
+
+// Waiter is a Consumer that can tell how long until tokens are available,
+// see TokenBucket.WaitFor
+type Waiter interface {
+	WaitFor(tokens int64) time.Duration
+}
+
+// TokenBucket implements the token bucket algorithm for rate limiting
+type TokenBucket struct {
+	tokens     int64
+	limit      int64
+	burstSize  int64
+	lastRefill time.Time
+	mutex      sync.Mutex
+}
+
+// NewTokenBucket creates a new token bucket
+func NewTokenBucket(limit, burstSize int64) *TokenBucket {
+	return &TokenBucket{
+		tokens:     burstSize,
+		limit:      limit,
+		burstSize:  burstSize,
+		lastRefill: time.Now(),
+	}
+}
+
+// NewWindowBucket creates a bucket enforcing a per-minute byte budget.
+// The whole budget is available as burst and refills evenly over the minute.
+func NewWindowBucket(minuteLimit int64) *TokenBucket {
+	rate := minuteLimit / 60
+	if rate < 1 {
+		rate = 1
+	}
+	return NewTokenBucket(rate, minuteLimit)
+}
+
+// Refill returns the tokens of a bucket holding tokens after elapsed, at limit
+// tokens per second and capped at burstSize. Partial tokens are dropped; see
+// RefillVectors for the exact rounding.
+func Refill(tokens, limit, burstSize int64, elapsed time.Duration) int64 {
+	return min(tokens+int64(elapsed.Seconds()*float64(limit)), burstSize)
+}
+
+// Consume attempts to consume tokens from the bucket
+func (tb *TokenBucket) Consume(tokens int64) bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	// Refill tokens based on time elapsed
+	now := time.Now()
+	tb.tokens = Refill(tb.tokens, tb.limit, tb.burstSize, now.Sub(tb.lastRefill))
+	tb.lastRefill = now
+	
+	// Check if we have enough tokens
+	if tb.tokens >= tokens {
+		tb.tokens -= tokens
+		return true
+	}
+	
+	// Not enough tokens, return false
+	return false
+}
+
+// ConsumeUpTo consumes at most tokens and returns how many were consumed
+func (tb *TokenBucket) ConsumeUpTo(tokens int64) int64 {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	now := time.Now()
+	tb.tokens = Refill(tb.tokens, tb.limit, tb.burstSize, now.Sub(tb.lastRefill))
+	tb.lastRefill = now
+	
+	granted := min(tokens, tb.tokens)
+	if granted < 0 {
+		granted = 0
+	}
+	tb.tokens -= granted
+	return granted
+}
+
+// Refund returns previously consumed tokens to the bucket, capped at the burst size
+func (tb *TokenBucket) Refund(tokens int64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	tb.tokens = min(tb.tokens+tokens, tb.burstSize)
+}
+
+// Available returns the tokens that could be consumed right now, without consuming them
+func (tb *TokenBucket) Available() int64 {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	return Refill(tb.tokens, tb.limit, tb.burstSize, time.Since(tb.lastRefill))
+}
+
+// BurstSize returns the most tokens the bucket can hold
+func (tb *TokenBucket) BurstSize() int64 {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	return tb.burstSize
+}
+
+// WaitFor returns how long until tokens could be consumed, 0 if they can be now.
+// Requests for more than the burst size are treated as a full bucket.
+func (tb *TokenBucket) WaitFor(tokens int64) time.Duration {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	tokens = min(tokens, tb.burstSize)
+	missing := tokens - Refill(tb.tokens, tb.limit, tb.burstSize, time.Since(tb.lastRefill))
+	if missing <= 0 {
+		return 0
+	}
+	if tb.limit <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(float64(missing) / float64(tb.limit) * float64(time.Second))
+}
+
+// ConsumeWait waits until tokens can be consumed and consumes them. Instead of
+// polling, it computes when enough tokens will have accrued and sleeps once,
+// retrying only if another consumer took them first. It returns ctx.Err() if
+// the context is done before then. Requests for more than the burst size
+// fail right away with ErrExceedsBurst, while those from a bucket without
+// refill only return with the context.
+func (tb *TokenBucket) ConsumeWait(ctx context.Context, tokens int64) error {
+	for {
+		wait, ok, err := tb.consumeOrWait(tokens)
+		if ok || err != nil {
+			return err
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// consumeOrWait consumes tokens if they are available, or returns how long
+// until they will be, or ErrExceedsBurst if they never will
+func (tb *TokenBucket) consumeOrWait(tokens int64) (time.Duration, bool, error) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	now := time.Now()
+	tb.tokens = Refill(tb.tokens, tb.limit, tb.burstSize, now.Sub(tb.lastRefill))
+	tb.lastRefill = now
+	
+	if tb.tokens >= tokens {
+		tb.tokens -= tokens
+		return 0, true, nil
+	}
+	if tokens > tb.burstSize {
+		return 0, false, ErrExceedsBurst
+	}
+	if tb.limit <= 0 {
+		return time.Duration(math.MaxInt64), false, nil // Never, unless the bucket is restored
+	}
+	
+	// Round up, so the tokens have accrued when the sleep ends
+	missing := tokens - tb.tokens
+	return time.Duration(math.Ceil(float64(missing) / float64(tb.limit) * float64(time.Second))), false, nil
+}
+
+// SetTokens sets the tokens currently available, capped at the burst size
+func (tb *TokenBucket) SetTokens(tokens int64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	tb.tokens = min(tokens, tb.burstSize)
+}
+
+// SetLimit changes the rate and burst size of the bucket, keeping the tokens
+// it holds. Tokens refilled so far are counted at the previous rate.
+func (tb *TokenBucket) SetLimit(limit, burstSize int64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	if limit == tb.limit && burstSize == tb.burstSize {
+		return
+	}
+	now := time.Now()
+	tb.tokens = min(Refill(tb.tokens, tb.limit, tb.burstSize, now.Sub(tb.lastRefill)), burstSize)
+	tb.lastRefill = now
+	tb.limit, tb.burstSize = limit, burstSize
+}
+
+// State returns the serializable state of the bucket
+func (tb *TokenBucket) State() State {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	return State{
+		Tokens:     tb.tokens,
+		Limit:      tb.limit,
+		BurstSize:  tb.burstSize,
+		LastRefill: tb.lastRefill,
+	}
+}
+
+// Restore restores the bucket from a saved state
+func (tb *TokenBucket) Restore(state State) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	tb.tokens = state.Tokens
+	tb.limit = state.Limit
+	tb.burstSize = state.BurstSize
+	tb.lastRefill = state.LastRefill
+}
+
+// ConsumeAll takes tokens from every bucket, or from none of them.
+// Buckets that already supplied tokens are refunded when a later one can't.
+func ConsumeAll(buckets []Consumer, tokens int64) bool {
+	for i, bucket := range buckets {
+		if !bucket.Consume(tokens) {
+			for _, consumed := range buckets[:i] {
+				consumed.Refund(tokens)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// ConsumeAllWait waits until tokens can be taken from every bucket and takes
+// them, or returns ctx.Err() if the context is done first, or ErrExceedsBurst
+// right away if a TokenBucket can never hold them. A single TokenBucket is
+// waited on with ConsumeWait. Otherwise the wait is computed
+// from the buckets that implement Waiter, while buckets that can't predict
+// their refill, e.g. leases on remote buckets, are retried every poll.
+func ConsumeAllWait(ctx context.Context, buckets []Consumer, tokens int64, poll time.Duration) error {
+	if len(buckets) == 1 {
+		if bucket, ok := buckets[0].(*TokenBucket); ok {
+			return bucket.ConsumeWait(ctx, tokens)
+		}
+	}
+	for _, bucket := range buckets {
+		if bucket, ok := bucket.(*TokenBucket); ok && tokens > bucket.BurstSize() {
+			return ErrExceedsBurst
+		}
+	}
+	
+	for !ConsumeAll(buckets, tokens) {
+		wait := time.Duration(0)
+		for _, bucket := range buckets {
+			waiter, ok := bucket.(Waiter)
+			if !ok {
+				wait = maxDuration(wait, poll)
+				continue
+			}
+			wait = maxDuration(wait, waiter.WaitFor(tokens))
+		}
+		
+		// Another consumer won the race for tokens that were available
+		if wait <= 0 {
+			wait = poll
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sleepContext sleeps for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// maxDuration returns the longer of two durations
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
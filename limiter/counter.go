@@ -0,0 +1,183 @@
+package limiter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteTransferred writes the bytes transferred of every entry that has
+// transferred any as a Prometheus counter, labelled by key and label
+func (s *MemoryStore) WriteTransferred(w io.Writer, name, help string) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name); err != nil {
+		return err
+	}
+	
+	var err error
+	s.Range(func(entry *Entry) bool {
+		transferred := entry.Transferred()
+		if transferred == 0 {
+			return true
+		}
+		labels := `key="` + escapeLabelValue(entry.Key) + `"`
+		if entry.Label != "" {
+			labels += `,label="` + escapeLabelValue(entry.Label) + `"`
+		}
+		_, err = fmt.Fprintf(w, "%s{%s} %d\n", name, labels, transferred)
+		return err == nil
+	})
+	return err
+}
+
+// CounterVec is a set of counters told apart by the value of a single label,
+// like a Prometheus counter vector
+type CounterVec struct {
+	mutex  sync.Mutex
+	label  string
+	values map[string]int64
+}
+
+// NewCounterVec creates an empty counter vector with the given label name
+func NewCounterVec(label string) *CounterVec {
+	return &CounterVec{
+		label:  label,
+		values: make(map[string]int64),
+	}
+}
+
+// Add adds n to the counter for the label value
+func (c *CounterVec) Add(value string, n int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	c.values[value] += n
+}
+
+// Get returns the counter for the label value
+func (c *CounterVec) Get(value string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	return c.values[value]
+}
+
+// Total returns the sum of the counters for all label values
+func (c *CounterVec) Total() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	total := int64(0)
+	for _, n := range c.values {
+		total += n
+	}
+	return total
+}
+
+// WritePrometheus writes the counters in the Prometheus text format, sorted by label value
+func (c *CounterVec) WritePrometheus(w io.Writer, name, help string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name); err != nil {
+		return err
+	}
+	
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	
+	for _, value := range values {
+		if _, err := fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, c.label, escapeLabelValue(value), c.values[value]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DurationVec is a set of time counters told apart by the values of a few
+// labels, written as Prometheus counters in seconds
+type DurationVec struct {
+	mutex  sync.Mutex
+	labels []string
+	values map[string]time.Duration // By label values joined with labelSeparator
+}
+
+// labelSeparator joins label values in DurationVec keys; it can't occur in UTF-8 text
+const labelSeparator = "\xff"
+
+// NewDurationVec creates an empty duration vector with the given label names
+func NewDurationVec(labels ...string) *DurationVec {
+	return &DurationVec{
+		labels: labels,
+		values: make(map[string]time.Duration),
+	}
+}
+
+// Add adds d to the counter for the label values, given in the order of the label names
+func (v *DurationVec) Add(d time.Duration, values ...string) {
+	key := strings.Join(values, labelSeparator)
+	
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	
+	v.values[key] += d
+}
+
+// Get returns the counter for the label values
+func (v *DurationVec) Get(values ...string) time.Duration {
+	key := strings.Join(values, labelSeparator)
+	
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	
+	return v.values[key]
+}
+
+// Total returns the sum of the counters for all label values
+func (v *DurationVec) Total() time.Duration {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	
+	total := time.Duration(0)
+	for _, d := range v.values {
+		total += d
+	}
+	return total
+}
+
+// WritePrometheus writes the counters in the Prometheus text format, sorted by label values
+func (v *DurationVec) WritePrometheus(w io.Writer, name, help string) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name); err != nil {
+		return err
+	}
+	
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	
+	for _, key := range keys {
+		values := strings.Split(key, labelSeparator)
+		pairs := make([]string, len(v.labels))
+		for i, label := range v.labels {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs[i] = label + `="` + escapeLabelValue(value) + `"`
+		}
+		if _, err := fmt.Fprintf(w, "%s{%s} %g\n", name, strings.Join(pairs, ","), v.values[key].Seconds()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package limiter
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultWaitBuckets are histogram upper bounds in seconds suited to pacing waits
+var DefaultWaitBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts durations into cumulative buckets, like a Prometheus histogram
+type Histogram struct {
+	mutex  sync.Mutex
+	bounds []float64 // Upper bounds in seconds, ascending
+	counts []uint64  // Per-bound counts, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given ascending upper bounds in seconds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe records a duration
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// WritePrometheus writes the histogram in the Prometheus text format
+func (h *Histogram) WritePrometheus(w io.Writer, name, help string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name); err != nil {
+		return err
+	}
+	
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	_, err := fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+	return err
+}
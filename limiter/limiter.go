@@ -0,0 +1,38 @@
+// Package limiter implements the bandwidth limiting core: token buckets, bucket
+// stores, pacing and resolved policies. It has no dependency on Traefik, so it
+// can be used by any http.Handler based consumer.
+package limiter
+
+import "time"
+
+// Policy is the set of limits resolved for a single request
+type Policy struct {
+	// Bandwidth limit in bytes per second
+	Limit int64
+	
+	// Burst size in bytes
+	Burst int64
+	
+	// Per-minute byte budget, 0 when no minute window applies
+	MinuteLimit int64
+	
+	// Bytes per second a response keeps getting while its buckets are empty, 0 for none
+	MinRate int64
+	
+	// How long a request may queue for a transfer slot, 0 to fail immediately
+	QueueMaxWait time.Duration
+	
+	// Which class of rule supplied Limit, e.g. "client", "backend" or "default"
+	Class string
+	
+	// Human-meaningful name of the rule's owner, e.g. "partner-acme"
+	Label string
+}
+
+// min helper function
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,635 @@
+package limiter_test
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// TestMemoryStoreEvictIdle tests that only idle entries are evicted
+func TestMemoryStoreEvictIdle(t *testing.T) {
+	store := limiter.NewMemoryStore()
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+
+	idle := store.LoadOrCreate("idle", policy)
+	idle.SetLastUsed(time.Now().Add(-time.Hour))
+	store.LoadOrCreate("active", policy)
+
+	quota := store.LoadOrCreate("quota", limiter.Policy{Limit: 1000, Burst: 2000, MinuteLimit: 60000})
+	quota.SetLastUsed(time.Now().Add(-time.Hour))
+
+	removed, kept := store.EvictIdle(time.Now().Add(-time.Minute), time.Now().Add(-2*time.Hour))
+	if removed != 1 || kept != 2 {
+		t.Errorf("Expected 1 removed and 2 kept, got %d removed and %d kept", removed, kept)
+	}
+
+	if _, ok := store.Load("quota"); !ok {
+		t.Error("Quota entry should have been kept until its own cutoff")
+	}
+
+	if _, ok := store.Load("idle"); ok {
+		t.Error("Idle entry should have been evicted")
+	}
+	if _, ok := store.Load("active"); !ok {
+		t.Error("Active entry should have been kept")
+	}
+}
+
+// TestMemoryStoreEvictInUse tests that entries held by a transfer survive cleanup
+func TestMemoryStoreEvictInUse(t *testing.T) {
+	store := limiter.NewMemoryStore()
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+
+	entry := store.Acquire("download", policy)
+	entry.SetLastUsed(time.Now().Add(-time.Hour))
+
+	if removed, _ := store.EvictIdle(time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)); removed != 0 {
+		t.Fatalf("Expected the in-use entry to be kept, %d removed", removed)
+	}
+	if !entry.InUse() {
+		t.Error("Entry should still be in use")
+	}
+
+	// Releasing counts as a use, so the entry gets a full idle period
+	entry.Release()
+	if removed, _ := store.EvictIdle(time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)); removed != 0 {
+		t.Fatalf("Expected the just released entry to be kept, %d removed", removed)
+	}
+	if removed, _ := store.EvictIdle(time.Now().Add(time.Minute), time.Now().Add(time.Minute)); removed != 1 {
+		t.Fatalf("Expected the idle entry to be removed, %d removed", removed)
+	}
+
+	// A later transfer gets a fresh entry instead of a deleted one
+	if again := store.Acquire("download", policy); again == entry {
+		t.Error("Expected a new entry after eviction")
+	} else if stored, _ := store.Load("download"); stored != again {
+		t.Error("Expected the new entry to be stored")
+	}
+}
+
+// TestSnapshotRoundTrip tests that entries survive a write and read of the snapshot file
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/nested/buckets.json"
+
+	entry := limiter.NewEntry("10.0.0.1:default", limiter.Policy{Limit: 1000, Burst: 2000, MinuteLimit: 6000, Label: "partner-acme"})
+	entry.Bucket.SetTokens(500)
+
+	if err := limiter.WriteSnapshot(path, []limiter.State{entry.Snapshot()}); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := limiter.ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("Expected 1 state, got %d", len(states))
+	}
+
+	restored := limiter.RestoreEntry(states[0])
+	if restored.Key != entry.Key {
+		t.Errorf("Unexpected key. Expected %q, got %q", entry.Key, restored.Key)
+	}
+	if restored.Label != "partner-acme" {
+		t.Errorf("Unexpected label. Expected %q, got %q", "partner-acme", restored.Label)
+	}
+	if got := restored.Bucket.State().Tokens; got != 500 {
+		t.Errorf("Unexpected tokens. Expected 500, got %d", got)
+	}
+	if restored.Window == nil || restored.Window.State().BurstSize != 6000 {
+		t.Error("Per-minute window was not restored")
+	}
+}
+
+// TestReadSnapshotMissingFile tests that a missing snapshot file is not an error
+func TestReadSnapshotMissingFile(t *testing.T) {
+	states, err := limiter.ReadSnapshot(t.TempDir() + "/missing.json")
+	if err != nil || states != nil {
+		t.Errorf("Expected no states and no error, got %v, %v", states, err)
+	}
+}
+
+// TestTransferQueueFairness tests that waiting keys take turns for freed slots
+func TestTransferQueueFairness(t *testing.T) {
+	queue := limiter.NewTransferQueue(1)
+	ctx := context.Background()
+
+	if !queue.Acquire(ctx, "a", 0) {
+		t.Fatal("Expected free slot to be acquired")
+	}
+	if queue.Acquire(ctx, "b", 0) {
+		t.Fatal("Expected acquire without wait to fail when full")
+	}
+
+	order := make(chan string, 3)
+	enqueue := func(key string) {
+		waiting := queue.Waiting()
+		go func() {
+			if queue.Acquire(ctx, key, time.Second) {
+				order <- key
+			}
+		}()
+		for queue.Waiting() == waiting {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Key a queues twice before b, but b must not wait behind both
+	enqueue("a")
+	enqueue("a")
+	enqueue("b")
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		queue.Release()
+		got = append(got, <-order)
+	}
+	if got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Errorf("Expected dequeue order [a b a], got %v", got)
+	}
+
+	if queue.Acquire(ctx, "c", 10*time.Millisecond) {
+		t.Error("Expected queued acquire to time out")
+	}
+	if queue.Waiting() != 0 {
+		t.Errorf("Expected timed out waiter to leave the queue, %d waiting", queue.Waiting())
+	}
+}
+
+// TestKeySlots tests the per-key transfer cap and its bounded queue
+func TestKeySlots(t *testing.T) {
+	slots := limiter.NewKeySlots(2, 1)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if !slots.Acquire(ctx, "a", 0) {
+			t.Fatalf("Expected slot %d of a to be acquired", i)
+		}
+	}
+	if slots.Acquire(ctx, "a", 0) {
+		t.Fatal("Expected acquire without wait to fail when the key is full")
+	}
+	if !slots.Acquire(ctx, "b", 0) {
+		t.Fatal("Expected other keys to have slots of their own")
+	}
+
+	granted := make(chan bool, 1)
+	go func() {
+		granted <- slots.Acquire(ctx, "a", time.Second)
+	}()
+	for slots.Waiting("a") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if slots.Acquire(ctx, "a", time.Second) {
+		t.Fatal("Expected acquire to fail when the key's queue is full")
+	}
+
+	slots.Release("a")
+	if !<-granted {
+		t.Fatal("Expected the queued transfer to get the freed slot")
+	}
+	if active := slots.Active("a"); active != 2 {
+		t.Errorf("Expected the slot to be handed over, %d active", active)
+	}
+
+	if slots.Acquire(ctx, "a", 10*time.Millisecond) {
+		t.Error("Expected queued acquire to time out")
+	}
+	if slots.Waiting("a") != 0 {
+		t.Errorf("Expected timed out waiter to leave the queue, %d waiting", slots.Waiting("a"))
+	}
+
+	slots.Release("a")
+	slots.Release("a")
+	slots.Release("b")
+	if slots.Active("a") != 0 || slots.Active("b") != 0 {
+		t.Error("Expected all slots to be free")
+	}
+}
+
+// TestWriteOpenMetrics tests the OpenMetrics bucket state export
+func TestWriteOpenMetrics(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	states := []limiter.State{
+		{Key: "10.0.0.2:backend", Tokens: 500, Limit: 1000, BurstSize: 2000, LastUsed: now, Created: now.Add(-time.Hour), Label: "partner-acme"},
+		{Key: `odd"key`, Tokens: 10, Limit: 1000, BurstSize: 2000, Window: &limiter.State{Tokens: 7, BurstSize: 60000}},
+	}
+
+	var buf bytes.Buffer
+	if err := limiter.WriteOpenMetrics(&buf, states, now); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE bwl_bucket_tokens gauge\n",
+		`bwl_bucket_tokens{key="10.0.0.2:backend",label="partner-acme"} 500 1700000000.000` + "\n",
+		`bwl_bucket_last_used_seconds{key="10.0.0.2:backend",label="partner-acme"} 1.7e+09 1700000000.000` + "\n",
+		`bwl_bucket_created_seconds{key="10.0.0.2:backend",label="partner-acme"} 1.6999964e+09 1700000000.000` + "\n",
+		`bwl_window_tokens{key="odd\"key"} 7 1700000000.000` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	if strings.Contains(out, `bwl_bucket_created_seconds{key="odd`) {
+		t.Error("Expected no creation time sample for a bucket without creation time")
+	}
+	if strings.Contains(out, `bwl_window_tokens{key="10.0.0.2:backend"`) {
+		t.Error("Expected no window sample for a bucket without window")
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Error("Expected output to end with # EOF")
+	}
+}
+
+// TestDurationVec tests the labelled time counters and their Prometheus output
+func TestDurationVec(t *testing.T) {
+	vec := limiter.NewDurationVec("class", "route")
+	vec.Add(1500*time.Millisecond, "default", "")
+	vec.Add(500*time.Millisecond, "default", "")
+	vec.Add(250*time.Millisecond, "path", `/a"b`)
+
+	if got := vec.Get("default", ""); got != 2*time.Second {
+		t.Errorf("Expected 2s, got %v", got)
+	}
+	if got := vec.Total(); got != 2250*time.Millisecond {
+		t.Errorf("Expected a total of 2.25s, got %v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := vec.WritePrometheus(&buf, "bwl_test_seconds_total", "Test."); err != nil {
+		t.Fatal(err)
+	}
+	want := "# HELP bwl_test_seconds_total Test.\n# TYPE bwl_test_seconds_total counter\n" +
+		`bwl_test_seconds_total{class="default",route=""} 2` + "\n" +
+		`bwl_test_seconds_total{class="path",route="/a\"b"} 0.25` + "\n"
+	if buf.String() != want {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+}
+
+// TestHashRing tests that keys spread across nodes and mostly stay put when a node joins
+func TestHashRing(t *testing.T) {
+	before := limiter.NewHashRing([]string{"a:1", "b:1"}, 64)
+	after := limiter.NewHashRing([]string{"a:1", "b:1", "c:1"}, 64)
+
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ":default"
+		owner := before.Owner(key)
+		counts[owner]++
+		if newOwner := after.Owner(key); newOwner != owner && newOwner != "c:1" {
+			moved++
+		}
+	}
+
+	if counts["a:1"] < 1000 || counts["b:1"] < 1000 {
+		t.Errorf("Keys are unevenly spread: %v", counts)
+	}
+	if moved > 0 {
+		t.Errorf("Expected keys to only move to the new node, %d moved between old nodes", moved)
+	}
+	if owner := limiter.NewHashRing(nil, 64).Owner("key"); owner != "" {
+		t.Errorf("Expected no owner on an empty ring, got %q", owner)
+	}
+}
+
+// TestHistogram tests cumulative bucket counts in the Prometheus output
+func TestHistogram(t *testing.T) {
+	histogram := limiter.NewHistogram([]float64{0.01, 0.1})
+	histogram.Observe(0)
+	histogram.Observe(50 * time.Millisecond)
+	histogram.Observe(time.Second)
+
+	var buf bytes.Buffer
+	if err := histogram.WritePrometheus(&buf, "wait_seconds", "Waits."); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE wait_seconds histogram\n",
+		`wait_seconds_bucket{le="0.01"} 1` + "\n",
+		`wait_seconds_bucket{le="0.1"} 2` + "\n",
+		`wait_seconds_bucket{le="+Inf"} 3` + "\n",
+		"wait_seconds_sum 1.05\n",
+		"wait_seconds_count 3\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+// TestTokenBucketWaitFor tests the time until tokens become available
+func TestTokenBucketWaitFor(t *testing.T) {
+	bucket := limiter.NewTokenBucket(1000, 2000)
+	if wait := bucket.WaitFor(2000); wait != 0 {
+		t.Errorf("Expected no wait on a full bucket, got %v", wait)
+	}
+
+	bucket.SetTokens(0)
+	if wait := bucket.WaitFor(500); wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Expected about 500ms for 500 tokens at 1000/s, got %v", wait)
+	}
+	if wait := bucket.WaitFor(10000); wait < 1900*time.Millisecond || wait > 2*time.Second {
+		t.Errorf("Expected requests over the burst to wait for a full bucket, got %v", wait)
+	}
+}
+
+// TestTokenBucketSetLimit tests that changing the limit keeps the tokens of a bucket
+func TestTokenBucketSetLimit(t *testing.T) {
+	bucket := limiter.NewTokenBucket(1000, 2000)
+	bucket.SetTokens(500)
+	bucket.SetLimit(4000, 8000)
+	if available := bucket.Available(); available < 500 || available > 600 {
+		t.Errorf("Expected the tokens to be kept, got %d", available)
+	}
+	if wait := bucket.WaitFor(2500); wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Expected the bucket to refill at the new rate, got %v", wait)
+	}
+	if state := bucket.State(); state.Limit != 4000 || state.BurstSize != 8000 {
+		t.Errorf("Expected the new limit and burst, got %+v", state)
+	}
+
+	// A smaller burst caps the tokens
+	bucket.SetLimit(100, 200)
+	if available := bucket.Available(); available != 200 {
+		t.Errorf("Expected the tokens to be capped at the new burst, got %d", available)
+	}
+}
+
+// TestTokenBucketConsumeWait tests that waits end when the tokens have accrued, or with the context
+func TestTokenBucketConsumeWait(t *testing.T) {
+	bucket := limiter.NewTokenBucket(10000, 1000)
+	bucket.SetTokens(0)
+
+	start := time.Now()
+	if err := bucket.ConsumeWait(context.Background(), 500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Errorf("Expected about 50ms for 500 tokens at 10000/s, took %v", elapsed)
+	}
+	if available := bucket.Available(); available > 50 {
+		t.Errorf("Expected the accrued tokens to be consumed, %d left", available)
+	}
+
+	// Requests over the burst can never be served and fail right away
+	start = time.Now()
+	if err := bucket.ConsumeWait(context.Background(), 5000); err != limiter.ErrExceedsBurst {
+		t.Errorf("Expected ErrExceedsBurst, got %v", err)
+	}
+	other := limiter.NewTokenBucket(10000, 10000)
+	if err := limiter.ConsumeAllWait(context.Background(), []limiter.Consumer{other, bucket}, 5000, time.Millisecond); err != limiter.ErrExceedsBurst {
+		t.Errorf("Expected ErrExceedsBurst from ConsumeAllWait, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected the waits to fail without waiting, took %v", elapsed)
+	}
+	if available := other.Available(); available < 9000 {
+		t.Errorf("Expected no tokens taken from the other bucket, %d left", available)
+	}
+
+	// Buckets without refill still wait for the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	empty := limiter.NewTokenBucket(0, 1000)
+	empty.SetTokens(0)
+	if err := empty.ConsumeWait(ctx, 500); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+}
+
+// TestTokenBucketReserve tests that reservations take their tokens up front and release them at the bucket's rate
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := limiter.NewTokenBucket(10000, 1000)
+
+	// The burst is ready right away, the rest follows at 10000/s
+	first, ok := bucket.Reserve(3000, 0)
+	if !ok {
+		t.Fatal("Expected the reservation to be taken")
+	}
+	if first.Ready != 1000 || first.Remaining() != 3000 {
+		t.Errorf("Expected 1000 of 3000 tokens ready, got %d of %d", first.Ready, first.Remaining())
+	}
+	if end := time.Until(first.End()); end < 150*time.Millisecond || end > 200*time.Millisecond {
+		t.Errorf("Expected the reservation to end in about 200ms, got %v", end)
+	}
+	if bucket.Consume(1) {
+		t.Error("Expected the bucket to be in debt")
+	}
+
+	// Later reservations start once the debt is paid off
+	second, ok := bucket.Reserve(1000, 0)
+	if !ok {
+		t.Fatal("Expected the second reservation to be taken")
+	}
+	if second.Ready != 0 || !second.Start.After(first.Start.Add(150*time.Millisecond)) {
+		t.Errorf("Expected the second reservation to start after the first, got %+v", second)
+	}
+
+	// Reservations over maxWait take nothing
+	before := bucket.State().Tokens
+	if _, ok := bucket.Reserve(1000, 100*time.Millisecond); ok {
+		t.Error("Expected a reservation over maxWait to be refused")
+	}
+	if tokens := bucket.State().Tokens; tokens > before+100 {
+		t.Errorf("Expected a refused reservation to take no tokens, %d before and %d after", before, tokens)
+	}
+
+	// Buckets without refill can't reserve
+	if _, ok := limiter.NewTokenBucket(0, 1000).Reserve(10, 0); ok {
+		t.Error("Expected a bucket without refill to refuse reservations")
+	}
+}
+
+// TestReservationWait tests that waits on a reservation follow its schedule
+func TestReservationWait(t *testing.T) {
+	bucket := limiter.NewTokenBucket(10000, 1000)
+	reservation, _ := bucket.Reserve(1500, 0)
+
+	start := time.Now()
+	if err := reservation.Wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("Expected the burst without a wait, took %v", elapsed)
+	}
+	if err := reservation.Wait(context.Background(), 500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Errorf("Expected about 50ms for 500 tokens at 10000/s, took %v", elapsed)
+	}
+	if reservation.Remaining() != 0 {
+		t.Errorf("Expected the reservation to be used up, %d left", reservation.Remaining())
+	}
+
+	// Waits end with the context
+	late, _ := bucket.Reserve(10000, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := late.Wait(ctx, 10000); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+}
+
+// leaseConsumer is a Consumer that can't predict its refill
+type leaseConsumer struct {
+	available int32 // Only accessed atomically
+}
+
+func (c *leaseConsumer) Consume(tokens int64) bool { return atomic.LoadInt32(&c.available) == 1 }
+func (c *leaseConsumer) Refund(tokens int64)       {}
+
+// TestConsumeAllWait tests that waits across buckets last until the slowest one has the tokens
+func TestConsumeAllWait(t *testing.T) {
+	fast, slow := limiter.NewTokenBucket(100000, 1000), limiter.NewTokenBucket(10000, 1000)
+	fast.SetTokens(0)
+	slow.SetTokens(0)
+
+	start := time.Now()
+	if err := limiter.ConsumeAllWait(context.Background(), []limiter.Consumer{fast, slow}, 500, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Errorf("Expected about 50ms for the slower bucket, took %v", elapsed)
+	}
+
+	// Consumers without a computed wait are retried until they grant the tokens
+	lease := &leaseConsumer{}
+	time.AfterFunc(30*time.Millisecond, func() { atomic.StoreInt32(&lease.available, 1) })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := limiter.ConsumeAllWait(ctx, []limiter.Consumer{fast, lease}, 100, 5*time.Millisecond); err != nil {
+		t.Errorf("Expected the lease to be retried, got %v", err)
+	}
+}
+
+// TestTokenBucketConsumeAllocs tests that paying for chunks doesn't allocate
+func TestTokenBucketConsumeAllocs(t *testing.T) {
+	bucket := limiter.NewTokenBucket(1<<40, 1<<40)
+	buckets := []limiter.Consumer{bucket, limiter.NewTokenBucket(1<<40, 1<<40)}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		bucket.Consume(100)
+		limiter.ConsumeAll(buckets, 100)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+// BenchmarkConsume measures paying for a chunk from one bucket, alone and under contention
+func BenchmarkConsume(b *testing.B) {
+	b.Run("serial", func(b *testing.B) {
+		bucket := limiter.NewTokenBucket(1<<40, 1<<40)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bucket.Consume(100)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		bucket := limiter.NewTokenBucket(1<<40, 1<<40)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				bucket.Consume(100)
+			}
+		})
+	})
+	b.Run("all", func(b *testing.B) {
+		buckets := []limiter.Consumer{
+			limiter.NewTokenBucket(1<<40, 1<<40),
+			limiter.NewTokenBucket(1<<40, 1<<40),
+			limiter.NewTokenBucket(1<<40, 1<<40),
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			limiter.ConsumeAll(buckets, 100)
+		}
+	})
+}
+
+// newBenchStore creates a store with n client buckets, half of them with a per-minute window
+func newBenchStore(n int) *limiter.MemoryStore {
+	store := limiter.NewMemoryStore()
+	for i := 0; i < n; i++ {
+		policy := limiter.Policy{Limit: 1 << 20, Burst: 2 << 20}
+		if i%2 == 0 {
+			policy.MinuteLimit = 60 << 20
+		}
+		store.LoadOrCreate("10."+strconv.Itoa(i>>16)+"."+strconv.Itoa(i>>8&255)+"."+strconv.Itoa(i&255)+":backend.local", policy)
+	}
+	return store
+}
+
+// BenchmarkSnapshot measures saving and loading the persistence file of 100k buckets
+func BenchmarkSnapshot(b *testing.B) {
+	const buckets = 100000
+	path := b.TempDir() + "/buckets.json"
+
+	b.Run("save", func(b *testing.B) {
+		store := newBenchStore(buckets)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := limiter.WriteSnapshot(path, store.Snapshot()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("load", func(b *testing.B) {
+		if err := limiter.WriteSnapshot(path, newBenchStore(buckets).Snapshot()); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			states, err := limiter.ReadSnapshot(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			store := limiter.NewMemoryStore()
+			for _, state := range states {
+				store.Store(limiter.RestoreEntry(state))
+			}
+			if store.Len() != buckets {
+				b.Fatalf("Expected %d restored buckets, got %d", buckets, store.Len())
+			}
+		}
+	})
+}
+
+// TestRefillVectors tests the refill math against the exported vectors
+func TestRefillVectors(t *testing.T) {
+	for _, v := range limiter.RefillVectors {
+		if got := limiter.Refill(v.Tokens, v.Limit, v.BurstSize, v.Elapsed); got != v.Expected {
+			t.Errorf("%s: expected %d tokens, got %d", v.Name, v.Expected, got)
+		}
+	}
+}
+
+// TestTokenBucketRefillRounding tests that buckets drop partial tokens between refills
+func TestTokenBucketRefillRounding(t *testing.T) {
+	bucket := limiter.NewTokenBucket(1000, 2000)
+	bucket.SetTokens(0)
+
+	// Checking every 100µs refills a tenth of a token each time, which is dropped
+	for i := 0; i < 20; i++ {
+		state := bucket.State()
+		state.LastRefill = time.Now().Add(-100 * time.Microsecond)
+		bucket.Restore(state)
+		bucket.Consume(0)
+	}
+	if tokens := bucket.State().Tokens; tokens != 0 {
+		t.Errorf("Expected partial tokens to be dropped, got %d", tokens)
+	}
+}
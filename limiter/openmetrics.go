@@ -0,0 +1,101 @@
+package limiter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// openMetricsFamily describes one metric family of the bucket state export
+type openMetricsFamily struct {
+	name  string
+	help  string
+	value func(state State) (float64, bool)
+}
+
+// openMetricsFamilies lists the exported bucket state, one sample per bucket
+var openMetricsFamilies = []openMetricsFamily{
+	{"bwl_bucket_tokens", "Tokens available in the bucket.", func(s State) (float64, bool) {
+		return float64(s.Tokens), true
+	}},
+	{"bwl_bucket_limit_bytes_per_second", "Refill rate of the bucket.", func(s State) (float64, bool) {
+		return float64(s.Limit), true
+	}},
+	{"bwl_bucket_burst", "Burst size of the bucket in bytes.", func(s State) (float64, bool) {
+		return float64(s.BurstSize), true
+	}},
+	{"bwl_bucket_last_used_seconds", "Unix time the bucket was last used.", func(s State) (float64, bool) {
+		return unixSeconds(s.LastUsed), true
+	}},
+	{"bwl_bucket_created_seconds", "Unix time the bucket was created.", func(s State) (float64, bool) {
+		return unixSeconds(s.Created), !s.Created.IsZero()
+	}},
+	{"bwl_bucket_last_refill_seconds", "Unix time the bucket was last refilled.", func(s State) (float64, bool) {
+		return unixSeconds(s.LastRefill), true
+	}},
+	{"bwl_window_tokens", "Tokens available in the per-minute window.", func(s State) (float64, bool) {
+		if s.Window == nil {
+			return 0, false
+		}
+		return float64(s.Window.Tokens), true
+	}},
+	{"bwl_window_limit_bytes_per_minute", "Per-minute budget of the window.", func(s State) (float64, bool) {
+		if s.Window == nil {
+			return 0, false
+		}
+		return float64(s.Window.BurstSize), true
+	}},
+}
+
+// WriteOpenMetrics writes bucket states in the OpenMetrics text format. Every
+// sample carries timestamp, so the output can be backfilled into a TSDB, e.g.
+// with promtool tsdb create-blocks-from openmetrics.
+func WriteOpenMetrics(w io.Writer, states []State, timestamp time.Time) error {
+	sorted := make([]State, len(states))
+	copy(sorted, states)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	
+	ts := unixSeconds(timestamp)
+	buf := bufio.NewWriter(w)
+	for _, family := range openMetricsFamilies {
+		fmt.Fprintf(buf, "# TYPE %s gauge\n", family.name)
+		fmt.Fprintf(buf, "# HELP %s %s\n", family.name, family.help)
+		for _, state := range sorted {
+			if value, ok := family.value(state); ok {
+				fmt.Fprintf(buf, "%s{%s} %g %.3f\n", family.name, openMetricsLabels(state), value, ts)
+			}
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Flush()
+}
+
+// openMetricsLabels formats the labels of a bucket's samples
+func openMetricsLabels(state State) string {
+	labels := `key="` + escapeLabelValue(state.Key) + `"`
+	if state.Label != "" {
+		labels += `,label="` + escapeLabelValue(state.Label) + `"`
+	}
+	return labels
+}
+
+// unixSeconds converts t to fractional Unix seconds, 0 for the zero time
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// labelValueEscaper escapes label values as required by OpenMetrics
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes a label value as required by OpenMetrics
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,190 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeSlicePacer lets a single response send a fixed number of bytes per tick.
+// It keeps no shared state, trading exact shaping for near-zero bookkeeping.
+type TimeSlicePacer struct {
+	bytesPerTick int64
+	tick         time.Duration
+	sliceStart   time.Time
+	used         int64
+}
+
+// NewTimeSlicePacer creates a pacer sending limit bytes per second in tick-sized slices
+func NewTimeSlicePacer(limit int64, tick time.Duration) *TimeSlicePacer {
+	bytesPerTick := int64(float64(limit) * tick.Seconds())
+	if bytesPerTick < 1 {
+		bytesPerTick = 1
+	}
+	return &TimeSlicePacer{
+		bytesPerTick: bytesPerTick,
+		tick:         tick,
+	}
+}
+
+// Take returns how many of n bytes may be written now, sleeping until the
+// next slice when the current one is used up. It also reports the time slept.
+func (p *TimeSlicePacer) Take(n int64) (int64, time.Duration) {
+	var waited time.Duration
+	for {
+		now := time.Now()
+		if now.Sub(p.sliceStart) >= p.tick {
+			p.sliceStart = now
+			p.used = 0
+		}
+		
+		if available := p.bytesPerTick - p.used; available > 0 {
+			granted := min(n, available)
+			p.used += granted
+			return granted, waited
+		}
+		
+		// Current slice is used up, sleep until the next one starts
+		sleep := p.tick - now.Sub(p.sliceStart)
+		time.Sleep(sleep)
+		waited += sleep
+	}
+}
+
+// DefaultChunkSize is how many bytes are paid for and written at a time
+const DefaultChunkSize = 4096
+
+// Bounds of configured chunk sizes
+const (
+	MinChunkSize = 512
+	MaxChunkSize = 1 << 20
+)
+
+// Bounds of high-resolution pacing chunks and token waits
+const (
+	maxHighResChunkSize = MaxChunkSize
+	minHighResWait      = time.Millisecond
+	maxHighResWait      = 10 * time.Millisecond
+)
+
+// HighResChunkSize returns the chunk size for high-resolution pacing: about
+// 10ms of traffic at limit, so multi-gigabit rates need few writes and bucket
+// locks per second. It never drops below DefaultChunkSize unless burst is
+// smaller, and never exceeds burst, which must be able to pay for a whole chunk.
+func HighResChunkSize(limit, burst int64) int64 {
+	chunkSize := limit / 100
+	if chunkSize < DefaultChunkSize {
+		chunkSize = DefaultChunkSize
+	}
+	return ChunkForBurst(min(chunkSize, maxHighResChunkSize), burst)
+}
+
+// AutoChunkSize returns a chunk size derived from limit: about 10ms of
+// traffic, so slow limits pay for small chunks instead of being dominated by
+// the burst, and fast ones aren't split into thousands of writes. It stays
+// between MinChunkSize and MaxChunkSize, and never exceeds burst.
+func AutoChunkSize(limit, burst int64) int64 {
+	chunkSize := limit / 100
+	if chunkSize < MinChunkSize {
+		chunkSize = MinChunkSize
+	}
+	return ChunkForBurst(min(chunkSize, MaxChunkSize), burst)
+}
+
+// ChunkForBurst shrinks chunkSize to burst, however small, since a bucket
+// can never hold the tokens for a chunk above its burst. A burst of 0 or
+// less leaves chunkSize as is.
+func ChunkForBurst(chunkSize, burst int64) int64 {
+	if burst > 0 {
+		return min(chunkSize, burst)
+	}
+	return chunkSize
+}
+
+// HighResWait returns how long to sleep before tokens for another try at
+// limit are likely available. Sleeps are coalesced to at least a millisecond
+// so fast limits don't spin on the timer.
+func HighResWait(tokens, limit int64) time.Duration {
+	if limit <= 0 {
+		return maxHighResWait
+	}
+	wait := time.Duration(float64(tokens) / float64(limit) * float64(time.Second))
+	if wait < minHighResWait {
+		return minHighResWait
+	}
+	if wait > maxHighResWait {
+		return maxHighResWait
+	}
+	return wait
+}
+
+// InFlightGauge tracks the bytes a single client currently has in in-progress chunk writes
+type InFlightGauge struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	bytes int64
+	refs  int // Active responses using this gauge, guarded by InFlightGauges.mutex
+}
+
+// newInFlightGauge creates an empty gauge
+func newInFlightGauge() *InFlightGauge {
+	g := &InFlightGauge{}
+	g.cond = sync.NewCond(&g.mutex)
+	return g
+}
+
+// Acquire blocks until n more bytes fit under max, then reserves them.
+// A chunk larger than max is let through when nothing else is in flight.
+func (g *InFlightGauge) Acquire(n, max int64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	
+	for g.bytes > 0 && g.bytes+n > max {
+		g.cond.Wait()
+	}
+	g.bytes += n
+}
+
+// Release returns n reserved bytes and wakes waiting writers
+func (g *InFlightGauge) Release(n int64) {
+	g.mutex.Lock()
+	g.bytes -= n
+	g.mutex.Unlock()
+	
+	g.cond.Broadcast()
+}
+
+// InFlightGauges hands out one gauge per key for as long as any response uses it
+type InFlightGauges struct {
+	mutex  sync.Mutex
+	gauges map[string]*InFlightGauge
+}
+
+// Retain returns the gauge for key, creating it if needed.
+// Every call must be paired with Release.
+func (r *InFlightGauges) Retain(key string) *InFlightGauge {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if r.gauges == nil {
+		r.gauges = make(map[string]*InFlightGauge)
+	}
+	
+	gauge, exists := r.gauges[key]
+	if !exists {
+		gauge = newInFlightGauge()
+		r.gauges[key] = gauge
+	}
+	gauge.refs++
+	return gauge
+}
+
+// Release drops a reference and forgets the gauge once no response uses it
+func (r *InFlightGauges) Release(key string, gauge *InFlightGauge) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	gauge.refs--
+	if gauge.refs == 0 {
+		delete(r.gauges, key)
+	}
+}
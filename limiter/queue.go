@@ -0,0 +1,136 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TransferQueue caps the number of concurrent transfers. Excess transfers wait
+// in a FIFO queue per key, and freed slots go to the waiting keys in turn, so
+// one busy client can't starve the others.
+type TransferQueue struct {
+	mutex   sync.Mutex
+	max     int64
+	active  int64
+	waiting map[string][]*transferWaiter
+	order   []string // Keys with waiters, in round-robin order
+}
+
+// transferWaiter is a queued transfer; ready is closed once it was granted a slot
+type transferWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// NewTransferQueue creates a queue allowing max concurrent transfers
+func NewTransferQueue(max int64) *TransferQueue {
+	return &TransferQueue{
+		max:     max,
+		waiting: make(map[string][]*transferWaiter),
+	}
+}
+
+// Acquire takes a transfer slot for key, queueing for at most maxWait or until
+// ctx is done. It reports whether a slot was taken; every successful call must
+// be paired with Release.
+func (q *TransferQueue) Acquire(ctx context.Context, key string, maxWait time.Duration) bool {
+	q.mutex.Lock()
+	if q.active < q.max {
+		q.active++
+		q.mutex.Unlock()
+		return true
+	}
+	if maxWait <= 0 {
+		q.mutex.Unlock()
+		return false
+	}
+	
+	w := &transferWaiter{ready: make(chan struct{})}
+	if len(q.waiting[key]) == 0 {
+		q.order = append(q.order, key)
+	}
+	q.waiting[key] = append(q.waiting[key], w)
+	q.mutex.Unlock()
+	
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	
+	// The slot may have been handed over while we were timing out
+	if w.granted {
+		return true
+	}
+	q.remove(key, w)
+	return false
+}
+
+// Release frees a slot, handing it to the next waiting key if there is one
+func (q *TransferQueue) Release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	
+	if len(q.order) == 0 {
+		q.active--
+		return
+	}
+	
+	// Take the oldest waiter of the next key and move the key to the back
+	key := q.order[0]
+	q.order = q.order[1:]
+	waiters := q.waiting[key]
+	w := waiters[0]
+	if len(waiters) > 1 {
+		q.waiting[key] = waiters[1:]
+		q.order = append(q.order, key)
+	} else {
+		delete(q.waiting, key)
+	}
+	
+	w.granted = true
+	close(w.ready)
+}
+
+// Waiting returns the number of queued transfers
+func (q *TransferQueue) Waiting() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	
+	count := 0
+	for _, waiters := range q.waiting {
+		count += len(waiters)
+	}
+	return count
+}
+
+// remove drops a waiter that gave up; the caller holds the mutex
+func (q *TransferQueue) remove(key string, w *transferWaiter) {
+	waiters := q.waiting[key]
+	for i, candidate := range waiters {
+		if candidate == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		q.waiting[key] = waiters
+		return
+	}
+	
+	delete(q.waiting, key)
+	for i, candidate := range q.order {
+		if candidate == key {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
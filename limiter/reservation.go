@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Reserver is a Consumer that can pay for a whole transfer up front, see TokenBucket.Reserve
+type Reserver interface {
+	Reserve(tokens int64, maxWait time.Duration) (*Reservation, bool)
+}
+
+// Reservation is a transfer paid for up front. Its tokens are released as
+// they would have accrued in the bucket, so the transfer goes at the bucket's
+// rate and its completion time is known when it starts.
+type Reservation struct {
+	Tokens int64     // Tokens reserved
+	Ready  int64     // Tokens the bucket held for the transfer right away
+	Limit  int64     // Tokens per second the rest is released at
+	Start  time.Time // When the rest starts to be released, after earlier reservations are paid off
+	
+	released int64
+}
+
+// End returns when all of the reservation's tokens are released
+func (r *Reservation) End() time.Time {
+	return r.releasedAt(r.Tokens)
+}
+
+// Remaining returns the reserved tokens not released yet
+func (r *Reservation) Remaining() int64 {
+	return r.Tokens - r.released
+}
+
+// Wait waits until tokens more of the reservation's tokens are released and
+// takes them, or returns ctx.Err() if the context is done first. Callers must
+// not wait for more than Remaining.
+func (r *Reservation) Wait(ctx context.Context, tokens int64) error {
+	target := r.released + tokens
+	if wait := time.Until(r.releasedAt(target)); wait > 0 {
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+	r.released = target
+	return nil
+}
+
+// releasedAt returns when the first tokens of the reservation are released
+func (r *Reservation) releasedAt(tokens int64) time.Time {
+	if tokens <= r.Ready || r.Limit <= 0 {
+		return r.Start
+	}
+	// Round up, so the tokens have accrued when the wait ends
+	return r.Start.Add(time.Duration(math.Ceil(float64(tokens-r.Ready) / float64(r.Limit) * float64(time.Second))))
+}
+
+// Reserve takes tokens from the bucket up front, even if that leaves it in
+// debt, and returns the reservation releasing them at the bucket's rate.
+// Consumers after it wait until the debt is paid off. If the reservation
+// would take longer than maxWait to be released in full, nothing is taken and
+// it returns false along with the reservation it would have made; a maxWait
+// of 0 accepts any wait. Buckets without refill can't reserve.
+func (tb *TokenBucket) Reserve(tokens int64, maxWait time.Duration) (*Reservation, bool) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	now := time.Now()
+	tb.tokens = Refill(tb.tokens, tb.limit, tb.burstSize, now.Sub(tb.lastRefill))
+	tb.lastRefill = now
+	
+	r := &Reservation{Tokens: tokens, Ready: min(tokens, tb.tokens), Limit: tb.limit, Start: now}
+	if r.Ready < 0 {
+		r.Ready = 0
+	}
+	if tb.limit <= 0 {
+		return r, false
+	}
+	if tb.tokens < 0 {
+		r.Start = now.Add(time.Duration(math.Ceil(float64(-tb.tokens) / float64(tb.limit) * float64(time.Second))))
+	}
+	if maxWait > 0 && r.End().Sub(now) > maxWait {
+		return r, false
+	}
+	
+	tb.tokens -= tokens
+	return r, true
+}
@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// HashRing assigns keys to nodes by consistent hashing, so adding or removing
+// a node only moves the keys of its own slice
+type HashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewHashRing places every node on the ring vnodes times
+func NewHashRing(nodes []string, vnodes int) *HashRing {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	
+	ring := &HashRing{owners: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			point := hashKey(node + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = node
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+	return ring
+}
+
+// Owner returns the node responsible for key, or "" for an empty ring
+func (r *HashRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	
+	point := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= point
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hashKey hashes a key or node onto the ring. FNV alone clusters similar
+// strings such as IP addresses, so the result goes through a murmur3 finalizer.
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
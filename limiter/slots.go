@@ -0,0 +1,128 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KeySlots caps the number of concurrent transfers per key. Transfers over a
+// key's cap wait in a bounded FIFO queue of that key for one of its transfers
+// to finish. Keys without transfers take no memory.
+type KeySlots struct {
+	mutex     sync.Mutex
+	max       int64
+	maxQueued int
+	keys      map[string]*keySlots
+}
+
+// keySlots holds the transfers of a single key
+type keySlots struct {
+	active  int64
+	waiting []*transferWaiter
+}
+
+// NewKeySlots creates slots allowing max concurrent transfers per key, with
+// at most maxQueued more of the key waiting for one
+func NewKeySlots(max int64, maxQueued int) *KeySlots {
+	return &KeySlots{
+		max:       max,
+		maxQueued: maxQueued,
+		keys:      make(map[string]*keySlots),
+	}
+}
+
+// Acquire takes a transfer slot of key, queueing for at most maxWait or until
+// ctx is done if the key's queue has room. It reports whether a slot was
+// taken; every successful call must be paired with Release.
+func (s *KeySlots) Acquire(ctx context.Context, key string, maxWait time.Duration) bool {
+	s.mutex.Lock()
+	slots := s.keys[key]
+	if slots == nil {
+		slots = &keySlots{}
+		s.keys[key] = slots
+	}
+	if slots.active < s.max {
+		slots.active++
+		s.mutex.Unlock()
+		return true
+	}
+	if maxWait <= 0 || len(slots.waiting) >= s.maxQueued {
+		s.mutex.Unlock()
+		return false
+	}
+	
+	w := &transferWaiter{ready: make(chan struct{})}
+	slots.waiting = append(slots.waiting, w)
+	s.mutex.Unlock()
+	
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	// The slot may have been handed over while we were timing out
+	if w.granted {
+		return true
+	}
+	for i, candidate := range slots.waiting {
+		if candidate == w {
+			slots.waiting = append(slots.waiting[:i], slots.waiting[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// Release frees a slot of key, handing it to the key's oldest waiter if there is one
+func (s *KeySlots) Release(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	slots := s.keys[key]
+	if slots == nil {
+		return
+	}
+	if len(slots.waiting) == 0 {
+		slots.active--
+		if slots.active <= 0 {
+			delete(s.keys, key)
+		}
+		return
+	}
+	
+	w := slots.waiting[0]
+	slots.waiting = slots.waiting[1:]
+	w.granted = true
+	close(w.ready)
+}
+
+// Active returns the number of transfers holding a slot of key
+func (s *KeySlots) Active(key string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if slots := s.keys[key]; slots != nil {
+		return slots.active
+	}
+	return 0
+}
+
+// Waiting returns the number of transfers queued for a slot of key
+func (s *KeySlots) Waiting(key string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if slots := s.keys[key]; slots != nil {
+		return len(slots.waiting)
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package limiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State represents the serializable state of a bucket
+type State struct {
+	Key        string    `json:"key"`
+	Tokens     int64     `json:"tokens"`
+	Limit      int64     `json:"limit"`
+	BurstSize  int64     `json:"burstSize"`
+	LastRefill time.Time `json:"lastRefill"`
+	LastUsed   time.Time `json:"lastUsed"`
+	Created    time.Time `json:"created"`
+	Label      string    `json:"label,omitempty"`
+	
+	// State of the per-minute window bucket, if any
+	Window *State `json:"window,omitempty"`
+}
+
+// Snapshot returns the serializable state of the entry and its buckets
+func (e *Entry) Snapshot() State {
+	state := e.Bucket.State()
+	state.Key = e.Key
+	state.LastUsed = e.LastUsed()
+	state.Created = e.created
+	state.Label = e.Label
+	if e.Window != nil {
+		windowState := e.Window.State()
+		state.Window = &windowState
+	}
+	return state
+}
+
+// Snapshot returns the serializable state of all stored entries
+func (s *MemoryStore) Snapshot() []State {
+	var states []State
+	s.Range(func(entry *Entry) bool {
+		states = append(states, entry.Snapshot())
+		return true
+	})
+	return states
+}
+
+// RestoreEntry recreates an entry from its saved state
+func RestoreEntry(state State) *Entry {
+	bucket := NewTokenBucket(state.Limit, state.BurstSize)
+	bucket.Restore(state)
+	
+	entry := &Entry{
+		Key:     state.Key,
+		Bucket:  bucket,
+		Label:   state.Label,
+		created: state.Created,
+	}
+	entry.SetLastUsed(state.LastUsed)
+	
+	if state.Window != nil {
+		entry.Window = NewTokenBucket(state.Window.Limit, state.Window.BurstSize)
+		entry.Window.Restore(*state.Window)
+	}
+	return entry
+}
+
+// WriteSnapshot atomically writes bucket states to a JSON file
+func WriteSnapshot(path string, states []State) error {
+	// Create directory if it doesn't exist
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	
+	// Write to temporary file first (atomic save)
+	tempFile := path + ".tmp"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer file.Close()
+	
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ") // Pretty print for debugging
+	if err := encoder.Encode(states); err != nil {
+		file.Close()
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to encode buckets: %w", err)
+	}
+	
+	// Windows can't rename a file that is still open
+	file.Close()
+	
+	// Atomic rename
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshot reads bucket states from a JSON file.
+// A missing file is not an error and yields no states.
+func ReadSnapshot(path string) ([]State, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // File doesn't exist yet, that's OK
+		}
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	
+	var states []State
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&states); err != nil {
+		return nil, fmt.Errorf("failed to decode buckets: %w", err)
+	}
+	return states, nil
+}
@@ -0,0 +1,285 @@
+package limiter
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is a stored bucket together with its cleanup and persistence metadata
+type Entry struct {
+	// Last use in Unix nanoseconds. Requests update it while cleanup reads it,
+	// so it is only accessed atomically. First in the struct for 64-bit alignment.
+	lastUsed int64
+	
+	// Body bytes paid from the entry since it was created, only accessed atomically
+	transferred int64
+	
+	// Number of transfers currently paying from the entry, or -1 once it is
+	// being evicted. Only accessed atomically.
+	refs int32
+	
+	Key    string
+	Bucket *TokenBucket
+	Window *TokenBucket // Per-minute bucket, nil when no minute limit applies
+	Label  string       // Copied from the policy, for observability
+	
+	// When the bucket was first created, kept across restarts. Zero for
+	// buckets restored from snapshots that predate it.
+	created time.Time
+}
+
+// NewEntry creates an entry with fresh buckets for the given policy
+func NewEntry(key string, policy Policy) *Entry {
+	now := time.Now()
+	entry := &Entry{
+		lastUsed: now.UnixNano(),
+		Key:      key,
+		Bucket:   NewTokenBucket(policy.Limit, policy.Burst),
+		Label:    policy.Label,
+		created:  now,
+	}
+	
+	// Attach the per-minute window if one applies
+	if policy.MinuteLimit > 0 {
+		entry.Window = NewWindowBucket(policy.MinuteLimit)
+	}
+	return entry
+}
+
+// LastUsed returns when the entry was last used
+func (e *Entry) LastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&e.lastUsed))
+}
+
+// Created returns when the entry's bucket was first created, or the zero
+// time if that is unknown
+func (e *Entry) Created() time.Time {
+	return e.created
+}
+
+// SetLastUsed records when the entry was last used
+func (e *Entry) SetLastUsed(t time.Time) {
+	atomic.StoreInt64(&e.lastUsed, t.UnixNano())
+}
+
+// Touch marks the entry as used now
+func (e *Entry) Touch() {
+	e.SetLastUsed(time.Now())
+}
+
+// AddTransferred counts n more body bytes paid from the entry
+func (e *Entry) AddTransferred(n int64) {
+	atomic.AddInt64(&e.transferred, n)
+}
+
+// Transferred returns the body bytes paid from the entry since it was created
+func (e *Entry) Transferred() int64 {
+	return atomic.LoadInt64(&e.transferred)
+}
+
+// Retain registers a transfer using the entry. It fails if the entry is being
+// evicted, in which case the store's Acquire must get a fresh entry.
+func (e *Entry) Retain() bool {
+	for {
+		refs := atomic.LoadInt32(&e.refs)
+		if refs < 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&e.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Release ends a transfer registered by MemoryStore.Acquire. The entry counts
+// as used until now, so it gets a full idle period before it can be evicted.
+func (e *Entry) Release() {
+	e.Touch()
+	atomic.AddInt32(&e.refs, -1)
+}
+
+// InUse reports whether a transfer is currently paying from the entry
+func (e *Entry) InUse() bool {
+	return atomic.LoadInt32(&e.refs) > 0
+}
+
+// Refill fills the entry's buckets, including the per-minute window, up to
+// their burst
+func (e *Entry) Refill() {
+	e.Bucket.SetTokens(e.Bucket.State().BurstSize)
+	if e.Window != nil {
+		e.Window.SetTokens(e.Window.State().BurstSize)
+	}
+}
+
+// ClaimEviction marks an entry no transfer is using as being evicted, so
+// Retain fails from then on. Stores call it before deleting idle entries.
+func (e *Entry) ClaimEviction() bool {
+	return atomic.CompareAndSwapInt32(&e.refs, 0, -1)
+}
+
+// Store keeps the entries of a limiter. Implementations must be safe for
+// concurrent use; the storetest package checks them against the contract
+// MemoryStore implements.
+type Store interface {
+	// Load returns the entry stored under key
+	Load(key string) (*Entry, bool)
+	
+	// LoadOrCreate returns the entry stored under key, creating it with the
+	// given policy if missing. Concurrent calls for a key return the same entry.
+	LoadOrCreate(key string, policy Policy) *Entry
+	
+	// Acquire returns the entry like LoadOrCreate and registers a transfer
+	// using it, which EvictIdle respects until Entry.Release is called
+	Acquire(key string, policy Policy) *Entry
+	
+	// Store saves an entry, replacing any entry with the same key
+	Store(entry *Entry)
+	
+	// Delete removes the entry stored under key
+	Delete(key string)
+	
+	// Range calls fn for every entry until fn returns false
+	Range(fn func(entry *Entry) bool)
+	
+	// Len returns the number of stored entries
+	Len() int
+	
+	// EvictIdle removes entries unused since cutoff, or quotaCutoff for entries
+	// with a per-minute window, keeping those in use. It returns the number of
+	// removed and remaining entries.
+	EvictIdle(cutoff, quotaCutoff time.Time) (removed, kept int)
+	
+	// DeleteMatching removes every entry whose key satisfies match and returns
+	// the number of removed entries. Entries in use are reset in place instead,
+	// see MemoryStore.DeleteMatching.
+	DeleteMatching(match func(key string) bool) int
+	
+	// Snapshot returns the serializable state of all stored entries
+	Snapshot() []State
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore keeps entries in process memory
+type MemoryStore struct {
+	entries sync.Map // map[string]*Entry
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Load returns the entry stored under key
+func (s *MemoryStore) Load(key string) (*Entry, bool) {
+	value, ok := s.entries.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*Entry), true
+}
+
+// LoadOrCreate returns the entry stored under key, creating it with the given policy if missing
+func (s *MemoryStore) LoadOrCreate(key string, policy Policy) *Entry {
+	if entry, ok := s.Load(key); ok {
+		return entry
+	}
+	
+	// Another goroutine may create the same entry concurrently, keep whichever was stored first
+	actual, _ := s.entries.LoadOrStore(key, NewEntry(key, policy))
+	return actual.(*Entry)
+}
+
+// Acquire returns the entry stored under key like LoadOrCreate, and registers
+// a transfer using it. The entry is not evicted until Release is called.
+func (s *MemoryStore) Acquire(key string, policy Policy) *Entry {
+	for {
+		entry := s.LoadOrCreate(key, policy)
+		if entry.Retain() {
+			entry.Touch()
+			return entry
+		}
+		
+		// Lost the race with EvictIdle, which is about to delete the entry
+		runtime.Gosched()
+	}
+}
+
+// Store saves an entry, replacing any entry with the same key
+func (s *MemoryStore) Store(entry *Entry) {
+	s.entries.Store(entry.Key, entry)
+}
+
+// Delete removes the entry stored under key
+func (s *MemoryStore) Delete(key string) {
+	s.entries.Delete(key)
+}
+
+// Range calls fn for every entry until fn returns false
+func (s *MemoryStore) Range(fn func(entry *Entry) bool) {
+	s.entries.Range(func(key, value interface{}) bool {
+		return fn(value.(*Entry))
+	})
+}
+
+// Len returns the number of stored entries
+func (s *MemoryStore) Len() int {
+	count := 0
+	s.entries.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// EvictIdle removes entries that haven't been used since cutoff. Entries with a
+// per-minute window are quota records and are evicted by quotaCutoff instead.
+// Entries still in use by a transfer are kept regardless of their age.
+// It returns the number of removed and remaining entries.
+func (s *MemoryStore) EvictIdle(cutoff, quotaCutoff time.Time) (removed, kept int) {
+	s.entries.Range(func(key, value interface{}) bool {
+		entry := value.(*Entry)
+		entryCutoff := cutoff
+		if entry.Window != nil {
+			entryCutoff = quotaCutoff
+		}
+		// Claiming the entry keeps new transfers from retaining it while it is deleted
+		if entry.LastUsed().Before(entryCutoff) && entry.ClaimEviction() {
+			s.entries.Delete(key)
+			removed++
+		} else {
+			kept++
+		}
+		return true
+	})
+	return removed, kept
+}
+
+// DeleteMatching removes every entry whose key satisfies match. Like EvictIdle,
+// it claims entries before deleting them. An entry still in use by a transfer
+// is reset in place to a full burst and no bytes transferred instead: deleting
+// it would let the next request create a second bucket for the key while the
+// transfer keeps paying from the first. It returns the number of removed and
+// reset entries.
+func (s *MemoryStore) DeleteMatching(match func(key string) bool) int {
+	removed := 0
+	s.entries.Range(func(key, value interface{}) bool {
+		if !match(key.(string)) {
+			return true
+		}
+		entry := value.(*Entry)
+		if entry.ClaimEviction() {
+			s.entries.Delete(key)
+			removed++
+		} else if entry.InUse() {
+			entry.Refill()
+			atomic.StoreInt64(&entry.transferred, 0)
+			removed++
+		}
+		return true
+	})
+	return removed
+}
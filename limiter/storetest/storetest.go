@@ -0,0 +1,310 @@
+// Package storetest checks limiter.Store implementations against the contract
+// the in-memory store implements: bucket refill math, atomic consumption,
+// idle eviction and restoring saved state. Third-party stores run it from
+// their own tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func() limiter.Store { return newSQLiteStore(t) })
+//	}
+package storetest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// Run runs the conformance tests as subtests of t. newStore must return an
+// empty store each time it is called.
+func Run(t *testing.T, newStore func() limiter.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store limiter.Store)
+	}{
+		{"LoadOrCreate", testLoadOrCreate},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"Refill", testRefill},
+		{"AtomicConsume", testAtomicConsume},
+		{"EvictIdle", testEvictIdle},
+		{"EvictInUse", testEvictInUse},
+		{"Restore", testRestore},
+		{"DeleteMatching", testDeleteMatching},
+		{"DeleteInUse", testDeleteInUse},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore())
+		})
+	}
+}
+
+// testLoadOrCreate checks that entries are created once with the policy's buckets
+func testLoadOrCreate(t *testing.T, store limiter.Store) {
+	if _, ok := store.Load("missing"); ok {
+		t.Error("Expected no entry in an empty store")
+	}
+	
+	policy := limiter.Policy{Limit: 1000, Burst: 2000, MinuteLimit: 60000, Label: "partner-acme"}
+	entry := store.LoadOrCreate("10.0.0.1:default", policy)
+	if entry.Key != "10.0.0.1:default" || entry.Label != "partner-acme" {
+		t.Errorf("Unexpected entry %q with label %q", entry.Key, entry.Label)
+	}
+	if since := time.Since(entry.Created()); since < 0 || since > time.Minute {
+		t.Errorf("Expected the entry to be created now, got %v", entry.Created())
+	}
+	if state := entry.Bucket.State(); state.Limit != 1000 || state.BurstSize != 2000 || state.Tokens != 2000 {
+		t.Errorf("Expected a full bucket for the policy, got %+v", state)
+	}
+	if entry.Window == nil || entry.Window.State().BurstSize != 60000 {
+		t.Error("Expected a per-minute window for the minute limit")
+	}
+	
+	// Existing entries keep their state regardless of the policy passed
+	if again := store.LoadOrCreate("10.0.0.1:default", limiter.Policy{Limit: 5, Burst: 5}); again != entry {
+		t.Error("Expected the stored entry to be returned")
+	}
+	if loaded, ok := store.Load("10.0.0.1:default"); !ok || loaded != entry {
+		t.Error("Expected Load to return the created entry")
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected 1 entry, got %d", store.Len())
+	}
+}
+
+// testConcurrentCreate checks that concurrent creation of a key yields a single entry
+func testConcurrentCreate(t *testing.T, store limiter.Store) {
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+	
+	entries := make([]*limiter.Entry, 32)
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entries[i] = store.LoadOrCreate("shared", policy)
+		}(i)
+	}
+	wg.Wait()
+	
+	for _, entry := range entries {
+		if entry != entries[0] {
+			t.Fatal("Expected every caller to get the same entry")
+		}
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected 1 entry, got %d", store.Len())
+	}
+}
+
+// testRefill checks that stored buckets refill at their rate up to the burst
+func testRefill(t *testing.T, store limiter.Store) {
+	entry := store.LoadOrCreate("refill", limiter.Policy{Limit: 10000, Burst: 2000})
+	if !entry.Bucket.Consume(2000) {
+		t.Fatal("Expected the burst to be available")
+	}
+	if entry.Bucket.Consume(500) {
+		t.Fatal("Expected the drained bucket to refuse tokens")
+	}
+	
+	time.Sleep(100 * time.Millisecond)
+	if available := entry.Bucket.Available(); available < 900 || available > 2000 {
+		t.Errorf("Expected about 1000 tokens after 100ms at 10000/s, got %d", available)
+	}
+	
+	time.Sleep(200 * time.Millisecond)
+	if available := entry.Bucket.Available(); available != 2000 {
+		t.Errorf("Expected the refill to stop at the burst, got %d", available)
+	}
+}
+
+// testAtomicConsume checks that concurrent transfers never take more than the bucket holds
+func testAtomicConsume(t *testing.T, store limiter.Store) {
+	policy := limiter.Policy{Limit: 1, Burst: 10000}
+	
+	var mutex sync.Mutex
+	granted := int64(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry := store.Acquire("contended", policy)
+			defer entry.Release()
+			
+			for j := 0; j < 100; j++ {
+				if entry.Bucket.Consume(10) {
+					mutex.Lock()
+					granted += 10
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	
+	// 1600 attempts of 10 tokens compete for a burst of 10000 plus a negligible refill
+	if granted < 10000 || granted > 10010 {
+		t.Errorf("Expected the burst to be granted exactly once, got %d tokens", granted)
+	}
+}
+
+// testEvictIdle checks that only entries idle past their cutoff are evicted
+func testEvictIdle(t *testing.T, store limiter.Store) {
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+	
+	store.LoadOrCreate("idle", policy).SetLastUsed(time.Now().Add(-time.Hour))
+	store.LoadOrCreate("active", policy)
+	store.LoadOrCreate("quota", limiter.Policy{Limit: 1000, Burst: 2000, MinuteLimit: 60000}).SetLastUsed(time.Now().Add(-time.Hour))
+	
+	removed, kept := store.EvictIdle(time.Now().Add(-time.Minute), time.Now().Add(-2*time.Hour))
+	if removed != 1 || kept != 2 {
+		t.Errorf("Expected 1 removed and 2 kept, got %d removed and %d kept", removed, kept)
+	}
+	if _, ok := store.Load("idle"); ok {
+		t.Error("Expected the idle entry to be evicted")
+	}
+	if _, ok := store.Load("active"); !ok {
+		t.Error("Expected the active entry to be kept")
+	}
+	if _, ok := store.Load("quota"); !ok {
+		t.Error("Expected the quota entry to be kept until its own cutoff")
+	}
+}
+
+// testEvictInUse checks that entries held by a transfer survive eviction
+func testEvictInUse(t *testing.T, store limiter.Store) {
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+	
+	entry := store.Acquire("download", policy)
+	entry.SetLastUsed(time.Now().Add(-time.Hour))
+	if removed, _ := store.EvictIdle(time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)); removed != 0 {
+		t.Fatalf("Expected the in-use entry to be kept, %d removed", removed)
+	}
+	
+	entry.Release()
+	if removed, _ := store.EvictIdle(time.Now().Add(time.Minute), time.Now().Add(time.Minute)); removed != 1 {
+		t.Fatalf("Expected the released entry to be evicted, %d removed", removed)
+	}
+	
+	// Transfers after the eviction must not pay from the deleted entry
+	again := store.Acquire("download", policy)
+	defer again.Release()
+	if again == entry {
+		t.Error("Expected a new entry after eviction")
+	}
+	if stored, ok := store.Load("download"); !ok || stored != again {
+		t.Error("Expected the new entry to be stored")
+	}
+}
+
+// testRestore checks that restored entries keep their tokens, refill time, last use and creation time
+func testRestore(t *testing.T, store limiter.Store) {
+	lastUsed := time.Now().Add(-10 * time.Minute).Truncate(time.Millisecond)
+	created := time.Now().Add(-48 * time.Hour).Truncate(time.Millisecond)
+	state := limiter.State{
+		Key:        "10.0.0.1:default",
+		Tokens:     500,
+		Limit:      1000,
+		BurstSize:  2000,
+		LastRefill: time.Now(),
+		LastUsed:   lastUsed,
+		Created:    created,
+		Label:      "partner-acme",
+		Window:     &limiter.State{Tokens: 100, Limit: 100, BurstSize: 6000, LastRefill: time.Now()},
+	}
+	store.Store(limiter.RestoreEntry(state))
+	
+	entry, ok := store.Load(state.Key)
+	if !ok {
+		t.Fatal("Expected the restored entry to be stored")
+	}
+	if tokens := entry.Bucket.State().Tokens; tokens != 500 {
+		t.Errorf("Expected 500 restored tokens, got %d", tokens)
+	}
+	if !entry.LastUsed().Equal(lastUsed) {
+		t.Errorf("Expected last use %v, got %v", lastUsed, entry.LastUsed())
+	}
+	if !entry.Created().Equal(created) {
+		t.Errorf("Expected creation time %v, got %v", created, entry.Created())
+	}
+	if entry.Window == nil || entry.Window.State().Tokens != 100 {
+		t.Error("Expected the per-minute window to be restored")
+	}
+	
+	// A restored entry replaces a fresh one
+	store.LoadOrCreate("10.0.0.2:default", limiter.Policy{Limit: 1000, Burst: 2000})
+	state.Key = "10.0.0.2:default"
+	store.Store(limiter.RestoreEntry(state))
+	if entry, _ := store.Load(state.Key); entry.Bucket.State().Tokens != 500 {
+		t.Error("Expected Store to replace the existing entry")
+	}
+	
+	snapshot := store.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Expected 2 entries in the snapshot, got %d", len(snapshot))
+	}
+	for _, saved := range snapshot {
+		if saved.Tokens != 500 || saved.Label != "partner-acme" || saved.Window == nil || !saved.Created.Equal(created) {
+			t.Errorf("Unexpected snapshot state %+v", saved)
+		}
+	}
+}
+
+// testDeleteMatching checks deletion by key and by key pattern
+func testDeleteMatching(t *testing.T, store limiter.Store) {
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+	for _, key := range []string{"10.0.0.1:a", "10.0.0.1:b", "10.0.0.2:a"} {
+		store.LoadOrCreate(key, policy)
+	}
+	
+	if removed := store.DeleteMatching(func(key string) bool { return strings.HasPrefix(key, "10.0.0.1:") }); removed != 2 {
+		t.Errorf("Expected 2 removed entries, got %d", removed)
+	}
+	store.Delete("10.0.0.2:a")
+	
+	count := 0
+	store.Range(func(entry *limiter.Entry) bool {
+		count++
+		return true
+	})
+	if count != 0 || store.Len() != 0 {
+		t.Errorf("Expected an empty store, got %d entries", count)
+	}
+}
+
+// testDeleteInUse checks that deleting an entry a transfer is paying from
+// doesn't give the key a second bucket, but resets the entry in place
+func testDeleteInUse(t *testing.T, store limiter.Store) {
+	policy := limiter.Policy{Limit: 1000, Burst: 2000}
+	
+	entry := store.Acquire("download", policy)
+	if !entry.Bucket.Consume(2000) {
+		t.Fatal("Expected the fresh bucket to pay for its burst")
+	}
+	if removed := store.DeleteMatching(func(key string) bool { return key == "download" }); removed != 1 {
+		t.Fatalf("Expected the in-use entry to count as removed, got %d", removed)
+	}
+	
+	// The next transfer pays from the same entry, which starts over with a full burst
+	again := store.Acquire("download", policy)
+	if again != entry {
+		t.Error("Expected the in-use entry to be kept")
+	}
+	if tokens := entry.Bucket.State().Tokens; tokens < 2000 {
+		t.Errorf("Expected the in-use entry to be refilled, got %d tokens", tokens)
+	}
+	again.Release()
+	entry.Release()
+	
+	// Once released, it is deleted like any other entry
+	if removed := store.DeleteMatching(func(key string) bool { return key == "download" }); removed != 1 {
+		t.Fatalf("Expected the released entry to be removed, got %d", removed)
+	}
+	if _, ok := store.Load("download"); ok {
+		t.Error("Expected the released entry to be deleted")
+	}
+}
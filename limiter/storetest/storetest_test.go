@@ -0,0 +1,13 @@
+package storetest_test
+
+import (
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter/storetest"
+)
+
+// TestMemoryStore tests that the in-memory store meets the contract
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func() limiter.Store { return limiter.NewMemoryStore() })
+}
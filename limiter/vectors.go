@@ -0,0 +1,44 @@
+package limiter
+
+import "time"
+
+// RefillVector is a known result of the refill math: a bucket holding Tokens,
+// refilling at Limit tokens per second up to BurstSize, holds Expected tokens
+// once Elapsed has passed
+type RefillVector struct {
+	Name      string
+	Tokens    int64
+	Limit     int64
+	BurstSize int64
+	Elapsed   time.Duration
+	Expected  int64
+}
+
+// RefillVectors pin down the rounding of Refill, so refactors of the bucket
+// keep its exact results. Stores that keep buckets outside a TokenBucket, e.g.
+// in a script on a shared server, can check their math against them.
+var RefillVectors = []RefillVector{
+	{Name: "no time passed", Tokens: 500, Limit: 1000, BurstSize: 2000, Elapsed: 0, Expected: 500},
+	{Name: "one second", Tokens: 500, Limit: 1000, BurstSize: 2000, Elapsed: time.Second, Expected: 1500},
+	{Name: "capped at the burst", Tokens: 500, Limit: 1000, BurstSize: 2000, Elapsed: 10 * time.Second, Expected: 2000},
+	{Name: "empty bucket", Tokens: 0, Limit: 1000, BurstSize: 2000, Elapsed: 999 * time.Millisecond, Expected: 999},
+	
+	// Partial tokens are dropped, not carried over to the next refill
+	{Name: "partial token dropped", Tokens: 0, Limit: 1000, BurstSize: 2000, Elapsed: 1500 * time.Microsecond, Expected: 1},
+	{Name: "less than a token", Tokens: 0, Limit: 1000, BurstSize: 2000, Elapsed: 999 * time.Microsecond, Expected: 0},
+	{Name: "per-minute window", Tokens: 0, Limit: 60, BurstSize: 3600, Elapsed: 16666 * time.Microsecond, Expected: 0},
+	{Name: "binary limit", Tokens: 0, Limit: 1 << 20, BurstSize: 2 << 20, Elapsed: 100 * time.Millisecond, Expected: 104857},
+	
+	// The product is computed in float64, so results just below an integer round down
+	{Name: "float product below an integer", Tokens: 0, Limit: 100, BurstSize: 1000, Elapsed: 290 * time.Millisecond, Expected: 28},
+	{Name: "float product exact", Tokens: 0, Limit: 10, BurstSize: 100, Elapsed: 300 * time.Millisecond, Expected: 3},
+	
+	// Multi-gigabit limits refill within nanoseconds
+	{Name: "10 Gbit/s nanosecond", Tokens: 0, Limit: 1250000000, BurstSize: 125000000, Elapsed: time.Nanosecond, Expected: 1},
+	{Name: "10 Gbit/s millisecond", Tokens: 0, Limit: 1250000000, BurstSize: 125000000, Elapsed: time.Millisecond, Expected: 1250000},
+	{Name: "year idle at 10 Gbit/s", Tokens: 0, Limit: 1250000000, BurstSize: 125000000, Elapsed: 365 * 24 * time.Hour, Expected: 125000000},
+	
+	// Restoring a smaller burst trims the tokens on the next refill
+	{Name: "over the burst", Tokens: 3000, Limit: 1000, BurstSize: 2000, Elapsed: 0, Expected: 2000},
+	{Name: "no refill", Tokens: 100, Limit: 0, BurstSize: 2000, Elapsed: time.Hour, Expected: 100},
+}
@@ -0,0 +1,190 @@
+package bandwidthlimiter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errPersistenceReplaced is returned by checkPersistenceLock once the lock was
+// taken over by a reloaded instance of the same middleware
+var errPersistenceReplaced = errors.New("persistence file taken over by a reloaded instance")
+
+// Persistence lock modes
+const (
+	persistenceLockWarn      = "warn"
+	persistenceLockExclusive = "exclusive"
+	persistenceLockOff       = "off"
+)
+
+// persistenceLock is the ownership stamp written next to the persistence file
+type persistenceLock struct {
+	InstanceID string    `json:"instanceId"`
+	Name       string    `json:"name"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	Created    time.Time `json:"created"`
+	Heartbeat  time.Time `json:"heartbeat"`
+}
+
+// newInstanceID generates an identifier that is unique per middleware instance
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random))
+}
+
+// usesPersistenceLock reports whether this instance writes and therefore owns the persistence file
+func (bl *BandwidthLimiter) usesPersistenceLock() bool {
+	return bl.config.PersistenceFile != "" &&
+		!bl.config.PersistenceReadOnly &&
+		bl.config.PersistenceLock != persistenceLockOff
+}
+
+// lockFilePath returns the path of the ownership lock file
+func (bl *BandwidthLimiter) lockFilePath() string {
+	return bl.config.PersistenceFile + ".lock"
+}
+
+// lockStaleAfter returns how long a lock stays valid without a heartbeat
+func (bl *BandwidthLimiter) lockStaleAfter() time.Duration {
+	return 3 * bl.parsed.saveInterval
+}
+
+// readPersistenceLock returns the current lock holder, or nil if there is none
+func (bl *BandwidthLimiter) readPersistenceLock() (*persistenceLock, error) {
+	data, err := os.ReadFile(bl.lockFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+	
+	var lock persistenceLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to decode lock file: %w", err)
+	}
+	return &lock, nil
+}
+
+// foreignPersistenceLock returns the lock if it is held by another live instance
+func (bl *BandwidthLimiter) foreignPersistenceLock() *persistenceLock {
+	lock, err := bl.readPersistenceLock()
+	if err != nil {
+		bl.log.warnf("Ignoring unreadable persistence lock: %v", err)
+		return nil
+	}
+	
+	if lock == nil || lock.InstanceID == bl.instanceID || bl.reloadOf(lock) {
+		return nil
+	}
+	
+	// Owners that stopped refreshing their heartbeat are considered gone
+	if time.Since(lock.Heartbeat) > bl.lockStaleAfter() {
+		return nil
+	}
+	return lock
+}
+
+// reloadOf reports whether lock is held by another instance of this middleware
+// in this process. Traefik creates a new instance on every configuration
+// reload without shutting down the previous one, so the newer instance takes
+// the lock over and the older one stops saving.
+func (bl *BandwidthLimiter) reloadOf(lock *persistenceLock) bool {
+	hostname, _ := os.Hostname()
+	return lock.InstanceID != bl.instanceID && lock.Name == bl.name &&
+		lock.PID == os.Getpid() && lock.Hostname == hostname
+}
+
+// acquirePersistenceLock claims the persistence file at startup
+func (bl *BandwidthLimiter) acquirePersistenceLock() error {
+	if lock := bl.foreignPersistenceLock(); lock != nil {
+		if bl.config.PersistenceLock == persistenceLockExclusive {
+			return fmt.Errorf("persistence file %s is owned by instance %s (%s, pid %d)",
+				bl.config.PersistenceFile, lock.InstanceID, lock.Hostname, lock.PID)
+		}
+		bl.log.warnf("Persistence file %s is also used by instance %s (%s, pid %d); instances will overwrite each other's state",
+			bl.config.PersistenceFile, lock.InstanceID, lock.Hostname, lock.PID)
+	}
+	
+	return bl.writePersistenceLock()
+}
+
+// checkPersistenceLock verifies before a save that no other live instance owns
+// the file. It returns errPersistenceReplaced once an instance created by a
+// reload took it over, which only ever happens to the older instance.
+func (bl *BandwidthLimiter) checkPersistenceLock() error {
+	// A save of the older instance racing the takeover may have stamped the
+	// lock again, which the newer instance simply takes back
+	if lock, err := bl.readPersistenceLock(); err == nil && lock != nil && bl.reloadOf(lock) && lock.Created.After(bl.created) {
+		return errPersistenceReplaced
+	}
+	
+	lock := bl.foreignPersistenceLock()
+	if lock == nil {
+		return nil
+	}
+	
+	if bl.config.PersistenceLock == persistenceLockExclusive {
+		return fmt.Errorf("persistence file %s was taken over by instance %s (%s, pid %d), not saving",
+			bl.config.PersistenceFile, lock.InstanceID, lock.Hostname, lock.PID)
+	}
+	
+	bl.log.warnf("Persistence file %s is also written by instance %s (%s, pid %d); instances are overwriting each other's state",
+		bl.config.PersistenceFile, lock.InstanceID, lock.Hostname, lock.PID)
+	return nil
+}
+
+// writePersistenceLock stamps the lock file with this instance and a fresh heartbeat
+func (bl *BandwidthLimiter) writePersistenceLock() error {
+	hostname, _ := os.Hostname()
+	lock := persistenceLock{
+		InstanceID: bl.instanceID,
+		Name:       bl.name,
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+		Created:    bl.created,
+		Heartbeat:  time.Now(),
+	}
+	
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("failed to encode lock file: %w", err)
+	}
+	
+	if err := os.MkdirAll(filepath.Dir(bl.lockFilePath()), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	
+	// Write to temporary file first (atomic save)
+	tempFile := bl.lockFilePath() + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	if err := os.Rename(tempFile, bl.lockFilePath()); err != nil {
+		return fmt.Errorf("failed to rename lock file: %w", err)
+	}
+	return nil
+}
+
+// releasePersistenceLock removes the lock file if this instance still owns it
+func (bl *BandwidthLimiter) releasePersistenceLock() {
+	lock, err := bl.readPersistenceLock()
+	if err != nil || lock == nil || lock.InstanceID != bl.instanceID {
+		return
+	}
+	
+	if err := os.Remove(bl.lockFilePath()); err != nil && !os.IsNotExist(err) {
+		bl.log.warnf("Failed to remove persistence lock: %v", err)
+	}
+}
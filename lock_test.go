@@ -0,0 +1,122 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestPersistenceLock tests that a second instance detects a live owner of the persistence file
+func TestPersistenceLock(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	ctx := context.Background()
+
+	cfg1 := bandwidthlimiter.CreateConfig()
+	cfg1.PersistenceFile = tempFile
+
+	handler1, err := bandwidthlimiter.New(ctx, next, cfg1, "test-limiter-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tempFile + ".lock"); err != nil {
+		t.Fatalf("Lock file was not created: %v", err)
+	}
+
+	// An exclusive instance must refuse to share the file
+	cfg2 := bandwidthlimiter.CreateConfig()
+	cfg2.PersistenceFile = tempFile
+	cfg2.PersistenceLock = "exclusive"
+
+	if _, err := bandwidthlimiter.New(ctx, next, cfg2, "test-limiter-2"); err == nil {
+		t.Error("Expected exclusive instance to fail while the file is owned by another instance")
+	}
+
+	// A read-only instance doesn't write and therefore doesn't contend
+	cfg3 := bandwidthlimiter.CreateConfig()
+	cfg3.PersistenceFile = tempFile
+	cfg3.PersistenceReadOnly = true
+	cfg3.PersistenceLock = "exclusive"
+
+	handler3, err := bandwidthlimiter.New(ctx, next, cfg3, "test-limiter-3")
+	if err != nil {
+		t.Errorf("Read-only instance should not contend for the lock: %v", err)
+	} else {
+		handler3.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+	}
+
+	// Once the owner shuts down the lock is released
+	handler1.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	if _, err := os.Stat(tempFile + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Lock file was not released on shutdown: %v", err)
+	}
+
+	handler2, err := bandwidthlimiter.New(ctx, next, cfg2, "test-limiter-2")
+	if err != nil {
+		t.Fatalf("Exclusive instance should start once the lock is released: %v", err)
+	}
+	handler2.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+}
+
+// TestPersistenceLockReload tests that an instance created by a Traefik reload
+// takes the lock over from the instance it replaces, which isn't shut down
+func TestPersistenceLockReload(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	ctx := context.Background()
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = tempFile
+	cfg.PersistenceLock = "exclusive"
+
+	handler1, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := handler1.(*bandwidthlimiter.BandwidthLimiter)
+
+	handler2, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatalf("Reloaded instance should take the lock over: %v", err)
+	}
+	reloaded := handler2.(*bandwidthlimiter.BandwidthLimiter)
+	defer reloaded.Shutdown()
+
+	if err := reloaded.Save(); err != nil {
+		t.Fatalf("Reloaded instance failed to save: %v", err)
+	}
+	lock, err := os.ReadFile(tempFile + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replaced instance quietly stops saving and leaves the lock alone
+	if err := old.Save(); err != nil {
+		t.Errorf("Replaced instance should skip saving, got %v", err)
+	}
+	old.Shutdown()
+
+	after, err := os.ReadFile(tempFile + ".lock")
+	if err != nil {
+		t.Fatalf("Replaced instance removed the lock of the reloaded one: %v", err)
+	}
+	if string(after) != string(lock) {
+		t.Errorf("Replaced instance rewrote the lock: %s", after)
+	}
+
+	if err := reloaded.Save(); err != nil {
+		t.Errorf("Reloaded instance failed to save after the old one shut down: %v", err)
+	}
+
+	// Another middleware sharing the file is still refused
+	if _, err := bandwidthlimiter.New(ctx, next, cfg, "other-limiter"); err == nil {
+		t.Error("Expected an exclusive instance of another middleware to fail")
+	}
+}
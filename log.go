@@ -0,0 +1,149 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log formats, see Config.LogFormat
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+// Log levels, from the most to the least verbose
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+	logOff // Above every message, silences the middleware
+)
+
+// logLevelNames are the names of log levels in Config.LogLevel and log output
+var logLevelNames = []string{"debug", "info", "warn", "error", "off"}
+
+// String returns the name of the level, e.g. "warn"
+func (l LogLevel) String() string {
+	if l < LogDebug || l > logOff {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// MarshalText makes levels appear by name in JSON
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// parseLogLevel parses Config.LogLevel
+func parseLogLevel(value string) (LogLevel, error) {
+	if value == "" {
+		return LogInfo, nil
+	}
+	for level, name := range logLevelNames {
+		if value == name {
+			return LogLevel(level), nil
+		}
+	}
+	return 0, wrapf(ErrInvalidLimit, "logLevel must be one of %q, %q, %q, %q or %q", "debug", "info", "warn", "error", "off")
+}
+
+// LogEntry is a message logged by the middleware
+type LogEntry struct {
+	Time       time.Time `json:"time"`
+	Level      LogLevel  `json:"level"`
+	Middleware string    `json:"middleware"` // Name the middleware was created with
+	Message    string    `json:"msg"`
+}
+
+// Logger receives the messages of the middleware at or above Config.LogLevel
+type Logger interface {
+	Log(entry LogEntry)
+}
+
+// writerLogger writes entries as lines of text or JSON
+type writerLogger struct {
+	mutex  sync.Mutex // Keeps concurrent lines apart
+	writer io.Writer
+	json   bool
+}
+
+// Log writes the entry on a line of its own
+func (w *writerLogger) Log(entry LogEntry) {
+	var line []byte
+	if w.json {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = []byte(fmt.Sprintf("%s %-5s %s: %s", entry.Time.UTC().Format(time.RFC3339), entry.Level, entry.Middleware, entry.Message))
+	}
+	line = append(line, '\n')
+	
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writer.Write(line)
+}
+
+// logger filters the middleware's messages by level and passes them on to
+// its Logger
+type logger struct {
+	name   string
+	level  LogLevel
+	mutex  sync.RWMutex
+	output Logger
+}
+
+// newLogger returns the logger configured with LogLevel and LogFormat,
+// writing to stdout like Traefik's other plugins
+func newLogger(config *Config, name string) (*logger, error) {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	output := &writerLogger{writer: os.Stdout}
+	switch config.LogFormat {
+	case "", logFormatText:
+	case logFormatJSON:
+		output.json = true
+	default:
+		return nil, wrapf(ErrInvalidLimit, "logFormat must be one of %q or %q", logFormatText, logFormatJSON)
+	}
+	return &logger{name: name, level: level, output: output}, nil
+}
+
+// logf formats and passes on a message unless its level is filtered out
+func (l *logger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	entry := LogEntry{Time: time.Now(), Level: level, Middleware: l.name, Message: fmt.Sprintf(format, args...)}
+	
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	l.output.Log(entry)
+}
+
+// debugf, infof, warnf and errorf log a message at their level
+func (l *logger) debugf(format string, args ...interface{}) { l.logf(LogDebug, format, args...) }
+func (l *logger) infof(format string, args ...interface{})  { l.logf(LogInfo, format, args...) }
+func (l *logger) warnf(format string, args ...interface{})  { l.logf(LogWarn, format, args...) }
+func (l *logger) errorf(format string, args ...interface{}) { l.logf(LogError, format, args...) }
+
+// SetLogger routes the middleware's messages at or above Config.LogLevel to
+// logger instead of stdout, e.g. into an embedder's own logging. Nil restores
+// the configured output.
+func (bl *BandwidthLimiter) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = &writerLogger{writer: os.Stdout, json: bl.config.LogFormat == logFormatJSON}
+	}
+	bl.log.mutex.Lock()
+	defer bl.log.mutex.Unlock()
+	bl.log.output = logger
+}
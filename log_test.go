@@ -0,0 +1,120 @@
+package bandwidthlimiter_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// recordingLogger keeps the entries it receives
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []bandwidthlimiter.LogEntry
+}
+
+func (r *recordingLogger) Log(entry bandwidthlimiter.LogEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// TestLogLevel tests that messages below LogLevel are dropped
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		level  string
+		logged int
+	}{
+		{"debug", 2}, // Limit set and buckets saved
+		{"", 1},
+		{"error", 0},
+		{"off", 0},
+	}
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.LogLevel = tt.level
+		cfg.PersistenceFile = filepath.Join(t.TempDir(), "buckets.json")
+		handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+		recorder := &recordingLogger{}
+		bl.SetLogger(recorder)
+
+		if err := bl.SetKeyLimit("10.0.0.1:backend.local", "1MB", ""); err != nil {
+			t.Fatal(err)
+		}
+		bl.Shutdown()
+
+		if len(recorder.entries) != tt.logged {
+			t.Errorf("logLevel %q: expected %d entries, got %+v", tt.level, tt.logged, recorder.entries)
+			continue
+		}
+		if tt.logged > 0 {
+			if entry := recorder.entries[0]; entry.Level != bandwidthlimiter.LogInfo || entry.Middleware != "test-limiter" || entry.Time.IsZero() {
+				t.Errorf("Unexpected entry %+v", entry)
+			}
+		}
+	}
+}
+
+// TestLogFormatJSON tests that JSON lines carry the entry's fields
+func TestLogFormatJSON(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.LogFormat = "json"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	bl.ClearKeyLimit("unknown") // Logs nothing
+	if err := bl.SetKeyLimit("10.0.0.1:backend.local", "1MB", ""); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	line, err := bufio.NewReader(reader).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]string
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatalf("Expected a JSON line, got %q: %v", line, err)
+	}
+	if entry["level"] != "info" || entry["middleware"] != "test-limiter" || entry["msg"] == "" || entry["time"] == "" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+}
+
+// TestLogConfig tests that logLevel and logFormat are validated
+func TestLogConfig(t *testing.T) {
+	for _, cfg := range []*bandwidthlimiter.Config{
+		{LogLevel: "verbose"},
+		{LogFormat: "xml"},
+	} {
+		config := bandwidthlimiter.CreateConfig()
+		config.LogLevel = cfg.LogLevel
+		config.LogFormat = cfg.LogFormat
+		if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), config, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for logLevel %q, logFormat %q", cfg.LogLevel, cfg.LogFormat)
+		}
+	}
+}
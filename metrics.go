@@ -0,0 +1,166 @@
+package bandwidthlimiter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// metrics holds the instrumentation exposed on the admin and metrics listeners
+type metrics struct {
+	evictions       int64              // Buckets removed by cleanup, only accessed atomically
+	duplicates      int64              // Requests already limited by another instance, only accessed atomically
+	persistenceErrors int64            // Failed loads and saves of the persistence file, only accessed atomically
+	chunkWait       *limiter.Histogram // Wait before each chunk could be written
+	requestThrottle *limiter.Histogram // Total wait per response
+	uploadThrottle  *limiter.Histogram // Total wait per request body, with LimitUploads
+	cleanupDuration *limiter.Histogram // Duration of each cleanup run, including remote buckets
+	transferred     *limiter.CounterVec // Body bytes by direction
+	rejected        *limiter.CounterVec // Requests turned away by the limiter, by status code
+	
+	// Time requests took and the part of it the limiter held them up, by
+	// limit class and path rule, for error budgets
+	responseTime *limiter.DurationVec
+	delayTime    *limiter.DurationVec
+}
+
+// newMetrics creates empty metrics
+func newMetrics() *metrics {
+	return &metrics{
+		chunkWait:       limiter.NewHistogram(limiter.DefaultWaitBuckets),
+		requestThrottle: limiter.NewHistogram(limiter.DefaultWaitBuckets),
+		uploadThrottle:  limiter.NewHistogram(limiter.DefaultWaitBuckets),
+		cleanupDuration: limiter.NewHistogram(limiter.DefaultWaitBuckets),
+		transferred:     limiter.NewCounterVec("direction"),
+		rejected:        limiter.NewCounterVec("code"),
+		responseTime:    limiter.NewDurationVec("class", "route"),
+		delayTime:       limiter.NewDurationVec("class", "route"),
+	}
+}
+
+// observeCleanup counts a cleanup run
+func (m *metrics) observeCleanup(stats CleanupStats) {
+	atomic.AddInt64(&m.evictions, int64(stats.Removed))
+	m.cleanupDuration.Observe(stats.Duration)
+}
+
+// observeRequest counts a completed request's stats
+func (bl *BandwidthLimiter) observeRequest(stats *RequestStats) {
+	// Only responses that went through the limiter count towards the throttle distribution
+	if stats.Limited {
+		bl.metrics.requestThrottle.Observe(stats.Wait)
+	}
+	if stats.BytesRead > 0 {
+		bl.metrics.uploadThrottle.Observe(stats.UploadWait)
+	}
+	if stats.Rejected != 0 {
+		bl.metrics.rejected.Add(strconv.Itoa(stats.Rejected), 1)
+	}
+	
+	// Routes are the PathLimits rules, which are few, unlike backends
+	class, route := stats.Decision.Policy.Class, stats.Decision.PathLimit
+	bl.metrics.responseTime.Add(stats.Duration, class, route)
+	bl.metrics.delayTime.Add(stats.Delay(), class, route)
+	if stats.Bypassed {
+		return
+	}
+	
+	if stats.BytesWritten > 0 {
+		bl.metrics.transferred.Add(string(directionDownload), stats.BytesWritten)
+	}
+	if stats.BytesRead > 0 {
+		bl.metrics.transferred.Add(string(directionUpload), stats.BytesRead)
+	}
+	
+	// Per-key totals live on the bucket, so they go away with it. They are
+	// exported with MetricsPerKey and always shown by /buckets.
+	if stats.BytesWritten > 0 {
+		if entry, ok := bl.buckets.Load(stats.Decision.Key); ok {
+			entry.AddTransferred(stats.BytesWritten)
+		}
+	}
+	if stats.BytesRead > 0 {
+		if entry, ok := bl.buckets.Load(bl.uploadKey(stats.Decision)); ok {
+			entry.AddTransferred(stats.BytesRead)
+		}
+	}
+}
+
+// MetricsHandler returns the Prometheus metrics endpoint, so embedders can
+// mount it on their own server or scrape it in-process
+func (bl *BandwidthLimiter) MetricsHandler() http.Handler {
+	return http.HandlerFunc(bl.handleMetrics)
+}
+
+// startMetrics starts the optional dedicated metrics listener
+func (bl *BandwidthLimiter) startMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", bl.handleMetrics)
+	bl.metricsServer = bl.listen("Metrics", bl.config.MetricsAddress, bearerAuth(bl.config.AdminToken, mux))
+}
+
+// stopMetrics stops the metrics listener if it is running
+func (bl *BandwidthLimiter) stopMetrics() {
+	bl.unlisten(bl.metricsServer)
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text format
+func (bl *BandwidthLimiter) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	
+	if err := bl.WriteMetrics(rw); err != nil {
+		bl.log.errorf("Error writing metrics: %v", err)
+	}
+}
+
+// WriteMetrics writes all metrics in the Prometheus text format
+func (bl *BandwidthLimiter) WriteMetrics(w io.Writer) error {
+	if err := bl.metrics.chunkWait.WritePrometheus(w, "bwl_chunk_wait_seconds",
+		"Time each chunk waited for tokens before it was written."); err != nil {
+		return err
+	}
+	bl.metrics.requestThrottle.WritePrometheus(w, "bwl_request_throttle_seconds",
+		"Total time a response spent waiting for tokens.")
+	bl.metrics.uploadThrottle.WritePrometheus(w, "bwl_upload_throttle_seconds",
+		"Total time a request body spent waiting for upload tokens.")
+	bl.metrics.cleanupDuration.WritePrometheus(w, "bwl_cleanup_duration_seconds",
+		"Time each cleanup run took.")
+	bl.metrics.transferred.WritePrometheus(w, "bwl_transferred_bytes_total",
+		"Body bytes that went through the limiter.")
+	bl.metrics.rejected.WritePrometheus(w, "bwl_rejected_requests_total",
+		"Requests the limiter turned away, by response status code.")
+	bl.metrics.responseTime.WritePrometheus(w, "bwl_response_seconds_total",
+		"Time limited requests took, by limit class and path rule.")
+	bl.metrics.delayTime.WritePrometheus(w, "bwl_limiter_delay_seconds_total",
+		"Time the limiter held limited requests up, waiting for tokens or transfer slots, by limit class and path rule.")
+	
+	fmt.Fprintf(w, "# HELP bwl_active_buckets Buckets currently held in memory.\n# TYPE bwl_active_buckets gauge\nbwl_active_buckets %d\n", bl.buckets.Len())
+	fmt.Fprintf(w, "# HELP bwl_cleanup_evictions_total Buckets removed by cleanup.\n# TYPE bwl_cleanup_evictions_total counter\nbwl_cleanup_evictions_total %d\n", atomic.LoadInt64(&bl.metrics.evictions))
+	fmt.Fprintf(w, "# HELP bwl_duplicate_requests_total Requests already limited by another instance of the middleware in the chain.\n# TYPE bwl_duplicate_requests_total counter\nbwl_duplicate_requests_total %d\n", atomic.LoadInt64(&bl.metrics.duplicates))
+	if bl.config.GlobalEarlyThrottle > 0 {
+		fmt.Fprintf(w, "# HELP bwl_early_throttle_delays_total Chunks delayed as the global bucket ran low.\n# TYPE bwl_early_throttle_delays_total counter\nbwl_early_throttle_delays_total %d\n", atomic.LoadInt64(&bl.early.delayed))
+	}
+	
+	tripped, overflowed := bl.overflowStats()
+	active := 0
+	if tripped {
+		active = 1
+	}
+	fmt.Fprintf(w, "# HELP bwl_overflow_active Whether new bucket keys are currently collapsed into the overflow bucket.\n# TYPE bwl_overflow_active gauge\nbwl_overflow_active %d\n", active)
+	fmt.Fprintf(w, "# HELP bwl_overflow_requests_total Requests collapsed into the overflow bucket.\n# TYPE bwl_overflow_requests_total counter\nbwl_overflow_requests_total %d\n", overflowed)
+	
+	if bl.resolutions != nil {
+		fmt.Fprintf(w, "# HELP bwl_resolution_cache_hits_total Requests whose limits came from the resolution cache.\n# TYPE bwl_resolution_cache_hits_total counter\nbwl_resolution_cache_hits_total %d\n", atomic.LoadInt64(&bl.resolutions.hits))
+		fmt.Fprintf(w, "# HELP bwl_resolution_cache_misses_total Requests whose limits had to be resolved.\n# TYPE bwl_resolution_cache_misses_total counter\nbwl_resolution_cache_misses_total %d\n", atomic.LoadInt64(&bl.resolutions.misses))
+	}
+	
+	if bl.config.MetricsPerKey {
+		return bl.buckets.WriteTransferred(w, "bwl_key_transferred_bytes_total",
+			"Body bytes paid from each bucket since it was created.")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package bandwidthlimiter
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RateLimitOptions is the configuration of Traefik's rateLimit middleware, with
+// the field names of Traefik's dynamic configuration
+type RateLimitOptions struct {
+	Average         int64            `json:"average"`         // Requests per period
+	Period          Duration         `json:"period"`          // Default: 1s
+	Burst           int64            `json:"burst"`           // Requests, default: 1
+	SourceCriterion *SourceCriterion `json:"sourceCriterion"` // Nil for the remote address
+}
+
+// SourceCriterion is how Traefik's rateLimit middleware groups requests
+type SourceCriterion struct {
+	IPStrategy        *IPStrategy `json:"ipStrategy"`
+	RequestHeaderName string      `json:"requestHeaderName"`
+	RequestHost       bool        `json:"requestHost"`
+}
+
+// IPStrategy is Traefik's choice of the client IP among X-Forwarded-For entries
+type IPStrategy struct {
+	Depth       int      `json:"depth"`
+	ExcludedIPs []string `json:"excludedIPs"`
+	IPv6Subnet  int      `json:"ipv6Subnet"`
+}
+
+// ConvertRateLimit translates a Traefik rateLimit middleware into a
+// configuration limiting the same clients to the same request rate, assuming
+// responses of responseSize bytes on average: the byte rate is average times
+// responseSize per period, and the burst holds burst responses. Clients keep
+// one bucket across all routes, as with a shared rateLimit middleware.
+// Settings without an exact equivalent are described in the returned notes.
+func ConvertRateLimit(options RateLimitOptions, responseSize Size) (*Config, []string, error) {
+	size, err := parseSize(responseSize)
+	if err != nil {
+		return nil, nil, wrapf(ErrInvalidLimit, "responseSize: %v", err)
+	}
+	if size <= 0 {
+		return nil, nil, wrapf(ErrInvalidLimit, "responseSize must be greater than 0")
+	}
+	if options.Average <= 0 {
+		return nil, nil, wrapf(ErrInvalidLimit, "average must be greater than 0, Traefik doesn't limit with an average of 0")
+	}
+	period, err := parseDuration(options.Period)
+	if err != nil {
+		return nil, nil, wrapf(ErrInvalidLimit, "period: %v", err)
+	}
+	if period < 0 {
+		return nil, nil, wrapf(ErrInvalidLimit, "period must not be negative")
+	}
+	if period == 0 {
+		period = time.Second
+	}
+	burst := options.Burst
+	if burst <= 0 {
+		burst = 1 // Traefik's default
+	}
+	
+	limit := int64(math.Round(float64(options.Average) * float64(size) / period.Seconds()))
+	if limit < 1 {
+		limit = 1
+	}
+	
+	config := CreateConfig()
+	config.DefaultLimit = Bytes(limit)
+	config.BurstSize = Bytes(burst * size)
+	config.BucketScope = scopeClient
+	config.ClientIPStrategy = clientIPRemoteAddr
+	notes := []string{
+		fmt.Sprintf("%d requests per %v at %d bytes each is %d bytes/s, with a burst of %d responses", options.Average, period, size, limit, burst),
+		fmt.Sprintf("Traefik answers requests over the rate with 429 Too Many Requests, the converted configuration slows responses down instead; set mode to %q to keep rejecting", modeReject),
+	}
+	
+	criterion := options.SourceCriterion
+	switch {
+	case criterion == nil:
+	case criterion.IPStrategy != nil:
+		if criterion.IPStrategy.Depth > 0 {
+			config.ClientIPStrategy = fmt.Sprintf("%s:%d", clientIPDepth, criterion.IPStrategy.Depth)
+		}
+		if len(criterion.IPStrategy.ExcludedIPs) > 0 {
+			notes = append(notes, fmt.Sprintf("ipStrategy.excludedIPs has no equivalent, clients are identified by clientIPStrategy %q; set it to \"xff:<depth>\" for the number of trusted proxies", config.ClientIPStrategy))
+		}
+		if criterion.IPStrategy.IPv6Subnet > 0 {
+			notes = append(notes, "ipStrategy.ipv6Subnet has no equivalent, IPv6 clients get a bucket per address; add clientLimits for their networks to share limits")
+		}
+	case criterion.RequestHeaderName != "":
+		config.KeyHeader = criterion.RequestHeaderName
+		notes = append(notes, fmt.Sprintf("Requests without the %s header are keyed by their client IP; set keyFallback to %q to turn them away", criterion.RequestHeaderName, keyFallbackReject))
+	case criterion.RequestHost:
+		notes = append(notes, "requestHost shares one bucket among all clients of a host, which has no equivalent; clients are limited individually, use backendAggregateLimits to cap the total of a host")
+	}
+	return config, notes, nil
+}
@@ -0,0 +1,80 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestConvertRateLimit tests that a request rate becomes the byte rate of average responses
+func TestConvertRateLimit(t *testing.T) {
+	options := bandwidthlimiter.RateLimitOptions{Average: 100, Period: "1m", Burst: 50}
+	config, notes, err := bandwidthlimiter.ConvertRateLimit(options, "64KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DefaultLimit != "109227" || config.BurstSize != "3276800" {
+		t.Errorf("Expected 100 responses of 64KB per minute with a burst of 50, got %s and %s", config.DefaultLimit, config.BurstSize)
+	}
+	if config.BucketScope != "client" || config.ClientIPStrategy != "remoteAddr" {
+		t.Errorf("Expected one bucket per remote address, got scope %q and strategy %q", config.BucketScope, config.ClientIPStrategy)
+	}
+	if len(notes) != 2 || !strings.Contains(notes[1], "429") {
+		t.Errorf("Expected notes on the rate and on rejections, got %q", notes)
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := bandwidthlimiter.New(context.Background(), next, config, "test-limiter"); err != nil {
+		t.Errorf("Expected the converted configuration to be valid, got %v", err)
+	}
+
+	// Traefik's defaults: a period of 1s and a burst of one request
+	config, _, err = bandwidthlimiter.ConvertRateLimit(bandwidthlimiter.RateLimitOptions{Average: 10}, "1KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DefaultLimit != "10240" || config.BurstSize != "1024" {
+		t.Errorf("Expected 10KB/s with a 1KB burst, got %s and %s", config.DefaultLimit, config.BurstSize)
+	}
+
+	for _, options := range []bandwidthlimiter.RateLimitOptions{{}, {Average: 10, Period: "soon"}, {Average: 10, Period: "-1s"}} {
+		if _, _, err := bandwidthlimiter.ConvertRateLimit(options, "1KB"); err == nil {
+			t.Errorf("Expected an error for %+v", options)
+		}
+	}
+	if _, _, err := bandwidthlimiter.ConvertRateLimit(bandwidthlimiter.RateLimitOptions{Average: 10}, "0"); err == nil {
+		t.Error("Expected an error for an empty response size")
+	}
+}
+
+// TestConvertRateLimitSourceCriterion tests that clients are identified like Traefik identified them
+func TestConvertRateLimitSourceCriterion(t *testing.T) {
+	tests := []struct {
+		criterion bandwidthlimiter.SourceCriterion
+		strategy  string
+		keyHeader string
+		note      string
+	}{
+		{bandwidthlimiter.SourceCriterion{IPStrategy: &bandwidthlimiter.IPStrategy{Depth: 2}}, "xff:2", "", ""},
+		{bandwidthlimiter.SourceCriterion{IPStrategy: &bandwidthlimiter.IPStrategy{ExcludedIPs: []string{"10.0.0.1"}}}, "remoteAddr", "", "excludedIPs"},
+		{bandwidthlimiter.SourceCriterion{RequestHeaderName: "X-User"}, "remoteAddr", "X-User", "keyFallback"},
+		{bandwidthlimiter.SourceCriterion{RequestHost: true}, "remoteAddr", "", "requestHost"},
+	}
+
+	for _, tt := range tests {
+		criterion := tt.criterion
+		config, notes, err := bandwidthlimiter.ConvertRateLimit(bandwidthlimiter.RateLimitOptions{Average: 10, SourceCriterion: &criterion}, "1KB")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ClientIPStrategy != tt.strategy || config.KeyHeader != tt.keyHeader {
+			t.Errorf("%+v: expected strategy %q and key header %q, got %q and %q", tt.criterion, tt.strategy, tt.keyHeader, config.ClientIPStrategy, config.KeyHeader)
+		}
+		if tt.note != "" && !strings.Contains(strings.Join(notes, "\n"), tt.note) {
+			t.Errorf("%+v: expected a note on %s, got %q", tt.criterion, tt.note, notes)
+		}
+	}
+}
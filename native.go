@@ -0,0 +1,28 @@
+//go:build bwlnative
+
+package bandwidthlimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+	rpprof "runtime/pprof"
+)
+
+// nativeBuild reports whether the plugin was compiled with the bwlnative tag,
+// enabling features that can't run under the Yaegi interpreter
+const nativeBuild = true
+
+// registerPprof mounts the net/http/pprof handlers on mux
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// withPprofLabels runs fn with the given label pairs attached to the goroutine
+func withPprofLabels(ctx context.Context, fn func(ctx context.Context), labels ...string) {
+	rpprof.Do(ctx, rpprof.Labels(labels...), fn)
+}
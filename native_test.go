@@ -0,0 +1,59 @@
+//go:build bwlnative
+
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestPprofLabels tests that request goroutines carry limiter labels
+func TestPprofLabels(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PprofLabels = true
+	cfg.ClientLimits = map[string]bandwidthlimiter.Size{"10.0.0.1": "1MB"}
+
+	ctx := context.Background()
+
+	var class, backend string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		class, _ = pprof.Label(req.Context(), "bwl_limit_class")
+		backend, _ = pprof.Label(req.Context(), "bwl_backend")
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://api.local", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if class != "client" || backend != "api.local" {
+		t.Errorf("Unexpected pprof labels. Expected client/api.local, got %q/%q", class, backend)
+	}
+}
+
+// TestAdminPprof tests that pprof handlers are mounted on the admin listener
+func TestAdminPprof(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.AdminPprof = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.(*bandwidthlimiter.BandwidthLimiter).AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %d from pprof index, got %d", http.StatusOK, recorder.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package bandwidthlimiter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// originTransport limits how fast proxied responses are read from their
+// origin, see Config.OriginReadLimit
+type originTransport struct {
+	bl   *BandwidthLimiter
+	next http.RoundTripper
+}
+
+// OriginTransport wraps the transport of a reverse proxy behind the limiter,
+// so the bodies of upstream responses are read at no more than
+// OriginReadLimit per upstream host, however fast the clients take them. It
+// returns next unchanged if OriginReadLimit is not set, and uses
+// http.DefaultTransport if next is nil.
+func (bl *BandwidthLimiter) OriginTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if bl.parsed.originReadLimit == 0 {
+		return next
+	}
+	return &originTransport{bl: bl, next: next}
+}
+
+// RoundTrip sends the request and limits reading its response body
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp, err
+	}
+	resp.Body = &originBody{
+		ReadCloser: resp.Body,
+		ctx:        req.Context(),
+		bucket:     t.bl.originBucket(req.URL.Host),
+		chunkSize:  int(min(4096, t.bl.parsed.originReadBurst)), // 4KB chunks, like uploads, within the burst
+		stats:      StatsFromContext(req.Context()),
+	}
+	return resp, nil
+}
+
+// originBuckets holds one read bucket per upstream host. Proxies have few
+// origins, so buckets are kept for the lifetime of the middleware.
+type originBuckets struct {
+	mutex   sync.Mutex
+	buckets map[string]*limiter.TokenBucket
+}
+
+// originBucket returns the read bucket of an upstream host
+func (bl *BandwidthLimiter) originBucket(host string) *limiter.TokenBucket {
+	bl.origins.mutex.Lock()
+	defer bl.origins.mutex.Unlock()
+	
+	bucket, exists := bl.origins.buckets[host]
+	if !exists {
+		if bl.origins.buckets == nil {
+			bl.origins.buckets = make(map[string]*limiter.TokenBucket)
+		}
+		bucket = limiter.NewTokenBucket(bl.parsed.originReadLimit, bl.parsed.originReadBurst)
+		bl.origins.buckets[host] = bucket
+	}
+	return bucket
+}
+
+// originBody wraps an upstream response body to limit how fast it is read
+type originBody struct {
+	io.ReadCloser
+	ctx       context.Context // Request context, done once the client went away
+	bucket    *limiter.TokenBucket
+	chunkSize int           // Bytes read and paid for at a time
+	stats     *RequestStats // Stats of the proxied request, nil if it isn't limited
+}
+
+// Read reads at most one chunk and waits until its bytes are paid for, so the
+// origin, through TCP backpressure, only sends at the limited rate
+func (ob *originBody) Read(p []byte) (int, error) {
+	if len(p) > ob.chunkSize {
+		p = p[:ob.chunkSize]
+	}
+	
+	n, err := ob.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	
+	if !ob.bucket.Consume(int64(n)) {
+		waitStart := time.Now()
+		waitErr := ob.bucket.ConsumeWait(ob.ctx, int64(n))
+		if ob.stats != nil {
+			ob.stats.OriginWait += time.Since(waitStart)
+		}
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
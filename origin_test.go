@@ -0,0 +1,88 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestOriginReadLimit tests that proxied responses are read from their origin
+// at the origin read limit, however fast the client is allowed to be
+func TestOriginReadLimit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 64*1024))
+	}))
+	defer origin.Close()
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB"
+	cfg.BurstSize = "10MB"
+	cfg.OriginReadLimit = "64KB"
+	cfg.OriginReadBurst = "16KB"
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	handler, err := bandwidthlimiter.New(context.Background(), proxy, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+	proxy.Transport = bl.OriginTransport(nil)
+
+	done := make(chan *bandwidthlimiter.RequestStats, 1)
+	bl.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		done <- stats
+	})
+	server := httptest.NewServer(bl)
+	defer server.Close()
+
+	// 48KB over the burst take about 750ms at 64KB/s
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 64*1024 {
+		t.Fatalf("Expected the full body, got %d bytes: %v", len(body), err)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("Expected the origin to be read at its limit, took %v", elapsed)
+	}
+	if stats := <-done; stats.OriginWait < 500*time.Millisecond || stats.Wait > 100*time.Millisecond {
+		t.Errorf("Expected the wait on the origin side, got %+v", stats)
+	}
+}
+
+// TestOriginTransportDisabled tests that transports are left alone without an
+// origin read limit
+func TestOriginTransportDisabled(t *testing.T) {
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), bandwidthlimiter.CreateConfig(), "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	transport := &http.Transport{}
+	if bl.OriginTransport(transport) != http.RoundTripper(transport) {
+		t.Error("Expected the transport to be returned unchanged")
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.OriginReadLimit = "-1KB"
+	if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for a negative originReadLimit")
+	}
+}
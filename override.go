@@ -0,0 +1,100 @@
+package bandwidthlimiter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// keyOverrides holds the limits set at runtime for single bucket keys, e.g.
+// to cap a misbehaving client until the configuration catches up
+type keyOverrides struct {
+	mutex  sync.RWMutex
+	limits map[string]LimitOverride
+	
+	// Set once a key was ever overridden, updated atomically. Buckets then
+	// follow their current limits on every use, so they return to their
+	// rule's limits once the override is cleared.
+	used int32
+}
+
+// LimitOverride is the limit and burst replacing the rule of a bucket key,
+// set with SetKeyLimit
+type LimitOverride struct {
+	Limit int64 `json:"limit"`
+	Burst int64 `json:"burst"`
+}
+
+// SetKeyLimit replaces the limit of a download bucket key, e.g.
+// "10.0.0.1:backend.local", until ClearKeyLimit or a restart. If burst is
+// empty, the bucket may burst one second at the new limit. Existing buckets
+// keep their tokens and refill at the new limit from their next use.
+func (bl *BandwidthLimiter) SetKeyLimit(key string, limit, burst Size) error {
+	if key == "" {
+		return wrapf(ErrInvalidLimit, "key must not be empty")
+	}
+	override := LimitOverride{}
+	var err error
+	if override.Limit, err = parseSize(limit); err != nil {
+		return wrapf(ErrInvalidLimit, "limit: %v", err)
+	}
+	if override.Limit == 0 || (override.Limit < 0 && override.Limit != Unlimited) {
+		return wrapf(ErrInvalidLimit, "limit must be positive or unlimited")
+	}
+	if override.Burst, err = parseSize(burst); err != nil {
+		return wrapf(ErrInvalidLimit, "burst: %v", err)
+	}
+	if override.Burst < 0 {
+		return wrapf(ErrInvalidLimit, "burst must not be negative")
+	}
+	if override.Burst == 0 && override.Limit != Unlimited {
+		override.Burst = override.Limit
+	}
+	
+	bl.overrides.mutex.Lock()
+	defer bl.overrides.mutex.Unlock()
+	
+	if bl.overrides.limits == nil {
+		bl.overrides.limits = make(map[string]LimitOverride)
+	}
+	bl.overrides.limits[key] = override
+	atomic.StoreInt32(&bl.overrides.used, 1)
+	bl.log.infof("Limit of %s set to %d bytes/s (burst %d) at runtime", key, override.Limit, override.Burst)
+	return nil
+}
+
+// ClearKeyLimit returns a bucket key to the limit of its rule. It reports
+// whether the key had a limit set with SetKeyLimit.
+func (bl *BandwidthLimiter) ClearKeyLimit(key string) bool {
+	bl.overrides.mutex.Lock()
+	defer bl.overrides.mutex.Unlock()
+	
+	if _, ok := bl.overrides.limits[key]; !ok {
+		return false
+	}
+	delete(bl.overrides.limits, key)
+	bl.log.infof("Limit of %s returned to its rule", key)
+	return true
+}
+
+// keyLimit returns the limit set at runtime for a bucket key, if any
+func (bl *BandwidthLimiter) keyLimit(key string) (LimitOverride, bool) {
+	if atomic.LoadInt32(&bl.overrides.used) == 0 {
+		return LimitOverride{}, false
+	}
+	
+	bl.overrides.mutex.RLock()
+	defer bl.overrides.mutex.RUnlock()
+	
+	override, ok := bl.overrides.limits[key]
+	return override, ok
+}
+
+// override applies the limit set at runtime for the decision's key, if any
+func (bl *BandwidthLimiter) override(decision Decision) Decision {
+	if override, ok := bl.keyLimit(decision.Key); ok {
+		decision.Policy.Limit = override.Limit
+		decision.Policy.Burst = override.Burst
+		decision.Overridden = true
+	}
+	return decision
+}
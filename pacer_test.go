@@ -0,0 +1,194 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestTimeSlicePacing tests that time-slice pacing sends a fixed number of bytes per tick
+func TestTimeSlicePacing(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "50KB" // 50 KB/s
+	cfg.Pacing = "timeslice"
+	cfg.TickInterval = "100ms" // 5 KB per 100ms slice
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 20*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+
+	start := time.Now()
+	handler.ServeHTTP(recorder, req)
+	elapsed := time.Since(start)
+
+	// 20 KB needs four slices, the first of which starts immediately
+	minExpectedTime := 250 * time.Millisecond
+	if elapsed < minExpectedTime {
+		t.Errorf("Response was not paced. Expected >%v, got %v", minExpectedTime, elapsed)
+	}
+
+	if recorder.Body.Len() != 20*1024 {
+		t.Errorf("Unexpected response size. Expected %d, got %d", 20*1024, recorder.Body.Len())
+	}
+}
+
+// TestInvalidPacing tests that unknown pacing modes are rejected
+func TestInvalidPacing(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.Pacing = "bogus"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an unknown pacing mode")
+	}
+}
+
+// discardWriter is a ResponseWriter that drops the body, for multi-gigabit responses
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *discardWriter) WriteHeader(statusCode int) {}
+
+// TestHighResPacing tests that high-resolution pacing reaches fast limits with few, large chunks
+func TestHighResPacing(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "256MB"
+	cfg.BurstSize = "32MB"
+	cfg.Pacing = "highres"
+
+	body := make([]byte, 1<<20)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 96; i++ {
+			rw.Write(body)
+		}
+	})
+
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats bandwidthlimiter.RequestStats
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(done *bandwidthlimiter.RequestStats) {
+		stats = *done
+	})
+
+	start := time.Now()
+	handler.ServeHTTP(&discardWriter{}, httptest.NewRequest(http.MethodGet, "/", nil))
+	elapsed := time.Since(start)
+
+	// 32 MB of burst, then 64 MB at 256 MB/s
+	if elapsed < 200*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("Expected about 250ms at the configured rate, took %v", elapsed)
+	}
+	if stats.BytesWritten != 96<<20 {
+		t.Errorf("Expected %d bytes written, got %d", 96<<20, stats.BytesWritten)
+	}
+	if stats.Chunks > 200 {
+		t.Errorf("Expected large chunks, got %d chunks", stats.Chunks)
+	}
+}
+
+// BenchmarkPacing measures the throughput reached at multi-gigabit limits.
+// Every iteration writes a quarter second of traffic, so ns/op should be
+// close to 250ms and MB/s close to the limit. chunks/op is the number of
+// bucket payments and writes to the connection each response needed.
+func BenchmarkPacing(b *testing.B) {
+	for _, pacing := range []string{"tokens", "highres"} {
+		for _, gbits := range []int64{1, 10} {
+			b.Run(fmt.Sprintf("%s/%dGbit", pacing, gbits), func(b *testing.B) {
+				limit := gbits * 1000 * 1000 * 1000 / 8
+
+				cfg := bandwidthlimiter.CreateConfig()
+				cfg.DefaultLimit = bandwidthlimiter.Bytes(limit)
+				cfg.BurstSize = bandwidthlimiter.Bytes(limit / 10)
+				cfg.Pacing = pacing
+
+				size := limit / 4
+				body := make([]byte, 1<<20)
+				next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					for written := int64(0); written < size; written += int64(len(body)) {
+						rw.Write(body)
+					}
+				})
+
+				handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "bench-limiter")
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// Use up the initial burst so iterations measure the steady rate
+				handler.ServeHTTP(&discardWriter{}, httptest.NewRequest(http.MethodGet, "/", nil))
+
+				var chunks int64
+				handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+					chunks += stats.Chunks
+				})
+
+				b.SetBytes(size)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					handler.ServeHTTP(&discardWriter{}, httptest.NewRequest(http.MethodGet, "/", nil))
+				}
+				b.ReportMetric(float64(chunks)/float64(b.N), "chunks/op")
+			})
+		}
+	}
+}
+
+// BenchmarkWrite measures paced writes of 32KB at limits below the pacing
+// benchmark's. MB/s should match the limit; allocations are per write.
+func BenchmarkWrite(b *testing.B) {
+	for _, limit := range []string{"1MB", "16MB", "256MB"} {
+		b.Run(limit, func(b *testing.B) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = bandwidthlimiter.Size(limit)
+			cfg.BurstSize = "64KB"
+
+			body := make([]byte, 32*1024)
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				// Use up the initial burst so the writes measure the steady rate
+				rw.Write(make([]byte, 64*1024))
+
+				b.ReportAllocs()
+				b.SetBytes(int64(len(body)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					rw.Write(body)
+				}
+				b.StopTimer()
+			})
+
+			handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "bench-limiter")
+			if err != nil {
+				b.Fatal(err)
+			}
+			handler.ServeHTTP(&discardWriter{}, httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package bandwidthlimiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// partitionRetryInterval is how long a remote bucket waits after a short
+// lease before asking its owner again, bounding cross-node chatter
+const partitionRetryInterval = 50 * time.Millisecond
+
+// partitionDownInterval is how long a key is limited locally after its owner failed to answer
+const partitionDownInterval = 5 * time.Second
+
+// leaseRequest asks the owner of a key for tokens from its bucket
+type leaseRequest struct {
+	Key         string `json:"key"`
+	Limit       int64  `json:"limit"`
+	Burst       int64  `json:"burst"`
+	MinuteLimit int64  `json:"minuteLimit,omitempty"`
+	Class       string `json:"class,omitempty"`
+	Label       string `json:"label,omitempty"`
+	Tokens      int64  `json:"tokens"`
+}
+
+// leaseResponse reports how many of the requested tokens were granted
+type leaseResponse struct {
+	Granted int64 `json:"granted"`
+}
+
+// remoteBucket is the local face of a bucket owned by another instance. It
+// leases tokens from the owner in batches and hands them out locally.
+type remoteBucket struct {
+	bl      *BandwidthLimiter
+	owner   string
+	request leaseRequest
+	
+	mutex     sync.Mutex
+	leased    int64
+	lastAsk   time.Time
+	lastUsed  time.Time
+	downUntil time.Time // Limit locally until then, the owner was unreachable
+}
+
+// Consume takes tokens from the lease, topping it up from the owner when needed.
+// If the owner can't be reached, the local bucket for the key is used instead.
+func (rb *remoteBucket) Consume(tokens int64) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	
+	now := time.Now()
+	rb.lastUsed = now
+	if rb.leased >= tokens {
+		rb.leased -= tokens
+		return true
+	}
+	if now.Before(rb.downUntil) {
+		return limiter.ConsumeAll(rb.bl.localConsumers(rb.request.Key, rb.policy()), tokens)
+	}
+	if now.Sub(rb.lastAsk) < partitionRetryInterval {
+		return false
+	}
+	rb.lastAsk = now
+	
+	want := tokens - rb.leased
+	if want < rb.bl.parsed.partitionLease {
+		want = rb.bl.parsed.partitionLease
+	}
+	granted, err := rb.bl.requestLease(rb.owner, rb.request, want)
+	if err != nil {
+		rb.bl.log.warnf("Partition owner %s unreachable, limiting %s locally: %v", rb.owner, rb.request.Key, err)
+		rb.downUntil = now.Add(partitionDownInterval)
+		return limiter.ConsumeAll(rb.bl.localConsumers(rb.request.Key, rb.policy()), tokens)
+	}
+	
+	rb.leased += granted
+	if granted >= want {
+		rb.lastAsk = time.Time{} // Full lease, the next top-up may ask right away
+	}
+	if rb.leased >= tokens {
+		rb.leased -= tokens
+		return true
+	}
+	return false
+}
+
+// Refund returns tokens to the lease
+func (rb *remoteBucket) Refund(tokens int64) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	
+	rb.leased += tokens
+}
+
+// setLimit changes the limit the owner's bucket is leased with
+func (rb *remoteBucket) setLimit(limit int64) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	
+	rb.request.Limit = limit
+}
+
+// policy reconstructs the policy the bucket was created for
+func (rb *remoteBucket) policy() limiter.Policy {
+	return limiter.Policy{
+		Limit:       rb.request.Limit,
+		Burst:       rb.request.Burst,
+		MinuteLimit: rb.request.MinuteLimit,
+		Class:       rb.request.Class,
+		Label:       rb.request.Label,
+	}
+}
+
+// PartitionOwner returns the peer authoritative for a bucket key, or "" if
+// partitioning is disabled
+func (bl *BandwidthLimiter) PartitionOwner(key string) string {
+	if bl.ring == nil {
+		return ""
+	}
+	return bl.ring.Owner(key)
+}
+
+// consumers returns what a chunk for key must be paid from: the local bucket
+// and window, or a lease on the owning peer's bucket. Local entries are held
+// by refs, so cleanup doesn't evict them while the transfer is running.
+func (bl *BandwidthLimiter) consumers(key string, policy limiter.Policy, refs *entryRefs) []limiter.Consumer {
+	// Limits can change while buckets live on, which then follow them
+	dynamic := bl.dynamicLimits()
+	if bl.redis != nil {
+		rb := bl.redisConsumer(key, policy)
+		if dynamic {
+			rb.setLimit(policy.Limit)
+		}
+		return []limiter.Consumer{rb}
+	}
+	
+	owner := bl.PartitionOwner(key)
+	if owner == "" || owner == bl.config.PartitionSelf {
+		entry := bl.buckets.Acquire(key, policy)
+		refs.add(entry)
+		if dynamic {
+			entry.Bucket.SetLimit(policy.Limit, policy.Burst)
+		}
+		return entryConsumers(entry)
+	}
+	
+	value, loaded := bl.remoteBuckets.Load(key)
+	if !loaded {
+		value, _ = bl.remoteBuckets.LoadOrStore(key, &remoteBucket{
+			bl:    bl,
+			owner: owner,
+			request: leaseRequest{
+				Key:         key,
+				Limit:       policy.Limit,
+				Burst:       policy.Burst,
+				MinuteLimit: policy.MinuteLimit,
+				Class:       policy.Class,
+				Label:       policy.Label,
+			},
+			lastUsed: time.Now(),
+		})
+	}
+	rb := value.(*remoteBucket)
+	if dynamic {
+		rb.setLimit(policy.Limit)
+	}
+	return []limiter.Consumer{rb}
+}
+
+// localConsumers gets or creates the local entry for key and returns its buckets
+func (bl *BandwidthLimiter) localConsumers(key string, policy limiter.Policy) []limiter.Consumer {
+	// Get or create bucket with automatic update of last used time
+	entry := bl.buckets.LoadOrCreate(key, policy)
+	entry.Touch()
+	if bl.dynamicLimits() {
+		entry.Bucket.SetLimit(policy.Limit, policy.Burst)
+	}
+	return entryConsumers(entry)
+}
+
+// entryConsumers returns the buckets of a local entry
+func entryConsumers(entry *limiter.Entry) []limiter.Consumer {
+	if entry.Window != nil {
+		return []limiter.Consumer{entry.Bucket, entry.Window}
+	}
+	return []limiter.Consumer{entry.Bucket}
+}
+
+// entryRefs holds the entries a request's transfers pay from until the request completes
+type entryRefs struct {
+	mutex    sync.Mutex
+	entries  []*limiter.Entry
+	released bool
+}
+
+// add holds entry, or releases it right away if the request has already completed,
+// e.g. when a backend reads the request body after the response was written
+func (refs *entryRefs) add(entry *limiter.Entry) {
+	refs.mutex.Lock()
+	defer refs.mutex.Unlock()
+	
+	if refs.released {
+		entry.Release()
+		return
+	}
+	refs.entries = append(refs.entries, entry)
+}
+
+// release releases every held entry
+func (refs *entryRefs) release() {
+	refs.mutex.Lock()
+	defer refs.mutex.Unlock()
+	
+	for _, entry := range refs.entries {
+		entry.Release()
+	}
+	refs.entries = nil
+	refs.released = true
+}
+
+// requestLease asks owner for tokens from the bucket described by request
+func (bl *BandwidthLimiter) requestLease(owner string, request leaseRequest, tokens int64) (int64, error) {
+	request.Tokens = tokens
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+	
+	req, err := http.NewRequest(http.MethodPost, "http://"+owner+"/partition/lease", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bl.config.PartitionToken != "" {
+		req.Header.Set("Authorization", "Bearer "+bl.config.PartitionToken)
+	}
+	
+	resp, err := bl.partitionClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	
+	var lease leaseResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return 0, err
+	}
+	return lease.Granted, nil
+}
+
+// grantLease consumes up to the requested tokens from the local bucket and window
+func (bl *BandwidthLimiter) grantLease(request leaseRequest) int64 {
+	entry := bl.buckets.LoadOrCreate(request.Key, limiter.Policy{
+		Limit:       request.Limit,
+		Burst:       request.Burst,
+		MinuteLimit: request.MinuteLimit,
+		Class:       request.Class,
+		Label:       request.Label,
+	})
+	entry.Touch()
+	if bl.dynamicLimits() {
+		entry.Bucket.SetLimit(request.Limit, request.Burst)
+	}
+	
+	granted := entry.Bucket.ConsumeUpTo(request.Tokens)
+	if entry.Window != nil && granted > 0 {
+		windowGranted := entry.Window.ConsumeUpTo(granted)
+		entry.Bucket.Refund(granted - windowGranted)
+		granted = windowGranted
+	}
+	return granted
+}
+
+// PartitionHandler returns the peer RPC endpoints, so embedders can mount them on their own server
+func (bl *BandwidthLimiter) PartitionHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/partition/lease", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		
+		var request leaseRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.Key == "" || request.Tokens < 0 {
+			http.Error(rw, "invalid lease request", http.StatusBadRequest)
+			return
+		}
+		
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(leaseResponse{Granted: bl.grantLease(request)})
+	})
+	return bearerAuth(bl.config.PartitionToken, mux)
+}
+
+// startPartition starts the listener answering lease requests from peers.
+// Like the admin listener, it is taken over from the previous instance on a
+// reload, so peers lease from the buckets of the instance serving traffic.
+func (bl *BandwidthLimiter) startPartition() {
+	bl.partitionServer = bl.listen("Partition", bl.config.PartitionAddress, bl.PartitionHandler())
+}
+
+// stopPartition stops the partition listener if it is running
+func (bl *BandwidthLimiter) stopPartition() {
+	bl.unlisten(bl.partitionServer)
+}
+
+// evictRemoteBuckets forgets leases on remote buckets that haven't been used since cutoff
+func (bl *BandwidthLimiter) evictRemoteBuckets(cutoff time.Time) {
+	bl.remoteBuckets.Range(func(key, value interface{}) bool {
+		rb := value.(*remoteBucket)
+		rb.mutex.Lock()
+		idle := rb.lastUsed.Before(cutoff)
+		rb.mutex.Unlock()
+		if idle {
+			bl.remoteBuckets.Delete(key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,218 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestPartitionedBuckets tests that a key owned by a peer is limited by the peer's bucket
+func TestPartitionedBuckets(t *testing.T) {
+	// Reserve peer addresses before the instances exist
+	servers := make([]*httptest.Server, 2)
+	handlers := make([]http.Handler, 2)
+	peers := make([]string, 2)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			handlers[i].ServeHTTP(rw, req)
+		}))
+		peers[i] = servers[i].Listener.Addr().String()
+	}
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 10*1024))
+	})
+
+	instances := make([]*bandwidthlimiter.BandwidthLimiter, 2)
+	for i := range instances {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DefaultLimit = "50KB" // 50 KB/s
+		cfg.BurstSize = "20KB"    // 20 KB burst
+		cfg.PartitionPeers = peers
+		cfg.PartitionSelf = peers[i]
+		cfg.PartitionAddress = "127.0.0.1:0"
+		cfg.PartitionLease = "4KB"
+		cfg.PartitionToken = "secret"
+
+		handler, err := bandwidthlimiter.New(ctx, next, cfg, fmt.Sprintf("test-limiter-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i] = handler.(*bandwidthlimiter.BandwidthLimiter)
+		defer instances[i].Shutdown()
+
+		handlers[i] = instances[i].PartitionHandler()
+		servers[i].Start()
+		defer servers[i].Close()
+	}
+
+	// Find a client whose bucket is owned by the second instance
+	var remote string
+	for i := 1; remote == ""; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		if instances[0].PartitionOwner(ip+":backend.local") == peers[1] {
+			remote = ip + ":12345"
+		}
+	}
+
+	serve := func(instance *bandwidthlimiter.BandwidthLimiter) time.Duration {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = remote
+		start := time.Now()
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		return time.Since(start)
+	}
+
+	// Both instances draw from the single 20 KB burst held by the owner
+	serve(instances[0])
+	serve(instances[1])
+	if elapsed := serve(instances[0]); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the shared burst to be used up, took %v", elapsed)
+	}
+
+	// Peers must present the partition token
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/partition/lease", strings.NewReader(`{"key":"k","limit":1,"burst":1,"tokens":1}`))
+	instances[1].PartitionHandler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d without token, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+// TestPartitionOwnerUnreachable tests that keys fall back to local limiting when the owner is down
+func TestPartitionOwnerUnreachable(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PartitionPeers = []string{"127.0.0.1:1", "self.invalid:1"}
+	cfg.PartitionSelf = "self.invalid:1"
+	cfg.PartitionAddress = "127.0.0.1:0"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	for i := 1; i <= 10; i++ {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:12345", i)
+		handler.ServeHTTP(recorder, req)
+		if recorder.Body.String() != "hello" {
+			t.Fatalf("Expected response to be served, got %q", recorder.Body.String())
+		}
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.PartitionPeers = []string{"10.0.0.1:9190"}
+	cfg.PartitionSelf = "10.0.0.2:9190"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected error when partitionSelf is not a peer")
+	}
+}
+
+// TestPartitionListenerReload tests that an instance created by a configuration
+// reload takes over the partition listener still held by the previous instance
+func TestPartitionListenerReload(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := free.Addr().String()
+	free.Close()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	start := func(token string) *bandwidthlimiter.BandwidthLimiter {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.PartitionPeers = []string{address}
+		cfg.PartitionSelf = address
+		cfg.PartitionToken = token
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(*bandwidthlimiter.BandwidthLimiter)
+	}
+	status := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+address+"/partition/lease",
+			strings.NewReader(`{"key":"k","limit":1024,"burst":1024,"tokens":1}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	old := start("old-token")
+	if code := status("old-token"); code != http.StatusOK {
+		t.Fatalf("Expected the partition listener to serve the first instance, got %d", code)
+	}
+
+	// Traefik doesn't shut the previous instance down on a reload
+	reloaded := start("new-token")
+	defer reloaded.Shutdown()
+	if code := status("old-token"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the previous instance to stop granting leases, got %d", code)
+	}
+	if code := status("new-token"); code != http.StatusOK {
+		t.Errorf("Expected the reloaded instance to grant leases, got %d", code)
+	}
+
+	old.Shutdown()
+	if code := status("new-token"); code != http.StatusOK {
+		t.Errorf("Expected the listener to survive shutting down the previous instance, got %d", code)
+	}
+}
+
+// TestPartitionTokenRequired tests that a partition listener reachable by
+// other hosts must authenticate its peers
+func TestPartitionTokenRequired(t *testing.T) {
+	tests := []struct {
+		address string
+		token   string
+		wantErr bool
+	}{
+		{"127.0.0.1:0", "", false},
+		{"10.0.0.1:9190", "", true},
+		{":0", "", true},
+		{":0", "secret", false},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.PartitionPeers = []string{"10.0.0.1:9190"}
+		cfg.PartitionSelf = "10.0.0.1:9190"
+		cfg.PartitionAddress = tt.address
+		cfg.PartitionToken = tt.token
+
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter-"+tt.address)
+		if tt.wantErr {
+			if !errors.Is(err, bandwidthlimiter.ErrInvalidLimit) || !strings.HasPrefix(err.Error(), "partitionAddress") {
+				t.Errorf("Expected a partitionAddress error for %q without a token, got %v", tt.address, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q with token %q: %v", tt.address, tt.token, err)
+			continue
+		}
+		handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+	}
+}
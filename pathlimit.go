@@ -0,0 +1,78 @@
+package bandwidthlimiter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PathLimit limits requests whose path matches Path. Paths starting with "^"
+// are regular expressions, all others are prefixes.
+type PathLimit struct {
+	Path  string `json:"path"`
+	Limit Size   `json:"limit"`
+}
+
+// limitClassPath is reported for requests limited by a PathLimits rule
+const limitClassPath = "path"
+
+// pathLimit is a compiled entry of Config.PathLimits
+type pathLimit struct {
+	path   string
+	prefix string         // Set for prefix rules
+	regex  *regexp.Regexp // Set for regular expression rules
+	limit  int64
+}
+
+// matches reports whether the rule applies to a request path
+func (rule *pathLimit) matches(path string) bool {
+	if rule.regex != nil {
+		return rule.regex.MatchString(path)
+	}
+	return strings.HasPrefix(path, rule.prefix)
+}
+
+// compilePathLimits parses the limits and compiles the matchers of PathLimits, keeping their order
+func compilePathLimits(limits []PathLimit) ([]pathLimit, error) {
+	compiled := make([]pathLimit, 0, len(limits))
+	for i, rule := range limits {
+		if rule.Path == "" {
+			return nil, wrapf(ErrInvalidLimit, "pathLimits[%d].path must be set", i)
+		}
+		
+		limit, err := parseSize(rule.Limit)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "pathLimits[%d].limit: %v", i, err)
+		}
+		if limit <= 0 && limit != Unlimited {
+			return nil, wrapf(ErrInvalidLimit, "pathLimits[%d].limit must be greater than 0, or -1 or \"unlimited\"", i)
+		}
+		
+		entry := pathLimit{path: rule.Path, limit: limit}
+		if strings.HasPrefix(rule.Path, "^") {
+			if entry.regex, err = regexp.Compile(rule.Path); err != nil {
+				return nil, wrapf(ErrInvalidLimit, "pathLimits[%d].path: %v", i, err)
+			}
+		} else {
+			entry.prefix = rule.Path
+		}
+		compiled = append(compiled, entry)
+	}
+	return compiled, nil
+}
+
+// matchPathLimit returns the index of the first PathLimits rule matching path, or -1
+func (bl *BandwidthLimiter) matchPathLimit(path string) int {
+	for i := range bl.parsed.pathLimits {
+		if bl.parsed.pathLimits[i].matches(path) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pathKey marks a bucket key as limited by the PathLimits rule at index,
+// kept apart from the client's other buckets since its limit differs
+func pathKey(key *keyBuilder, index int) {
+	key.add("~", strconv.Itoa(index))
+}
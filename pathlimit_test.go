@@ -0,0 +1,87 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestPathLimits tests that path rules apply in order and between client and backend rules
+func TestPathLimits(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.PathLimits = []bandwidthlimiter.PathLimit{
+		{Path: "^/downloads/.*\\.iso$", Limit: "500KB/s"},
+		{Path: "/api/", Limit: "5MB/s"},
+		{Path: "^/api/v1/", Limit: "1KB"}, // Shadowed by the prefix rule above
+		{Path: "/health", Limit: "unlimited"},
+	}
+	cfg.BackendLimits["backend.local"] = "2MB"
+	cfg.ClientLimits["10.0.0.9"] = "8MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	decide := func(ip, path string) bandwidthlimiter.Decision {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local"+path, nil)
+		req.RemoteAddr = ip + ":1000"
+		return bl.Decide(req)
+	}
+
+	tests := []struct {
+		ip, path string
+		limit    int64
+		class    string
+	}{
+		{"10.0.0.1", "/downloads/ubuntu.iso", 500 * 1024, "path"},
+		{"10.0.0.1", "/downloads/readme.txt", 2 * 1024 * 1024, "backend"},
+		{"10.0.0.1", "/api/v1/users", 5 * 1024 * 1024, "path"},
+		{"10.0.0.1", "/health", bandwidthlimiter.Unlimited, "path"},
+		{"10.0.0.9", "/downloads/ubuntu.iso", 8 * 1024 * 1024, "client"},
+	}
+	for _, tt := range tests {
+		decision := decide(tt.ip, tt.path)
+		if decision.Policy.Limit != tt.limit || decision.Policy.Class != tt.class {
+			t.Errorf("%s %s: expected %d from %s, got %d from %s", tt.ip, tt.path, tt.limit, tt.class, decision.Policy.Limit, decision.Policy.Class)
+		}
+	}
+
+	// Path rules get buckets of their own
+	decision := decide("10.0.0.1", "/api/v1/users")
+	if decision.Key != "10.0.0.1:backend.local~1" || decision.PathLimit != "/api/" {
+		t.Errorf("Expected the bucket of the /api/ rule, got key %q for %q", decision.Key, decision.PathLimit)
+	}
+	if decision := decide("10.0.0.1", "/"); decision.Key != "10.0.0.1:backend.local" {
+		t.Errorf("Expected the client's usual bucket without a path rule, got %q", decision.Key)
+	}
+}
+
+// TestPathLimitsErrors tests that invalid path rules are rejected at startup
+func TestPathLimitsErrors(t *testing.T) {
+	tests := []struct {
+		rule  bandwidthlimiter.PathLimit
+		field string
+	}{
+		{bandwidthlimiter.PathLimit{Path: "^/downloads/(", Limit: "1MB"}, "pathLimits[0].path"},
+		{bandwidthlimiter.PathLimit{Path: "/api/", Limit: "fast"}, "pathLimits[0].limit"},
+		{bandwidthlimiter.PathLimit{Path: "/api/", Limit: "0"}, "pathLimits[0].limit"},
+		{bandwidthlimiter.PathLimit{Limit: "1MB"}, "pathLimits[0].path"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.PathLimits = []bandwidthlimiter.PathLimit{tt.rule}
+		_, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err == nil || !strings.HasPrefix(err.Error(), tt.field) {
+			t.Errorf("%+v: expected an error naming %s, got %v", tt.rule, tt.field, err)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package bandwidthlimiter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// cleanupRoutine periodically removes unused buckets
+func (bl *BandwidthLimiter) cleanupRoutine() {
+	defer bl.wg.Done()
+	
+	for {
+		select {
+		case <-bl.cleanupTicker.C:
+			bl.doCleanup()
+		case <-bl.shutdownChan:
+			return
+		}
+	}
+}
+
+// doCleanup removes buckets that haven't been used recently
+func (bl *BandwidthLimiter) doCleanup() CleanupStats {
+	now := time.Now()
+	maxAge := bl.parsed.bucketMaxAge
+	
+	// Quota buckets are kept until their minute has passed plus the grace,
+	// and never for less time than ordinary buckets
+	quotaCutoff := now.Add(-time.Minute - bl.parsed.quotaGrace)
+	if quotaCutoff.After(now.Add(-maxAge)) {
+		quotaCutoff = now.Add(-maxAge)
+	}
+	
+	// Remove old buckets
+	removed, afterCount := bl.buckets.EvictIdle(now.Add(-maxAge), quotaCutoff)
+	
+	if bl.config.VideoAware {
+		bl.evictVideoSessions(now.Add(-maxAge))
+	}
+	
+	if bl.ring != nil {
+		bl.evictRemoteBuckets(now.Add(-maxAge))
+	}
+	
+	if bl.redis != nil {
+		bl.evictRedisBuckets(now.Add(-maxAge))
+	}
+	
+	stats := CleanupStats{Start: now, Duration: time.Since(now), Removed: removed, Kept: afterCount}
+	bl.reportCleanup(stats)
+	return stats
+}
+
+// saveRoutine periodically saves buckets to file
+func (bl *BandwidthLimiter) saveRoutine() {
+	defer bl.wg.Done()
+	
+	for {
+		select {
+		case <-bl.saveTicker.C:
+			// Report a failing save once rather than every interval
+			err := bl.saveBuckets()
+			if err != nil && !bl.saveFailing {
+				bl.log.errorf("Error saving buckets: %v (further errors are suppressed until a save succeeds)", err)
+				bl.saveFailing = true
+			} else if err == nil && bl.saveFailing {
+				bl.log.infof("Saving buckets to %s succeeded again", bl.config.PersistenceFile)
+				bl.saveFailing = false
+			}
+		case <-bl.shutdownChan:
+			// Save one final time on shutdown
+			if err := bl.saveBuckets(); err != nil {
+				bl.log.errorf("Error saving buckets on shutdown: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// checkPersistenceWritable makes sure the persistence file can be saved. If it
+// can't, saving moves to PersistenceFallbackFile, or stops with a single warning
+// and buckets live in memory only.
+func (bl *BandwidthLimiter) checkPersistenceWritable() {
+	if bl.config.PersistenceFile == "" || bl.config.PersistenceReadOnly {
+		return
+	}
+	
+	err := probeWritable(bl.config.PersistenceFile)
+	if err == nil {
+		return
+	}
+	
+	if fallback := bl.config.PersistenceFallbackFile; fallback != "" {
+		fallbackErr := probeWritable(fallback)
+		if fallbackErr == nil {
+			bl.log.warnf("Persistence file %s is not writable (%v), saving to %s instead",
+				bl.config.PersistenceFile, err, fallback)
+			bl.seedFile = bl.config.PersistenceFile
+			bl.config.PersistenceFile = fallback
+			return
+		}
+		err = fmt.Errorf("%v; fallback %s: %v", err, fallback, fallbackErr)
+	}
+	
+	bl.log.warnf("Persistence file %s is not writable (%v), buckets will be kept in memory only",
+		bl.config.PersistenceFile, err)
+	bl.config.PersistenceReadOnly = true
+}
+
+// probeWritable checks that files can be created next to path
+func probeWritable(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	
+	probe, err := os.CreateTemp(dir, ".bwl-probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// staleDiff describes how a restored bucket differs from the limits the current
+// configuration would give its key, or returns "" if it still matches
+func (bl *BandwidthLimiter) staleDiff(state limiter.State) string {
+	policy, ok := bl.expectedPolicy(state.Key)
+	if !ok {
+		return fmt.Sprintf("%s: no matching rule", state.Key)
+	}
+	
+	// Buckets take on changing limits on their next use, see dynamicLimits
+	var changes []string
+	if state.Limit != policy.Limit && !bl.dynamicLimits() {
+		changes = append(changes, fmt.Sprintf("limit %d -> %d", state.Limit, policy.Limit))
+	}
+	if state.BurstSize != policy.Burst {
+		changes = append(changes, fmt.Sprintf("burst %d -> %d", state.BurstSize, policy.Burst))
+	}
+	var minuteLimit int64
+	if state.Window != nil {
+		minuteLimit = state.Window.BurstSize
+	}
+	if minuteLimit != policy.MinuteLimit {
+		changes = append(changes, fmt.Sprintf("minute limit %d -> %d", minuteLimit, policy.MinuteLimit))
+	}
+	
+	if len(changes) == 0 {
+		return ""
+	}
+	return state.Key + ": " + strings.Join(changes, ", ")
+}
+
+// expectedPolicy works out which limits the current configuration gives a
+// bucket key. It reports false if no rule would create the key any more.
+func (bl *BandwidthLimiter) expectedPolicy(key string) (limiter.Policy, bool) {
+	tier := ""
+	if i := strings.Index(key, "$"); i >= 0 {
+		key, tier = key[:i], key[i+1:]
+	}
+	reputation := ""
+	if i := strings.LastIndex(key, "!"); i >= 0 {
+		key, reputation = key[:i], key[i+1:]
+	}
+	anonymous := strings.HasSuffix(key, "#anon")
+	key = strings.TrimSuffix(key, "#anon")
+	entryPoint := ""
+	if i := strings.LastIndex(key, "@"); i >= 0 {
+		key, entryPoint = key[:i], key[i+1:]
+	}
+	pathRule := -1
+	if i := strings.LastIndex(key, "~"); i >= 0 {
+		index, err := strconv.Atoi(key[i+1:])
+		if err != nil || index >= len(bl.parsed.pathLimits) {
+			return limiter.Policy{}, false
+		}
+		key, pathRule = key[:i], index
+	}
+	dir := directionDownload
+	if i := strings.Index(key, "|"); i >= 0 {
+		dir = direction(key[i+1:])
+		key = key[:i]
+	}
+	
+	if key == overflowKey {
+		return limiter.Policy{
+			Limit: bl.parsed.defaultLimit,
+			Burst: bl.parsed.burstSize,
+		}, bl.config.MaxNewKeysPerMinute > 0
+	}
+	
+	if key == globalKey {
+		return bl.globalPolicy(), bl.parsed.globalLimit > 0
+	}
+	
+	if backend := strings.TrimPrefix(key, "*:"); backend != key {
+		aggregateLimit, exists := bl.parsed.backendAggregateLimits[backend]
+		return bl.aggregatePolicy(aggregateLimit), exists
+	}
+	
+	clientIP, backend := key, ""
+	if bl.config.BucketScope != scopeClient {
+		clientIP, backend = splitBucketKey(key)
+	}
+	clientIP = bl.clientForID(clientIP)
+	policy := bl.resolvePolicy(clientIP, backend)
+	
+	// Reputation, tier and path rules are known to match from the key's
+	// suffixes, and must still be the ones supplying the limit
+	rule, matched := bl.pickRule(func(class string) (ruleMatch, bool) {
+		switch class {
+		case limitClassReputation:
+			limit, exists := bl.parsed.reputationLimits[reputation]
+			return ruleMatch{class: class, limit: limit, reputation: reputation}, exists && reputation != ""
+		case limitClassTier:
+			limit, exists := bl.parsed.tierLimits[tier]
+			return ruleMatch{class: class, limit: limit, tier: tier}, exists && tier != "" && bl.config.TierClaim != ""
+		case limitClassPath:
+			if pathRule < 0 {
+				return ruleMatch{}, false
+			}
+			return ruleMatch{class: class, limit: bl.parsed.pathLimits[pathRule].limit, pathRule: pathRule}, true
+		}
+		return bl.matchRule(class, nil, clientIP, clientIP, backend)
+	})
+	if !matched {
+		rule = ruleMatch{class: limitClassDefault, limit: bl.parsed.defaultLimit}
+	}
+	if (tier != "" && rule.class != limitClassTier) || (reputation != "" && rule.class != limitClassReputation) || (pathRule >= 0 && rule.class != limitClassPath) {
+		return policy, false
+	}
+	policy.Limit, policy.Class = rule.limit, rule.class
+	if entryPoint != "" {
+		profile, exists := bl.parsed.entryPointProfiles[entryPoint]
+		if !exists || policy.Class != limitClassDefault {
+			return policy, false
+		}
+		policy.Limit, policy.Burst = profile.limit, profile.burst
+	}
+	if policy.Limit == Unlimited {
+		return policy, false
+	}
+	
+	if anonymous {
+		if bl.config.AuthDetection == "" || policy.Class != limitClassDefault {
+			return policy, false
+		}
+		if bl.parsed.anonymousLimit > 0 {
+			policy.Limit = bl.parsed.anonymousLimit
+		}
+		if bl.parsed.anonymousBurstSize > 0 {
+			policy.Burst = bl.parsed.anonymousBurstSize
+		}
+	}
+	
+	switch dir {
+	case directionUpload:
+		policy = bl.uploadPolicyFor(clientIP, backend, policy)
+		return policy, bl.config.LimitUploads && policy.Limit != Unlimited
+	case directionRequests:
+		return bl.requestPolicy(policy), bl.config.RequestLimit > 0
+	}
+	return policy, true
+}
+
+// splitBucketKey splits a "client:backend" key. IPv6 clients contain colons
+// themselves, so the longest prefix that parses as an IP is the client.
+func splitBucketKey(key string) (string, string) {
+	for i := len(key) - 1; i > 0; i-- {
+		if key[i] == ':' && net.ParseIP(key[:i]) != nil {
+			return key[:i], key[i+1:]
+		}
+	}
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+// reportStale logs a summary of restored buckets that no longer match the configuration
+func (bl *BandwidthLimiter) reportStale(stale []string, total int) {
+	if len(stale) == 0 {
+		return
+	}
+	
+	action := "kept until they are cleaned up; set persistenceDropStale to drop them"
+	if bl.config.PersistenceDropStale {
+		action = "dropped"
+	}
+	
+	// A large refactor can invalidate every bucket, a sample is enough to see why
+	const maxReported = 10
+	sample := stale
+	if len(sample) > maxReported {
+		sample = append(sample[:maxReported:maxReported], fmt.Sprintf("... and %d more", len(stale)-maxReported))
+	}
+	bl.log.warnf("%d of %d buckets in %s no longer match the configuration (%s):\n  %s",
+		len(stale), total, bl.config.PersistenceFile, action, strings.Join(sample, "\n  "))
+}
+
+// Save saves all current buckets to PersistenceFile right away, like POST
+// /save on the admin listener. It does nothing if persistence is disabled or
+// read-only. Errors wrap ErrStoreUnavailable.
+func (bl *BandwidthLimiter) Save() error {
+	return bl.saveBuckets()
+}
+
+// saveBuckets saves all current buckets to the configured file, counting
+// failed saves
+func (bl *BandwidthLimiter) saveBuckets() error {
+	err := bl.writeBuckets()
+	if err != nil {
+		atomic.AddInt64(&bl.metrics.persistenceErrors, 1)
+		return wrapf(ErrStoreUnavailable, "%w", err)
+	}
+	return nil
+}
+
+// writeBuckets writes all current buckets to the configured file
+func (bl *BandwidthLimiter) writeBuckets() error {
+	if bl.config.PersistenceFile == "" {
+		return nil // Persistence disabled
+	}
+	
+	if bl.config.PersistenceReadOnly {
+		return nil // State is only loaded, never written
+	}
+	
+	// Make sure no other live instance is writing the same file
+	if bl.usesPersistenceLock() {
+		err := bl.checkPersistenceLock()
+		if err == errPersistenceReplaced {
+			// The replacing instance saves the buckets from now on
+			if atomic.CompareAndSwapInt32(&bl.lockTakenOver, 0, 1) {
+				bl.log.infof("Persistence file %s was taken over by the instance replacing this one, no longer saving", bl.config.PersistenceFile)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	
+	// Saves triggered through the admin listener may overlap the save routine
+	bl.saveMutex.Lock()
+	defer bl.saveMutex.Unlock()
+	
+	// Collect all bucket states
+	states := bl.buckets.Snapshot()
+	
+	if err := limiter.WriteSnapshot(bl.config.PersistenceFile, states); err != nil {
+		return err
+	}
+	
+	// Refresh our ownership heartbeat
+	if bl.usesPersistenceLock() {
+		if err := bl.writePersistenceLock(); err != nil {
+			bl.log.warnf("Failed to refresh persistence lock: %v", err)
+		}
+	}
+	
+	bl.log.debugf("Saved %d buckets to %s", len(states), bl.config.PersistenceFile)
+	return nil
+}
+
+// loadBuckets loads saved buckets from the configured file
+func (bl *BandwidthLimiter) loadBuckets() error {
+	if bl.config.PersistenceFile == "" {
+		return nil // Persistence disabled
+	}
+	
+	source := bl.config.PersistenceFile
+	states, err := limiter.ReadSnapshot(source)
+	if err != nil {
+		return err
+	}
+	
+	// Until the fallback file has been written, start from the original state
+	if states == nil && bl.seedFile != "" {
+		source = bl.seedFile
+		if states, err = limiter.ReadSnapshot(source); err != nil {
+			return err
+		}
+	}
+	
+	// Restore buckets, reporting any left over from an older configuration
+	loaded := 0
+	var stale []string
+	for _, state := range states {
+		if diff := bl.staleDiff(state); diff != "" {
+			stale = append(stale, diff)
+			if bl.config.PersistenceDropStale {
+				continue
+			}
+		}
+		bl.buckets.Store(limiter.RestoreEntry(state))
+		loaded++
+	}
+	bl.reportStale(stale, len(states))
+	
+	if bl.config.PersistenceReadOnly {
+		bl.log.infof("Loaded %d buckets from %s (read-only, state will not be saved)", loaded, source)
+	} else {
+		bl.log.infof("Loaded %d buckets from %s", loaded, source)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// profileBase names the base rules, the configured ones and RulesFile, in
+// ActiveProfile, ProfileSchedules and SetProfile
+const profileBase = "base"
+
+// How often ProfileSchedules are checked for a window opening or closing
+const profileCheckInterval = time.Second
+
+// LimitProfile is a named set of limit rules layered over the profile it
+// inherits, e.g. an "incident" profile capping a few clients on top of
+// "peak-hours". Entries of its limit maps are merged into the inherited ones,
+// while its defaultLimit, pathLimits and limitSchedules replace them.
+type LimitProfile struct {
+	// Profile whose rules this one builds on
+	// If empty, the base rules
+	Inherits string `json:"inherits,omitempty"`
+	
+	DefaultLimit     Size            `json:"defaultLimit,omitempty"`
+	ClientLimits     map[string]Size `json:"clientLimits,omitempty"`
+	BackendLimits    map[string]Size `json:"backendLimits,omitempty"`
+	PathLimits       []PathLimit     `json:"pathLimits,omitempty"`
+	TierLimits       map[string]Size `json:"tierLimits,omitempty"`
+	ReputationLimits map[string]Size `json:"reputationLimits,omitempty"`
+	CountryLimits    map[string]Size `json:"countryLimits,omitempty"`
+	ContinentLimits  map[string]Size `json:"continentLimits,omitempty"`
+	KeyLimits        map[string]Size `json:"keyLimits,omitempty"`
+	ServiceLimits    map[string]Size `json:"serviceLimits,omitempty"`
+	LimitSchedules   []LimitSchedule `json:"limitSchedules,omitempty"`
+}
+
+// replace sets the rules of config the profile sets, replacing limit maps as
+// a whole. RulesFile is applied this way.
+func (p *LimitProfile) replace(config *Config) {
+	if p.DefaultLimit != "" {
+		config.DefaultLimit = p.DefaultLimit
+	}
+	if p.ClientLimits != nil {
+		config.ClientLimits = p.ClientLimits
+	}
+	if p.BackendLimits != nil {
+		config.BackendLimits = p.BackendLimits
+	}
+	if p.PathLimits != nil {
+		config.PathLimits = p.PathLimits
+	}
+	if p.TierLimits != nil {
+		config.TierLimits = p.TierLimits
+	}
+	if p.ReputationLimits != nil {
+		config.ReputationLimits = p.ReputationLimits
+	}
+	if p.CountryLimits != nil {
+		config.CountryLimits = p.CountryLimits
+	}
+	if p.ContinentLimits != nil {
+		config.ContinentLimits = p.ContinentLimits
+	}
+	if p.KeyLimits != nil {
+		config.KeyLimits = p.KeyLimits
+	}
+	if p.ServiceLimits != nil {
+		config.ServiceLimits = p.ServiceLimits
+	}
+	if p.LimitSchedules != nil {
+		config.LimitSchedules = p.LimitSchedules
+	}
+}
+
+// merge layers the profile over the rules of config, merging limit maps
+func (p *LimitProfile) merge(config *Config) {
+	if p.DefaultLimit != "" {
+		config.DefaultLimit = p.DefaultLimit
+	}
+	config.ClientLimits = mergeSizes(config.ClientLimits, p.ClientLimits)
+	config.BackendLimits = mergeSizes(config.BackendLimits, p.BackendLimits)
+	if p.PathLimits != nil {
+		config.PathLimits = p.PathLimits
+	}
+	config.TierLimits = mergeSizes(config.TierLimits, p.TierLimits)
+	config.ReputationLimits = mergeSizes(config.ReputationLimits, p.ReputationLimits)
+	config.CountryLimits = mergeSizes(config.CountryLimits, p.CountryLimits)
+	config.ContinentLimits = mergeSizes(config.ContinentLimits, p.ContinentLimits)
+	config.KeyLimits = mergeSizes(config.KeyLimits, p.KeyLimits)
+	config.ServiceLimits = mergeSizes(config.ServiceLimits, p.ServiceLimits)
+	if p.LimitSchedules != nil {
+		config.LimitSchedules = p.LimitSchedules
+	}
+}
+
+// mergeSizes returns the entries of base overridden by those of overlay,
+// without modifying either
+func mergeSizes(base, overlay map[string]Size) map[string]Size {
+	if len(overlay) == 0 {
+		return base
+	}
+	merged := make(map[string]Size, len(base)+len(overlay))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		merged[key] = value
+	}
+	return merged
+}
+
+// ProfileSchedule selects a limit profile during a recurring window
+type ProfileSchedule struct {
+	// Profile in effect during the window, or "base" for the base rules
+	Profile string `json:"profile"`
+	
+	// Days and hours of the window, like those of LimitSchedule
+	Days  string `json:"days,omitempty"`
+	Hours string `json:"hours,omitempty"`
+}
+
+// profileSchedule is a compiled entry of Config.ProfileSchedules
+type profileSchedule struct {
+	profile string // "" for the base rules
+	window  scheduleWindow
+}
+
+// compileProfileSchedules parses ProfileSchedules, keeping their order
+func compileProfileSchedules(config *Config) ([]profileSchedule, error) {
+	compiled := make([]profileSchedule, 0, len(config.ProfileSchedules))
+	for i, schedule := range config.ProfileSchedules {
+		field := fmt.Sprintf("profileSchedules[%d]", i)
+		profile, err := profileName(config, schedule.Profile)
+		if err != nil || profile == "" && schedule.Profile != profileBase {
+			return nil, wrapf(ErrInvalidLimit, "%s.profile: unknown limit profile %q", field, schedule.Profile)
+		}
+		entry := profileSchedule{profile: profile}
+		if entry.window, err = compileWindow(field, schedule.Days, schedule.Hours); err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, entry)
+	}
+	return compiled, nil
+}
+
+// profileName checks that name is a configured profile, returning "" for the
+// base rules
+func profileName(config *Config, name string) (string, error) {
+	if name == "" || name == profileBase {
+		return "", nil
+	}
+	if _, ok := config.LimitProfiles[name]; !ok {
+		return "", wrapf(ErrInvalidLimit, "unknown limit profile %q", name)
+	}
+	return name, nil
+}
+
+// profileChain returns the profiles name inherits from, the base-most first,
+// followed by the profile itself
+func profileChain(config *Config, name string) ([]LimitProfile, error) {
+	var chain []LimitProfile
+	seen := make(map[string]bool)
+	for name != "" && name != profileBase {
+		if seen[name] {
+			return nil, wrapf(ErrInvalidLimit, "limit profile %q inherits from itself", name)
+		}
+		seen[name] = true
+		
+		profile, ok := config.LimitProfiles[name]
+		if !ok {
+			return nil, wrapf(ErrInvalidLimit, "unknown limit profile %q", name)
+		}
+		chain = append([]LimitProfile{profile}, chain...)
+		name = profile.Inherits
+	}
+	return chain, nil
+}
+
+// validateProfiles makes sure every LimitProfiles entry builds valid rules
+func (bl *BandwidthLimiter) validateProfiles() error {
+	if _, ok := bl.config.LimitProfiles[profileBase]; ok {
+		return wrapf(ErrInvalidLimit, "limitProfiles: %q names the base rules and can't be a profile", profileBase)
+	}
+	names := make([]string, 0, len(bl.config.LimitProfiles))
+	for name := range bl.config.LimitProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	
+	for _, name := range names {
+		if _, err := bl.buildRules(nil, name); err != nil {
+			return fmt.Errorf("limitProfiles.%s: %w", name, err)
+		}
+	}
+	if _, err := profileName(bl.config, bl.config.ActiveProfile); err != nil {
+		return wrapf(ErrInvalidLimit, "activeProfile: %v", err)
+	}
+	return nil
+}
+
+// wantedProfile returns the profile that should be in effect at now: the one
+// selected with SetProfile, or that of the first open ProfileSchedules
+// window, or ActiveProfile. The layers' mutex must be held.
+func (bl *BandwidthLimiter) wantedProfile(now time.Time) string {
+	if bl.layers.selected != "" {
+		name, _ := profileName(bl.config, bl.layers.selected)
+		return name
+	}
+	local := now.In(bl.parsed.scheduleLocation)
+	for i := range bl.parsed.profileSchedules {
+		if schedule := &bl.parsed.profileSchedules[i]; schedule.window.active(local) {
+			return schedule.profile
+		}
+	}
+	name, _ := profileName(bl.config, bl.config.ActiveProfile)
+	return name
+}
+
+// updateProfile switches the rules to the wanted profile if another one is in effect
+func (bl *BandwidthLimiter) updateProfile() error {
+	bl.layers.mutex.Lock()
+	defer bl.layers.mutex.Unlock()
+	
+	wanted := bl.wantedProfile(time.Now())
+	if wanted == bl.layers.profile {
+		return nil
+	}
+	parsed, err := bl.buildRules(bl.layers.file, wanted)
+	if err != nil {
+		return err
+	}
+	bl.swapRules(parsed)
+	bl.layers.profile = wanted
+	
+	if wanted == "" {
+		bl.log.infof("Base limit rules in effect")
+	} else {
+		bl.log.infof("Limit profile %q in effect", wanted)
+	}
+	return nil
+}
+
+// SetProfile puts a limit profile in effect until it is cleared with an empty
+// name, or the instance restarts, regardless of ProfileSchedules and
+// ActiveProfile. "base" selects the base rules.
+func (bl *BandwidthLimiter) SetProfile(name string) error {
+	if _, err := profileName(bl.config, name); err != nil {
+		return err
+	}
+	bl.layers.mutex.Lock()
+	bl.layers.selected = name
+	bl.layers.mutex.Unlock()
+	return bl.updateProfile()
+}
+
+// Profile returns the limit profile in effect, "base" for the base rules
+func (bl *BandwidthLimiter) Profile() string {
+	bl.layers.mutex.Lock()
+	defer bl.layers.mutex.Unlock()
+	
+	if bl.layers.profile == "" {
+		return profileBase
+	}
+	return bl.layers.profile
+}
+
+// startProfiles keeps switching profiles as ProfileSchedules windows open and close
+func (bl *BandwidthLimiter) startProfiles() {
+	bl.profileTicker = time.NewTicker(profileCheckInterval)
+	bl.wg.Add(1)
+	go bl.profileRoutine()
+}
+
+// profileRoutine checks ProfileSchedules every profileCheckInterval
+func (bl *BandwidthLimiter) profileRoutine() {
+	defer bl.wg.Done()
+	
+	for {
+		select {
+		case <-bl.profileTicker.C:
+			if err := bl.updateProfile(); err != nil {
+				bl.log.errorf("Error switching limit profile, keeping the current rules: %v", err)
+			}
+		case <-bl.shutdownChan:
+			return
+		}
+	}
+}
+
+// profileStatus is the response of the /profile admin endpoint
+type profileStatus struct {
+	Active   string   `json:"active"`
+	Selected string   `json:"selected,omitempty"`
+	Profiles []string `json:"profiles"`
+}
+
+// handleProfile serves GET /profile, PUT /profile?name=<profile>, which puts
+// a profile in effect, and DELETE /profile, which returns to ProfileSchedules
+// and ActiveProfile
+func (bl *BandwidthLimiter) handleProfile(rw http.ResponseWriter, req *http.Request) {
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		name := req.URL.Query().Get("name")
+		if name == "" {
+			err = fmt.Errorf("name must not be empty")
+		} else {
+			err = bl.SetProfile(name)
+		}
+	case http.MethodDelete:
+		err = bl.SetProfile("")
+	default:
+		rw.Header().Set("Allow", http.MethodGet+", "+http.MethodPut+", "+http.MethodDelete)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	status := profileStatus{Active: bl.Profile(), Profiles: []string{}}
+	bl.layers.mutex.Lock()
+	status.Selected = bl.layers.selected
+	bl.layers.mutex.Unlock()
+	for name := range bl.config.LimitProfiles {
+		status.Profiles = append(status.Profiles, name)
+	}
+	sort.Strings(status.Profiles)
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(status)
+}
+
+// ruleLayers are what the limit rules in parsed are built from, on top of
+// the middleware configuration
+type ruleLayers struct {
+	mutex    sync.Mutex    // Serializes rebuilds of the rules
+	file     *LimitProfile // Last valid RulesFile content, nil before one was loaded
+	profile  string        // Profile the rules were built with, "" for the base rules
+	selected string        // Profile selected with SetProfile, "" if none
+}
@@ -0,0 +1,194 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// newProfileLimiter returns a limiter at 1MB/s, 500KB/s for 10.0.0.2, with a
+// "peak-hours" profile and an "incident" profile inheriting from it
+func newProfileLimiter(t *testing.T, cfg *bandwidthlimiter.Config) *bandwidthlimiter.BandwidthLimiter {
+	cfg.DefaultLimit = "1MB"
+	cfg.ClientLimits["10.0.0.2"] = "500KB"
+	cfg.LimitProfiles["peak-hours"] = bandwidthlimiter.LimitProfile{
+		DefaultLimit: "512KB",
+		ClientLimits: map[string]bandwidthlimiter.Size{"10.0.0.3": "100KB"},
+	}
+	cfg.LimitProfiles["incident"] = bandwidthlimiter.LimitProfile{
+		Inherits:     "peak-hours",
+		ClientLimits: map[string]bandwidthlimiter.Size{"10.0.0.2": "50KB"},
+	}
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	t.Cleanup(bl.Shutdown)
+	return bl
+}
+
+// TestLimitProfiles tests that profiles merge their rules into the ones they
+// inherit and can be switched at runtime
+func TestLimitProfiles(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ActiveProfile = "incident"
+	bl := newProfileLimiter(t, cfg)
+
+	tests := []struct {
+		ip    string
+		limit int64
+	}{
+		{"10.0.0.1", 512 * 1024},
+		{"10.0.0.2", 50 * 1024},
+		{"10.0.0.3", 100 * 1024},
+	}
+	for _, tt := range tests {
+		if decision := decideFor(bl, tt.ip); decision.Policy.Limit != tt.limit || decision.Profile != "incident" {
+			t.Errorf("%s: expected %d from the incident profile, got %+v", tt.ip, tt.limit, decision)
+		}
+	}
+	if len(cfg.ClientLimits) != 1 {
+		t.Errorf("Expected the configured rules to be left alone, got %v", cfg.ClientLimits)
+	}
+
+	if err := bl.SetProfile("base"); err != nil {
+		t.Fatal(err)
+	}
+	if decision := decideFor(bl, "10.0.0.2"); decision.Policy.Limit != 500*1024 || decision.Profile != "" || bl.Profile() != "base" {
+		t.Errorf("Expected the base rules, got %+v", decision)
+	}
+	if err := bl.SetProfile("unknown"); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+
+	// Clearing the selection returns to ActiveProfile
+	if err := bl.SetProfile(""); err != nil {
+		t.Fatal(err)
+	}
+	if bl.Profile() != "incident" {
+		t.Errorf("Expected the active profile again, got %q", bl.Profile())
+	}
+}
+
+// TestProfileRulesFile tests that profiles build on the rules of RulesFile
+func TestProfileRulesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, `{"defaultLimit": "2MB"}`, 0)
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.RulesFile = path
+	cfg.RulesReloadInterval = "20ms"
+	bl := newProfileLimiter(t, cfg)
+
+	if err := bl.SetProfile("incident"); err != nil {
+		t.Fatal(err)
+	}
+	if limit := decideFor(bl, "10.0.0.1").Policy.Limit; limit != 512*1024 {
+		t.Errorf("Expected the profile's default limit, got %d", limit)
+	}
+
+	writeRules(t, path, `{"defaultLimit": "2MB", "clientLimits": {"10.0.0.4": "10KB"}}`, 1)
+	waitForLimit(t, bl, "10.0.0.4", 10*1024)
+	if decision := decideFor(bl, "10.0.0.2"); decision.Policy.Limit != 50*1024 || decision.Profile != "incident" {
+		t.Errorf("Expected the profile to stay in effect after the reload, got %+v", decision)
+	}
+
+	if err := bl.SetProfile("base"); err != nil {
+		t.Fatal(err)
+	}
+	if limit := decideFor(bl, "10.0.0.1").Policy.Limit; limit != 2*1024*1024 {
+		t.Errorf("Expected the file's default limit, got %d", limit)
+	}
+}
+
+// TestProfileSchedules tests that the first open window selects the profile,
+// unless one is selected at runtime
+func TestProfileSchedules(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ProfileSchedules = []bandwidthlimiter.ProfileSchedule{
+		{Profile: "incident", Hours: hoursAround(time.Hour, 2*time.Hour)},
+		{Profile: "peak-hours", Hours: hoursAround(-time.Hour, time.Hour)},
+		{Profile: "incident"},
+	}
+	bl := newProfileLimiter(t, cfg)
+
+	if decision := decideFor(bl, "10.0.0.1"); decision.Policy.Limit != 512*1024 || decision.Profile != "peak-hours" {
+		t.Errorf("Expected the scheduled profile, got %+v", decision)
+	}
+	if err := bl.SetProfile("base"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if profile := bl.Profile(); profile != "base" {
+		t.Errorf("Expected the selected profile to outlast schedule checks, got %q", profile)
+	}
+}
+
+// TestProfileAdmin tests selecting profiles through the admin endpoint
+func TestProfileAdmin(t *testing.T) {
+	bl := newProfileLimiter(t, bandwidthlimiter.CreateConfig())
+	admin := bl.AdminHandler()
+
+	var status struct {
+		Active   string   `json:"active"`
+		Selected string   `json:"selected"`
+		Profiles []string `json:"profiles"`
+	}
+	adminRequest(t, admin, http.MethodGet, "/profile", http.StatusOK, &status)
+	if status.Active != "base" || len(status.Profiles) != 2 || status.Profiles[0] != "incident" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	adminRequest(t, admin, http.MethodPut, "/profile?name=peak-hours", http.StatusOK, &status)
+	if status.Active != "peak-hours" || status.Selected != "peak-hours" {
+		t.Errorf("Expected the selected profile to be in effect, got %+v", status)
+	}
+	if limit := decideFor(bl, "10.0.0.1").Policy.Limit; limit != 512*1024 {
+		t.Errorf("Expected the profile's default limit, got %d", limit)
+	}
+
+	adminRequest(t, admin, http.MethodPut, "/profile?name=unknown", http.StatusBadRequest, nil)
+	adminRequest(t, admin, http.MethodPut, "/profile", http.StatusBadRequest, nil)
+	adminRequest(t, admin, http.MethodPost, "/profile?name=incident", http.StatusMethodNotAllowed, nil)
+
+	status.Selected = ""
+	adminRequest(t, admin, http.MethodDelete, "/profile", http.StatusOK, &status)
+	if status.Active != "base" || status.Selected != "" {
+		t.Errorf("Expected the base rules after clearing the selection, got %+v", status)
+	}
+}
+
+// TestProfileConfig tests that profiles and their selection are validated
+func TestProfileConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		profiles  map[string]bandwidthlimiter.LimitProfile
+		active    string
+		schedules []bandwidthlimiter.ProfileSchedule
+	}{
+		{"reserved name", map[string]bandwidthlimiter.LimitProfile{"base": {DefaultLimit: "1MB"}}, "", nil},
+		{"unknown parent", map[string]bandwidthlimiter.LimitProfile{"a": {Inherits: "b"}}, "", nil},
+		{"cycle", map[string]bandwidthlimiter.LimitProfile{"a": {Inherits: "b"}, "b": {Inherits: "a"}}, "", nil},
+		{"invalid limit", map[string]bandwidthlimiter.LimitProfile{"a": {DefaultLimit: "fast"}}, "", nil},
+		{"key limits without header", map[string]bandwidthlimiter.LimitProfile{"a": {KeyLimits: map[string]bandwidthlimiter.Size{"key": "1MB"}}}, "", nil},
+		{"unknown active profile", nil, "a", nil},
+		{"unknown scheduled profile", nil, "", []bandwidthlimiter.ProfileSchedule{{Profile: "a"}}},
+		{"invalid hours", map[string]bandwidthlimiter.LimitProfile{"a": {}}, "", []bandwidthlimiter.ProfileSchedule{{Profile: "a", Hours: "late"}}},
+	}
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		for name, profile := range tt.profiles {
+			cfg.LimitProfiles[name] = profile
+		}
+		cfg.ActiveProfile = tt.active
+		cfg.ProfileSchedules = tt.schedules
+		if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Purge immediately removes the buckets selected by target, which is either an
+// exact bucket key, a client IP or a CIDR. Buckets in use are reset to their
+// burst instead, see limiter.MemoryStore.DeleteMatching. It returns the number
+// of removed buckets.
+func (bl *BandwidthLimiter) Purge(target string) (int, error) {
+	if target == "" {
+		return 0, wrapf(ErrInvalidLimit, "purge target must not be empty")
+	}
+	match, err := bl.bucketMatcher(target)
+	if err != nil {
+		return 0, err
+	}
+	
+	removed := bl.buckets.DeleteMatching(match)
+	
+	bl.log.infof("Purged %d buckets matching %s", removed, target)
+	return removed, nil
+}
+
+// bucketMatcher returns a function selecting the bucket keys of target, which
+// is either an exact bucket key, a client IP or a CIDR
+func (bl *BandwidthLimiter) bucketMatcher(target string) (func(key string) bool, error) {
+	var network *net.IPNet
+	var clientID string
+	if strings.Contains(target, "/") {
+		if bl.config.ClientIDMode == clientIDHash {
+			return nil, wrapf(ErrInvalidLimit, "cannot select buckets by CIDR when client IPs are hashed")
+		}
+		_, cidr, err := net.ParseCIDR(target)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "invalid CIDR %q: %v", target, err)
+		}
+		network = cidr
+	} else if ip := net.ParseIP(target); ip != nil {
+		if bl.config.ClientIDMode != "" {
+			clientID = bl.clientID(target) // Keys only hold the obfuscated form
+		} else {
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+	}
+	
+	return func(key string) bool {
+		if key == target {
+			return true
+		}
+		if clientID != "" {
+			return keyHasClientID(key, clientID)
+		}
+		if network == nil {
+			return false
+		}
+		ip := keyClientIP(key)
+		return ip != nil && network.Contains(ip)
+	}, nil
+}
+
+// keyClientIP recovers the client IP from a bucket key. Backends may contain
+// colons themselves, so the longest colon-delimited prefix that parses wins.
+func keyClientIP(key string) net.IP {
+	if i := strings.IndexAny(key, "|#"); i >= 0 {
+		key = key[:i]
+	}
+	
+	if ip := net.ParseIP(key); ip != nil {
+		return ip
+	}
+	for i := len(key) - 1; i > 0; i-- {
+		if key[i] == ':' {
+			if ip := net.ParseIP(key[:i]); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+// handlePurge serves POST /buckets/purge?target=<key|ip|cidr>
+func (bl *BandwidthLimiter) handlePurge(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	removed, err := bl.Purge(req.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"removed": removed})
+}
@@ -0,0 +1,58 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestPurge tests removing buckets by CIDR, IP and through the admin API
+func TestPurge(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	for _, remote := range []string{"10.0.0.1:1000", "10.0.0.2:1000", "192.168.1.5:1000", "[2001:db8::1]:1000"} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local:8080/", nil)
+		req.RemoteAddr = remote
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	recorder := httptest.NewRecorder()
+	bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/buckets/purge?target=10.0.0.0/24", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"removed":2`) {
+		t.Errorf("Expected 2 buckets purged by CIDR, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if removed, _ := bl.Purge("2001:db8::1"); removed != 1 {
+		t.Errorf("Expected 1 bucket purged by IPv6 address, got %d", removed)
+	}
+
+	if removed, _ := bl.Purge("192.168.1.5:backend.local:8080"); removed != 1 {
+		t.Errorf("Expected 1 bucket purged by key, got %d", removed)
+	}
+
+	if _, err := bl.Purge("10.0.0.0/99"); err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+
+	recorder = httptest.NewRecorder()
+	bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/buckets/purge?target=10.0.0.1", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d for GET, got %d", http.StatusMethodNotAllowed, recorder.Code)
+	}
+}
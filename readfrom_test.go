@@ -0,0 +1,104 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// readerFromRecorder is a ResponseWriter with a ReadFrom fast path, like the server's
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (rr *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rr.calls++
+	return io.Copy(rr.ResponseRecorder, src)
+}
+
+// plainReader hides the WriterTo of a reader, so io.Copy calls ReadFrom
+type plainReader struct {
+	io.Reader
+}
+
+// TestReadFrom tests that copies into the response take the writer's ReadFrom path in paid-for chunks
+func TestReadFrom(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "8KB"
+	cfg.BurstSize = "8KB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := rw.(io.ReaderFrom); !ok {
+			t.Error("Expected the response writer to be a ReaderFrom")
+		}
+		io.CopyN(rw, plainReader{bytes.NewReader(make([]byte, 16*1024))}, 16*1024)
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats bandwidthlimiter.RequestStats
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(done *bandwidthlimiter.RequestStats) {
+		stats = *done
+	})
+
+	recorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/file", nil))
+	elapsed := time.Since(start)
+
+	// 8KB come from the burst and the other 8KB take a second
+	if recorder.Body.Len() != 16*1024 {
+		t.Errorf("Expected the full body, got %d bytes", recorder.Body.Len())
+	}
+	if elapsed < 700*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the copy to be limited to about 1s, took %v", elapsed)
+	}
+	if recorder.calls != 4 || stats.Chunks != 4 || stats.BytesWritten != 16*1024 {
+		t.Errorf("Expected 4 chunks through ReadFrom, got %d calls and %+v", recorder.calls, stats)
+	}
+}
+
+// TestReadFromRefund tests that tokens paid for a chunk the source couldn't fill are given back
+func TestReadFromRefund(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1KB"
+	cfg.BurstSize = "8KB"
+
+	first := true
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if first {
+			io.Copy(rw, plainReader{bytes.NewReader(make([]byte, 6000))}) // Length unknown to the limiter
+			first = false
+		} else {
+			io.CopyN(rw, plainReader{bytes.NewReader(make([]byte, 2048))}, 2048)
+		}
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() time.Duration {
+		recorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		start := time.Now()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/file", nil))
+		return time.Since(start)
+	}
+
+	// The second chunk of the first copy is paid in full but only 1904 bytes
+	// long, so 2192 tokens are left for the second response
+	if elapsed := serve(); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the burst to cover the first copy, took %v", elapsed)
+	}
+	if elapsed := serve(); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the refunded tokens to cover the second copy, took %v", elapsed)
+	}
+}
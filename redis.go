@@ -0,0 +1,250 @@
+package bandwidthlimiter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// Storage backends
+const (
+	storageMemory = "memory"
+	storageRedis  = "redis"
+)
+
+// redisRetryInterval is how long a Redis bucket waits after a short lease
+// before asking again, bounding round trips for a throttled key
+const redisRetryInterval = 50 * time.Millisecond
+
+// redisDownInterval is how long buckets are kept locally after Redis failed to answer
+const redisDownInterval = 5 * time.Second
+
+// redisTokenScript refills and takes up to ARGV[1] tokens from every bucket in
+// KEYS atomically, and returns how many were granted. Each bucket is a hash of
+// its tokens and last refill in milliseconds of the Redis clock, so instances
+// with skewed clocks agree. ARGV holds a rate, burst and TTL in milliseconds
+// per key.
+const redisTokenScript = `
+redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local granted = tonumber(ARGV[1])
+local levels = {}
+for i, key in ipairs(KEYS) do
+  local rate = tonumber(ARGV[i * 3 - 1])
+  local burst = tonumber(ARGV[i * 3])
+  local state = redis.call('HMGET', key, 'tokens', 'ts')
+  local tokens = tonumber(state[1]) or burst
+  local last = tonumber(state[2]) or now
+  if now > last then
+    tokens = math.min(burst, tokens + (now - last) * rate / 1000)
+  end
+  levels[i] = tokens
+  granted = math.min(granted, math.floor(tokens))
+end
+if granted < 0 then
+  granted = 0
+end
+for i, key in ipairs(KEYS) do
+  redis.call('HSET', key, 'tokens', levels[i] - granted, 'ts', now)
+  redis.call('PEXPIRE', key, ARGV[i * 3 + 1])
+end
+return granted
+`
+
+// redisTokenScriptSHA identifies the script for EVALSHA
+var redisTokenScriptSHA = func() string {
+	sum := sha1.Sum([]byte(redisTokenScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisStore shares buckets between instances through Redis
+type redisStore struct {
+	client *redisClient
+	prefix string
+	log    *logger
+	
+	buckets sync.Map // Per-key *redisBucket
+	
+	mutex     sync.Mutex
+	downUntil time.Time // Limit locally until then, Redis was unreachable
+}
+
+// redisBucket is the local face of a bucket kept in Redis. It leases tokens
+// in batches, like a remoteBucket, so not every chunk costs a round trip.
+type redisBucket struct {
+	bl     *BandwidthLimiter
+	key    string
+	policy limiter.Policy
+	
+	mutex    sync.Mutex
+	leased   int64
+	lastAsk  time.Time
+	lastUsed time.Time
+}
+
+// newRedisStore creates the Redis storage from the configuration
+func newRedisStore(config *Config, timeout time.Duration, log *logger) *redisStore {
+	return &redisStore{
+		client: newRedisClient(config.RedisAddress, config.RedisPassword, config.RedisDB,
+			int(config.RedisPoolSize), timeout),
+		prefix: config.RedisKeyPrefix,
+		log:    log,
+	}
+}
+
+// redisConsumer returns the Redis bucket for key
+func (bl *BandwidthLimiter) redisConsumer(key string, policy limiter.Policy) *redisBucket {
+	value, loaded := bl.redis.buckets.Load(key)
+	if !loaded {
+		value, _ = bl.redis.buckets.LoadOrStore(key, &redisBucket{
+			bl:       bl,
+			key:      key,
+			policy:   policy,
+			lastUsed: time.Now(),
+		})
+	}
+	return value.(*redisBucket)
+}
+
+// Consume takes tokens from the lease, topping it up from Redis when needed.
+// While Redis is unreachable, the local bucket for the key is used instead.
+func (rb *redisBucket) Consume(tokens int64) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	
+	now := time.Now()
+	rb.lastUsed = now
+	if rb.leased >= tokens {
+		rb.leased -= tokens
+		return true
+	}
+	if rb.bl.redis.down(now) {
+		return limiter.ConsumeAll(rb.bl.localConsumers(rb.key, rb.policy), tokens)
+	}
+	if now.Sub(rb.lastAsk) < redisRetryInterval {
+		return false
+	}
+	rb.lastAsk = now
+	
+	want := tokens - rb.leased
+	if want < rb.bl.parsed.redisLease {
+		want = rb.bl.parsed.redisLease
+	}
+	granted, err := rb.bl.redisTake(rb.key, rb.policy, want)
+	if err != nil {
+		rb.bl.redis.markDown(now, err)
+		return limiter.ConsumeAll(rb.bl.localConsumers(rb.key, rb.policy), tokens)
+	}
+	
+	rb.leased += granted
+	if granted >= want {
+		rb.lastAsk = time.Time{} // Full lease, the next top-up may ask right away
+	}
+	if rb.leased >= tokens {
+		rb.leased -= tokens
+		return true
+	}
+	return false
+}
+
+// Refund returns tokens to the lease
+func (rb *redisBucket) Refund(tokens int64) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	
+	rb.leased += tokens
+}
+
+// setLimit changes the rate the bucket refills at in Redis
+func (rb *redisBucket) setLimit(limit int64) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	
+	rb.policy.Limit = limit
+}
+
+// redisTake runs the token script for the bucket of key and, if the policy
+// has a per-minute budget, its window
+func (bl *BandwidthLimiter) redisTake(key string, policy limiter.Policy, want int64) (int64, error) {
+	keys := []string{bl.redis.prefix + key}
+	args := []string{strconv.FormatInt(want, 10)}
+	args = append(args, strconv.FormatInt(policy.Limit, 10), strconv.FormatInt(policy.Burst, 10),
+		strconv.FormatInt(bl.parsed.bucketMaxAge.Milliseconds(), 10))
+	
+	if policy.MinuteLimit > 0 {
+		rate := policy.MinuteLimit / 60
+		if rate < 1 {
+			rate = 1
+		}
+		
+		// Quota records outlive ordinary buckets, as in memory
+		ttl := time.Minute + bl.parsed.quotaGrace
+		if ttl < bl.parsed.bucketMaxAge {
+			ttl = bl.parsed.bucketMaxAge
+		}
+		keys = append(keys, bl.redis.prefix+key+"|window")
+		args = append(args, strconv.FormatInt(rate, 10), strconv.FormatInt(policy.MinuteLimit, 10),
+			strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	
+	command := append([]string{"EVALSHA", redisTokenScriptSHA, strconv.Itoa(len(keys))}, keys...)
+	command = append(command, args...)
+	reply, err := bl.redis.client.Do(command...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		// First use on this server, send the script itself, which also caches it
+		command[0], command[1] = "EVAL", redisTokenScript
+		reply, err = bl.redis.client.Do(command...)
+	}
+	if err != nil {
+		return 0, err
+	}
+	
+	granted, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %v to the token script", reply)
+	}
+	return granted, nil
+}
+
+// down reports whether buckets are currently kept locally
+func (rs *redisStore) down(now time.Time) bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	
+	return now.Before(rs.downUntil)
+}
+
+// markDown switches to local buckets for redisDownInterval. Failures are
+// logged at most once per interval.
+func (rs *redisStore) markDown(now time.Time, err error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	
+	if now.Before(rs.downUntil) {
+		return
+	}
+	rs.log.warnf("Redis unreachable, limiting locally for %v: %v", redisDownInterval, err)
+	rs.downUntil = now.Add(redisDownInterval)
+}
+
+// evictRedisBuckets forgets leases on Redis buckets that haven't been used since cutoff.
+// The buckets themselves expire in Redis by their TTL.
+func (bl *BandwidthLimiter) evictRedisBuckets(cutoff time.Time) {
+	bl.redis.buckets.Range(func(key, value interface{}) bool {
+		rb := value.(*redisBucket)
+		rb.mutex.Lock()
+		idle := rb.lastUsed.Before(cutoff)
+		rb.mutex.Unlock()
+		if idle {
+			bl.redis.buckets.Delete(key)
+		}
+		return true
+	})
+}
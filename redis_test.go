@@ -0,0 +1,233 @@
+package bandwidthlimiter_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// fakeRedis speaks just enough RESP to stand in for Redis, evaluating the
+// token script in Go
+type fakeRedis struct {
+	listener net.Listener
+
+	mutex   sync.Mutex
+	scripts map[string]bool // SHA1s loaded by EVAL
+	evals   int
+	buckets map[string]*fakeBucket
+}
+
+type fakeBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRedis{listener: listener, scripts: make(map[string]bool), buckets: make(map[string]*fakeBucket)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, f.handle(args))
+	}
+}
+
+// readCommand reads a RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) handle(args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "EVALSHA":
+		if !f.scripts[args[1]] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+	case "EVAL":
+		f.scripts[fmt.Sprintf("%x", sha1.Sum([]byte(args[1])))] = true
+	default:
+		return "-ERR unknown command\r\n"
+	}
+	f.evals++
+
+	numKeys, _ := strconv.Atoi(args[2])
+	keys, argv := args[3:3+numKeys], args[3+numKeys:]
+	granted, _ := strconv.ParseFloat(argv[0], 64)
+	now := time.Now()
+	for i, key := range keys {
+		rate, _ := strconv.ParseFloat(argv[1+i*3], 64)
+		burst, _ := strconv.ParseFloat(argv[2+i*3], 64)
+		bucket, exists := f.buckets[key]
+		if !exists {
+			bucket = &fakeBucket{tokens: burst, last: now}
+			f.buckets[key] = bucket
+		}
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+		bucket.last = now
+		granted = math.Min(granted, math.Floor(bucket.tokens))
+	}
+	for _, key := range keys {
+		f.buckets[key].tokens -= granted
+	}
+	return fmt.Sprintf(":%d\r\n", int64(granted))
+}
+
+// TestRedisStorage tests that instances sharing Redis share their buckets
+func TestRedisStorage(t *testing.T) {
+	fake := newFakeRedis(t)
+
+	newInstance := func(name string) http.Handler {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DefaultLimit = "8KB"
+		cfg.BurstSize = "8KB"
+		cfg.Storage = "redis"
+		cfg.RedisAddress = fake.listener.Addr().String()
+		cfg.RedisLease = "4KB"
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write(make([]byte, 8*1024))
+		})
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	first, second := newInstance("instance-1"), newInstance("instance-2")
+
+	serve := func(handler http.Handler) time.Duration {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return time.Since(start)
+	}
+
+	// The first instance uses up the shared burst, so the second has to wait for the refill
+	if elapsed := serve(first); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the burst to cover the first response, took %v", elapsed)
+	}
+	if elapsed := serve(second); elapsed < 700*time.Millisecond {
+		t.Errorf("Expected the second instance to be throttled by the shared bucket, took %v", elapsed)
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, exists := fake.buckets["bwl:10.0.0.1:backend.local"]; !exists {
+		t.Errorf("Expected the bucket to be kept in Redis, got %v", fake.buckets)
+	}
+	if len(fake.scripts) != 1 || fake.evals < 4 {
+		t.Errorf("Expected the script to be loaded once and used for every lease, got %d scripts and %d calls", len(fake.scripts), fake.evals)
+	}
+}
+
+// TestRedisFallback tests that requests are limited locally while Redis is unreachable
+func TestRedisFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "8KB"
+	cfg.BurstSize = "8KB"
+	cfg.Storage = "redis"
+	cfg.RedisAddress = address
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 16*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+	elapsed := time.Since(start)
+
+	if recorder.Body.Len() != 16*1024 {
+		t.Errorf("Expected the full response, got %d bytes", recorder.Body.Len())
+	}
+	if elapsed < 700*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the local bucket to limit the response to about 1s, took %v", elapsed)
+	}
+}
+
+// TestRedisStorageConfig tests that Redis storage rejects partitioning
+func TestRedisStorageConfig(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.Storage = "redis"
+	cfg.PartitionPeers = []string{"10.0.0.1:9190"}
+	cfg.PartitionSelf = "10.0.0.1:9190"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for redis storage with partitionPeers")
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.Storage = "etcd"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an unknown storage")
+	}
+}
@@ -0,0 +1,98 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// rejection is the JSON body of a rejected request when RejectDiagnostics is enabled
+type rejection struct {
+	Error  string            `json:"error"`
+	Key    string            `json:"key"`
+	Rule   string            `json:"rule"`
+	Label  string            `json:"label,omitempty"`
+	Bucket *bucketDiagnostic `json:"bucket,omitempty"` // Nil if the key has no local bucket yet
+}
+
+// bucketDiagnostic is the state of a bucket at the time of a rejection
+type bucketDiagnostic struct {
+	Tokens     int64 `json:"tokens"`
+	RefillRate int64 `json:"refillRate"`
+	Burst      int64 `json:"burst"`
+}
+
+// reject answers a request that won't be served. Without RejectDiagnostics the
+// body is just the message, so nothing about the limiter leaks to clients.
+func (bl *BandwidthLimiter) reject(rw http.ResponseWriter, status int, message string, decision Decision) {
+	if !bl.config.RejectDiagnostics {
+		http.Error(rw, message, status)
+		return
+	}
+	
+	body := rejection{
+		Error: message,
+		Key:   decision.Key,
+		Rule:  decision.Policy.Class,
+		Label: decision.Policy.Label,
+	}
+	if entry, ok := bl.buckets.Load(decision.Key); ok {
+		state := entry.Bucket.State()
+		body.Bucket = &bucketDiagnostic{
+			Tokens:     entry.Bucket.Available(),
+			RefillRate: state.Limit,
+			Burst:      state.BurstSize,
+		}
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(body)
+}
+
+// idempotent reports whether requests with a method can safely be retried, i.e.
+// whether the method is safe or idempotent (RFC 9110, section 9.2.2)
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// tokenWait returns how long until the request's local buckets can pay for the
+// first chunk of its response. Keys without a bucket yet start with a full one,
+// and buckets kept by a peer or in Redis are not checked.
+func (bl *BandwidthLimiter) tokenWait(decision Decision) time.Duration {
+	chunkSize := bl.parsed.chunkSize
+	if bl.parsed.autoChunkSize {
+		chunkSize = limiter.AutoChunkSize(decision.Policy.Limit, decision.Policy.Burst)
+	}
+	tokens := int64(math.Ceil(float64(chunkSize) * decision.Cost))
+	
+	var wait time.Duration
+	check := func(key string) {
+		entry, ok := bl.buckets.Load(key)
+		if !ok {
+			return
+		}
+		if w := entry.Bucket.WaitFor(tokens); w > wait {
+			wait = w
+		}
+		if entry.Window != nil {
+			if w := entry.Window.WaitFor(tokens); w > wait {
+				wait = w
+			}
+		}
+	}
+	
+	check(decision.Key)
+	for _, level := range bl.parentLevels(decision.Backend) {
+		check(level.key)
+	}
+	return wait
+}
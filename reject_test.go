@@ -0,0 +1,194 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestRejectDiagnostics tests the opt-in JSON body of rejected requests
+func TestRejectDiagnostics(t *testing.T) {
+	for _, diagnostics := range []bool{false, true} {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DefaultLimit = "4KB"
+		cfg.BurstSize = "8KB"
+		cfg.MaxConcurrentTransfers = 1
+		cfg.RejectDiagnostics = diagnostics
+
+		ctx := context.Background()
+
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/slow" {
+				close(started)
+				<-finish
+			}
+			rw.Write([]byte("hello"))
+		})
+
+		handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serve := func(path string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local"+path, nil)
+			req.RemoteAddr = "10.0.0.1:1000"
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		// Create the client's bucket, then hold the only transfer slot
+		serve("/")
+		go serve("/slow")
+		<-started
+
+		recorder := serve("/")
+		close(finish)
+
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+		}
+
+		var metrics strings.Builder
+		handler.(*bandwidthlimiter.BandwidthLimiter).WriteMetrics(&metrics)
+		if !strings.Contains(metrics.String(), `bwl_rejected_requests_total{code="503"} 1`+"\n") {
+			t.Errorf("Expected the rejection to be counted, got:\n%s", metrics.String())
+		}
+
+		if !diagnostics {
+			if strings.Contains(recorder.Body.String(), "10.0.0.1") {
+				t.Errorf("Expected no diagnostics by default, got %q", recorder.Body.String())
+			}
+			continue
+		}
+
+		var body struct {
+			Error  string
+			Key    string
+			Rule   string
+			Bucket *struct {
+				Tokens     int64
+				RefillRate int64
+				Burst      int64
+			}
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+			t.Fatalf("Expected a JSON body: %v", err)
+		}
+		if body.Key != "10.0.0.1:backend.local" || body.Rule != "default" || body.Error != "too many concurrent transfers" {
+			t.Errorf("Unexpected rejection body %+v", body)
+		}
+		if body.Bucket == nil || body.Bucket.RefillRate != 4096 || body.Bucket.Burst != 8192 || body.Bucket.Tokens <= 0 {
+			t.Errorf("Unexpected bucket diagnostics %+v", body.Bucket)
+		}
+	}
+}
+
+// TestRejectMode tests that drained clients are rejected with Retry-After instead of throttled
+func TestRejectMode(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "4KB"
+	cfg.BurstSize = "16KB"
+	cfg.Mode = "reject"
+	cfg.MaxWait = "500ms"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 16*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = ip + ":1000"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// The burst covers the first response, after which the bucket needs 1s for a chunk
+	if recorder := serve("10.0.0.1"); recorder.Code != http.StatusOK || recorder.Body.Len() != 16*1024 {
+		t.Fatalf("Expected the first response in full, got %d with %d bytes", recorder.Code, recorder.Body.Len())
+	}
+	recorder := serve("10.0.0.1")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for the drained client, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", recorder.Header().Get("Retry-After"))
+	}
+
+	// Other clients have buckets of their own
+	if recorder := serve("10.0.0.2"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", recorder.Code)
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.Mode = "reject"
+	cfg.Pacing = "timeslice"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for reject mode with time-slice pacing")
+	}
+}
+
+// TestRejectIdempotentOnly tests that only retryable requests are rejected, while others are throttled
+func TestRejectIdempotentOnly(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "16KB"
+	cfg.BurstSize = "16KB"
+	cfg.Mode = "reject"
+	cfg.RejectIdempotentOnly = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 16*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method string) (*httptest.ResponseRecorder, time.Duration) {
+		req := httptest.NewRequest(method, "http://backend.local/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		recorder := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(recorder, req)
+		return recorder, time.Since(start)
+	}
+
+	// The first response drains the burst
+	if recorder, _ := serve(http.MethodGet); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the first response to be served, got %d", recorder.Code)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		if recorder, _ := serve(method); recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: expected 429 for the drained client, got %d", method, recorder.Code)
+		}
+	}
+
+	// A POST could have side effects, so it is slowed down rather than turned away
+	recorder, elapsed := serve(http.MethodPost)
+	if recorder.Code != http.StatusOK || recorder.Body.Len() != 16*1024 {
+		t.Errorf("Expected the POST to be served in full, got %d with %d bytes", recorder.Code, recorder.Body.Len())
+	}
+	if elapsed < 700*time.Millisecond {
+		t.Errorf("Expected the POST to be throttled, took %v", elapsed)
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.RejectIdempotentOnly = true
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for rejectIdempotentOnly in throttle mode")
+	}
+}
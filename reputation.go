@@ -0,0 +1,265 @@
+package bandwidthlimiter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitClassReputation is reported for requests limited by the ReputationLimits entry of their client's reputation
+const limitClassReputation = "reputation"
+
+// reputationFetchTimeout bounds the download of a reputation list from a URL
+const reputationFetchTimeout = 10 * time.Second
+
+// ReputationProvider rates client IPs for ReputationLimits, e.g. from a threat
+// intelligence feed. Reputation is called for every request that isn't
+// limited by a more specific rule and must be safe for concurrent use.
+type ReputationProvider interface {
+	// Reputation returns the reputation tier of an IP, e.g. "vpn" or "tor",
+	// or "" if nothing is known about it
+	Reputation(ip net.IP) string
+}
+
+// reputationState holds the provider rating client IPs
+type reputationState struct {
+	mutex    sync.RWMutex
+	provider ReputationProvider
+	list     *ReputationList // Built from ReputationLists, nil if there are none
+	ticker   *time.Ticker
+}
+
+// SetReputationProvider replaces the provider rating client IPs for
+// ReputationLimits, by default the lists of ReputationLists. A nil provider
+// rates no IP.
+func (bl *BandwidthLimiter) SetReputationProvider(provider ReputationProvider) {
+	bl.reputation.mutex.Lock()
+	bl.reputation.provider = provider
+	bl.reputation.mutex.Unlock()
+	
+	// Cached decisions were made with the previous provider
+	if bl.resolutions != nil {
+		bl.resolutions.clear()
+	}
+}
+
+// reputationOf returns the reputation tier of a client IP, or "" if it has none
+func (bl *BandwidthLimiter) reputationOf(clientIP string) string {
+	bl.reputation.mutex.RLock()
+	provider := bl.reputation.provider
+	bl.reputation.mutex.RUnlock()
+	if provider == nil {
+		return ""
+	}
+	
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	return provider.Reputation(ip)
+}
+
+// reputationKey marks a bucket key as belonging to a reputation tier, so a
+// client keeps its bucket only as long as its reputation
+func reputationKey(key *keyBuilder, tier string) {
+	key.add("!", tier)
+}
+
+// parseReputationLimits parses ReputationLimits. Tiers end up in bucket keys
+// and must not contain their separators.
+func parseReputationLimits(limits map[string]Size) (map[string]int64, error) {
+	for tier := range limits {
+		if !validServiceName(tier) {
+			return nil, wrapf(ErrInvalidLimit, "reputationLimits: invalid tier %q, only letters, digits, '-', '_' and '.' are allowed", tier)
+		}
+	}
+	return parseLimits("reputationLimits", limits)
+}
+
+// startReputation loads ReputationLists and keeps them up to date
+func (bl *BandwidthLimiter) startReputation() {
+	list := NewReputationList(bl.config.ReputationLists, &http.Client{Timeout: reputationFetchTimeout})
+	if err := list.Load(); err != nil {
+		bl.log.warnf("Failed to load reputation lists: %v", err)
+	}
+	bl.reputation.list = list
+	bl.reputation.provider = list
+	
+	bl.reputation.ticker = time.NewTicker(bl.parsed.reputationRefresh)
+	bl.wg.Add(1)
+	go bl.reputationRoutine()
+}
+
+// reputationRoutine periodically reloads ReputationLists
+func (bl *BandwidthLimiter) reputationRoutine() {
+	defer bl.wg.Done()
+	
+	for {
+		select {
+		case <-bl.reputation.ticker.C:
+			if err := bl.reputation.list.Load(); err != nil {
+				bl.log.errorf("Error refreshing reputation lists: %v", err)
+			}
+			if bl.resolutions != nil {
+				bl.resolutions.clear()
+			}
+		case <-bl.shutdownChan:
+			return
+		}
+	}
+}
+
+// ReputationList is a ReputationProvider rating IPs by lists of addresses and
+// CIDRs per tier, such as published lists of VPN and Tor exit nodes. Each list
+// is read from a file or an http(s) URL and holds one entry per line; "#"
+// starts a comment. The narrowest entry holding an IP decides its tier, and
+// among equal entries in several lists the tier first in alphabetical order.
+type ReputationList struct {
+	sources map[string]string // File path or URL by tier
+	client  *http.Client
+	
+	mutex    sync.RWMutex
+	lists    map[string][]*net.IPNet // Last loaded entries by tier
+	networks *cidrTrie               // Entries of all tiers, valued by index in tiers
+	tiers    []string
+}
+
+// NewReputationList creates a list reading each tier's entries from its source,
+// a file path or an http(s) URL fetched with client. Call Load to read them.
+func NewReputationList(sources map[string]string, client *http.Client) *ReputationList {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &ReputationList{
+		sources:  sources,
+		client:   client,
+		lists:    make(map[string][]*net.IPNet, len(sources)),
+		networks: newCIDRTrie(),
+	}
+}
+
+// Load reads all sources. Tiers whose source can't be read keep the entries
+// they were last loaded with; the first such error is returned.
+func (l *ReputationList) Load() error {
+	tiers := make([]string, 0, len(l.sources))
+	for tier := range l.sources {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+	
+	loaded := make(map[string][]*net.IPNet, len(tiers))
+	var firstErr error
+	for _, tier := range tiers {
+		entries, err := l.read(l.sources[tier])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", tier, err)
+			}
+			l.mutex.RLock()
+			entries = l.lists[tier]
+			l.mutex.RUnlock()
+		}
+		loaded[tier] = entries
+	}
+	
+	// Equal entries keep the value inserted last, the alphabetically first tier
+	networks := newCIDRTrie()
+	for i := len(tiers) - 1; i >= 0; i-- {
+		for _, network := range loaded[tiers[i]] {
+			networks.insert(network, int64(i))
+		}
+	}
+	
+	l.mutex.Lock()
+	l.lists, l.networks, l.tiers = loaded, networks, tiers
+	l.mutex.Unlock()
+	return firstErr
+}
+
+// Reputation returns the tier of the narrowest entry holding ip, or "" if no list holds it
+func (l *ReputationList) Reputation(ip net.IP) string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	
+	index, found := l.networks.lookup(ip)
+	if !found {
+		return ""
+	}
+	return l.tiers[index]
+}
+
+// Len returns the number of entries loaded across all tiers
+func (l *ReputationList) Len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	
+	return l.networks.len()
+}
+
+// read returns the entries of a source
+func (l *ReputationList) read(source string) ([]*net.IPNet, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return parseReputationList(file)
+	}
+	
+	resp, err := l.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	return parseReputationList(resp.Body)
+}
+
+// parseReputationList parses a list of IPs and CIDRs, one per line. Anything
+// after the entry, such as a "#" comment, is ignored.
+func parseReputationList(r io.Reader) ([]*net.IPNet, error) {
+	var entries []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		
+		entry := fields[0]
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid CIDR %q", line, entry)
+			}
+			entries = append(entries, network)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: invalid IP %q", line, entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		entries = append(entries, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
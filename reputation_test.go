@@ -0,0 +1,178 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestReputationLists tests that listed clients get the limit of their reputation tier
+func TestReputationLists(t *testing.T) {
+	dir := t.TempDir()
+	vpn := filepath.Join(dir, "vpn.txt")
+	tor := filepath.Join(dir, "tor.txt")
+	if err := os.WriteFile(vpn, []byte("# VPN exit nodes\n198.51.100.0/24\n203.0.113.7  # also a Tor node\n\n2001:db8::/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tor, []byte("203.0.113.7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ReputationLists["vpn"] = vpn
+	cfg.ReputationLists["tor"] = tor
+	cfg.ReputationLimits["vpn"] = "100KB"
+	cfg.ReputationLimits["tor"] = "50KB"
+	cfg.ClientLimits["198.51.100.9"] = "unlimited"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	decision := decideFor(bl, "198.51.100.1")
+	if decision.Policy.Limit != 100*1024 || decision.Policy.Class != "reputation" || decision.Reputation != "vpn" {
+		t.Errorf("Expected the vpn tier, got %+v", decision)
+	}
+	if decision.Key != "198.51.100.1:backend.local!vpn" {
+		t.Errorf("Expected a bucket per reputation, got key %q", decision.Key)
+	}
+
+	tests := []struct {
+		ip         string
+		limit      int64
+		class      string
+		reputation string
+	}{
+		{"203.0.113.7", 50 * 1024, "reputation", "tor"}, // Listed twice, the first tier wins
+		{"2001:db8::1", 100 * 1024, "reputation", "vpn"},
+		{"10.0.0.1", 1024 * 1024, "default", ""},
+		{"198.51.100.9", bandwidthlimiter.Unlimited, "client", ""},
+	}
+	for _, tt := range tests {
+		decision := decideFor(bl, tt.ip)
+		if decision.Policy.Limit != tt.limit || decision.Policy.Class != tt.class || decision.Reputation != tt.reputation {
+			t.Errorf("%s: expected limit %d of %s rule with reputation %q, got %+v", tt.ip, tt.limit, tt.class, tt.reputation, decision)
+		}
+	}
+}
+
+// TestReputationListRefresh tests that lists fetched from URLs are reloaded,
+// and keep their entries while their source fails
+func TestReputationListRefresh(t *testing.T) {
+	var failing int32
+	var body atomic.Value
+	body.Store("198.51.100.1\n")
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	list := bandwidthlimiter.NewReputationList(map[string]string{"proxy": server.URL}, nil)
+	if err := list.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if tier := list.Reputation(net.ParseIP("198.51.100.1")); tier != "proxy" {
+		t.Errorf("Expected the listed IP in the proxy tier, got %q", tier)
+	}
+
+	body.Store("198.51.100.2\n")
+	if err := list.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if list.Reputation(net.ParseIP("198.51.100.1")) != "" || list.Reputation(net.ParseIP("198.51.100.2")) != "proxy" {
+		t.Error("Expected the reloaded list to replace the old entries")
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	if err := list.Load(); err == nil {
+		t.Error("Expected an error for the failing source")
+	}
+	if list.Reputation(net.ParseIP("198.51.100.2")) != "proxy" || list.Len() != 1 {
+		t.Error("Expected the failing source to keep its entries")
+	}
+
+	body.Store("198.51.100.2\nnot-an-ip\n")
+	atomic.StoreInt32(&failing, 0)
+	if err := list.Load(); err == nil {
+		t.Error("Expected an error for an invalid entry")
+	}
+}
+
+// reputationFunc adapts a function to a ReputationProvider
+type reputationFunc func(ip net.IP) string
+
+func (f reputationFunc) Reputation(ip net.IP) string { return f(ip) }
+
+// TestSetReputationProvider tests that embedders can rate clients themselves,
+// and that cached decisions follow a new provider
+func TestSetReputationProvider(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ReputationLimits["datacenter"] = "200KB"
+	cfg.ResolutionCacheTTL = "1m"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	if decision := decideFor(bl, "192.0.2.1"); decision.Policy.Class != "default" {
+		t.Errorf("Expected the default limit without a provider, got %+v", decision.Policy)
+	}
+
+	bl.SetReputationProvider(reputationFunc(func(ip net.IP) string {
+		if ip.Equal(net.ParseIP("192.0.2.1")) {
+			return "datacenter"
+		}
+		return ""
+	}))
+	if decision := decideFor(bl, "192.0.2.1"); decision.Policy.Limit != 200*1024 || decision.Reputation != "datacenter" {
+		t.Errorf("Expected the provider's tier to supply the limit, got %+v", decision)
+	}
+	if decision := decideFor(bl, "192.0.2.2"); decision.Policy.Class != "default" {
+		t.Errorf("Expected unrated clients to get the default limit, got %+v", decision.Policy)
+	}
+}
+
+// TestReputationConfig tests that reputation settings are validated
+func TestReputationConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *bandwidthlimiter.Config)
+	}{
+		{"tier with separator", func(cfg *bandwidthlimiter.Config) { cfg.ReputationLimits["vpn:exit"] = "100KB" }},
+		{"invalid limit", func(cfg *bandwidthlimiter.Config) { cfg.ReputationLimits["vpn"] = "fast" }},
+		{"negative refresh", func(cfg *bandwidthlimiter.Config) { cfg.ReputationRefresh = "-1h" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			tt.modify(cfg)
+			if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	// Lists that can't be read don't keep the middleware from starting
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ReputationLists["vpn"] = filepath.Join(t.TempDir(), "missing.txt")
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatalf("Expected a missing list to be skipped, got %v", err)
+	}
+	handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+}
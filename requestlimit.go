@@ -0,0 +1,70 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// requestKey returns the key of the bucket a request's admission is paid from
+func (bl *BandwidthLimiter) requestKey(decision Decision) string {
+	return bl.sideKey(decision, directionRequests)
+}
+
+// requestPolicy derives the request-rate limits from a request's download
+// policy: the same rule and label, at RequestLimit requests per second
+func (bl *BandwidthLimiter) requestPolicy(policy limiter.Policy) limiter.Policy {
+	policy.Limit = bl.config.RequestLimit
+	policy.Burst = bl.config.RequestBurst
+	policy.MinuteLimit = 0
+	policy.MinRate = 0
+	return policy
+}
+
+// admitRequest pays one token from the request's request-rate bucket. Requests
+// that can't pay right away wait for the token, or are rejected with 429 in
+// reject mode when the wait exceeds MaxWait. It returns false if the request
+// must not be served.
+func (bl *BandwidthLimiter) admitRequest(rw http.ResponseWriter, req *http.Request, stats *RequestStats, refs *entryRefs) bool {
+	decision := stats.Decision
+	buckets := bl.consumers(bl.requestKey(decision), bl.requestPolicy(decision.Policy), refs)
+	if limiter.ConsumeAll(buckets, 1) {
+		return true
+	}
+	
+	if bl.config.Mode == modeReject && (!bl.config.RejectIdempotentOnly || idempotent(req.Method)) {
+		if wait := requestWait(buckets); wait > bl.parsed.maxWait {
+			rw.Header().Set("Retry-After", strconv.FormatInt(int64(wait.Seconds())+1, 10))
+			bl.reject(rw, http.StatusTooManyRequests, "request rate limit exceeded", decision)
+			stats.Rejected = http.StatusTooManyRequests
+			return false
+		}
+	}
+	
+	waitStart := time.Now()
+	err := limiter.ConsumeAllWait(req.Context(), buckets, 1, leaseRetryInterval)
+	stats.RequestWait = time.Since(waitStart)
+	if err != nil {
+		stats.Canceled = true
+		return false
+	}
+	return true
+}
+
+// requestWait returns how long until buckets can admit another request.
+// Leases on buckets kept elsewhere can't tell and count as a second.
+func requestWait(buckets []limiter.Consumer) time.Duration {
+	var wait time.Duration
+	for _, bucket := range buckets {
+		w := time.Second
+		if waiter, ok := bucket.(limiter.Waiter); ok {
+			w = waiter.WaitFor(1)
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
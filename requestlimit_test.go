@@ -0,0 +1,129 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// newRequestLimiter creates a limiter with a request rate, reporting the stats of every request
+func newRequestLimiter(t *testing.T, cfg *bandwidthlimiter.Config) (http.Handler, chan bandwidthlimiter.RequestStats) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 100))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reported := make(chan bandwidthlimiter.RequestStats, 16)
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		reported <- *stats
+	})
+	return handler, reported
+}
+
+// serveFrom sends a request from a client IP and returns the recorded response
+func serveFrom(handler http.Handler, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = ip + ":1000"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestRequestLimit tests that requests over the rate wait for their turn
+func TestRequestLimit(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.RequestLimit = 10
+	cfg.RequestBurst = 2
+	handler, reported := newRequestLimiter(t, cfg)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		serveFrom(handler, "10.0.0.1")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 2 requests to wait 100ms each after the burst, took %v", elapsed)
+	}
+	for i := 0; i < 4; i++ {
+		stats := <-reported
+		if waited := stats.RequestWait > 0; waited != (i >= 2) {
+			t.Errorf("Request %d: unexpected request wait %v", i, stats.RequestWait)
+		}
+		if stats.BytesWritten != 100 || stats.TotalWait() < stats.RequestWait {
+			t.Errorf("Request %d: expected the response to be sent, got %+v", i, stats)
+		}
+	}
+
+	// Other clients have buckets of their own
+	start = time.Now()
+	serveFrom(handler, "10.0.0.2")
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected another client to be served right away, took %v", elapsed)
+	}
+}
+
+// TestRequestLimitReject tests that reject mode answers requests over the rate with 429
+func TestRequestLimitReject(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.Mode = "reject"
+	cfg.RequestLimit = 1
+	handler, _ := newRequestLimiter(t, cfg)
+
+	if recorder := serveFrom(handler, "10.0.0.1"); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to be served, got %d", recorder.Code)
+	}
+	recorder := serveFrom(handler, "10.0.0.1")
+	if retryAfter := recorder.Header().Get("Retry-After"); recorder.Code != http.StatusTooManyRequests || (retryAfter != "1" && retryAfter != "2") {
+		t.Errorf("Expected 429 with Retry-After after the next token, got %d and %q", recorder.Code, retryAfter)
+	}
+
+	// HEAD requests carry no body but still pay for their request token
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodHead, "http://backend.local/", nil)
+		req.RemoteAddr = "10.0.0.2:1000"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != want {
+			t.Errorf("HEAD %d: expected %d, got %d", i, want, recorder.Code)
+		}
+	}
+
+	for _, invalid := range []struct{ limit, burst int64 }{{-1, 0}, {10, -1}, {0, 5}} {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.RequestLimit, cfg.RequestBurst = invalid.limit, invalid.burst
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for requestLimit %d and requestBurst %d", invalid.limit, invalid.burst)
+		}
+	}
+}
+
+// TestRequestLimitRestore tests that request-rate buckets survive a restart
+func TestRequestLimitRestore(t *testing.T) {
+	tempFile := t.TempDir() + "/test-buckets.json"
+	now := time.Now()
+	states := []limiter.State{
+		{Key: "10.0.0.1:backend.local|requests", Tokens: 0, Limit: 1, BurstSize: 1, LastRefill: now, LastUsed: now},
+	}
+	if err := limiter.WriteSnapshot(tempFile, states); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.Mode = "reject"
+	cfg.RequestLimit = 1
+	cfg.PersistenceFile = tempFile
+	cfg.PersistenceDropStale = true
+	handler, _ := newRequestLimiter(t, cfg)
+	defer handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+	if recorder := serveFrom(handler, "10.0.0.1"); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the restored, drained bucket to reject, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package bandwidthlimiter
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// errReservationRefused is returned to the backend's writes once its response
+// was replaced with a 429 for exceeding ReservationMaxWait
+var errReservationRefused = errors.New("bandwidthlimiter: response exceeds the reservation budget")
+
+// reserveBody pays for a response body up front from all of its buckets, if
+// the response has a Content-Length and every bucket can reserve. Others are
+// paid for chunk by chunk. A reservation over ReservationMaxWait replaces the
+// response of an idempotent request with a 429.
+func (bl *BandwidthLimiter) reserveBody(lrw *limitedResponseWriter, req *http.Request) {
+	if req.Method == http.MethodHead || len(lrw.buckets) == 0 {
+		return
+	}
+	length, err := strconv.ParseInt(lrw.Header().Get("Content-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return
+	}
+	if lrw.maxBytes > 0 {
+		length = min(length, lrw.maxBytes)
+	}
+	
+	reservers := make([]limiter.Reserver, 0, len(lrw.buckets))
+	for _, bucket := range lrw.buckets {
+		reserver, ok := bucket.(limiter.Reserver)
+		if !ok {
+			return // Leases and remote buckets are paid as the body goes
+		}
+		reservers = append(reservers, reserver)
+	}
+	
+	// The body goes at the pace of the bucket taking longest to release it
+	tokens := lrw.tokens(length)
+	var binding *limiter.Reservation
+	for i, reserver := range reservers {
+		reservation, ok := reserver.Reserve(tokens, bl.parsed.reservationMaxWait)
+		if !ok && reservation.Limit > 0 && !idempotent(req.Method) {
+			// Requests that can't be retried are sent however long they take
+			reservation, ok = reserver.Reserve(tokens, 0)
+		}
+		if !ok {
+			for _, bucket := range lrw.buckets[:i] {
+				bucket.Refund(tokens)
+			}
+			// Buckets without refill can't reserve, the others are over the budget
+			if reservation.Limit > 0 {
+				bl.refuseReservation(lrw, reservation)
+			}
+			return
+		}
+		if binding == nil || reservation.End().After(binding.End()) {
+			binding = reservation
+		}
+	}
+	lrw.reservation = binding
+	lrw.stats.Reserved = tokens
+}
+
+// refuseReservation replaces the backend's response with a 429 asking the
+// client to come back once the reservation would fit ReservationMaxWait
+func (bl *BandwidthLimiter) refuseReservation(lrw *limitedResponseWriter, reservation *limiter.Reservation) {
+	header := lrw.Header()
+	for name := range header {
+		delete(header, name)
+	}
+	wait := time.Until(reservation.End()) - bl.parsed.reservationMaxWait
+	header.Set("Retry-After", strconv.FormatInt(int64(wait.Seconds())+1, 10))
+	bl.reject(lrw.ResponseWriter, http.StatusTooManyRequests, "response exceeds the reservation budget", lrw.stats.Decision)
+	lrw.stats.Rejected = http.StatusTooManyRequests
+	lrw.rejected = true
+}
+
+// releaseReservation returns the reserved tokens a response didn't send, e.g.
+// because the client went away, to its buckets
+func (lrw *limitedResponseWriter) releaseReservation() {
+	if lrw.reservation == nil {
+		return
+	}
+	if unused := lrw.reservation.Remaining(); unused > 0 {
+		for _, bucket := range lrw.buckets {
+			bucket.Refund(unused)
+		}
+	}
+	lrw.reservation = nil
+}
@@ -0,0 +1,132 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// newReservationLimiter returns a limiter at 100KB/s with a 10KB burst in
+// front of a backend sending 60KB responses with a Content-Length. The
+// backend's write errors go to writeErrs.
+func newReservationLimiter(t *testing.T, cfg *bandwidthlimiter.Config, writeErrs chan error) *bandwidthlimiter.BandwidthLimiter {
+	cfg.DefaultLimit = "100KB"
+	cfg.BurstSize = "10KB"
+	cfg.Reservation = true
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", strconv.Itoa(60*1024))
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		_, err := rw.Write(make([]byte, 60*1024))
+		if writeErrs != nil {
+			writeErrs <- err
+		}
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	t.Cleanup(bl.Shutdown)
+	return bl
+}
+
+// TestReservation tests that reserved responses go at the bucket's rate and
+// later responses of the client wait until they are paid off
+func TestReservation(t *testing.T) {
+	bl := newReservationLimiter(t, bandwidthlimiter.CreateConfig(), nil)
+	done := make(chan bandwidthlimiter.RequestStats, 2)
+	bl.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		done <- *stats
+	})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/file", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		go bl.ServeHTTP(httptest.NewRecorder(), req)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// 10KB from the burst and 50KB at 100KB/s, then 60KB behind them
+	first := <-done
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("Expected the first response to take about 500ms, took %v", elapsed)
+	}
+	if first.Reserved != 60*1024 || first.BytesWritten != 60*1024 {
+		t.Errorf("Expected the first response to be reserved and sent in full, got %+v", first)
+	}
+	second := <-done
+	if elapsed := time.Since(start); elapsed < 1000*time.Millisecond || elapsed > 1600*time.Millisecond {
+		t.Errorf("Expected the second response to finish about 1.1s in, took %v", elapsed)
+	}
+	if second.BytesWritten != 60*1024 {
+		t.Errorf("Expected the second response to be sent in full, got %+v", second)
+	}
+}
+
+// TestReservationMaxWait tests that idempotent requests over ReservationMaxWait
+// are rejected with 429, and others are sent anyway
+func TestReservationMaxWait(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ReservationMaxWait = "200ms"
+	writeErrs := make(chan error, 1)
+	bl := newReservationLimiter(t, cfg, writeErrs)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/file", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	rr := httptest.NewRecorder()
+	bl.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for a response over the budget, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if length := rr.Header().Get("Content-Length"); length == strconv.Itoa(60*1024) {
+		t.Error("Expected the backend's Content-Length to be dropped")
+	}
+	if err := <-writeErrs; err == nil {
+		t.Error("Expected the backend's write to fail")
+	}
+
+	// Requests that can't be retried are sent however long they take
+	req = httptest.NewRequest(http.MethodPost, "http://backend.local/file", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	rr = httptest.NewRecorder()
+	bl.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 60*1024 {
+		t.Errorf("Expected the POST response to be sent in full, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+	if err := <-writeErrs; err != nil {
+		t.Errorf("Expected the POST response to be written, got %v", err)
+	}
+}
+
+// TestReservationConfig tests that reservation settings are validated
+func TestReservationConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	tests := []struct {
+		name   string
+		modify func(cfg *bandwidthlimiter.Config)
+	}{
+		{"max wait without reservation", func(cfg *bandwidthlimiter.Config) { cfg.ReservationMaxWait = "10s" }},
+		{"negative max wait", func(cfg *bandwidthlimiter.Config) {
+			cfg.Reservation = true
+			cfg.ReservationMaxWait = "-1s"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			tt.modify(cfg)
+			if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resolutionKey holds everything a Decision depends on. Inputs that no
+// configured rule looks at are left empty, so they don't split the cache.
+type resolutionKey struct {
+	clientIP   string
+	backend    string
+	path       string // Only with PathLimits
+	entryPoint string
+	token      string // Authentication or tier token, only with AuthDetection or TierClaim
+	apiKey     string // Only with KeyHeader
+	identity   string // Only with ServiceIdentityHeader
+}
+
+// resolution is a cached Decision
+type resolution struct {
+	decision Decision
+	expires  time.Time
+}
+
+// resolutionCache remembers Decisions for a short while, so repeat clients
+// skip regular expressions and token validation
+type resolutionCache struct {
+	// Only accessed atomically. First in the struct for 64-bit alignment.
+	hits   int64
+	misses int64
+	
+	ttl     time.Duration
+	size    int
+	mutex   sync.RWMutex
+	entries map[resolutionKey]resolution
+}
+
+// newResolutionCache creates a cache holding up to size decisions for ttl
+func newResolutionCache(ttl time.Duration, size int) *resolutionCache {
+	return &resolutionCache{ttl: ttl, size: size, entries: make(map[resolutionKey]resolution)}
+}
+
+// get returns the cached decision for key, if it hasn't expired
+func (c *resolutionCache) get(key resolutionKey, now time.Time) (Decision, bool) {
+	c.mutex.RLock()
+	cached, ok := c.entries[key]
+	c.mutex.RUnlock()
+	
+	if !ok || now.After(cached.expires) {
+		atomic.AddInt64(&c.misses, 1)
+		return Decision{}, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return cached.decision, true
+}
+
+// put caches a decision. A full cache first drops its expired entries, and
+// arbitrary ones if that isn't enough.
+func (c *resolutionCache) put(key resolutionKey, decision Decision, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	if len(c.entries) >= c.size {
+		for cachedKey, cached := range c.entries {
+			if now.After(cached.expires) {
+				delete(c.entries, cachedKey)
+			}
+		}
+		for cachedKey := range c.entries {
+			if len(c.entries) < c.size*9/10 {
+				break
+			}
+			delete(c.entries, cachedKey)
+		}
+	}
+	c.entries[key] = resolution{decision: decision, expires: now.Add(c.ttl)}
+}
+
+// clear drops every cached decision, e.g. after the rules changed
+func (c *resolutionCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	c.entries = make(map[resolutionKey]resolution)
+}
+
+// resolutionKey collects the inputs of the decision for a request
+func (bl *BandwidthLimiter) resolutionKey(req *http.Request, entryPoint string) resolutionKey {
+	key := resolutionKey{
+		clientIP:   bl.clientIPs.clientIP(req),
+		backend:    req.URL.Host,
+		entryPoint: entryPoint,
+	}
+	if len(bl.parsed.pathLimits) > 0 {
+		key.path = req.URL.Path
+	}
+	if bl.config.TierClaim != "" && bl.config.TierTokenCookie != "" {
+		if cookie, err := req.Cookie(bl.config.TierTokenCookie); err == nil {
+			key.token = cookie.Value
+		}
+	} else if bl.config.TierClaim != "" {
+		key.token = req.Header.Get(bl.config.TierTokenHeader)
+	}
+	if bl.config.KeyHeader != "" {
+		key.apiKey = bl.apiKey(req)
+	}
+	if bl.config.ServiceIdentityHeader != "" {
+		key.identity = req.Header.Get(bl.config.ServiceIdentityHeader)
+	}
+	if bl.config.AuthDetection != "" {
+		if auth := req.Header.Get(bl.config.AuthHeader); auth != key.token {
+			key.token += "\n" + auth
+		}
+	}
+	return key
+}
@@ -0,0 +1,100 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestResolutionCache tests that cached decisions are reused per client and path
+func TestResolutionCache(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ResolutionCacheTTL = "1m"
+	cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "^/downloads/", Limit: "256KB"}}
+	cfg.RouteCosts["/export"] = 2
+	cfg.TierClaim = "plan"
+	cfg.TierJWTSecret = "tier-secret"
+	cfg.TierLimits["premium"] = "10MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	decide := func(ip, path, token string) bandwidthlimiter.Decision {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local"+path, nil)
+		req.RemoteAddr = ip + ":1000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return bl.Decide(req)
+	}
+
+	premium := signJWT(`{"plan":"premium"}`, "tier-secret")
+	for i := 0; i < 3; i++ {
+		if decision := decide("10.0.0.1", "/downloads/a.iso", ""); decision.Policy.Limit != 256*1024 {
+			t.Errorf("Expected the path rule, got %+v", decision.Policy)
+		}
+		if decision := decide("10.0.0.1", "/", premium); decision.Policy.Limit != 10*1024*1024 {
+			t.Errorf("Expected the premium tier, got %+v", decision.Policy)
+		}
+		if decision := decide("10.0.0.1", "/", ""); decision.Policy.Limit != 1024*1024 {
+			t.Errorf("Expected the default limit without a token, got %+v", decision.Policy)
+		}
+	}
+
+	// Route costs still follow the path of each request
+	if decision := decide("10.0.0.1", "/export/report.csv", ""); decision.Cost != 2 {
+		t.Errorf("Expected the route cost despite the cached decision, got %v", decision.Cost)
+	}
+
+	var metrics bytes.Buffer
+	if err := bl.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(metrics.String(), "bwl_resolution_cache_hits_total 6") || !strings.Contains(metrics.String(), "bwl_resolution_cache_misses_total 4") {
+		t.Errorf("Expected 6 hits and 4 misses, got:\n%s", metrics.String())
+	}
+}
+
+// TestResolutionCacheExpiry tests that cached decisions are resolved again after the TTL
+func TestResolutionCacheExpiry(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.ResolutionCacheTTL = "50ms"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	bl.Decide(req)
+	bl.Decide(req)
+	time.Sleep(100 * time.Millisecond)
+	bl.Decide(req)
+
+	var metrics bytes.Buffer
+	if err := bl.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(metrics.String(), "bwl_resolution_cache_hits_total 1") || !strings.Contains(metrics.String(), "bwl_resolution_cache_misses_total 2") {
+		t.Errorf("Expected the expired entry to be resolved again, got:\n%s", metrics.String())
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.ResolutionCacheTTL = "1m"
+	cfg.ResolutionCacheSize = -1
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for a negative resolutionCacheSize")
+	}
+}
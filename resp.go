@@ -0,0 +1,185 @@
+package bandwidthlimiter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisClient is a minimal Redis client speaking RESP2 over a small pool of
+// connections. It only supports what the Redis storage needs.
+type redisClient struct {
+	address  string
+	password string
+	db       int64
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+// redisConn is a pooled connection with its reply reader
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply sent by the server. The connection stays usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// newRedisClient creates a client keeping up to poolSize idle connections
+func newRedisClient(address, password string, db int64, poolSize int, timeout time.Duration) *redisClient {
+	return &redisClient{
+		address:  address,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		pool:     make(chan *redisConn, poolSize),
+	}
+}
+
+// Do sends a command and returns its reply: a string, an int64, nil or a
+// []interface{} of those. Error replies are returned as redisError.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	
+	reply, err := conn.do(c.timeout, args)
+	if err != nil {
+		if _, isReply := err.(redisError); !isReply {
+			// The connection is in an unknown state after a network error
+			conn.conn.Close()
+			return nil, err
+		}
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// Close closes all idle connections
+func (c *redisClient) Close() {
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// get takes an idle connection from the pool or dials a new one
+func (c *redisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+	
+	netConn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	
+	if c.password != "" {
+		if _, err := conn.do(c.timeout, []string{"AUTH", c.password}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %v", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(c.timeout, []string{"SELECT", strconv.FormatInt(c.db, 10)}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("redis SELECT failed: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// do writes a command as a RESP array of bulk strings and reads the reply
+func (conn *redisConn) do(timeout time.Duration, args []string) (interface{}, error) {
+	conn.conn.SetDeadline(time.Now().Add(timeout))
+	
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(conn.reader)
+}
+
+// readRedisReply reads one RESP2 reply
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+	
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readRedisReply(reader)
+			if err != nil {
+				if _, isReply := err.(redisError); !isReply {
+					return nil, err
+				}
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid redis reply %q", line)
+}
@@ -0,0 +1,130 @@
+package bandwidthlimiter
+
+import (
+	"time"
+)
+
+// When cluster quota periods start, see Config.ClusterQuotaReset. The default
+// are periods of ClusterQuotaPeriod counted from the Unix epoch.
+const (
+	quotaResetDaily   = "daily"
+	quotaResetMonthly = "monthly"
+	quotaResetRolling = "rolling"
+)
+
+// currentPeriod returns the index of the quota period containing now. Fixed
+// periods are numbered from the Unix epoch, calendar periods by the Unix
+// seconds they start at.
+func (bl *BandwidthLimiter) currentPeriod(now time.Time) int64 {
+	local := now.In(bl.parsed.clusterQuotaLocation)
+	switch bl.config.ClusterQuotaReset {
+	case quotaResetDaily:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location()).Unix()
+	case quotaResetMonthly:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, local.Location()).Unix()
+	}
+	return now.Unix() / int64(bl.parsed.clusterQuotaPeriod/time.Second)
+}
+
+// periodStart returns when the quota period with the given index starts
+func (bl *BandwidthLimiter) periodStart(period int64) time.Time {
+	switch bl.config.ClusterQuotaReset {
+	case quotaResetDaily, quotaResetMonthly:
+		return time.Unix(period, 0)
+	}
+	return time.Unix(period*int64(bl.parsed.clusterQuotaPeriod/time.Second), 0)
+}
+
+// periodEnd returns when the quota period with the given index ends
+func (bl *BandwidthLimiter) periodEnd(period int64) time.Time {
+	start := bl.periodStart(period).In(bl.parsed.clusterQuotaLocation)
+	switch bl.config.ClusterQuotaReset {
+	case quotaResetDaily:
+		return time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+	case quotaResetMonthly:
+		return time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, start.Location())
+	}
+	return start.Add(bl.parsed.clusterQuotaPeriod)
+}
+
+// previousPeriod returns the index of the quota period before the given one
+func (bl *BandwidthLimiter) previousPeriod(period int64) int64 {
+	return bl.currentPeriod(bl.periodStart(period).Add(-time.Second))
+}
+
+// tracksPreviousPeriod reports whether quotas depend on the usage of the
+// previous period, which is then kept and reported next to the current one
+func (bl *BandwidthLimiter) tracksPreviousPeriod() bool {
+	return bl.parsed.clusterQuotaCarryOver > 0 || bl.config.ClusterQuotaReset == quotaResetRolling
+}
+
+// rollPeriod resets usage when a new quota period started, keeping the usage
+// and shares of the period just over if needed. The caller holds the mutex.
+func (bl *BandwidthLimiter) rollPeriod(period int64) {
+	cs := bl.cluster
+	if cs.period == period {
+		return
+	}
+	cs.previous, cs.last = nil, nil
+	if bl.tracksPreviousPeriod() && cs.period == bl.previousPeriod(period) {
+		cs.previous, cs.last = cs.used, cs.shares
+	}
+	cs.period = period
+	cs.used = make(map[string]int64)
+	cs.shares = nil
+}
+
+// previousUsage returns what a client received in the previous period, across
+// the cluster if the leader published it; the caller holds the mutex
+func (cs *clusterState) previousUsage(key string) int64 {
+	used := cs.previous[key]
+	if cs.last != nil && cs.last.Totals[key] > used {
+		used = cs.last.Totals[key]
+	}
+	if cs.shares != nil && cs.shares.Previous[key] > used {
+		used = cs.shares.Previous[key]
+	}
+	return used
+}
+
+// quotaAllowance returns the bytes a client with the given quota may receive
+// in a period after receiving previous bytes in the period before: the quota
+// plus what it left unused of the previous one, up to ClusterQuotaCarryOver
+func (bl *BandwidthLimiter) quotaAllowance(quota, previous int64) int64 {
+	carry := min(quota-previous, bl.parsed.clusterQuotaCarryOver)
+	if carry < 0 {
+		carry = 0
+	}
+	return quota + carry
+}
+
+// rollingWeight returns the share of the previous period's usage that still
+// counts at now: the part of the previous period within the rolling window
+// ending now, and 0 unless the window rolls
+func (bl *BandwidthLimiter) rollingWeight(period int64, now time.Time) float64 {
+	if bl.config.ClusterQuotaReset != quotaResetRolling {
+		return 0
+	}
+	start, end := bl.periodStart(period), bl.periodEnd(period)
+	return 1 - float64(now.Sub(start))/float64(end.Sub(start))
+}
+
+// quotaRetryAt returns when a client over its allowance after using used
+// bytes of the current period and previous bytes of the one before may come
+// back: at the end of the period, or with a rolling window once enough usage
+// slid out of it
+func (bl *BandwidthLimiter) quotaRetryAt(period, used, previous, allowance int64) time.Time {
+	start, end := bl.periodStart(period), bl.periodEnd(period)
+	if bl.config.ClusterQuotaReset != quotaResetRolling {
+		return end
+	}
+	length := float64(end.Sub(start))
+	switch {
+	case used >= allowance:
+		// Then the current period's usage has to slide out in the next one
+		return end.Add(time.Duration((1 - float64(allowance)/float64(used)) * length))
+	case previous > 0:
+		return start.Add(time.Duration((1 - float64(allowance-used)/float64(previous)) * length))
+	}
+	return end
+}
@@ -0,0 +1,38 @@
+package bandwidthlimiter
+
+import (
+	"sort"
+	"strings"
+)
+
+// routeCost is a compiled entry of Config.RouteCosts
+type routeCost struct {
+	prefix     string
+	multiplier float64
+}
+
+// compileRouteCosts validates RouteCosts and orders them longest prefix first
+func compileRouteCosts(costs map[string]float64) ([]routeCost, error) {
+	compiled := make([]routeCost, 0, len(costs))
+	for prefix, multiplier := range costs {
+		if multiplier <= 0 {
+			return nil, wrapf(ErrInvalidLimit, "routeCosts[%q] must be greater than 0", prefix)
+		}
+		compiled = append(compiled, routeCost{prefix: prefix, multiplier: multiplier})
+	}
+	
+	sort.Slice(compiled, func(i, j int) bool {
+		return len(compiled[i].prefix) > len(compiled[j].prefix)
+	})
+	return compiled, nil
+}
+
+// resolveCost returns the token multiplier for a request path, 1 if no route matches
+func (bl *BandwidthLimiter) resolveCost(path string) float64 {
+	for _, cost := range bl.routeCosts {
+		if strings.HasPrefix(path, cost.prefix) {
+			return cost.multiplier
+		}
+	}
+	return 1
+}
@@ -0,0 +1,128 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+)
+
+// Rule matching modes, see Config.RuleMatching
+const (
+	ruleMatchFirst = "first"
+	ruleMatchAll   = "all"
+)
+
+// defaultRuleOrder is the precedence of limit rules, most specific first
+var defaultRuleOrder = []string{limitClassKey, limitClassService, limitClassClient, limitClassReputation, limitClassTier, limitClassPath, limitClassCountry, limitClassBackend}
+
+// ruleMatch is a limit rule matching a request
+type ruleMatch struct {
+	class      string // Limit class of the rule
+	limit      int64
+	tier       string // TierClaim value, for tier rules
+	reputation string // Reputation tier, for reputation rules
+	pathRule   int    // Index in parsed.pathLimits, for path rules
+	country    string // Country or continent code, for country rules
+}
+
+// parseRuleOrder validates Config.RuleOrder and completes it with the rule
+// types it leaves out, in their default order
+func parseRuleOrder(order []string) ([]string, error) {
+	parsed := make([]string, 0, len(defaultRuleOrder))
+	listed := make(map[string]bool, len(order))
+	for _, class := range order {
+		known := false
+		for _, valid := range defaultRuleOrder {
+			known = known || class == valid
+		}
+		if !known {
+			return nil, wrapf(ErrInvalidLimit, "ruleOrder: unknown rule type %q, must be one of %q", class, defaultRuleOrder)
+		}
+		if listed[class] {
+			return nil, wrapf(ErrInvalidLimit, "ruleOrder: rule type %q is listed twice", class)
+		}
+		listed[class] = true
+		parsed = append(parsed, class)
+	}
+	for _, class := range defaultRuleOrder {
+		if !listed[class] {
+			parsed = append(parsed, class)
+		}
+	}
+	return parsed, nil
+}
+
+// pickRule returns the rule supplying the limit among the rules match reports:
+// the first in rule order or, with RuleMatching "all", the one with the lowest
+// limit. ok is false if no rule matches.
+func (bl *BandwidthLimiter) pickRule(match func(class string) (ruleMatch, bool)) (picked ruleMatch, ok bool) {
+	for _, class := range bl.ruleOrder {
+		rule, matched := match(class)
+		if !matched {
+			continue
+		}
+		if bl.config.RuleMatching != ruleMatchAll {
+			return rule, true
+		}
+		if !ok || lowerLimit(rule.limit, picked.limit) {
+			picked, ok = rule, true
+		}
+	}
+	return picked, ok
+}
+
+// lowerLimit reports whether limit a is stricter than limit b
+func lowerLimit(a, b int64) bool {
+	if a == Unlimited {
+		return false
+	}
+	return b == Unlimited || a < b
+}
+
+// matchRule reports the rule of a class matching a request, if any. keyID is
+// the client ID of the request's API key or calling service, "" if it has none.
+func (bl *BandwidthLimiter) matchRule(class string, req *http.Request, clientIP, keyID, backend string) (ruleMatch, bool) {
+	switch class {
+	case limitClassKey:
+		if limit, exists := bl.parsed.keyLimits[keyID]; exists {
+			return ruleMatch{class: class, limit: limit}, true
+		}
+	case limitClassService:
+		if limit, exists := bl.parsed.serviceLimits[keyID]; exists {
+			return ruleMatch{class: class, limit: limit}, true
+		}
+	case limitClassClient:
+		if limit, exists := bl.clientLimit(clientIP); exists {
+			return ruleMatch{class: class, limit: limit}, true
+		}
+	case limitClassReputation:
+		if len(bl.parsed.reputationLimits) == 0 {
+			break
+		}
+		if tier := bl.reputationOf(clientIP); tier != "" {
+			if limit, exists := bl.parsed.reputationLimits[tier]; exists {
+				return ruleMatch{class: class, limit: limit, reputation: tier}, true
+			}
+		}
+	case limitClassTier:
+		if bl.config.TierClaim == "" {
+			break
+		}
+		if value := bl.tier(req); value != "" {
+			if limit, exists := bl.parsed.tierLimits[value]; exists {
+				return ruleMatch{class: class, limit: limit, tier: value}, true
+			}
+		}
+	case limitClassPath:
+		if index := bl.matchPathLimit(req.URL.Path); index >= 0 {
+			return ruleMatch{class: class, limit: bl.parsed.pathLimits[index].limit, pathRule: index}, true
+		}
+	case limitClassCountry:
+		if code, limit, exists := bl.countryLimit(clientIP); exists {
+			return ruleMatch{class: class, limit: limit, country: code}, true
+		}
+	case limitClassBackend:
+		if limit, exists := bl.backendLimit(backend); exists {
+			return ruleMatch{class: class, limit: limit}, true
+		}
+	}
+	return ruleMatch{}, false
+}
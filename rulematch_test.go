@@ -0,0 +1,129 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// newRuleLimiter creates a limiter whose client, path and backend rules overlap
+func newRuleLimiter(t *testing.T, matching string, order []string) *bandwidthlimiter.BandwidthLimiter {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.RuleMatching = matching
+	cfg.RuleOrder = order
+	cfg.ClientLimits["10.0.0.1"] = "2MB"
+	cfg.ClientLimits["10.0.0.3"] = "unlimited"
+	cfg.BackendLimits["backend.local"] = "4MB"
+	cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "/api/", Limit: "512KB"}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler.(*bandwidthlimiter.BandwidthLimiter)
+}
+
+// TestRuleMatching tests that overlapping rules apply in rule order or combine to the lowest limit
+func TestRuleMatching(t *testing.T) {
+	tests := []struct {
+		matching string
+		order    []string
+		client   string
+		path     string
+		limit    int64
+		class    string
+		key      string
+	}{
+		// The default order: client rules beat path rules, which beat backend rules
+		{"", nil, "10.0.0.1", "/api/users", 2 * 1024 * 1024, "client", "10.0.0.1:backend.local"},
+		{"", nil, "10.0.0.2", "/api/users", 512 * 1024, "path", "10.0.0.2:backend.local~0"},
+		{"", nil, "10.0.0.2", "/", 4 * 1024 * 1024, "backend", "10.0.0.2:backend.local"},
+
+		// Reordered rules
+		{"first", []string{"path"}, "10.0.0.1", "/api/users", 512 * 1024, "path", "10.0.0.1:backend.local~0"},
+		{"first", []string{"backend", "client"}, "10.0.0.1", "/", 4 * 1024 * 1024, "backend", "10.0.0.1:backend.local"},
+
+		// The lowest of all matching limits, unlimited rules never being the lowest
+		{"all", nil, "10.0.0.1", "/api/users", 512 * 1024, "path", "10.0.0.1:backend.local~0"},
+		{"all", nil, "10.0.0.1", "/", 2 * 1024 * 1024, "client", "10.0.0.1:backend.local"},
+		{"all", nil, "10.0.0.3", "/", 4 * 1024 * 1024, "backend", "10.0.0.3:backend.local"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local"+tt.path, nil)
+		req.RemoteAddr = tt.client + ":1000"
+		decision := newRuleLimiter(t, tt.matching, tt.order).Decide(req)
+		if decision.Policy.Limit != tt.limit || decision.Policy.Class != tt.class || decision.Key != tt.key {
+			t.Errorf("%s %v %s%s: expected %d from the %s rule in %q, got %d from %s in %q",
+				tt.matching, tt.order, tt.client, tt.path, tt.limit, tt.class, tt.key, decision.Policy.Limit, decision.Policy.Class, decision.Key)
+		}
+	}
+}
+
+// TestRuleMatchingErrors tests that unknown modes and rule types are rejected at startup
+func TestRuleMatchingErrors(t *testing.T) {
+	tests := []struct {
+		matching string
+		order    []string
+	}{
+		{"any", nil},
+		{"first", []string{"header"}},
+		{"first", []string{"path", "client", "path"}},
+	}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.RuleMatching = tt.matching
+		cfg.RuleOrder = tt.order
+		if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for ruleMatching %q with ruleOrder %v", tt.matching, tt.order)
+		}
+	}
+}
+
+// TestRuleOrderRestore tests that restored path buckets are only kept while the path rule still supplies their limit
+func TestRuleOrderRestore(t *testing.T) {
+	for _, tt := range []struct {
+		order []string
+		kept  bool
+	}{
+		{nil, false},
+		{[]string{"path"}, true},
+	} {
+		tempFile := t.TempDir() + "/test-buckets.json"
+		now := time.Now()
+		states := []limiter.State{
+			{Key: "10.0.0.1:backend.local~0", Tokens: 4096, Limit: 512 * 1024, BurstSize: 10 * 1024 * 1024, LastRefill: now, LastUsed: now},
+		}
+		if err := limiter.WriteSnapshot(tempFile, states); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.RuleOrder = tt.order
+		cfg.ClientLimits["10.0.0.1"] = "2MB"
+		cfg.PathLimits = []bandwidthlimiter.PathLimit{{Path: "/api/", Limit: "512KB"}}
+		cfg.PersistenceFile = tempFile
+		cfg.PersistenceDropStale = true
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+
+		saved, err := limiter.ReadSnapshot(tempFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := len(saved) == 1; kept != tt.kept {
+			t.Errorf("ruleOrder %v: expected kept %v, got %+v", tt.order, tt.kept, saved)
+		}
+	}
+}
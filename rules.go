@@ -0,0 +1,151 @@
+package bandwidthlimiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// dynamicLimits reports whether limits can change while buckets live on, with
+// LimitSchedules, RulesFile, LimitProfiles or SetKeyLimit, so buckets take on
+// their policy's current limits on every use
+func (bl *BandwidthLimiter) dynamicLimits() bool {
+	return bl.config.RulesFile != "" || len(bl.config.LimitProfiles) > 0 || len(bl.parsed.schedules) > 0 || atomic.LoadInt32(&bl.overrides.used) == 1
+}
+
+// loadRules reads RulesFile and replaces the limit rules with its rules on top
+// of the middleware configuration, under the profile in effect. Invalid files
+// leave the rules unchanged.
+func (bl *BandwidthLimiter) loadRules() error {
+	data, err := os.ReadFile(bl.config.RulesFile)
+	if err != nil {
+		return err
+	}
+	
+	// Settings that can't be reloaded are rejected rather than silently
+	// ignored. The file holds a LimitProfile's rules, but replaces the
+	// configured ones rather than building on them.
+	var rules LimitProfile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return fmt.Errorf("%s: %v", bl.config.RulesFile, err)
+	}
+	if rules.Inherits != "" {
+		return wrapf(ErrInvalidLimit, "%s: unknown field \"inherits\"", bl.config.RulesFile)
+	}
+	
+	bl.layers.mutex.Lock()
+	defer bl.layers.mutex.Unlock()
+	
+	parsed, err := bl.buildRules(&rules, bl.layers.profile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", bl.config.RulesFile, err)
+	}
+	bl.swapRules(parsed)
+	bl.layers.file = &rules
+	return nil
+}
+
+// buildRules parses the limit rules of the middleware configuration replaced
+// by those of file, if any, and then layered with the profile, "" for none
+func (bl *BandwidthLimiter) buildRules(file *LimitProfile, profile string) (parsedUnits, error) {
+	chain, err := profileChain(bl.config, profile)
+	if err != nil {
+		return parsedUnits{}, err
+	}
+	
+	config := *bl.config
+	if file != nil {
+		file.replace(&config)
+	}
+	for i := range chain {
+		chain[i].merge(&config)
+	}
+	if config.KeyHeader == "" && len(config.KeyLimits) > 0 {
+		return parsedUnits{}, wrapf(ErrInvalidLimit, "keyHeader must be set when keyLimits are set")
+	}
+	if config.ServiceIdentityHeader == "" && len(config.ServiceLimits) > 0 {
+		return parsedUnits{}, wrapf(ErrInvalidLimit, "serviceIdentityHeader must be set when serviceLimits are set")
+	}
+	parsed, err := parseUnits(&config)
+	if err != nil {
+		return parsedUnits{}, err
+	}
+	parsed.profile = profile
+	return parsed, nil
+}
+
+// swapRules replaces the limit rules with those of parsed
+func (bl *BandwidthLimiter) swapRules(parsed parsedUnits) {
+	// Decisions hold the read lock until they are cached, so none made with
+	// the previous rules outlives the swap
+	bl.rulesMutex.Lock()
+	defer bl.rulesMutex.Unlock()
+	
+	bl.parsed.defaultLimit = parsed.defaultLimit
+	bl.parsed.clientLimits = parsed.clientLimits
+	bl.parsed.clientNetworks = parsed.clientNetworks
+	bl.parsed.backendLimits = parsed.backendLimits
+	bl.parsed.pathLimits = parsed.pathLimits
+	bl.parsed.tierLimits = parsed.tierLimits
+	bl.parsed.reputationLimits = parsed.reputationLimits
+	bl.parsed.countryLimits = parsed.countryLimits
+	bl.parsed.continentLimits = parsed.continentLimits
+	bl.parsed.keyLimits = parsed.keyLimits
+	bl.parsed.serviceLimits = parsed.serviceLimits
+	bl.parsed.schedules = parsed.schedules
+	bl.parsed.profile = parsed.profile
+	if bl.resolutions != nil {
+		bl.resolutions.clear()
+	}
+}
+
+// initialRules loads RulesFile at startup, keeping the configured rules if it
+// can't be. It returns the file's info, nil if it doesn't exist yet.
+func (bl *BandwidthLimiter) initialRules() os.FileInfo {
+	info, err := os.Stat(bl.config.RulesFile)
+	if err == nil {
+		err = bl.loadRules()
+	}
+	if err != nil {
+		bl.log.warnf("Failed to load rules, using the configured ones until the file changes: %v", err)
+	}
+	return info
+}
+
+// startRules keeps watching RulesFile for changes after its initial load
+func (bl *BandwidthLimiter) startRules(loaded os.FileInfo) {
+	bl.rulesTicker = time.NewTicker(bl.parsed.rulesReloadInterval)
+	bl.wg.Add(1)
+	go bl.rulesRoutine(loaded)
+}
+
+// rulesRoutine reloads RulesFile whenever its modification time or size
+// changes. Polling works on every platform and for files replaced through
+// symlinks, such as Kubernetes ConfigMap mounts.
+func (bl *BandwidthLimiter) rulesRoutine(loaded os.FileInfo) {
+	defer bl.wg.Done()
+	
+	for {
+		select {
+		case <-bl.rulesTicker.C:
+			info, err := os.Stat(bl.config.RulesFile)
+			if err != nil || (loaded != nil && info.ModTime().Equal(loaded.ModTime()) && info.Size() == loaded.Size()) {
+				continue
+			}
+			loaded = info
+			
+			if err := bl.loadRules(); err != nil {
+				bl.log.errorf("Error reloading rules, keeping the previous ones: %v", err)
+				continue
+			}
+			bl.log.infof("Reloaded rules from %s", bl.config.RulesFile)
+		case <-bl.shutdownChan:
+			return
+		}
+	}
+}
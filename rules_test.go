@@ -0,0 +1,160 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// writeRules writes a rules file with a modification time of its own, so
+// quick rewrites are noticed
+func writeRules(t *testing.T, path, rules string, version int) {
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(time.Duration(version) * time.Second)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForLimit waits until the limiter gives a client the expected limit
+func waitForLimit(t *testing.T, bl *bandwidthlimiter.BandwidthLimiter, ip string, limit int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for decideFor(bl, ip).Policy.Limit != limit {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected limit %d, got %+v", ip, limit, decideFor(bl, ip).Policy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRulesFile tests that rules are reloaded from the file when it changes,
+// and invalid files keep the previous rules
+func TestRulesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, `{"defaultLimit": "2MB", "clientLimits": {"10.0.0.2": "500KB"}}`, 0)
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.BackendLimits["backend.local"] = "3MB"
+	cfg.RulesFile = path
+	cfg.RulesReloadInterval = "20ms"
+	cfg.ResolutionCacheTTL = "1m"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+
+	// Rules the file sets replace the configured ones, the others are kept
+	if decision := decideFor(bl, "10.0.0.2"); decision.Policy.Limit != 500*1024 || decision.Policy.Class != "client" {
+		t.Errorf("Expected the client rule from the file, got %+v", decision.Policy)
+	}
+	if decision := decideFor(bl, "10.0.0.1"); decision.Policy.Limit != 3*1024*1024 || decision.Policy.Class != "backend" {
+		t.Errorf("Expected the configured backend rule, got %+v", decision.Policy)
+	}
+
+	// Cached decisions are dropped with the old rules
+	writeRules(t, path, `{"backendLimits": {}, "pathLimits": [{"path": "/api/", "limit": "100KB"}]}`, 1)
+	waitForLimit(t, bl, "10.0.0.1", 1024*1024)
+	if limit := decideFor(bl, "10.0.0.2").Policy.Limit; limit != 1024*1024 {
+		t.Errorf("Expected client rules to revert to the configured ones, got %d", limit)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/api/items", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	if decision := bl.Decide(req); decision.Policy.Limit != 100*1024 || decision.PathLimit != "/api/" {
+		t.Errorf("Expected the new path rule, got %+v", decision)
+	}
+
+	// Settings that aren't rules, and invalid rules, keep the previous rules
+	writeRules(t, path, `{"defaultLimit": "5MB", "burstSize": "1MB"}`, 2)
+	time.Sleep(100 * time.Millisecond)
+	writeRules(t, path, `{"defaultLimit": "fast"}`, 3)
+	time.Sleep(100 * time.Millisecond)
+	if limit := decideFor(bl, "10.0.0.1").Policy.Limit; limit != 1024*1024 {
+		t.Errorf("Expected invalid files to keep the previous rules, got %d", limit)
+	}
+
+	writeRules(t, path, `{"defaultLimit": "5MB", "backendLimits": {}}`, 4)
+	waitForLimit(t, bl, "10.0.0.1", 5*1024*1024)
+}
+
+// TestRulesFileKeepsBuckets tests that reloads keep buckets, which take on the
+// new limits on their next use
+func TestRulesFileKeepsBuckets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.json")
+	writeRules(t, path, `{}`, 0)
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.RulesFile = path
+	cfg.RulesReloadInterval = "20ms"
+	cfg.PersistenceFile = filepath.Join(dir, "buckets.json")
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		bl.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve()
+	reloaded := time.Now()
+	writeRules(t, path, `{"defaultLimit": "200KB"}`, 1)
+	waitForLimit(t, bl, "10.0.0.1", 200*1024)
+	serve()
+
+	bl.Shutdown()
+	states, err := limiter.ReadSnapshot(cfg.PersistenceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("Expected one bucket, got %+v", states)
+	}
+	if states[0].Limit != 200*1024 || !states[0].Created.Before(reloaded) {
+		t.Errorf("Expected the bucket from before the reload with the new limit, got %+v", states[0])
+	}
+}
+
+// TestRulesFileConfig tests that the reload interval is validated, and a
+// missing rules file keeps the configured rules until it appears
+func TestRulesFileConfig(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.RulesFile = filepath.Join(t.TempDir(), "rules.json")
+	cfg.RulesReloadInterval = "often"
+	if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an invalid rulesReloadInterval")
+	}
+
+	cfg.DefaultLimit = "1MB"
+	cfg.RulesReloadInterval = "20ms"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatalf("Expected a missing rules file to be accepted, got %v", err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+	if limit := decideFor(bl, "10.0.0.1").Policy.Limit; limit != 1024*1024 {
+		t.Errorf("Expected the configured rules, got %d", limit)
+	}
+
+	writeRules(t, cfg.RulesFile, `{"defaultLimit": "2MB"}`, 0)
+	waitForLimit(t, bl, "10.0.0.1", 2*1024*1024)
+}
@@ -0,0 +1,225 @@
+package bandwidthlimiter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LimitSchedule replaces the limit of a rule class during a recurring window,
+// e.g. a lower default limit on weekdays from 09:00 to 18:00
+type LimitSchedule struct {
+	// Limit class whose limit is replaced, e.g. "default", "client" or "tier"
+	// If empty, the default limit
+	Class string `json:"class,omitempty"`
+	
+	// Days of the week in cron notation: names or numbers from 0 (Sunday) to
+	// 7 (Sunday again), lists and ranges, e.g. "mon-fri", "sat,sun" or "1-5"
+	// If empty or "*", every day
+	Days string `json:"days,omitempty"`
+	
+	// Time of day the window starts and ends, e.g. "09:00-18:00". Windows
+	// ending before they start run past midnight, e.g. "22:00-06:00".
+	// If empty, all day
+	Hours string `json:"hours,omitempty"`
+	
+	// Limit during the window
+	Limit Size `json:"limit"`
+}
+
+// minutesPerDay is the end of the day in minutes since midnight
+const minutesPerDay = 24 * 60
+
+// weekdayNames are the day names accepted by LimitSchedule.Days, by time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleWindow is a compiled days and hours window of a schedule
+type scheduleWindow struct {
+	days  [7]bool // By time.Weekday
+	start int     // Minutes since midnight
+	end   int     // Minutes since midnight, before start for windows past midnight
+}
+
+// active reports whether the window is open at the given local time. Windows
+// past midnight belong to the day they start on.
+func (w *scheduleWindow) active(local time.Time) bool {
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// compileWindow parses the days and hours of the schedule entry field
+func compileWindow(field, days, hours string) (scheduleWindow, error) {
+	window := scheduleWindow{end: minutesPerDay}
+	var err error
+	if window.days, err = parseScheduleDays(days); err != nil {
+		return window, wrapf(ErrInvalidLimit, "%s.days: %v", field, err)
+	}
+	if hours != "" {
+		if window.start, window.end, err = parseScheduleHours(hours); err != nil {
+			return window, wrapf(ErrInvalidLimit, "%s.hours: %v", field, err)
+		}
+	}
+	return window, nil
+}
+
+// limitSchedule is a compiled entry of Config.LimitSchedules
+type limitSchedule struct {
+	class  string
+	window scheduleWindow
+	limit  int64
+}
+
+// compileSchedules parses LimitSchedules, keeping their order
+func compileSchedules(schedules []LimitSchedule) ([]limitSchedule, error) {
+	compiled := make([]limitSchedule, 0, len(schedules))
+	for i, schedule := range schedules {
+		entry := limitSchedule{class: schedule.Class}
+		if entry.class == "" {
+			entry.class = limitClassDefault
+		}
+		if !scheduledClass(entry.class) {
+			return nil, wrapf(ErrInvalidLimit, "limitSchedules[%d].class: unknown limit class %q", i, schedule.Class)
+		}
+		
+		var err error
+		if entry.window, err = compileWindow(fmt.Sprintf("limitSchedules[%d]", i), schedule.Days, schedule.Hours); err != nil {
+			return nil, err
+		}
+		
+		if entry.limit, err = parseSize(schedule.Limit); err != nil {
+			return nil, wrapf(ErrInvalidLimit, "limitSchedules[%d].limit: %v", i, err)
+		}
+		if entry.limit <= 0 && entry.limit != Unlimited {
+			return nil, wrapf(ErrInvalidLimit, "limitSchedules[%d].limit must be greater than 0, or -1 or \"unlimited\"", i)
+		}
+		compiled = append(compiled, entry)
+	}
+	return compiled, nil
+}
+
+// scheduledClass reports whether schedules can replace the limits of a class
+func scheduledClass(class string) bool {
+	switch class {
+	case limitClassDefault, limitClassEntryPoint, limitClassAnonymous:
+		return true
+	}
+	for _, rule := range defaultRuleOrder {
+		if class == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScheduleDays parses a cron day-of-week field
+func parseScheduleDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	if spec == "" || spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	
+	for _, part := range strings.Split(spec, ",") {
+		first, last := strings.TrimSpace(part), ""
+		if i := strings.Index(first, "-"); i >= 0 {
+			first, last = first[:i], first[i+1:]
+		}
+		from, err := parseWeekday(first)
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if last != "" {
+			if to, err = parseWeekday(last); err != nil {
+				return days, err
+			}
+		}
+		
+		// Ranges like "fri-mon" wrap around the end of the week
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseWeekday parses a day name or cron day number
+func parseWeekday(value string) (int, error) {
+	lower := strings.ToLower(value)
+	for i, name := range weekdayNames {
+		if lower == name {
+			return i, nil
+		}
+	}
+	day, err := strconv.Atoi(value)
+	if err != nil || day < 0 || day > 7 {
+		return 0, fmt.Errorf("invalid day %q, must be a name like \"mon\" or a number from 0 to 7", value)
+	}
+	return day % 7, nil
+}
+
+// parseScheduleHours parses a "HH:MM-HH:MM" window into minutes since midnight
+func parseScheduleHours(spec string) (int, int, error) {
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid window %q, must look like \"09:00-18:00\"", spec)
+	}
+	start, err := parseTimeOfDay(strings.TrimSpace(spec[:i]))
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseTimeOfDay(strings.TrimSpace(spec[i+1:]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end || start == minutesPerDay {
+		return 0, 0, fmt.Errorf("invalid window %q, must not be empty", spec)
+	}
+	return start, end, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight; "24:00" is the end of the day
+func parseTimeOfDay(value string) (int, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid time %q, must look like \"09:00\"", value)
+	}
+	hour, err := strconv.Atoi(value[:i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must look like \"09:00\"", value)
+	}
+	minute, err := strconv.Atoi(value[i+1:])
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > minutesPerDay {
+		return 0, fmt.Errorf("invalid time %q, must look like \"09:00\"", value)
+	}
+	return hour*60 + minute, nil
+}
+
+// schedule applies the first LimitSchedules entry open at now for the class
+// of a decision. Keys don't depend on the schedule, so buckets carry their
+// tokens across window boundaries and only change their rate.
+func (bl *BandwidthLimiter) schedule(decision Decision, now time.Time) Decision {
+	if len(bl.parsed.schedules) == 0 {
+		return decision
+	}
+	local := now.In(bl.parsed.scheduleLocation)
+	for i := range bl.parsed.schedules {
+		schedule := &bl.parsed.schedules[i]
+		if schedule.class == decision.Policy.Class && schedule.window.active(local) {
+			decision.Policy.Limit = schedule.limit
+			decision.Scheduled = true
+			return decision
+		}
+	}
+	return decision
+}
@@ -0,0 +1,167 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// hoursAround returns an hours window from the given offsets to now in UTC
+func hoursAround(from, to time.Duration) string {
+	now := time.Now().UTC()
+	return now.Add(from).Format("15:04") + "-" + now.Add(to).Format("15:04")
+}
+
+// TestLimitSchedules tests that open windows replace the limit of their class
+func TestLimitSchedules(t *testing.T) {
+	today := strings.ToLower(time.Now().UTC().Weekday().String()[:3])
+	tomorrow := strings.ToLower(time.Now().UTC().Add(24 * time.Hour).Weekday().String()[:3])
+
+	tests := []struct {
+		name      string
+		schedules []bandwidthlimiter.LimitSchedule
+		ip        string
+		limit     int64
+	}{
+		{"today", []bandwidthlimiter.LimitSchedule{{Days: today, Limit: "5MB"}}, "10.0.0.1", 5 * 1024 * 1024},
+		{"tomorrow", []bandwidthlimiter.LimitSchedule{{Days: tomorrow, Limit: "5MB"}}, "10.0.0.1", 1024 * 1024},
+		{"open window", []bandwidthlimiter.LimitSchedule{{Hours: hoursAround(-time.Hour, time.Hour), Limit: "5MB"}}, "10.0.0.1", 5 * 1024 * 1024},
+		{"closed window", []bandwidthlimiter.LimitSchedule{{Hours: hoursAround(time.Hour, 2*time.Hour), Limit: "5MB"}}, "10.0.0.1", 1024 * 1024},
+		{"other class", []bandwidthlimiter.LimitSchedule{{Class: "client", Limit: "5MB"}}, "10.0.0.1", 1024 * 1024},
+		{"client class", []bandwidthlimiter.LimitSchedule{{Class: "client", Limit: "5MB"}}, "192.0.2.1", 5 * 1024 * 1024},
+		{"first open window wins", []bandwidthlimiter.LimitSchedule{
+			{Days: tomorrow, Limit: "2MB"},
+			{Days: "*", Limit: "3MB"},
+			{Limit: "4MB"},
+		}, "10.0.0.1", 3 * 1024 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.DefaultLimit = "1MB"
+			cfg.ClientLimits["192.0.2.1"] = "2MB"
+			cfg.LimitSchedules = tt.schedules
+			cfg.ResolutionCacheTTL = "1m"
+			handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+			defer bl.Shutdown()
+
+			// The second decision comes from the resolution cache
+			for i := 0; i < 2; i++ {
+				decision := decideFor(bl, tt.ip)
+				if decision.Policy.Limit != tt.limit {
+					t.Errorf("Expected limit %d, got %d", tt.limit, decision.Policy.Limit)
+				}
+				if decision.Scheduled != (tt.limit == 5*1024*1024 || tt.limit == 3*1024*1024) {
+					t.Errorf("Unexpected scheduled flag in %+v", decision)
+				}
+			}
+		})
+	}
+}
+
+// TestScheduleKeepsBuckets tests that existing buckets keep their tokens and
+// continue at the scheduled rate
+func TestScheduleKeepsBuckets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "buckets.json")
+	now := time.Now()
+	err := limiter.WriteSnapshot(file, []limiter.State{{
+		Key:        "10.0.0.1:backend.local",
+		Tokens:     0,
+		Limit:      1024 * 1024,
+		BurstSize:  10 * 1024 * 1024,
+		LastRefill: now,
+		LastUsed:   now,
+		Created:    now,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.PersistenceFile = file
+	cfg.PersistenceDropStale = true
+	cfg.LimitSchedules = []bandwidthlimiter.LimitSchedule{{Limit: "100KB"}}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 50*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	// An empty bucket at 100KB/s, rather than a fresh one or the old rate
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	rr := httptest.NewRecorder()
+	bl.ServeHTTP(rr, req)
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 1200*time.Millisecond {
+		t.Errorf("Expected the 50KB response to take about 500ms, took %v", elapsed)
+	}
+	if rr.Body.Len() != 50*1024 {
+		t.Errorf("Expected the full response, got %d bytes", rr.Body.Len())
+	}
+
+	bl.Shutdown()
+	states, err := limiter.ReadSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Limit != 100*1024 {
+		t.Errorf("Expected the restored bucket to follow the schedule, got %+v", states)
+	}
+}
+
+// TestScheduleConfig tests that schedules are validated
+func TestScheduleConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule bandwidthlimiter.LimitSchedule
+		timezone string
+	}{
+		{"unknown class", bandwidthlimiter.LimitSchedule{Class: "global", Limit: "1MB"}, ""},
+		{"unknown day", bandwidthlimiter.LimitSchedule{Days: "mon-funday", Limit: "1MB"}, ""},
+		{"day out of range", bandwidthlimiter.LimitSchedule{Days: "8", Limit: "1MB"}, ""},
+		{"hours without minutes", bandwidthlimiter.LimitSchedule{Hours: "9-18", Limit: "1MB"}, ""},
+		{"empty window", bandwidthlimiter.LimitSchedule{Hours: "18:00-18:00", Limit: "1MB"}, ""},
+		{"hour out of range", bandwidthlimiter.LimitSchedule{Hours: "22:00-25:00", Limit: "1MB"}, ""},
+		{"missing limit", bandwidthlimiter.LimitSchedule{Days: "mon-fri"}, ""},
+		{"unknown timezone", bandwidthlimiter.LimitSchedule{Limit: "1MB"}, "Mars/Olympus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := bandwidthlimiter.CreateConfig()
+			cfg.LimitSchedules = []bandwidthlimiter.LimitSchedule{tt.schedule}
+			cfg.ScheduleTimezone = tt.timezone
+			if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.LimitSchedules = []bandwidthlimiter.LimitSchedule{
+		{Days: "Sat,SUN", Hours: "00:00-24:00", Limit: "unlimited"},
+		{Class: "tier", Days: "fri-mon", Hours: "22:00-06:00", Limit: "50MB"},
+		{Class: "anonymous", Days: "1-5,0", Limit: "1MB"},
+	}
+	cfg.ScheduleTimezone = "Europe/Berlin"
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	if err != nil {
+		t.Fatalf("Expected valid schedules, got %v", err)
+	}
+	handler.(*bandwidthlimiter.BandwidthLimiter).Shutdown()
+}
@@ -0,0 +1,95 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// simulation is the response of the simulate endpoint
+type simulation struct {
+	ClientIP       string  `json:"clientIP"`
+	Backend        string  `json:"backend"`
+	Key            string  `json:"key"`
+	Rule           string  `json:"rule"`
+	Label          string  `json:"label,omitempty"`
+	Unlimited      bool    `json:"unlimited"`
+	Limit          int64   `json:"limit"`
+	Burst          int64   `json:"burst"`
+	MinuteLimit    int64   `json:"minuteLimit,omitempty"`
+	MinRate        int64   `json:"minRate,omitempty"`
+	UploadLimit    int64   `json:"uploadLimit,omitempty"`
+	QueueMaxWaitMs int64   `json:"queueMaxWaitMs,omitempty"`
+	Cost           float64 `json:"cost"`
+	EntryPoint     string  `json:"entryPoint,omitempty"`
+	PathLimit      string  `json:"pathLimit,omitempty"`
+	Scheduled      bool    `json:"scheduled,omitempty"`
+	Overridden     bool    `json:"overridden,omitempty"`
+	Profile        string  `json:"profile,omitempty"`
+}
+
+// syntheticRequest builds a GET request from a client IP to a backend for
+// resolving decisions without any traffic, the path defaulting to "/"
+func syntheticRequest(ip, host, path string) *http.Request {
+	if path == "" {
+		path = "/"
+	}
+	return &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: host, Path: path},
+		Header:     make(http.Header),
+		RemoteAddr: net.JoinHostPort(ip, "0"),
+	}
+}
+
+// handleSimulate serves GET /simulate?ip=<ip>&host=<host>&path=<path>&entryPoint=<name>, reporting
+// which rule and limits a request would get without touching any bucket
+func (bl *BandwidthLimiter) handleSimulate(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	query := req.URL.Query()
+	ip := query.Get("ip")
+	if ip == "" {
+		http.Error(rw, "ip must be set", http.StatusBadRequest)
+		return
+	}
+	
+	simulated := syntheticRequest(ip, query.Get("host"), query.Get("path"))
+	bl.rulesMutex.RLock()
+	decision := bl.override(bl.schedule(bl.decide(simulated, query.Get("entryPoint")), time.Now()))
+	bl.rulesMutex.RUnlock()
+	
+	// Only reported if uploads are limited at all
+	var uploadLimit int64
+	if bl.config.LimitUploads {
+		uploadLimit = bl.uploadPolicy(decision).Limit
+	}
+	
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(simulation{
+		ClientIP:       decision.ClientIP,
+		Backend:        decision.Backend,
+		Key:            decision.Key,
+		Rule:           decision.Policy.Class,
+		Label:          decision.Policy.Label,
+		Unlimited:      decision.Policy.Limit == Unlimited,
+		Limit:          decision.Policy.Limit,
+		Burst:          decision.Policy.Burst,
+		MinuteLimit:    decision.Policy.MinuteLimit,
+		MinRate:        decision.Policy.MinRate,
+		UploadLimit:    uploadLimit,
+		QueueMaxWaitMs: decision.Policy.QueueMaxWait.Milliseconds(),
+		Cost:           decision.Cost,
+		EntryPoint:     decision.EntryPoint,
+		PathLimit:      decision.PathLimit,
+		Scheduled:      decision.Scheduled,
+		Overridden:     decision.Overridden,
+		Profile:        decision.Profile,
+	})
+}
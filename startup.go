@@ -0,0 +1,80 @@
+package bandwidthlimiter
+
+import (
+	"strings"
+)
+
+// logStartup logs a single line summing up the settings New ended up with,
+// once defaults are applied and persistence, rules and profiles are set up,
+// so operators can check them against what they meant to configure. Fields
+// are key=value pairs, limits in plain bytes per second.
+func (bl *BandwidthLimiter) logStartup() {
+	bl.rulesMutex.RLock()
+	defaultLimit, burstSize := bl.parsed.defaultLimit, bl.parsed.burstSize
+	rules := len(bl.parsed.clientLimits) + len(bl.parsed.backendLimits) + len(bl.parsed.pathLimits) +
+		len(bl.parsed.tierLimits) + len(bl.parsed.reputationLimits) + len(bl.parsed.countryLimits) +
+		len(bl.parsed.continentLimits) + len(bl.parsed.keyLimits) + len(bl.parsed.serviceLimits) +
+		len(bl.parsed.schedules)
+	if bl.parsed.clientNetworks != nil {
+		rules += bl.parsed.clientNetworks.len()
+	}
+	bl.rulesMutex.RUnlock()
+	
+	// PersistenceFile may have moved to the fallback, or become read-only if
+	// neither can be written
+	persistence := "off"
+	if bl.config.PersistenceFile != "" {
+		mode := "read-write"
+		if bl.config.PersistenceReadOnly {
+			mode = "read-only"
+		}
+		persistence = mode + " persistenceFile=" + bl.config.PersistenceFile
+	}
+	
+	features := bl.startupFeatures()
+	if len(features) == 0 {
+		features = []string{"none"}
+	}
+	
+	bl.log.infof("Started with profile=%s defaultLimit=%d burstSize=%d rules=%d entryPoints=%d mode=%s pacing=%s store=%s persistence=%s features=%s",
+		bl.Profile(), defaultLimit, burstSize, rules, len(bl.parsed.entryPointProfiles), bl.config.Mode, bl.config.Pacing,
+		bl.config.Storage, persistence, strings.Join(features, ","))
+}
+
+// startupFeatures names the optional features in effect, by the setting
+// enabling them
+func (bl *BandwidthLimiter) startupFeatures() []string {
+	// The database is only in effect if it could be opened
+	bl.country.mutex.RLock()
+	geoIP := bl.config.GeoIPDatabase != "" && bl.country.provider != nil
+	bl.country.mutex.RUnlock()
+	
+	var features []string
+	add := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	
+	add(bl.parsed.globalLimit > 0, "globalLimit")
+	add(bl.parsed.originReadLimit > 0, "originReadLimit")
+	add(bl.config.LimitUploads, "limitUploads")
+	add(bl.config.RequestLimit > 0, "requestLimit")
+	add(bl.parsed.maxBytesPerRequest > 0, "maxBytesPerRequest")
+	add(bl.parsed.maxTransferTime > 0, "maxTransferTime")
+	add(bl.config.Reservation, "reservation")
+	add(bl.config.MaxConcurrent > 0, "maxConcurrent")
+	add(bl.config.MaxConcurrentTransfers > 0, "maxConcurrentTransfers")
+	add(bl.config.VideoAware, "videoAware")
+	add(bl.ring != nil, "partitionPeers")
+	add(bl.config.ClusterDir != "", "clusterDir")
+	add(bl.config.RulesFile != "", "rulesFile")
+	add(len(bl.config.ProfileSchedules) > 0, "profileSchedules")
+	add(len(bl.config.ReputationLists) > 0, "reputationLists")
+	add(geoIP, "geoIPDatabase")
+	add(bl.config.AdminAddress != "", "adminAddress")
+	add(bl.config.MetricsAddress != "", "metricsAddress")
+	add(bl.config.Expvar, "expvar")
+	add(bl.config.PprofLabels, "pprofLabels")
+	return features
+}
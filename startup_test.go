@@ -0,0 +1,74 @@
+package bandwidthlimiter_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// startupLine returns the last line New logs for cfg, its summary
+func startupLine(t *testing.T, cfg *bandwidthlimiter.Config) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	handler, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	bl.SetLogger(&recordingLogger{}) // Keeps the shutdown out of the pipe
+	defer bl.Shutdown()
+	writer.Close()
+
+	var last string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		last = scanner.Text()
+	}
+	return last
+}
+
+// TestStartupSummary tests that New logs the settings it ended up with
+func TestStartupSummary(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1KB"
+	cfg.ClientLimits["10.0.0.1"] = "2KB"
+	cfg.ClientLimits["10.1.0.0/16"] = "4KB"
+	cfg.BackendLimits["backend.local"] = "8KB"
+	cfg.LimitUploads = true
+	cfg.Expvar = true
+	line := startupLine(t, cfg)
+
+	for _, field := range []string{
+		"info", "test-limiter: Started with", "profile=base", "defaultLimit=1024", "burstSize=10485760", "rules=3",
+		"mode=throttle", "pacing=tokens", "store=memory", "persistence=off", "features=limitUploads,expvar",
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("Expected %q in the summary, got %q", field, line)
+		}
+	}
+
+	// Persistence degrades to read-only when the file can't be written
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.PersistenceFile = filepath.Join(blocker, "buckets.json")
+	line = startupLine(t, cfg)
+	if !strings.Contains(line, "persistence=read-only persistenceFile="+cfg.PersistenceFile) || !strings.Contains(line, "features=none") {
+		t.Errorf("Expected read-only persistence and no features, got %q", line)
+	}
+}
@@ -0,0 +1,145 @@
+package bandwidthlimiter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestStats accumulates what the limiter did for a single request. It is
+// attached to the request context and finalized once the request completes,
+// when it feeds the access log headers, metrics and OnRequestDone callbacks.
+type RequestStats struct {
+	Decision Decision
+	
+	// When the limiter started handling the request, and how long it took
+	Start    time.Time
+	Duration time.Duration
+	
+	// Response body bytes written, the number of chunks they were written in
+	// and the time spent waiting for tokens
+	BytesWritten int64
+	Chunks       int64
+	Wait         time.Duration
+	
+	// Request body bytes read by the backend and the time spent waiting for
+	// upload tokens, see Config.LimitUploads
+	BytesRead  int64
+	UploadWait time.Duration
+	
+	// Time reading the response from its origin was held back, see
+	// Config.OriginReadLimit. It overlaps with Wait, the client side.
+	OriginWait time.Duration
+	
+	// Time the request was held for a request-rate token, see Config.RequestLimit
+	RequestWait time.Duration
+	
+	// Time the request waited for a transfer slot, see Config.MaxConcurrent
+	// and Config.MaxConcurrentTransfers
+	QueueWait time.Duration
+	
+	// Status the limiter rejected the request with, 0 if it was not rejected
+	Rejected int
+	
+	// Set once the response body went through the limiter's buckets
+	Limited bool
+	
+	// Set when a marker header made the response skip the limiter, see Config.BypassHeaders
+	Bypassed bool
+	
+	// Why the response was cut off, "maxBytesPerRequest" or "maxTransferTime",
+	// empty if it was sent in full
+	Aborted string
+	
+	// Error behind Rejected or Aborted, for errors.Is: it wraps
+	// ErrQuotaExceeded for ClusterQuota, MaxBytesPerRequest and
+	// MaxTransferTime, and is nil for other reasons
+	Err error
+	
+	// Set when the request context ended, e.g. because the client
+	// disconnected, before the response body was sent in full
+	Canceled bool
+	
+	// Set when the response was still transferring once Shutdown started
+	// draining, and was sped up by DrainBoost, see Config.DrainTimeout
+	Drained bool
+	
+	// Tokens the response body was paid with up front, see Config.Reservation
+	Reserved int64
+	
+	// Chunks delayed as the global bucket ran low, see Config.GlobalEarlyThrottle
+	EarlyThrottled int64
+	
+	// Set when the handler took over the connection, e.g. for a WebSocket
+	// upgrade. Traffic on hijacked connections is only counted with
+	// ThrottleHijacked.
+	Hijacked bool
+}
+
+// TotalWait returns the time spent waiting for tokens, downloads, uploads and request rates combined
+func (stats *RequestStats) TotalWait() time.Duration {
+	return stats.Wait + stats.UploadWait + stats.RequestWait
+}
+
+// Delay returns all the time the limiter held the request up: token waits
+// and waits for transfer slots
+func (stats *RequestStats) Delay() time.Duration {
+	return stats.TotalWait() + stats.QueueWait
+}
+
+// statsContextKey is the context key of a request's *RequestStats
+type statsContextKey struct{}
+
+// StatsFromContext returns the limiter statistics of the request the context
+// belongs to, or nil if the request is not limited. Handlers further down the
+// chain may read them while the request is in progress.
+func StatsFromContext(ctx context.Context) *RequestStats {
+	stats, _ := ctx.Value(statsContextKey{}).(*RequestStats)
+	return stats
+}
+
+// statsCallbacks holds the functions run for every completed request
+type statsCallbacks struct {
+	mutex     sync.RWMutex
+	callbacks []func(*RequestStats)
+}
+
+// OnRequestDone registers a function called with the finalized statistics of
+// every limited request, e.g. to feed an external metrics system. Callbacks run
+// on the request's goroutine after the response was written and must not keep
+// the stats.
+func (bl *BandwidthLimiter) OnRequestDone(callback func(*RequestStats)) {
+	bl.statsCallbacks.mutex.Lock()
+	defer bl.statsCallbacks.mutex.Unlock()
+	
+	bl.statsCallbacks.callbacks = append(bl.statsCallbacks.callbacks, callback)
+}
+
+// finishRequest finalizes a request's stats and reports them
+func (bl *BandwidthLimiter) finishRequest(req *http.Request, stats *RequestStats) {
+	stats.Duration = time.Since(stats.Start)
+	
+	bl.observeRequest(stats)
+	bl.recordSpan(req.Context(), stats)
+	
+	// Expose limiter data to the access log. Traefik logs the request headers
+	// after the chain returns, and the upstream request has already been sent.
+	if bl.config.AccessLogHeaders {
+		policy := stats.Decision.Policy
+		req.Header.Set(accessLogLimitHeader, strconv.FormatInt(policy.Limit, 10))
+		req.Header.Set(accessLogKeyHeader, stats.Decision.Key)
+		req.Header.Set(accessLogWaitHeader, strconv.FormatInt(stats.TotalWait().Milliseconds(), 10))
+		if policy.Label != "" {
+			req.Header.Set(accessLogLabelHeader, policy.Label)
+		}
+	}
+	
+	bl.statsCallbacks.mutex.RLock()
+	defer bl.statsCallbacks.mutex.RUnlock()
+	
+	for _, callback := range bl.statsCallbacks.callbacks {
+		callback(stats)
+	}
+}
@@ -0,0 +1,69 @@
+package bandwidthlimiter_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestRequestStats tests that a request's stats are visible downstream and reported on completion
+func TestRequestStats(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "1MB"
+	cfg.BurstSize = "1MB"
+	cfg.LimitUploads = true
+	cfg.AccessLogHeaders = true
+
+	var downstreamKey string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if stats := bandwidthlimiter.StatsFromContext(req.Context()); stats != nil {
+			downstreamKey = stats.Decision.Key
+		}
+		io.ReadAll(req.Body)
+		rw.Write(make([]byte, 10000))
+	})
+
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	var reported []bandwidthlimiter.RequestStats
+	bl.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		reported = append(reported, *stats)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "http://backend.local/upload", bytes.NewReader(make([]byte, 5000)))
+	req.RemoteAddr = "10.0.0.1:1000"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if downstreamKey != "10.0.0.1:backend.local" {
+		t.Errorf("Expected the stats to be visible downstream, got key %q", downstreamKey)
+	}
+	if len(reported) != 1 {
+		t.Fatalf("Expected 1 reported request, got %d", len(reported))
+	}
+
+	stats := reported[0]
+	if stats.BytesWritten != 10000 || stats.Chunks != 3 {
+		t.Errorf("Expected 10000 bytes in 3 chunks, got %d in %d", stats.BytesWritten, stats.Chunks)
+	}
+	if stats.BytesRead != 5000 {
+		t.Errorf("Expected 5000 bytes read, got %d", stats.BytesRead)
+	}
+	if !stats.Limited || stats.Bypassed || stats.Rejected != 0 {
+		t.Errorf("Expected a limited request, got %+v", stats)
+	}
+	if stats.Duration <= 0 {
+		t.Errorf("Expected the duration to be set, got %v", stats.Duration)
+	}
+	if req.Header.Get("X-Bandwidth-Key") != stats.Decision.Key {
+		t.Errorf("Expected the access log key %q, got %q", stats.Decision.Key, req.Header.Get("X-Bandwidth-Key"))
+	}
+}
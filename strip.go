@@ -0,0 +1,108 @@
+package bandwidthlimiter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// validateStripHeaders checks a list of header names to strip
+func validateStripHeaders(field string, names []string) error {
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return wrapf(ErrInvalidLimit, "%s must not contain empty header names", field)
+		}
+	}
+	return nil
+}
+
+// stripRequestHeaders wraps next so the backend never sees the named request
+// headers. The limiter itself has read them by the time next is called.
+func stripRequestHeaders(next http.Handler, names []string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, name := range names {
+			req.Header.Del(name)
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// strippingResponseWriter removes the named headers from the response before
+// they are sent. It wraps the client's writer, outside the limiter's own, so
+// markers in the response still reach the limiter.
+type strippingResponseWriter struct {
+	http.ResponseWriter
+	names       []string
+	wroteHeader bool
+}
+
+// strip removes the headers about to be sent
+func (w *strippingResponseWriter) strip() {
+	header := w.ResponseWriter.Header()
+	for _, name := range w.names {
+		header.Del(name)
+	}
+}
+
+// WriteHeader strips the headers before sending them, including for 1xx responses
+func (w *strippingResponseWriter) WriteHeader(statusCode int) {
+	w.strip()
+	if statusCode >= 200 {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write strips the headers if the first write sends them implicitly
+func (w *strippingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.strip()
+		w.wroteHeader = true
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom strips the headers if the copy sends them, and lets the client's
+// writer send src, e.g. with sendfile
+func (w *strippingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.strip()
+		w.wroteHeader = true
+	}
+	if readerFrom, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Flush strips the headers if flushing sends them, and flushes the client's writer
+func (w *strippingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.strip()
+		w.wroteHeader = true
+	}
+	if flusher, ok := flusherOf(w.ResponseWriter); ok {
+		flusher.Flush()
+	}
+}
+
+// Push starts an HTTP/2 server push, if a wrapped writer supports it
+func (w *strippingResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := pusherOf(w.ResponseWriter); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Hijack hands the client's connection over to the handler. Headers written
+// on the hijacked connection are the handler's own and are not stripped.
+func (w *strippingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// Unwrap returns the client's writer, for http.ResponseController
+func (w *strippingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,59 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestStripHeaders tests that internal headers are read by the limiter but never passed on
+func TestStripHeaders(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.BypassHeaders["X-Limited-Upstream"] = "1"
+	cfg.StripRequestHeaders = []string{"x-client-id"}
+	cfg.StripResponseHeaders = []string{"X-Limited-Upstream", "X-Debug"}
+
+	var backendSaw string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		backendSaw = req.Header.Get("X-Client-Id")
+		rw.Header().Set("X-Limited-Upstream", "1")
+		rw.Header().Set("X-Debug", "cache=miss")
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte("ok"))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bypassed bool
+	handler.(*bandwidthlimiter.BandwidthLimiter).OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		bypassed = stats.Bypassed
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.Header.Set("X-Client-Id", "user-42")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if backendSaw != "" {
+		t.Errorf("Expected the backend not to see the stripped request header, got %q", backendSaw)
+	}
+	if recorder.Header().Get("X-Limited-Upstream") != "" || recorder.Header().Get("X-Debug") != "" {
+		t.Errorf("Expected internal response headers to be stripped, got %v", recorder.Header())
+	}
+	if recorder.Header().Get("Content-Type") != "text/plain" || recorder.Body.String() != "ok" {
+		t.Errorf("Expected other headers and the body to pass, got %v %q", recorder.Header(), recorder.Body.String())
+	}
+	if !bypassed {
+		t.Error("Expected the limiter to honor the marker before it was stripped")
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.StripResponseHeaders = []string{" "}
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for an empty header name")
+	}
+}
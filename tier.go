@@ -0,0 +1,47 @@
+package bandwidthlimiter
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// limitClassTier is reported for requests limited by the TierLimits entry of their JWT claim
+const limitClassTier = "tier"
+
+// tier returns the value of the TierClaim of a request's JWT, or "" if the
+// request carries no valid token or the claim is missing
+func (bl *BandwidthLimiter) tier(req *http.Request) string {
+	token := ""
+	if bl.config.TierTokenCookie != "" {
+		if cookie, err := req.Cookie(bl.config.TierTokenCookie); err == nil {
+			token = cookie.Value
+		}
+	} else {
+		token = bearerToken(req.Header.Get(bl.config.TierTokenHeader))
+	}
+	if token == "" {
+		return ""
+	}
+	
+	claims, ok := verifyJWT(token, []byte(bl.config.TierJWTSecret), time.Now())
+	if !ok {
+		return ""
+	}
+	switch value := claims[bl.config.TierClaim].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return ""
+}
+
+// tierKey marks a bucket key as belonging to a tier, so a client's tokens of
+// different tiers don't share a bucket. Tier values may contain any character,
+// so the tier always comes last.
+func tierKey(key *keyBuilder, tier string) {
+	key.add("$", tier)
+}
@@ -0,0 +1,91 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestTierLimits tests that the JWT claim of a request selects its limit
+func TestTierLimits(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.TierClaim = "plan"
+	cfg.TierJWTSecret = "tier-secret"
+	cfg.TierLimits["premium"] = "10MB"
+	cfg.TierLimits["free"] = "256KB"
+	cfg.ClientLimits["10.0.0.9"] = "unlimited"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	decide := func(ip, token string) bandwidthlimiter.Decision {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		req.RemoteAddr = ip + ":1000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return bl.Decide(req)
+	}
+
+	decision := decide("10.0.0.1", signJWT(`{"sub":"alice","plan":"premium"}`, "tier-secret"))
+	if decision.Policy.Limit != 10*1024*1024 || decision.Policy.Class != "tier" || decision.Tier != "premium" {
+		t.Errorf("Expected the premium tier, got %+v", decision.Policy)
+	}
+	if decision.Key != "10.0.0.1:backend.local$premium" {
+		t.Errorf("Expected a bucket per tier, got key %q", decision.Key)
+	}
+
+	tests := []struct {
+		name, ip, token string
+		limit           int64
+		class           string
+	}{
+		{"free tier", "10.0.0.1", signJWT(`{"plan":"free"}`, "tier-secret"), 256 * 1024, "tier"},
+		{"unknown tier", "10.0.0.1", signJWT(`{"plan":"gold"}`, "tier-secret"), 1024 * 1024, "default"},
+		{"no claim", "10.0.0.1", signJWT(`{"sub":"bob"}`, "tier-secret"), 1024 * 1024, "default"},
+		{"bad signature", "10.0.0.1", signJWT(`{"plan":"premium"}`, "other-secret"), 1024 * 1024, "default"},
+		{"expired", "10.0.0.1", signJWT(`{"plan":"premium","exp":1000}`, "tier-secret"), 1024 * 1024, "default"},
+		{"no token", "10.0.0.1", "", 1024 * 1024, "default"},
+		{"client rule", "10.0.0.9", signJWT(`{"plan":"free"}`, "tier-secret"), bandwidthlimiter.Unlimited, "client"},
+	}
+	for _, tt := range tests {
+		decision := decide(tt.ip, tt.token)
+		if decision.Policy.Limit != tt.limit || decision.Policy.Class != tt.class {
+			t.Errorf("%s: expected %d from %s, got %d from %s", tt.name, tt.limit, tt.class, decision.Policy.Limit, decision.Policy.Class)
+		}
+	}
+}
+
+// TestTierCookie tests that the JWT can be read from a cookie
+func TestTierCookie(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.TierClaim = "plan"
+	cfg.AuthJWTSecret = "shared-secret"
+	cfg.TierTokenCookie = "session"
+	cfg.TierLimits["premium"] = "10MB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: signJWT(`{"plan":"premium"}`, "shared-secret")})
+	if decision := handler.(*bandwidthlimiter.BandwidthLimiter).Decide(req); decision.Tier != "premium" {
+		t.Errorf("Expected the tier from the cookie, got %+v", decision.Policy)
+	}
+
+	cfg = bandwidthlimiter.CreateConfig()
+	cfg.TierClaim = "plan"
+	if _, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter"); err == nil {
+		t.Error("Expected an error for tiers without a secret")
+	}
+}
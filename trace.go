@@ -0,0 +1,91 @@
+package bandwidthlimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Prefix of the span attributes recorded by the limiter
+const spanAttributePrefix = "bandwidthlimiter."
+
+// Span is the part of a tracing span the limiter records its attributes on.
+// Tracing libraries aren't available to Traefik plugins, so embedders wrap
+// their span type, e.g. OpenTelemetry's trace.Span, in a small adapter.
+type Span interface {
+	// SetAttribute records a string, int64 or bool attribute
+	SetAttribute(key string, value interface{})
+}
+
+// spanSource holds the function registered with TraceSpans
+type spanSource struct {
+	mutex sync.RWMutex
+	spans func(ctx context.Context) Span
+}
+
+// TraceSpans makes every limited request record its limiter attributes on
+// the span spans returns for the request's context, if it isn't nil: the
+// bucket key, rule class and limit, bytes transferred and the time the
+// limiter held the request up. Traces then show how much of a request was
+// spent waiting for tokens rather than on the backend. Attributes are
+// recorded once the response was written.
+func (bl *BandwidthLimiter) TraceSpans(spans func(ctx context.Context) Span) {
+	bl.spanSource.mutex.Lock()
+	defer bl.spanSource.mutex.Unlock()
+	
+	bl.spanSource.spans = spans
+}
+
+// recordSpan records a finished request's stats on its span, if TraceSpans
+// was set up and the request has one
+func (bl *BandwidthLimiter) recordSpan(ctx context.Context, stats *RequestStats) {
+	bl.spanSource.mutex.RLock()
+	spans := bl.spanSource.spans
+	bl.spanSource.mutex.RUnlock()
+	if spans == nil {
+		return
+	}
+	span := spans(ctx)
+	if span == nil {
+		return
+	}
+	
+	policy := stats.Decision.Policy
+	span.SetAttribute(spanAttributePrefix+"key", stats.Decision.Key)
+	span.SetAttribute(spanAttributePrefix+"class", policy.Class)
+	span.SetAttribute(spanAttributePrefix+"limit", policy.Limit)
+	span.SetAttribute(spanAttributePrefix+"bytes_written", stats.BytesWritten)
+	span.SetAttribute(spanAttributePrefix+"delay_ms", stats.Delay().Milliseconds())
+	if policy.Label != "" {
+		span.SetAttribute(spanAttributePrefix+"label", policy.Label)
+	}
+	if stats.BytesRead > 0 {
+		span.SetAttribute(spanAttributePrefix+"bytes_read", stats.BytesRead)
+	}
+	
+	// The parts of the delay, only when the request was held up by them
+	waits := []struct {
+		name string
+		wait time.Duration
+	}{
+		{"wait_ms", stats.Wait},
+		{"upload_wait_ms", stats.UploadWait},
+		{"request_wait_ms", stats.RequestWait},
+		{"queue_wait_ms", stats.QueueWait},
+	}
+	for _, w := range waits {
+		if w.wait > 0 {
+			span.SetAttribute(spanAttributePrefix+w.name, w.wait.Milliseconds())
+		}
+	}
+	
+	if stats.Rejected != 0 {
+		span.SetAttribute(spanAttributePrefix+"rejected", int64(stats.Rejected))
+	}
+	if stats.Aborted != "" {
+		span.SetAttribute(spanAttributePrefix+"aborted", stats.Aborted)
+	}
+	if stats.Canceled {
+		span.SetAttribute(spanAttributePrefix+"canceled", true)
+	}
+}
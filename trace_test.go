@@ -0,0 +1,67 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// recordingSpan keeps the attributes set on it
+type recordingSpan map[string]interface{}
+
+func (s recordingSpan) SetAttribute(key string, value interface{}) {
+	s[key] = value
+}
+
+// spanKey is the context key of a request's recordingSpan
+type spanKey struct{}
+
+// TestTraceSpans tests that the limiter's attributes are recorded on the
+// request's span
+func TestTraceSpans(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "100KB"
+	cfg.BurstSize = "10KB"
+	cfg.RuleLabels["backend.local"] = "standard"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 30*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	defer bl.Shutdown()
+	bl.TraceSpans(func(ctx context.Context) bandwidthlimiter.Span {
+		if span, ok := ctx.Value(spanKey{}).(recordingSpan); ok {
+			return span
+		}
+		return nil
+	})
+
+	span := recordingSpan{}
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	bl.ServeHTTP(httptest.NewRecorder(), req.WithContext(context.WithValue(req.Context(), spanKey{}, span)))
+
+	// 20KB over the burst take about 200ms at 100KB/s
+	if span["bandwidthlimiter.key"] != "10.0.0.1:backend.local" || span["bandwidthlimiter.class"] != "default" ||
+		span["bandwidthlimiter.label"] != "standard" || span["bandwidthlimiter.limit"] != int64(100*1024) ||
+		span["bandwidthlimiter.bytes_written"] != int64(30*1024) {
+		t.Errorf("Unexpected attributes %v", span)
+	}
+	if delay, _ := span["bandwidthlimiter.delay_ms"].(int64); delay < 150 || span["bandwidthlimiter.wait_ms"] != delay {
+		t.Errorf("Expected a token wait of about 200ms, got %v", span)
+	}
+	if _, ok := span["bandwidthlimiter.queue_wait_ms"]; ok {
+		t.Errorf("Expected waits that didn't happen to be left out, got %v", span)
+	}
+
+	// Requests without a span are left alone
+	req = httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	req.RemoteAddr = "10.0.0.2:1000"
+	bl.ServeHTTP(httptest.NewRecorder(), req)
+}
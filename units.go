@@ -0,0 +1,611 @@
+package bandwidthlimiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// Size is a byte count or a rate in bytes per second. It is either a plain
+// number of bytes or a number with a unit, e.g. "1048576", "1MB", "512KiB/s"
+// or "2.5M". Units are binary, so 1KB = 1KiB = 1024 bytes. Client and backend
+// limits also accept "unlimited".
+type Size string
+
+// Bytes returns the Size of n bytes
+func Bytes(n int64) Size {
+	return Size(strconv.FormatInt(n, 10))
+}
+
+// UnmarshalJSON accepts JSON numbers as well as strings
+func (s *Size) UnmarshalJSON(data []byte) error {
+	return unmarshalNumberOrString(data, (*string)(s))
+}
+
+// Duration is a length of time, either a number of seconds or a Go duration
+// such as "90s", "5m" or "1h"
+type Duration string
+
+// Seconds returns the Duration of n seconds
+func Seconds(n int64) Duration {
+	return Duration(strconv.FormatInt(n, 10))
+}
+
+// UnmarshalJSON accepts JSON numbers as well as strings
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	return unmarshalNumberOrString(data, (*string)(d))
+}
+
+// ShortDuration is a timeout or wait, either a number of milliseconds or a
+// Go duration such as "250ms" or "2s"
+type ShortDuration string
+
+// Milliseconds returns the ShortDuration of n milliseconds
+func Milliseconds(n int64) ShortDuration {
+	return ShortDuration(strconv.FormatInt(n, 10))
+}
+
+// UnmarshalJSON accepts JSON numbers as well as strings
+func (d *ShortDuration) UnmarshalJSON(data []byte) error {
+	return unmarshalNumberOrString(data, (*string)(d))
+}
+
+// unmarshalNumberOrString decodes a JSON number or string into s
+func unmarshalNumberOrString(data []byte, s *string) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*s = number.String()
+		return nil
+	}
+	return json.Unmarshal(data, s)
+}
+
+// sizeUnits maps lower-case unit suffixes to their number of bytes
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1 << 40,
+	"tib": 1 << 40,
+}
+
+// parseSize parses a Size into bytes. An empty Size is 0.
+func parseSize(value Size) (int64, error) {
+	text := strings.TrimSpace(string(value))
+	if text == "" {
+		return 0, nil
+	}
+	if strings.EqualFold(text, "unlimited") {
+		return Unlimited, nil
+	}
+	
+	// Rates may spell out the per-second suffix
+	text = strings.TrimSuffix(text, "/s")
+	
+	split := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-'
+	})
+	if split < 0 {
+		split = len(text)
+	}
+	number, unit := text[:split], strings.TrimSpace(text[split:])
+	
+	multiplier, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", value, unit)
+	}
+	
+	// Whole numbers stay exact, fractions are rounded to the nearest byte
+	if n, err := strconv.ParseInt(number, 10, 64); err == nil {
+		if n > math.MaxInt64/multiplier || n < math.MinInt64/multiplier {
+			return 0, fmt.Errorf("invalid size %q: out of range", value)
+		}
+		return n * multiplier, nil
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	bytes := math.Round(f * float64(multiplier))
+	if bytes > math.MaxInt64 || bytes < math.MinInt64 {
+		return 0, fmt.Errorf("invalid size %q: out of range", value)
+	}
+	return int64(bytes), nil
+}
+
+// parseDuration parses a Duration. An empty Duration is 0.
+func parseDuration(value Duration) (time.Duration, error) {
+	return parseDurationIn(string(value), time.Second)
+}
+
+// parseShortDuration parses a ShortDuration. An empty ShortDuration is 0.
+func parseShortDuration(value ShortDuration) (time.Duration, error) {
+	return parseDurationIn(string(value), time.Millisecond)
+}
+
+// parseDurationIn parses a Go duration, or a plain number of units
+func parseDurationIn(value string, unit time.Duration) (time.Duration, error) {
+	text := strings.TrimSpace(value)
+	if text == "" {
+		return 0, nil
+	}
+	
+	// Plain numbers are in the field's unit, as before units were supported
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+// parsedUnits holds the Config values written with units, parsed and defaulted by New
+type parsedUnits struct {
+	defaultLimit    int64
+	burstSize       int64
+	globalLimit     int64 // 0 when there is no global bucket
+	globalBurstSize int64
+	originReadLimit int64 // 0 when origin reads are not limited
+	originReadBurst int64
+	clientLimits    map[string]int64
+	clientNetworks  *cidrTrie // CIDR client limits, nil if there are none
+	backendLimits   map[string]int64
+	
+	// Backend aggregate buckets by backend, see Config.BackendAggregateLimits
+	backendAggregateLimits map[string]int64
+	
+	// Per-minute budgets and minimum rates, 0 when disabled
+	defaultMinuteLimit  int64
+	backendMinuteLimits map[string]int64
+	clientMinuteLimits  map[string]int64
+	defaultMinRate      int64
+	backendMinRates     map[string]int64
+	clientMinRates      map[string]int64
+	
+	// Upload limits, 0 when uploads get the download limit
+	uploadLimit         int64
+	backendUploadLimits map[string]int64
+	clientUploadLimits  map[string]int64
+	
+	// Other byte counts and rates, 0 when disabled
+	maxBytesInFlight    int64
+	segmentLimit        int64
+	startupSegmentLimit int64
+	anonymousLimit      int64
+	anonymousBurstSize  int64
+	preloadTokens       []int64 // By index into Config.Preload
+	
+	// Tokens taken from a peer or Redis at once
+	partitionLease int64
+	redisLease     int64
+	
+	// Cluster quotas in bytes, 0 when disabled
+	clusterQuota          int64
+	clientClusterQuotas   map[string]int64
+	clusterQuotaCarryOver int64
+	
+	bucketMaxAge    time.Duration
+	cleanupInterval time.Duration
+	saveInterval    time.Duration
+	quotaGrace      time.Duration
+	
+	// Cluster quotas, see Config.ClusterDir
+	clusterQuotaPeriod   time.Duration
+	clusterSyncInterval  time.Duration
+	clusterQuotaLocation *time.Location // Of daily and monthly resets
+	
+	// Interval between reloads of Config.ReputationLists
+	reputationRefresh time.Duration
+	
+	// Interval between checks of Config.RulesFile for changes
+	rulesReloadInterval time.Duration
+	
+	// Transfer slot waits by client and backend, see Config.QueueMaxWait
+	queueMaxWait         time.Duration
+	clientQueueMaxWaits  map[string]time.Duration
+	backendQueueMaxWaits map[string]time.Duration
+	
+	// Timeouts of lease requests to peers and of Redis commands
+	partitionTimeout time.Duration
+	redisTimeout     time.Duration
+	
+	entryPointProfiles map[string]entryPointProfile
+	pathLimits         []pathLimit
+	schedules          []limitSchedule
+	scheduleLocation   *time.Location
+	profile            string // LimitProfiles entry the rules were built with, "" for none
+	profileSchedules   []profileSchedule
+	tierLimits         map[string]int64
+	reputationLimits   map[string]int64
+	countryLimits      map[string]int64 // By upper case country code
+	continentLimits    map[string]int64 // By upper case continent code
+	keyLimits          map[string]int64 // By client ID, see apiKeyID
+	serviceLimits      map[string]int64 // By client ID, see serviceID
+	
+	// Per-response caps, 0 when disabled
+	maxBytesPerRequest int64
+	maxTransferTime    time.Duration
+	maxChunkWait       time.Duration
+	globalEarlyDelay   time.Duration // 0 until New defaults it to tickInterval
+	tickInterval       time.Duration // Of "timeslice" pacing
+	drainTimeout       time.Duration
+	
+	// Longest token wait accepted in reject mode
+	maxWait time.Duration
+	
+	// Longest a reserved response may take, 0 for no limit
+	reservationMaxWait time.Duration
+	
+	// How long resolved decisions are cached, 0 when disabled
+	resolutionCacheTTL time.Duration
+	
+	// Bytes paid for at a time, DefaultChunkSize unless configured. With
+	// autoChunkSize, chunks are sized per request from its limit instead.
+	chunkSize     int64
+	autoChunkSize bool
+}
+
+// parseUnits parses and validates the Config values written with units.
+// Errors name the offending field.
+func parseUnits(config *Config) (parsedUnits, error) {
+	var parsed parsedUnits
+	var err error
+	
+	if parsed.defaultLimit, err = parseSize(config.DefaultLimit); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "defaultLimit: %v", err)
+	}
+	if parsed.defaultLimit <= 0 {
+		return parsed, wrapf(ErrInvalidLimit, "defaultLimit must be greater than 0")
+	}
+	
+	if parsed.clientLimits, err = parseLimits("clientLimits", config.ClientLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.clientNetworks, err = parseClientNetworks(parsed.clientLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.backendLimits, err = parseLimits("backendLimits", config.BackendLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.clientUploadLimits, err = parseLimits("clientUploadLimits", config.ClientUploadLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.backendUploadLimits, err = parseLimits("backendUploadLimits", config.BackendUploadLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.tierLimits, err = parseLimits("tierLimits", config.TierLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.reputationLimits, err = parseReputationLimits(config.ReputationLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.countryLimits, err = parseCountryLimits("countryLimits", config.CountryLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.continentLimits, err = parseCountryLimits("continentLimits", config.ContinentLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.keyLimits, err = parseKeyLimits(config.KeyLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.serviceLimits, err = parseServiceLimits(config.ServiceLimits); err != nil {
+		return parsed, err
+	}
+	
+	if parsed.burstSize, err = parseSize(config.BurstSize); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "burstSize: %v", err)
+	}
+	if parsed.burstSize < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "burstSize must not be negative")
+	}
+	if parsed.burstSize == 0 {
+		parsed.burstSize = parsed.defaultLimit * 10 // Default burst is 10x the rate
+	}
+	
+	if parsed.globalLimit, err = parseSize(config.GlobalLimit); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "globalLimit: %v", err)
+	}
+	if parsed.globalLimit < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "globalLimit must not be negative")
+	}
+	if parsed.globalBurstSize, err = parseSize(config.GlobalBurstSize); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "globalBurstSize: %v", err)
+	}
+	if parsed.globalBurstSize < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "globalBurstSize must not be negative")
+	}
+	if parsed.globalBurstSize == 0 {
+		parsed.globalBurstSize = parsed.burstSize
+	}
+	
+	if parsed.originReadLimit, err = parseSize(config.OriginReadLimit); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "originReadLimit: %v", err)
+	}
+	if parsed.originReadLimit < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "originReadLimit must not be negative")
+	}
+	if parsed.originReadBurst, err = parseSize(config.OriginReadBurst); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "originReadBurst: %v", err)
+	}
+	if parsed.originReadBurst < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "originReadBurst must not be negative")
+	}
+	if parsed.originReadBurst == 0 {
+		parsed.originReadBurst = parsed.originReadLimit
+	}
+	
+	if parsed.entryPointProfiles, err = parseEntryPointProfiles(config.EntryPointProfiles); err != nil {
+		return parsed, err
+	}
+	if parsed.pathLimits, err = compilePathLimits(config.PathLimits); err != nil {
+		return parsed, err
+	}
+	if parsed.schedules, err = compileSchedules(config.LimitSchedules); err != nil {
+		return parsed, err
+	}
+	parsed.scheduleLocation = time.UTC
+	if config.ScheduleTimezone != "" {
+		if parsed.scheduleLocation, err = time.LoadLocation(config.ScheduleTimezone); err != nil {
+			return parsed, wrapf(ErrInvalidLimit, "scheduleTimezone: %v", err)
+		}
+	}
+	if parsed.profileSchedules, err = compileProfileSchedules(config); err != nil {
+		return parsed, err
+	}
+	
+	durations := []struct {
+		field        string
+		value        string
+		unit         time.Duration // Of plain numbers
+		target       *time.Duration
+		defaultValue time.Duration
+	}{
+		{"bucketMaxAge", string(config.BucketMaxAge), time.Second, &parsed.bucketMaxAge, time.Hour},
+		{"cleanupInterval", string(config.CleanupInterval), time.Second, &parsed.cleanupInterval, 5 * time.Minute},
+		{"saveInterval", string(config.SaveInterval), time.Second, &parsed.saveInterval, time.Minute},
+		{"quotaGrace", string(config.QuotaGrace), time.Second, &parsed.quotaGrace, time.Minute},
+		{"clusterQuotaPeriod", string(config.ClusterQuotaPeriod), time.Second, &parsed.clusterQuotaPeriod, time.Hour},
+		{"clusterSyncInterval", string(config.ClusterSyncInterval), time.Second, &parsed.clusterSyncInterval, 10 * time.Second},
+		{"reputationRefresh", string(config.ReputationRefresh), time.Second, &parsed.reputationRefresh, time.Hour},
+		{"rulesReloadInterval", string(config.RulesReloadInterval), time.Second, &parsed.rulesReloadInterval, 10 * time.Second},
+		{"queueMaxWait", string(config.QueueMaxWait), time.Millisecond, &parsed.queueMaxWait, 0},
+		{"globalEarlyDelay", string(config.GlobalEarlyDelay), time.Millisecond, &parsed.globalEarlyDelay, 0},
+		{"partitionTimeout", string(config.PartitionTimeout), time.Millisecond, &parsed.partitionTimeout, 250 * time.Millisecond},
+		{"redisTimeout", string(config.RedisTimeout), time.Millisecond, &parsed.redisTimeout, 100 * time.Millisecond},
+		{"tickInterval", string(config.TickInterval), time.Millisecond, &parsed.tickInterval, 100 * time.Millisecond},
+	}
+	for _, d := range durations {
+		duration, err := parseDurationIn(d.value, d.unit)
+		if err != nil {
+			return parsed, wrapf(ErrInvalidLimit, "%s: %v", d.field, err)
+		}
+		if duration < 0 {
+			return parsed, wrapf(ErrInvalidLimit, "%s must not be negative", d.field)
+		}
+		if duration == 0 {
+			duration = d.defaultValue
+		}
+		*d.target = duration
+	}
+	
+	sizes := []struct {
+		field        string
+		value        Size
+		target       *int64
+		defaultValue int64
+	}{
+		{"defaultMinuteLimit", config.DefaultMinuteLimit, &parsed.defaultMinuteLimit, 0},
+		{"defaultMinRate", config.DefaultMinRate, &parsed.defaultMinRate, 0},
+		{"uploadLimit", config.UploadLimit, &parsed.uploadLimit, 0},
+		{"maxBytesInFlight", config.MaxBytesInFlight, &parsed.maxBytesInFlight, 0},
+		{"segmentLimit", config.SegmentLimit, &parsed.segmentLimit, 0},
+		{"startupSegmentLimit", config.StartupSegmentLimit, &parsed.startupSegmentLimit, 0},
+		{"anonymousLimit", config.AnonymousLimit, &parsed.anonymousLimit, 0},
+		{"anonymousBurstSize", config.AnonymousBurstSize, &parsed.anonymousBurstSize, 0},
+		{"partitionLease", config.PartitionLease, &parsed.partitionLease, 64 * 1024},
+		{"redisLease", config.RedisLease, &parsed.redisLease, 64 * 1024},
+		{"clusterQuota", config.ClusterQuota, &parsed.clusterQuota, 0},
+		{"clusterQuotaCarryOver", config.ClusterQuotaCarryOver, &parsed.clusterQuotaCarryOver, 0},
+	}
+	for _, s := range sizes {
+		size, err := parseSize(s.value)
+		if err != nil {
+			return parsed, wrapf(ErrInvalidLimit, "%s: %v", s.field, err)
+		}
+		if size < 0 {
+			return parsed, wrapf(ErrInvalidLimit, "%s must not be negative", s.field)
+		}
+		if size == 0 {
+			size = s.defaultValue
+		}
+		*s.target = size
+	}
+	
+	sizeMaps := []struct {
+		field  string
+		values map[string]Size
+		target *map[string]int64
+	}{
+		{"backendAggregateLimits", config.BackendAggregateLimits, &parsed.backendAggregateLimits},
+		{"backendMinuteLimits", config.BackendMinuteLimits, &parsed.backendMinuteLimits},
+		{"clientMinuteLimits", config.ClientMinuteLimits, &parsed.clientMinuteLimits},
+		{"backendMinRates", config.BackendMinRates, &parsed.backendMinRates},
+		{"clientMinRates", config.ClientMinRates, &parsed.clientMinRates},
+		{"clientClusterQuotas", config.ClientClusterQuotas, &parsed.clientClusterQuotas},
+	}
+	for _, m := range sizeMaps {
+		if *m.target, err = parseSizes(m.field, m.values); err != nil {
+			return parsed, err
+		}
+	}
+	
+	parsed.preloadTokens = make([]int64, len(config.Preload))
+	for i, preload := range config.Preload {
+		if parsed.preloadTokens[i], err = parseSize(preload.InitialTokens); err != nil {
+			return parsed, wrapf(ErrInvalidLimit, "preload[%d]: initialTokens: %v", i, err)
+		}
+		if parsed.preloadTokens[i] < 0 {
+			return parsed, wrapf(ErrInvalidLimit, "preload[%d]: initialTokens must not be negative", i)
+		}
+	}
+	
+	// Quota periods are numbered by the Unix seconds they start at
+	if parsed.clusterQuotaPeriod%time.Second != 0 {
+		return parsed, wrapf(ErrInvalidLimit, "clusterQuotaPeriod must be a whole number of seconds")
+	}
+	parsed.clusterQuotaLocation = time.UTC
+	if config.ClusterQuotaTimezone != "" {
+		if parsed.clusterQuotaLocation, err = time.LoadLocation(config.ClusterQuotaTimezone); err != nil {
+			return parsed, wrapf(ErrInvalidLimit, "clusterQuotaTimezone: %v", err)
+		}
+	}
+	if parsed.clientQueueMaxWaits, err = parseQueueMaxWaits("clientQueueMaxWaits", config.ClientQueueMaxWaits); err != nil {
+		return parsed, err
+	}
+	if parsed.backendQueueMaxWaits, err = parseQueueMaxWaits("backendQueueMaxWaits", config.BackendQueueMaxWaits); err != nil {
+		return parsed, err
+	}
+	
+	if parsed.maxBytesPerRequest, err = parseSize(config.MaxBytesPerRequest); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "maxBytesPerRequest: %v", err)
+	}
+	if parsed.maxBytesPerRequest < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "maxBytesPerRequest must not be negative")
+	}
+	if parsed.maxTransferTime, err = parseDuration(config.MaxTransferTime); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "maxTransferTime: %v", err)
+	}
+	if parsed.maxTransferTime < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "maxTransferTime must not be negative")
+	}
+	if parsed.maxChunkWait, err = parseDuration(config.MaxChunkWait); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "maxChunkWait: %v", err)
+	}
+	if parsed.maxChunkWait < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "maxChunkWait must not be negative")
+	}
+	if parsed.drainTimeout, err = parseDuration(config.DrainTimeout); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "drainTimeout: %v", err)
+	}
+	if parsed.drainTimeout < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "drainTimeout must not be negative")
+	}
+	if parsed.reservationMaxWait, err = parseDuration(config.ReservationMaxWait); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "reservationMaxWait: %v", err)
+	}
+	if parsed.reservationMaxWait < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "reservationMaxWait must not be negative")
+	}
+	if parsed.maxWait, err = parseDuration(config.MaxWait); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "maxWait: %v", err)
+	}
+	if parsed.maxWait < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "maxWait must not be negative")
+	}
+	if parsed.resolutionCacheTTL, err = parseDuration(config.ResolutionCacheTTL); err != nil {
+		return parsed, wrapf(ErrInvalidLimit, "resolutionCacheTTL: %v", err)
+	}
+	if parsed.resolutionCacheTTL < 0 {
+		return parsed, wrapf(ErrInvalidLimit, "resolutionCacheTTL must not be negative")
+	}
+	
+	parsed.chunkSize = limiter.DefaultChunkSize
+	if strings.EqualFold(strings.TrimSpace(string(config.ChunkSize)), "auto") {
+		parsed.autoChunkSize = true
+	} else if config.ChunkSize != "" {
+		if parsed.chunkSize, err = parseSize(config.ChunkSize); err != nil {
+			return parsed, wrapf(ErrInvalidLimit, "chunkSize: %v", err)
+		}
+		if parsed.chunkSize < limiter.MinChunkSize || parsed.chunkSize > limiter.MaxChunkSize {
+			return parsed, wrapf(ErrInvalidLimit, "chunkSize must be between %d and %d bytes, or \"auto\"", limiter.MinChunkSize, limiter.MaxChunkSize)
+		}
+	}
+	return parsed, nil
+}
+
+// parseLimits parses a map of per-client or per-backend limits
+func parseLimits(field string, limits map[string]Size) (map[string]int64, error) {
+	parsed := make(map[string]int64, len(limits))
+	for name, value := range limits {
+		limit, err := parseSize(value)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "%s[%s]: %v", field, name, err)
+		}
+		if limit < 0 && limit != Unlimited {
+			return nil, wrapf(ErrInvalidLimit, "%s[%s] must not be negative, except -1 or \"unlimited\"", field, name)
+		}
+		parsed[name] = limit
+	}
+	return parsed, nil
+}
+
+// parseSizes parses a map of byte counts or rates that can't be unlimited, such
+// as per-minute budgets and cluster quotas
+func parseSizes(field string, sizes map[string]Size) (map[string]int64, error) {
+	parsed := make(map[string]int64, len(sizes))
+	for name, value := range sizes {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "%s[%s]: %v", field, name, err)
+		}
+		if size < 0 {
+			return nil, wrapf(ErrInvalidLimit, "%s[%s] must not be negative", field, name)
+		}
+		parsed[name] = size
+	}
+	return parsed, nil
+}
+
+// parseClientNetworks moves the CIDR entries of clientLimits into a trie, so
+// large rule sets don't need a scan per request
+func parseClientNetworks(clientLimits map[string]int64) (*cidrTrie, error) {
+	var networks *cidrTrie
+	for client, limit := range clientLimits {
+		if !strings.Contains(client, "/") {
+			continue
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "clientLimits[%s]: invalid CIDR: %v", client, err)
+		}
+		if networks == nil {
+			networks = newCIDRTrie()
+		}
+		networks.insert(network, limit)
+		delete(clientLimits, client)
+	}
+	return networks, nil
+}
+
+// parseQueueMaxWaits parses per-client or per-backend queue waits
+func parseQueueMaxWaits(field string, waits map[string]ShortDuration) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration, len(waits))
+	for name, value := range waits {
+		wait, err := parseShortDuration(value)
+		if err != nil {
+			return nil, wrapf(ErrInvalidLimit, "%s[%s]: %v", field, name, err)
+		}
+		if wait < 0 {
+			return nil, wrapf(ErrInvalidLimit, "%s[%s] must not be negative", field, name)
+		}
+		parsed[name] = wait
+	}
+	return parsed, nil
+}
@@ -0,0 +1,180 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestUnits tests that sizes are accepted with units
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		size  bandwidthlimiter.Size
+		limit string
+	}{
+		{"1048576", `"limit":1048576`},
+		{"1MB", `"limit":1048576`},
+		{"512KiB/s", `"limit":524288`},
+		{"2.5M", `"limit":2621440`},
+		{"64 kb", `"limit":65536`},
+	}
+
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.DefaultLimit = tt.size
+		cfg.BurstSize = ""
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", tt.size, err)
+		}
+		bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+		recorder := httptest.NewRecorder()
+		bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/simulate?ip=1.2.3.4", nil))
+		if !strings.Contains(recorder.Body.String(), tt.limit) {
+			t.Errorf("Expected %q to give %s, got %s", tt.size, tt.limit, recorder.Body.String())
+		}
+	}
+}
+
+// TestUnitsErrors tests that invalid values are reported with their field
+func TestUnitsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *bandwidthlimiter.Config)
+		field  string
+	}{
+		{"unknown unit", func(cfg *bandwidthlimiter.Config) { cfg.DefaultLimit = "1 parsec" }, "defaultLimit"},
+		{"bad burst", func(cfg *bandwidthlimiter.Config) { cfg.BurstSize = "lots" }, "burstSize"},
+		{"bad backend limit", func(cfg *bandwidthlimiter.Config) { cfg.BackendLimits["api.example.com"] = "1XB" }, "backendLimits[api.example.com]"},
+		{"bad client limit", func(cfg *bandwidthlimiter.Config) { cfg.ClientLimits["10.0.0.1"] = "fast" }, "clientLimits[10.0.0.1]"},
+		{"bad duration", func(cfg *bandwidthlimiter.Config) { cfg.CleanupInterval = "5 minutes" }, "cleanupInterval"},
+		{"negative duration", func(cfg *bandwidthlimiter.Config) { cfg.BucketMaxAge = "-1h" }, "bucketMaxAge"},
+		{"bad queue wait", func(cfg *bandwidthlimiter.Config) { cfg.QueueMaxWait = "2 seconds" }, "queueMaxWait"},
+		{"negative queue wait", func(cfg *bandwidthlimiter.Config) { cfg.BackendQueueMaxWaits["api.example.com"] = "-1s" }, "backendQueueMaxWaits[api.example.com]"},
+		{"fractional quota period", func(cfg *bandwidthlimiter.Config) { cfg.ClusterQuotaPeriod = "1.5s" }, "clusterQuotaPeriod"},
+		{"bad upload limit", func(cfg *bandwidthlimiter.Config) { cfg.UploadLimit = "8 parsecs" }, "uploadLimit"},
+		{"unlimited minute limit", func(cfg *bandwidthlimiter.Config) { cfg.DefaultMinuteLimit = "unlimited" }, "defaultMinuteLimit"},
+		{"bad client minute limit", func(cfg *bandwidthlimiter.Config) { cfg.ClientMinuteLimits["10.0.0.1"] = "1XB" }, "clientMinuteLimits[10.0.0.1]"},
+		{"negative aggregate limit", func(cfg *bandwidthlimiter.Config) { cfg.BackendAggregateLimits["api.example.com"] = "-1KB" }, "backendAggregateLimits[api.example.com]"},
+		{"bad cluster quota", func(cfg *bandwidthlimiter.Config) { cfg.ClientClusterQuotas["10.0.0.1"] = "lots" }, "clientClusterQuotas[10.0.0.1]"},
+		{"bad tick interval", func(cfg *bandwidthlimiter.Config) { cfg.TickInterval = "1 tick" }, "tickInterval"},
+		{"bad initial tokens", func(cfg *bandwidthlimiter.Config) {
+			cfg.Preload = []bandwidthlimiter.PreloadBucket{{ClientIP: "10.0.0.1", InitialTokens: "half"}}
+		}, "preload[0]: initialTokens"},
+	}
+
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		tt.modify(cfg)
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		_, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+		if !strings.HasPrefix(err.Error(), tt.field) {
+			t.Errorf("%s: expected the error to name %s, got %v", tt.name, tt.field, err)
+		}
+	}
+}
+
+// TestUnitsEverywhere tests that per-minute budgets and minimum rates take
+// units like the per-second limits
+func TestUnitsEverywhere(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultMinuteLimit = "100MB"
+	cfg.ClientMinuteLimits["10.0.0.1"] = "1.5GB"
+	cfg.DefaultMinRate = "1KB/s"
+	cfg.BackendMinRates["api.example.com"] = "16KiB"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"ip=1.2.3.4", []string{`"minuteLimit":104857600`, `"minRate":1024`}},
+		{"ip=10.0.0.1&host=api.example.com", []string{`"minuteLimit":1610612736`, `"minRate":16384`}},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/simulate?"+tt.query, nil))
+		for _, want := range tt.want {
+			if !strings.Contains(recorder.Body.String(), want) {
+				t.Errorf("Expected %s to give %s, got %s", tt.query, want, recorder.Body.String())
+			}
+		}
+	}
+}
+
+// TestUnitsShortDurations tests that plain numbers are milliseconds for waits and timeouts
+func TestUnitsShortDurations(t *testing.T) {
+	tests := []struct {
+		wait     bandwidthlimiter.ShortDuration
+		override bandwidthlimiter.ShortDuration
+		want     string
+	}{
+		{"2000", "", `"queueMaxWaitMs":2000`},
+		{"2s", "", `"queueMaxWaitMs":2000`},
+		{"2s", "1m30s", `"queueMaxWaitMs":90000`},
+		{"", "250", `"queueMaxWaitMs":250`},
+	}
+
+	for _, tt := range tests {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.QueueMaxWait = tt.wait
+		if tt.override != "" {
+			cfg.ClientQueueMaxWaits["1.2.3.4"] = tt.override
+		}
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+		if err != nil {
+			t.Fatalf("Unexpected error for %q and %q: %v", tt.wait, tt.override, err)
+		}
+		bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+
+		recorder := httptest.NewRecorder()
+		bl.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/simulate?ip=1.2.3.4", nil))
+		if !strings.Contains(recorder.Body.String(), tt.want) {
+			t.Errorf("Expected %q and %q to give %s, got %s", tt.wait, tt.override, tt.want, recorder.Body.String())
+		}
+	}
+}
+
+// TestUnitsJSON tests that sizes and durations decode from JSON numbers and strings
+func TestUnitsJSON(t *testing.T) {
+	var cfg bandwidthlimiter.Config
+	data := `{"defaultLimit": 1048576, "burstSize": "10MB", "clientLimits": {"10.0.0.1": -1}, "saveInterval": "5m", "bucketMaxAge": 3600,
+		"queueMaxWait": 2000, "redisTimeout": "200ms", "clientQueueMaxWaits": {"10.0.0.1": 10000},
+		"uploadLimit": 8192, "clientMinuteLimits": {"10.0.0.1": "1GB"}, "tickInterval": 100}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.DefaultLimit != "1048576" || cfg.BurstSize != "10MB" || cfg.ClientLimits["10.0.0.1"] != "-1" {
+		t.Errorf("Unexpected sizes: %q %q %v", cfg.DefaultLimit, cfg.BurstSize, cfg.ClientLimits)
+	}
+	if cfg.UploadLimit != "8192" || cfg.ClientMinuteLimits["10.0.0.1"] != "1GB" {
+		t.Errorf("Unexpected sizes: %q %v", cfg.UploadLimit, cfg.ClientMinuteLimits)
+	}
+	if cfg.SaveInterval != "5m" || cfg.BucketMaxAge != "3600" {
+		t.Errorf("Unexpected durations: %q %q", cfg.SaveInterval, cfg.BucketMaxAge)
+	}
+	if cfg.QueueMaxWait != "2000" || cfg.RedisTimeout != "200ms" || cfg.TickInterval != "100" || cfg.ClientQueueMaxWaits["10.0.0.1"] != "10000" {
+		t.Errorf("Unexpected short durations: %q %q %q %v", cfg.QueueMaxWait, cfg.RedisTimeout, cfg.TickInterval, cfg.ClientQueueMaxWaits)
+	}
+}
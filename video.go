@@ -0,0 +1,98 @@
+package bandwidthlimiter
+
+import (
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media kinds detected for segmented video
+type mediaKind int
+
+const (
+	mediaOther mediaKind = iota
+	mediaManifest
+	mediaSegment
+)
+
+// File extensions of HLS/DASH manifests and segments
+var (
+	manifestExtensions = map[string]bool{".m3u8": true, ".mpd": true}
+	segmentExtensions  = map[string]bool{".ts": true, ".m4s": true, ".m4v": true, ".m4a": true, ".aac": true, ".cmfv": true, ".cmfa": true}
+)
+
+// MIME types of HLS/DASH manifests and segments
+var (
+	manifestTypes = map[string]bool{"application/vnd.apple.mpegurl": true, "application/x-mpegurl": true, "audio/mpegurl": true, "application/dash+xml": true}
+	segmentTypes  = map[string]bool{"video/mp2t": true, "video/iso.segment": true, "audio/aac": true}
+)
+
+// classifyMedia detects manifests and segments by path extension, falling back to the response MIME type
+func classifyMedia(urlPath, contentType string) mediaKind {
+	ext := strings.ToLower(path.Ext(urlPath))
+	switch {
+	case manifestExtensions[ext]:
+		return mediaManifest
+	case segmentExtensions[ext]:
+		return mediaSegment
+	}
+	
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return mediaOther
+	}
+	switch {
+	case manifestTypes[mediaType]:
+		return mediaManifest
+	case segmentTypes[mediaType]:
+		return mediaSegment
+	}
+	return mediaOther
+}
+
+// videoSession counts the segments a client fetched since its last manifest
+type videoSession struct {
+	mutex    sync.Mutex
+	segments int64
+	lastSeen time.Time
+}
+
+// segmentLimit records a manifest or segment fetch for key and returns the pacing
+// rate for a segment: StartupSegmentLimit during startup, SegmentLimit afterwards.
+// 0 means the segment is only paced by the client's buckets.
+func (bl *BandwidthLimiter) segmentLimit(key string, kind mediaKind) int64 {
+	value, _ := bl.videoSessions.LoadOrStore(key, &videoSession{})
+	session := value.(*videoSession)
+	
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.lastSeen = time.Now()
+	
+	// A manifest fetch marks the start of playback or a rendition switch
+	if kind == mediaManifest {
+		session.segments = 0
+		return 0
+	}
+	
+	session.segments++
+	if session.segments <= bl.config.StartupSegments {
+		return bl.parsed.startupSegmentLimit
+	}
+	return bl.parsed.segmentLimit
+}
+
+// evictVideoSessions removes sessions that haven't been seen since cutoff
+func (bl *BandwidthLimiter) evictVideoSessions(cutoff time.Time) {
+	bl.videoSessions.Range(func(key, value interface{}) bool {
+		session := value.(*videoSession)
+		session.mutex.Lock()
+		idle := session.lastSeen.Before(cutoff)
+		session.mutex.Unlock()
+		if idle {
+			bl.videoSessions.Delete(key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,63 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestVideoSegmentPacing tests startup and steady-state pacing of HLS segments
+func TestVideoSegmentPacing(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "10MB" // Buckets alone would not throttle
+	cfg.VideoAware = true
+	cfg.SegmentLimit = "100KB" // 100 KB/s per segment
+	cfg.StartupSegments = 1
+
+	ctx := context.Background()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/live/chunk") {
+			rw.Header().Set("Content-Type", "video/MP2T")
+		}
+		rw.Write(make([]byte, 50*1024))
+	})
+
+	handler, err := bandwidthlimiter.New(ctx, next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path string) time.Duration {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.local"+path, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return time.Since(start)
+	}
+
+	if elapsed := serve("/video/index.m3u8"); elapsed > 100*time.Millisecond {
+		t.Errorf("Manifest should not be paced, took %v", elapsed)
+	}
+
+	// The startup segment is delivered without segment pacing
+	if elapsed := serve("/video/seg1.ts"); elapsed > 100*time.Millisecond {
+		t.Errorf("Startup segment should not be paced, took %v", elapsed)
+	}
+
+	// Later segments, detected by MIME type here, are paced at segmentLimit
+	if elapsed := serve("/live/chunk2"); elapsed < 300*time.Millisecond {
+		t.Errorf("Segment should be paced at segmentLimit, took %v", elapsed)
+	}
+
+	// A new manifest fetch restarts the startup phase
+	serve("/video/index.m3u8")
+	if elapsed := serve("/video/seg1.ts"); elapsed > 100*time.Millisecond {
+		t.Errorf("Startup segment after manifest should not be paced, took %v", elapsed)
+	}
+}
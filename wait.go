@@ -0,0 +1,74 @@
+package bandwidthlimiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenWaits is what a request's chunks wait for tokens with: the request
+// context, which the server cancels when the client goes away or the
+// connection is closed on shutdown, and the limiter's own Shutdown. The
+// goroutine watching Shutdown only starts with the first wait, so requests
+// that never wait don't pay for it.
+type tokenWaits struct {
+	parent  context.Context
+	stop    <-chan struct{} // Closed by Shutdown
+	maxWait time.Duration   // Longest a single chunk may wait, see Config.MaxChunkWait
+	
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newTokenWaits returns the token waits of a request
+func (bl *BandwidthLimiter) newTokenWaits(req *http.Request) *tokenWaits {
+	return &tokenWaits{parent: req.Context(), stop: bl.shutdownChan, maxWait: bl.parsed.maxChunkWait}
+}
+
+// context returns a context done once the request ended or Shutdown stopped
+// the limiter
+func (w *tokenWaits) context() context.Context {
+	w.once.Do(func() {
+		w.ctx, w.cancel = context.WithCancel(w.parent)
+		go func(ctx context.Context, cancel context.CancelFunc) {
+			select {
+			case <-w.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}(w.ctx, w.cancel)
+	})
+	return w.ctx
+}
+
+// chunk returns the context one chunk waits with, bounded by MaxChunkWait, and
+// the function releasing it
+func (w *tokenWaits) chunk() (context.Context, context.CancelFunc) {
+	if w.maxWait > 0 {
+		return context.WithTimeout(w.context(), w.maxWait)
+	}
+	return w.context(), func() {}
+}
+
+// reason tells why a wait failed: "" if the request itself ended, otherwise
+// why the response is aborted, "shutdown" or "maxChunkWait"
+func (w *tokenWaits) reason() string {
+	if w.parent.Err() != nil {
+		return ""
+	}
+	select {
+	case <-w.stop:
+		return "shutdown"
+	default:
+		return "maxChunkWait"
+	}
+}
+
+// release stops watching for Shutdown once the request's handler returned
+func (w *tokenWaits) release() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
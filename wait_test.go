@@ -0,0 +1,92 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// newStarvedServer returns a limiter at 8KB/s with an 8KB burst in front of a
+// backend sending 64KB, so every chunk after the burst waits 500ms
+func newStarvedServer(t *testing.T, maxChunkWait string) (*bandwidthlimiter.BandwidthLimiter, *httptest.Server, chan string) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.DefaultLimit = "8KB"
+	cfg.BurstSize = "8KB"
+	cfg.MaxChunkWait = bandwidthlimiter.Duration(maxChunkWait)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(make([]byte, 64*1024))
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := handler.(*bandwidthlimiter.BandwidthLimiter)
+	aborted := make(chan string, 1)
+	bl.OnRequestDone(func(stats *bandwidthlimiter.RequestStats) {
+		aborted <- stats.Aborted
+	})
+
+	server := httptest.NewServer(bl)
+	t.Cleanup(server.Close)
+	return bl, server, aborted
+}
+
+// getCut fetches a response expected to be cut off and returns how long it took
+func getCut(t *testing.T, url string) time.Duration {
+	start := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || len(body) >= 64*1024 {
+		t.Errorf("Expected the response to be cut off, got %d bytes", len(body))
+	}
+	return time.Since(start)
+}
+
+// TestMaxChunkWait tests that responses whose next chunk can't be paid for in
+// time are cut off
+func TestMaxChunkWait(t *testing.T) {
+	bl, server, aborted := newStarvedServer(t, "100ms")
+	defer bl.Shutdown()
+
+	if elapsed := getCut(t, server.URL); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected the response to be cut off after its burst, took %v", elapsed)
+	}
+	if reason := <-aborted; reason != "maxChunkWait" {
+		t.Errorf("Expected the stats to record maxChunkWait, got %q", reason)
+	}
+}
+
+// TestShutdownEndsWaits tests that Shutdown ends responses waiting for tokens
+// instead of leaving them to throttle on
+func TestShutdownEndsWaits(t *testing.T) {
+	bl, server, aborted := newStarvedServer(t, "")
+
+	time.AfterFunc(200*time.Millisecond, bl.Shutdown)
+	if elapsed := getCut(t, server.URL); elapsed > time.Second {
+		t.Errorf("Expected the response to end with the shutdown, took %v", elapsed)
+	}
+	if reason := <-aborted; reason != "shutdown" {
+		t.Errorf("Expected the stats to record the shutdown, got %q", reason)
+	}
+}
+
+// TestMaxChunkWaitConfig tests that maxChunkWait is validated
+func TestMaxChunkWaitConfig(t *testing.T) {
+	for _, value := range []string{"-1s", "soon"} {
+		cfg := bandwidthlimiter.CreateConfig()
+		cfg.MaxChunkWait = bandwidthlimiter.Duration(value)
+		if _, err := bandwidthlimiter.New(context.Background(), http.NotFoundHandler(), cfg, "test-limiter"); err == nil {
+			t.Errorf("Expected an error for maxChunkWait %q", value)
+		}
+	}
+}
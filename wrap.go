@@ -0,0 +1,66 @@
+package bandwidthlimiter
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// rwUnwrapper is implemented by ResponseWriter wrappers following the
+// http.ResponseController convention, including the limiter's own
+type rwUnwrapper interface {
+	Unwrap() http.ResponseWriter
+}
+
+// flusherOf finds a Flusher in the chain of writers rw wraps. Middlewares
+// wrapping the writer without passing Flush on are looked through, so
+// stacking with them doesn't lose the capability.
+func flusherOf(rw http.ResponseWriter) (http.Flusher, bool) {
+	for {
+		if flusher, ok := rw.(http.Flusher); ok {
+			return flusher, true
+		}
+		unwrapper, ok := rw.(rwUnwrapper)
+		if !ok {
+			return nil, false
+		}
+		rw = unwrapper.Unwrap()
+	}
+}
+
+// hijackerOf finds a Hijacker in the chain of writers rw wraps, like flusherOf
+func hijackerOf(rw http.ResponseWriter) (http.Hijacker, bool) {
+	for {
+		if hijacker, ok := rw.(http.Hijacker); ok {
+			return hijacker, true
+		}
+		unwrapper, ok := rw.(rwUnwrapper)
+		if !ok {
+			return nil, false
+		}
+		rw = unwrapper.Unwrap()
+	}
+}
+
+// hijack takes over the connection of the writers rw wraps, or returns
+// http.ErrNotSupported if none of them can be hijacked, e.g. on HTTP/2
+func hijack(rw http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := hijackerOf(rw); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// pusherOf finds a Pusher in the chain of writers rw wraps, like flusherOf
+func pusherOf(rw http.ResponseWriter) (http.Pusher, bool) {
+	for {
+		if pusher, ok := rw.(http.Pusher); ok {
+			return pusher, true
+		}
+		unwrapper, ok := rw.(rwUnwrapper)
+		if !ok {
+			return nil, false
+		}
+		rw = unwrapper.Unwrap()
+	}
+}
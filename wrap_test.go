@@ -0,0 +1,92 @@
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// clientWriter is the server's writer, able to flush and push
+type clientWriter struct {
+	*httptest.ResponseRecorder
+	flushes int
+	pushed  []string
+}
+
+func (cw *clientWriter) Flush() {
+	cw.flushes++
+	cw.ResponseRecorder.Flush()
+}
+
+func (cw *clientWriter) Push(target string, opts *http.PushOptions) error {
+	cw.pushed = append(cw.pushed, target)
+	return nil
+}
+
+// hidingWriter stands in for a middleware wrapping the writer without passing
+// its interfaces on, only offering Unwrap
+type hidingWriter struct {
+	http.ResponseWriter
+}
+
+func (hw *hidingWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// TestNestedWriters tests that flushing and pushing reach the server's writer through other middlewares' wrappers
+func TestNestedWriters(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.StripResponseHeaders = []string{"X-Internal"}
+
+	var pushErr, controllerErr error
+	var unwrapped bool
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("data: hello\n\n"))
+		rw.(http.Flusher).Flush()
+		controllerErr = http.NewResponseController(rw).Flush()
+		pushErr = rw.(http.Pusher).Push("/style.css", nil)
+
+		// The chain down to the server's writer stays reachable
+		for {
+			unwrapper, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+			if !ok {
+				break
+			}
+			rw = unwrapper.Unwrap()
+		}
+		_, unwrapped = rw.(*clientWriter)
+	})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &clientWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(&hidingWriter{client}, httptest.NewRequest(http.MethodGet, "http://backend.local/events", nil))
+
+	if client.flushes != 2 || controllerErr != nil {
+		t.Errorf("Expected 2 flushes to reach the server's writer, got %d (%v)", client.flushes, controllerErr)
+	}
+	if pushErr != nil || len(client.pushed) != 1 || client.pushed[0] != "/style.css" {
+		t.Errorf("Expected the push to reach the server's writer, got %v (%v)", client.pushed, pushErr)
+	}
+	if !unwrapped {
+		t.Error("Expected Unwrap to lead to the server's writer")
+	}
+
+	// Writers without push support report it
+	next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		pushErr = rw.(http.Pusher).Push("/style.css", nil)
+	})
+	handler, err = bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://backend.local/", nil))
+	if pushErr != http.ErrNotSupported {
+		t.Errorf("Expected http.ErrNotSupported, got %v", pushErr)
+	}
+}
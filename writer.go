@@ -0,0 +1,413 @@
+package bandwidthlimiter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"time"
+	
+	"github.com/hhftechnology/bandwidthlimiter/limiter"
+)
+
+// limitedResponseWriter wraps http.ResponseWriter to apply bandwidth limiting
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context    // Request context, done once the client went away
+	waits   *tokenWaits        // What chunks wait for tokens with
+	buckets []limiter.Consumer // All buckets a chunk must be paid from
+	pacer   *limiter.TimeSlicePacer // Per-response pacer, used alone in time-slice pacing and before the buckets for video segments
+	cost    float64                 // Tokens consumed per byte written
+	stats   *RequestStats           // Bytes, chunks and waits of the request
+	
+	chunkSize  int64 // Bytes paid for and written at a time
+	refillRate int64 // Rate lease retries are sized for in high-resolution pacing, 0 for fixed retries
+	
+	maxBytes int64     // Body bytes the response may send, 0 for no cap
+	deadline time.Time // When the body transfer is cut off, zero for no cap
+	
+	minRate   int64     // Bytes per second granted without tokens while stalled, 0 for none
+	lastWrite time.Time // End of the previous chunk write, for the minimum rate
+	
+	chunkWaits *limiter.Histogram // Optional distribution of per-chunk waits
+	
+	flushChunks bool // Flush after every chunk, see Config.FlushChunks
+	
+	drain *drainState // Speeds the response up once Shutdown drains, nil unless DrainTimeout is set
+	
+	early *earlyShare // Delays chunks as the global bucket runs low, nil unless GlobalEarlyThrottle is set
+	
+	// Reservation paying for the whole body, see Config.Reservation. Set
+	// when it was refused and the response replaced with a 429.
+	reserve     bool
+	reservation *limiter.Reservation
+	rejected    bool
+	
+	// Wraps hijacked connections to keep limiting them, nil unless ThrottleHijacked is set
+	throttleConn func(conn net.Conn, buffered io.Reader) net.Conn
+	
+	inFlight    *limiter.InFlightGauge // Optional per-client in-flight byte cap
+	maxInFlight int64
+	
+	bind   func() // Binds buckets on the first write with a body, nil once bound
+	noBody bool   // Set when the status code doesn't allow a response body
+}
+
+// Write applies bandwidth limiting when writing response data
+func (lrw *limitedResponseWriter) Write(p []byte) (int, error) {
+	// Nothing to limit for empty writes and bodiless responses
+	if len(p) == 0 || lrw.noBody {
+		return lrw.ResponseWriter.Write(p)
+	}
+	
+	written, err := lrw.writeChunks(int64(len(p)), func(n int64) (int64, error) {
+		written, err := lrw.ResponseWriter.Write(p[:n])
+		p = p[written:]
+		return int64(written), err
+	})
+	return int(written), err
+}
+
+// ReadFrom copies src to the client in paid-for chunks. Each chunk is handed
+// to the wrapped writer's ReadFrom, so files can still be sent with sendfile
+// while being limited. Writers without ReadFrom get the chunks through Write.
+func (lrw *limitedResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	readerFrom, ok := lrw.ResponseWriter.(io.ReaderFrom)
+	if !ok || lrw.noBody {
+		return io.Copy(writerOnly{lrw}, src)
+	}
+	
+	// Sources that know their length, such as the io.LimitedReader of
+	// http.ServeContent, aren't paid for past their end. For others the
+	// last chunk is paid in full and the unused tokens are refunded.
+	n := int64(math.MaxInt64)
+	switch src := src.(type) {
+	case *io.LimitedReader:
+		n = src.N
+	case interface{ Len() int }:
+		n = int64(src.Len())
+	}
+	
+	return lrw.writeChunks(n, func(n int64) (int64, error) {
+		return readerFrom.ReadFrom(io.LimitReader(src, n))
+	})
+}
+
+// writerOnly hides the ReadFrom method of a writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
+
+// writeChunks pays for and sends up to n response body bytes one chunk at a
+// time. send writes the next chunk of the given size and returns how many
+// bytes it wrote; a short chunk without an error ends the body.
+func (lrw *limitedResponseWriter) writeChunks(n int64, send func(n int64) (int64, error)) (int64, error) {
+	if lrw.bind != nil {
+		lrw.bindBuckets()
+	}
+	if lrw.rejected {
+		return 0, errReservationRefused
+	}
+	
+	// Track the total bytes written
+	totalWritten := int64(0)
+	
+	for totalWritten < n {
+		// Nobody is left to pace the rest of the body for
+		if err := lrw.ctx.Err(); err != nil {
+			lrw.stats.Canceled = true
+			return totalWritten, err
+		}
+		
+		// Stop at a cap instead of pacing the rest of the body
+		allowed, err := lrw.capped(n - totalWritten)
+		if err != nil {
+			return totalWritten, err
+		}
+		
+		// Determine how many bytes to write in this iteration
+		chunkSize, paid, err := lrw.nextChunk(allowed)
+		if err != nil {
+			lrw.stats.Canceled = lrw.stats.Aborted == ""
+			return totalWritten, err
+		}
+		
+		// Write the chunk, holding a share of the client's in-flight budget
+		if lrw.inFlight != nil {
+			lrw.inFlight.Acquire(chunkSize, lrw.maxInFlight)
+		}
+		written, err := send(chunkSize)
+		if lrw.inFlight != nil {
+			lrw.inFlight.Release(chunkSize)
+		}
+		totalWritten += written
+		if written > 0 {
+			lrw.stats.BytesWritten += written
+			lrw.stats.Chunks++
+		}
+		lrw.lastWrite = time.Now()
+		
+		if err != nil {
+			return totalWritten, err
+		}
+		if lrw.flushChunks && written > 0 {
+			lrw.Flush()
+		}
+		
+		// The source ran dry: give back what the missing bytes were paid with
+		if written < chunkSize {
+			lrw.refund(paid, written)
+			return totalWritten, nil
+		}
+	}
+	
+	return totalWritten, nil
+}
+
+// nextChunk waits until the next chunk of at most n bytes may be written and
+// returns its size and the tokens paid for it, or the context's error if the
+// request ended first, errTransferCapped if the wait was cut short, or
+// limiter.ErrExceedsBurst if a bucket can never pay for the chunk
+func (lrw *limitedResponseWriter) nextChunk(n int64) (int64, int64, error) {
+	draining := lrw.drain != nil && lrw.drain.started()
+	if draining {
+		lrw.stats.Drained = true
+		if lrw.drain.boost == 0 {
+			return min(n, lrw.chunkSize), 0, nil
+		}
+	}
+	
+	var paced time.Duration
+	if lrw.pacer != nil {
+		take := n
+		if draining {
+			take = lrw.drain.boostTokens(n)
+		}
+		chunkSize, waited := lrw.pacer.Take(take)
+		if draining {
+			chunkSize = min(n, int64(float64(chunkSize)*lrw.drain.boost))
+		}
+		lrw.stats.Wait += waited
+		if len(lrw.buckets) == 0 {
+			lrw.observeChunkWait(waited)
+			return chunkSize, 0, nil
+		}
+		n = chunkSize
+		paced = waited
+	}
+	
+	chunkSize := min(n, lrw.chunkSize)
+	
+	// Expensive routes pay more tokens for the same bytes, draining responses fewer
+	tokens := lrw.tokens(chunkSize)
+	if draining {
+		tokens = lrw.drain.boostTokens(tokens)
+	}
+	
+	// Reserved bodies were paid for up front and only wait for their schedule
+	if lrw.reservation != nil && tokens <= lrw.reservation.Remaining() {
+		waitStart := time.Now()
+		ctx, cancel := lrw.waits.chunk()
+		err := lrw.reservation.Wait(ctx, tokens)
+		cancel()
+		waited := time.Since(waitStart)
+		lrw.stats.Wait += waited
+		if err != nil {
+			return 0, 0, lrw.waitError()
+		}
+		lrw.observeChunkWait(paced + waited)
+		return chunkSize, tokens, nil
+	}
+	
+	// Clients back off at random as the global bucket runs low
+	if lrw.early != nil {
+		held, err := lrw.holdEarly()
+		lrw.stats.Wait += held
+		if err != nil {
+			return 0, 0, err
+		}
+		paced += held
+	}
+	
+	// Wait until the buckets have the tokens, sleeping for the computed refill time
+	waitStart := time.Now()
+	waited := time.Duration(0)
+	if !limiter.ConsumeAll(lrw.buckets, tokens) {
+		ctx, cancel := lrw.waits.chunk()
+		defer cancel()
+		stalled := lrw.lastWrite.Add(minRateInterval)
+		if lrw.minRate > 0 {
+			ctx, cancel = context.WithDeadline(ctx, stalled)
+			defer cancel()
+		}
+		
+		// Keep a stalled response alive with a small chunk paid by nobody
+		if err := limiter.ConsumeAllWait(ctx, lrw.buckets, tokens, lrw.retryInterval(tokens)); err != nil {
+			if errors.Is(err, limiter.ErrExceedsBurst) {
+				lrw.stats.Wait += time.Since(waitStart)
+				return 0, 0, err
+			}
+			if lrw.minRate == 0 || lrw.waits.reason() != "maxChunkWait" || time.Now().Before(stalled) {
+				lrw.stats.Wait += time.Since(waitStart)
+				return 0, 0, lrw.waitError()
+			}
+			floor := int64(time.Since(lrw.lastWrite).Seconds() * float64(lrw.minRate))
+			if floor < 1 {
+				floor = 1
+			}
+			chunkSize = min(chunkSize, floor)
+			tokens = 0
+		}
+		waited = time.Since(waitStart)
+		lrw.stats.Wait += waited
+	}
+	lrw.observeChunkWait(paced + waited)
+	return chunkSize, tokens, nil
+}
+
+// waitError returns the error of a chunk whose wait for tokens failed: the
+// context's error if the request ended, otherwise errTransferCapped, with the
+// reason the response is aborted
+func (lrw *limitedResponseWriter) waitError() error {
+	if err := lrw.ctx.Err(); err != nil {
+		return err
+	}
+	lrw.stats.Aborted = lrw.waits.reason()
+	lrw.stats.Err = errTransferCapped
+	return errTransferCapped
+}
+
+// bindBuckets binds the response to its buckets, see limitedResponseWriter.bind
+func (lrw *limitedResponseWriter) bindBuckets() {
+	lrw.bind()
+	lrw.bind = nil
+	lrw.lastWrite = time.Now()
+}
+
+// tokens returns the tokens n body bytes cost
+func (lrw *limitedResponseWriter) tokens(n int64) int64 {
+	if lrw.cost != 1 {
+		return int64(math.Ceil(float64(n) * lrw.cost))
+	}
+	return n
+}
+
+// refund returns the tokens paid for a chunk that came out shorter than paid for
+func (lrw *limitedResponseWriter) refund(paid, written int64) {
+	if unused := paid - lrw.tokens(written); unused > 0 {
+		for _, bucket := range lrw.buckets {
+			bucket.Refund(unused)
+		}
+	}
+}
+
+// Flush sends buffered data to the client, if a wrapped writer supports it.
+// Flushing never waits for tokens: the data was paid for when it was written.
+func (lrw *limitedResponseWriter) Flush() {
+	if flusher, ok := flusherOf(lrw.ResponseWriter); ok {
+		flusher.Flush()
+	}
+}
+
+// Push starts an HTTP/2 server push, if a wrapped writer supports it. The
+// pushed response goes through the middleware chain, and the limiter, itself.
+func (lrw *limitedResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := pusherOf(lrw.ResponseWriter); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Hijack hands the connection over to the handler, e.g. for a WebSocket
+// upgrade. Unless ThrottleHijacked is set, traffic on the hijacked connection
+// bypasses the limiter.
+func (lrw *limitedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(lrw.ResponseWriter)
+	if err != nil {
+		return conn, rw, err
+	}
+	lrw.stats.Hijacked = true
+	
+	if lrw.throttleConn != nil {
+		conn = lrw.throttleConn(conn, rw.Reader)
+		rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	return conn, rw, nil
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (lrw *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// retryInterval returns how often buckets that can't compute their wait, such
+// as leases on remote buckets, are retried for tokens
+func (lrw *limitedResponseWriter) retryInterval(tokens int64) time.Duration {
+	if lrw.refillRate > 0 {
+		return limiter.HighResWait(tokens, lrw.refillRate)
+	}
+	return leaseRetryInterval
+}
+
+// leaseRetryInterval is how often leases are retried outside high-resolution pacing
+const leaseRetryInterval = 10 * time.Millisecond
+
+// capped returns how many of the next n bytes the response's caps let through,
+// or errTransferCapped once a cap is reached
+func (lrw *limitedResponseWriter) capped(n int64) (int64, error) {
+	if lrw.maxBytes > 0 {
+		left := lrw.maxBytes - lrw.stats.BytesWritten
+		if left <= 0 {
+			lrw.stats.Aborted = "maxBytesPerRequest"
+			lrw.stats.Err = errTransferCapped
+			return 0, errTransferCapped
+		}
+		n = min(n, left)
+	}
+	if !lrw.deadline.IsZero() && time.Now().After(lrw.deadline) {
+		lrw.stats.Aborted = "maxTransferTime"
+		lrw.stats.Err = errTransferCapped
+		return 0, errTransferCapped
+	}
+	return n, nil
+}
+
+// minRateInterval is how long a response may stall before the minimum rate kicks in
+const minRateInterval = time.Second
+
+// observeChunkWait records how long a chunk waited, if instrumentation is enabled
+func (lrw *limitedResponseWriter) observeChunkWait(waited time.Duration) {
+	if lrw.chunkWaits != nil {
+		lrw.chunkWaits.Observe(waited)
+	}
+}
+
+// WriteHeader records whether the status allows a body; no limiting is
+// applied here. In reservation mode the body is reserved first, so a refused
+// reservation can still replace the response.
+func (lrw *limitedResponseWriter) WriteHeader(statusCode int) {
+	lrw.noBody = !bodyAllowedForStatus(statusCode)
+	if lrw.reserve && !lrw.noBody && lrw.bind != nil {
+		lrw.bindBuckets()
+	}
+	if lrw.rejected {
+		return
+	}
+	lrw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// bodyAllowedForStatus reports whether a response with the given status may carry a body
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
\ No newline at end of file
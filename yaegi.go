@@ -0,0 +1,20 @@
+//go:build !bwlnative
+
+package bandwidthlimiter
+
+import (
+	"context"
+	"net/http"
+)
+
+// nativeBuild reports whether the plugin was compiled with the bwlnative tag,
+// enabling features that can't run under the Yaegi interpreter
+const nativeBuild = false
+
+// registerPprof is unavailable under Yaegi
+func registerPprof(mux *http.ServeMux) {}
+
+// withPprofLabels runs fn without labels, since Yaegi goroutines can't be profiled by label
+func withPprofLabels(ctx context.Context, fn func(ctx context.Context), labels ...string) {
+	fn(ctx)
+}
@@ -0,0 +1,31 @@
+//go:build !bwlnative
+
+package bandwidthlimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hhftechnology/bandwidthlimiter"
+)
+
+// TestPprofDisabledWithoutNativeBuild tests that pprof features degrade gracefully under the default build
+func TestPprofDisabledWithoutNativeBuild(t *testing.T) {
+	cfg := bandwidthlimiter.CreateConfig()
+	cfg.AdminPprof = true
+	cfg.PprofLabels = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := bandwidthlimiter.New(context.Background(), next, cfg, "test-limiter")
+	if err != nil {
+		t.Fatalf("pprof options should degrade instead of failing: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.(*bandwidthlimiter.BandwidthLimiter).AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected pprof to be unavailable, got %d", recorder.Code)
+	}
+}